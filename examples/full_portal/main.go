@@ -18,8 +18,16 @@ func main() {
 	// Set up logging
 	slog.SetLogLoggerLevel(slog.LevelDebug)
 
+	// Pick the network backend, e.g. WIFIPORTAL_BACKEND=iwd on images without NetworkManager
+	backend := network.Backend(os.Getenv("WIFIPORTAL_BACKEND"))
+	im, err := network.NewBackendInterfaceManager(backend)
+	if err != nil {
+		slog.Error("failed to create interface manager", slog.String("error", err.Error()))
+		return
+	}
+
 	// Find the best wireless interface for creating an access point
-	iFace, err := network.NewInterfaceManager().GetBestAPInterface()
+	iFace, err := im.GetBestAPInterface()
 	if err != nil {
 		if iFace != nil {
 			slog.Info("interface found", slog.String("name", iFace.Name))
@@ -32,15 +40,30 @@ func main() {
 		}
 	}
 	slog.Info("Using interface", slog.String("name", iFace.Name))
-
-	// Create NetworkManager-based hotspot service
-	h := network.NewAPService()
 	ctx := context.Background()
 
+	// Run the hotspot on a virtual interface when the radio supports AP and station at once,
+	// so the hotspot stays up while the physical interface joins the selected network
+	virtualAP := network.NewVirtualAPManager()
+	plan, err := virtualAP.Plan(ctx, iFace.Name)
+	if err != nil {
+		slog.Error("failed to plan interfaces", slog.String("error", err.Error()))
+		return
+	}
+	defer virtualAP.Release(context.Background(), plan)
+	slog.Info("Interface plan", slog.String("ap", plan.AP), slog.String("station", plan.Station), slog.Bool("concurrent", plan.Concurrent()))
+
+	// Create the hotspot service of the selected backend
+	h, err := network.NewBackendAPService(backend)
+	if err != nil {
+		slog.Error("failed to create hotspot service", slog.String("error", err.Error()))
+		return
+	}
+
 	// Configure the access point
 	apConfig := network.APConfig{
 		Name:        "go-wifiportal",
-		Interface:   iFace.Name,
+		Interface:   plan.AP,
 		SSID:        "GoWiFiPortal",
 		Password:    "12345678",
 		CountryCode: "SE",
@@ -49,18 +72,26 @@ func main() {
 		DHCPRange:   "192.168.4.2,192.168.4.50",
 		PortalPort:  "8080", // Portal runs on port 8080, traffic redirected from 80
 	}
-
 	// Configure the WiFi setup portal server (captive portal mode)
 	portalConfig := portal.Config{
 		Port:        apConfig.PortalPort,      // Use the same port configured in AP
-		Interface:   iFace.Name,               // WiFi interface to manage for internet connection
+		Interface:   plan.Station,             // WiFi interface to manage for internet connection
 		SSID:        apConfig.SSID,            // Same as AP SSID
 		Gateway:     apConfig.Gateway,         // Same as AP gateway
 		RedirectURL: "https://www.google.com", // Optional redirect after setup
 	}
 
-	// Create the portal server
-	portalServer := portal.NewServer(portalConfig)
+	// Verify new connections and bring the hotspot back if they do not work. A radio limited to
+	// one channel cannot run the hotspot elsewhere than the joined network, so it follows the station.
+	connector := network.NewConnector(im,
+		network.WithConnectorAP(h, apConfig),
+		network.WithConnectorVirtualAP(virtualAP, plan),
+		network.WithConnectivityCheck("http://connectivitycheck.gstatic.com/generate_204", http.StatusNoContent))
+
+	// Create the portal server on the same backend the connector joins networks with
+	portalServer := portal.NewServer(portalConfig,
+		portal.WithInterfaceManager(im),
+		portal.WithConnector(connector))
 
 	// Add custom routes if needed
 	portalServer.AddRoute("/api/custom", func(w http.ResponseWriter, r *http.Request) {
@@ -7,7 +7,13 @@ import (
 )
 
 func main() {
-	im := network.NewInterfaceManager()
+	// Prefer 5GHz capable USB dongles and never take over the interface carrying the uplink
+	policy := network.DefaultSelectionPolicy().With(
+		network.PreferBand(network.Band5GHz, 50),
+		network.PreferName("wlx*", 25),
+		network.ExcludeUplink(),
+	)
+	im := network.NewInterfaceManager(network.WithInterfaceSelectionPolicy(policy))
 
 	interfaces, err := im.ListWirelessInterfaces()
 	if err != nil {
@@ -19,6 +25,15 @@ func main() {
 		slog.With(slog.Any("interface", iface)).Info("Found wireless interface")
 	}
 
+	scores, err := im.RankAPInterfaces()
+	if err != nil {
+		slog.With("slog", "error").Error("Failed to rank wireless interfaces", "error", err)
+		return
+	}
+	for _, score := range scores {
+		slog.Info("Interface score", "interface", score.Interface.Name, "score", score.Score, "excluded", score.Excluded, "reasons", score.Reasons)
+	}
+
 	bestInterface, err := im.GetBestAPInterface()
 	if err != nil {
 		slog.With("slog", "error").Error("Failed to get best AP interface", "error", err)
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/AnteWall/go-wifiportal/pkg/portal"
+	"github.com/AnteWall/go-wifiportal/pkg/supervisor"
+)
+
+func main() {
+	slog.SetLogLoggerLevel(slog.LevelDebug)
+
+	backend := network.Backend(os.Getenv("WIFIPORTAL_BACKEND"))
+	im, err := network.NewBackendInterfaceManager(backend)
+	if err != nil {
+		slog.Error("failed to create interface manager", slog.String("error", err.Error()))
+		return
+	}
+	h, err := network.NewBackendAPService(backend)
+	if err != nil {
+		slog.Error("failed to create hotspot service", slog.String("error", err.Error()))
+		return
+	}
+
+	apConfig := network.APConfig{
+		Name:        "go-wifiportal",
+		Interface:   "wlan0",
+		SSID:        "GoWiFiPortal",
+		Password:    "12345678",
+		CountryCode: "SE",
+		Security:    "wpa2",
+		Gateway:     "192.168.4.1",
+		DHCPRange:   "192.168.4.2,192.168.4.50",
+		PortalPort:  "8080",
+	}
+
+	// Verify new connections and bring the hotspot back if they do not work
+	connectivityURL := "http://connectivitycheck.gstatic.com/generate_204"
+	connector := network.NewConnector(im,
+		network.WithConnectorAP(h, apConfig),
+		network.WithConnectivityCheck(connectivityURL, http.StatusNoContent))
+	portalOpts := []portal.ServerOption{portal.WithInterfaceManager(im), portal.WithConnector(connector)}
+
+	// Report dnsmasq and hostapd restarts, /api/status shows them as degraded
+	if monitored, ok := h.(network.MonitoredAPService); ok {
+		portalOpts = append(portalOpts, portal.WithAccessPoint(monitored))
+		go func() {
+			for event := range monitored.Events() {
+				slog.Warn("access point event", slog.String("type", string(event.Type)),
+					slog.String("process", event.Process), slog.String("error", event.Error))
+			}
+		}()
+	}
+	portalServer := portal.NewServer(portal.Config{
+		Port:      apConfig.PortalPort,
+		Interface: apConfig.Interface,
+		SSID:      apConfig.SSID,
+		Gateway:   apConfig.Gateway,
+	}, portalOpts...)
+
+	// Serve the portal only while the device has no working uplink for a minute, or right away
+	// on first boot when no network is saved
+	s := supervisor.New(im, h, apConfig, portalServer,
+		supervisor.WithGracePeriod(time.Minute),
+		supervisor.WithCheck(supervisor.AllChecks(
+			supervisor.UplinkCheck(command.NewExecRunner()),
+			supervisor.HTTPCheck(&http.Client{Timeout: 5 * time.Second}, connectivityURL, http.StatusNoContent))),
+		supervisor.WithHooks(supervisor.Hooks{
+			OnStateChange: func(from, to supervisor.State) {
+				slog.Info("provisioning state changed", slog.String("from", string(from)), slog.String("to", string(to)))
+			},
+		}))
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	if err := s.Run(ctx); err != nil {
+		slog.Error("supervisor failed", slog.String("error", err.Error()))
+	}
+	slog.Info("Shutdown complete")
+}
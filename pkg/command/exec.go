@@ -0,0 +1,95 @@
+package command
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"os/exec"
+	"syscall"
+	"time"
+)
+
+// stderrWaitDelay bounds how long Wait copies stderr after a started command exits
+const stderrWaitDelay = time.Second
+
+type execRunner struct{}
+
+func (e *execRunner) Run(cmd string, args ...string) (Result, error) {
+	command := exec.Command(cmd, args...)
+	var out, errBuffer bytes.Buffer
+	command.Stdout, command.Stderr = &out, &errBuffer
+	runErr := command.Run()
+	code := 0
+	var ee *exec.ExitError
+	if errors.As(runErr, &ee) && ee.ProcessState != nil {
+		code = ee.ProcessState.ExitCode()
+	}
+	return Result{Stdout: out.Bytes(), Stderr: errBuffer.Bytes(), ExitCode: code}, runErr
+}
+
+func (e *execRunner) RunWithContext(ctx context.Context, cmd string, args ...string) (Result, error) {
+	command := exec.CommandContext(ctx, cmd, args...)
+	var out, errBuffer bytes.Buffer
+	command.Stdout, command.Stderr = &out, &errBuffer
+	runErr := command.Run()
+	code := 0
+	var ee *exec.ExitError
+	if errors.As(runErr, &ee) && ee.ProcessState != nil {
+		code = ee.ProcessState.ExitCode()
+	}
+	return Result{Stdout: out.Bytes(), Stderr: errBuffer.Bytes(), ExitCode: code}, runErr
+}
+
+func (e *execRunner) RunWithTimeout(timeout time.Duration, cmd string, args ...string) (Result, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	return e.RunWithContext(ctx, cmd, args...)
+}
+
+// NewExecRunner creates a Runner executing commands with os/exec
+func NewExecRunner() Runner {
+	return &execRunner{}
+}
+
+type execProcess struct {
+	cmd *exec.Cmd
+}
+
+func (p *execProcess) Pid() int {
+	return p.cmd.Process.Pid
+}
+
+func (p *execProcess) Wait() error {
+	return p.cmd.Wait()
+}
+
+func (p *execProcess) Kill() error {
+	return p.cmd.Process.Kill()
+}
+
+func (p *execProcess) Terminate() error {
+	return p.cmd.Process.Signal(syscall.SIGTERM)
+}
+
+// Start launches a long-running command without waiting for it to exit.
+// The process is not bound to a context; callers own its lifetime.
+func (e *execRunner) Start(cmd string, args ...string) (Process, error) {
+	command := exec.Command(cmd, args...)
+	if err := command.Start(); err != nil {
+		return nil, err
+	}
+	return &execProcess{cmd: command}, nil
+}
+
+// StartWithStderr is Start with stderr copied to the writer. Wait gives up on the copy shortly
+// after the command exits, since children such as the one sudo forks may hold the pipe open.
+func (e *execRunner) StartWithStderr(stderr io.Writer, cmd string, args ...string) (Process, error) {
+	command := exec.Command(cmd, args...)
+	command.Stderr = stderr
+	command.WaitDelay = stderrWaitDelay
+	if err := command.Start(); err != nil {
+		return nil, err
+	}
+	return &execProcess{cmd: command}, nil
+}
@@ -1,6 +1,7 @@
 package command
 
 import (
+	"bytes"
 	"context"
 	"os/exec"
 	"runtime"
@@ -444,3 +445,58 @@ func TestExecRunner_EnvironmentIsolation(t *testing.T) {
 	assert.Equal(t, 0, result.ExitCode)
 	assert.NotEmpty(t, result.Stdout)
 }
+
+func TestExecRunner_StartAndKill(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sleep is not available on windows")
+	}
+	runner := NewExecRunner()
+
+	proc, err := runner.Start("sleep", "5")
+	require.NoError(t, err)
+	assert.Greater(t, proc.Pid(), 0)
+
+	require.NoError(t, proc.Kill())
+	assert.Error(t, proc.Wait())
+}
+
+func TestExecRunner_StartAndTerminate(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("signals are not available on windows")
+	}
+	proc, err := NewExecRunner().Start("sleep", "5")
+	require.NoError(t, err)
+
+	require.NoError(t, proc.Terminate())
+	assert.EqualError(t, proc.Wait(), "signal: terminated")
+}
+
+func TestExecRunner_StartWithStderr(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("sh is not available on windows")
+	}
+	var stderr bytes.Buffer
+	proc, err := NewExecRunner().StartWithStderr(&stderr, "sh", "-c", "echo failed >&2; exit 3")
+	require.NoError(t, err)
+
+	assert.Error(t, proc.Wait())
+	assert.Equal(t, "failed\n", stderr.String())
+}
+
+func TestFakeRunner_RecordsCallsAndProcesses(t *testing.T) {
+	runner := NewFakeRunner()
+	runner.AddScript("echo", []string{"hi"}, Result{Stdout: []byte("hi\n")})
+
+	result, err := runner.Run("echo", "hi")
+	require.NoError(t, err)
+	assert.Equal(t, "hi\n", string(result.Stdout))
+
+	proc, err := runner.Start("dnsmasq", "--keep-in-foreground")
+	require.NoError(t, err)
+	assert.True(t, runner.Called("dnsmasq", "--keep-in-foreground"))
+	assert.Same(t, proc, runner.Process("dnsmasq", "--keep-in-foreground"))
+
+	require.NoError(t, proc.Kill())
+	assert.ErrorIs(t, proc.Wait(), ErrFakeProcessKilled)
+	assert.Equal(t, []string{"echo hi", "dnsmasq --keep-in-foreground"}, runner.History())
+}
@@ -0,0 +1,200 @@
+package command
+
+import (
+	"context"
+	"errors"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ErrFakeProcessKilled is returned from Wait on a FakeProcess that was killed
+var ErrFakeProcessKilled = errors.New("fake process killed")
+
+// ErrFakeProcessTerminated is returned from Wait on a FakeProcess that was terminated
+var ErrFakeProcessTerminated = errors.New("fake process terminated")
+
+// FakeRunner records the commands it is asked to run and returns scripted results. Commands
+// without a script succeed with empty output. Script it with AddScript and AddError and read
+// the recorded calls with Called and History.
+type FakeRunner struct {
+	mu        sync.Mutex
+	scripts   map[string]Result
+	errs      map[string]error
+	calls     []string
+	processes map[string]*FakeProcess
+}
+
+func (f *FakeRunner) Run(cmd string, args ...string) (Result, error) {
+	key := commandKey(cmd, args)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, key)
+	return f.scripts[key], f.errs[key]
+}
+
+func (f *FakeRunner) RunWithContext(ctx context.Context, cmd string, args ...string) (Result, error) {
+	if err := ctx.Err(); err != nil {
+		return Result{}, err
+	}
+	return f.Run(cmd, args...)
+}
+
+func (f *FakeRunner) RunWithTimeout(timeout time.Duration, cmd string, args ...string) (Result, error) {
+	return f.Run(cmd, args...)
+}
+
+// Start records the call and returns a FakeProcess that runs until killed
+func (f *FakeRunner) Start(cmd string, args ...string) (Process, error) {
+	return f.StartWithStderr(io.Discard, cmd, args...)
+}
+
+// StartWithStderr is Start with WriteStderr of the FakeProcess writing to stderr
+func (f *FakeRunner) StartWithStderr(stderr io.Writer, cmd string, args ...string) (Process, error) {
+	key := commandKey(cmd, args)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, key)
+	if err := f.errs[key]; err != nil {
+		return nil, err
+	}
+	p := newFakeProcess(len(f.processes) + 1000)
+	p.stderr = stderr
+	f.processes[key] = p
+	return p, nil
+}
+
+func (f *FakeRunner) AddScript(cmd string, args []string, result Result) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.scripts[commandKey(cmd, args)] = result
+}
+
+// AddError makes the given command fail with err and result
+func (f *FakeRunner) AddError(cmd string, args []string, result Result, err error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	key := commandKey(cmd, args)
+	f.scripts[key] = result
+	f.errs[key] = err
+}
+
+// Called reports whether the exact command line was run
+func (f *FakeRunner) Called(cmd string, args ...string) bool {
+	key := commandKey(cmd, args)
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, c := range f.calls {
+		if c == key {
+			return true
+		}
+	}
+	return false
+}
+
+// History returns a copy of all recorded command lines
+func (f *FakeRunner) History() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]string(nil), f.calls...)
+}
+
+// Process returns the FakeProcess started for the exact command line, if any
+func (f *FakeRunner) Process(cmd string, args ...string) *FakeProcess {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.processes[commandKey(cmd, args)]
+}
+
+// NewFakeRunner creates a FakeRunner without scripts
+func NewFakeRunner() *FakeRunner {
+	return &FakeRunner{
+		scripts:   make(map[string]Result),
+		errs:      make(map[string]error),
+		processes: make(map[string]*FakeProcess),
+	}
+}
+
+// FakeProcess is a Process that blocks in Wait until Kill, Terminate or Exit is called
+type FakeProcess struct {
+	pid    int
+	done   chan struct{}
+	once   sync.Once
+	err    error
+	stderr io.Writer
+
+	mu              sync.Mutex
+	ignoreTerminate bool
+	terminated      bool
+}
+
+func newFakeProcess(pid int) *FakeProcess {
+	return &FakeProcess{pid: pid, done: make(chan struct{})}
+}
+
+func (p *FakeProcess) Pid() int {
+	return p.pid
+}
+
+func (p *FakeProcess) Wait() error {
+	<-p.done
+	return p.err
+}
+
+func (p *FakeProcess) Kill() error {
+	p.Exit(ErrFakeProcessKilled)
+	return nil
+}
+
+func (p *FakeProcess) Terminate() error {
+	p.mu.Lock()
+	p.terminated = true
+	ignore := p.ignoreTerminate
+	p.mu.Unlock()
+	if !ignore {
+		p.Exit(ErrFakeProcessTerminated)
+	}
+	return nil
+}
+
+// IgnoreTerminate makes the process keep running when it is terminated, only Kill or Exit end it
+func (p *FakeProcess) IgnoreTerminate() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.ignoreTerminate = true
+}
+
+// Terminated reports whether Terminate was called
+func (p *FakeProcess) Terminated() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.terminated
+}
+
+// Exit simulates the process terminating on its own with err
+func (p *FakeProcess) Exit(err error) {
+	p.once.Do(func() {
+		p.err = err
+		close(p.done)
+	})
+}
+
+// WriteStderr simulates the process writing to stderr
+func (p *FakeProcess) WriteStderr(output string) {
+	io.WriteString(p.stderr, output)
+}
+
+// Exited reports whether the process has terminated
+func (p *FakeProcess) Exited() bool {
+	select {
+	case <-p.done:
+		return true
+	default:
+		return false
+	}
+}
+
+func commandKey(cmd string, args []string) string {
+	return strings.Join(append([]string{cmd}, args...), " ")
+}
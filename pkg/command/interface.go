@@ -0,0 +1,41 @@
+// Package command runs system commands through a Runner, so callers can replace them with a
+// FakeRunner in tests
+package command
+
+import (
+	"context"
+	"io"
+	"time"
+)
+
+// Result is the output of a command that ran to completion
+type Result struct {
+	Stdout   []byte
+	Stderr   []byte
+	ExitCode int
+}
+
+// Combined returns stdout followed by stderr, similar to exec.Cmd.CombinedOutput
+func (r Result) Combined() string {
+	return string(r.Stdout) + string(r.Stderr)
+}
+
+// Process is a handle to a long-running command started by a Runner
+type Process interface {
+	Pid() int
+	Wait() error
+	Kill() error
+	// Terminate asks the process to exit with SIGTERM. Unlike SIGKILL, sudo forwards it to the
+	// command it runs.
+	Terminate() error
+}
+
+// Runner executes system commands, NewExecRunner runs them with os/exec
+type Runner interface {
+	Run(cmd string, args ...string) (Result, error)
+	RunWithContext(ctx context.Context, cmd string, args ...string) (Result, error)
+	RunWithTimeout(timeout time.Duration, cmd string, args ...string) (Result, error)
+	Start(cmd string, args ...string) (Process, error)
+	// StartWithStderr is Start with the stderr of the command written to stderr
+	StartWithStderr(stderr io.Writer, cmd string, args ...string) (Process, error)
+}
@@ -0,0 +1,72 @@
+package network
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+
+	"github.com/pkg/errors"
+)
+
+// DefaultAPStateFile is where NewAPService records what Start set up
+const DefaultAPStateFile = DefaultStateDir + "/ap-state.json"
+
+// apState records the steps Start has completed, so they can be undone by a later process
+// when this one crashes before Stop
+type apState struct {
+	Name          string `json:"name"`
+	Interface     string `json:"interface"`
+	PortalPort    string `json:"portal_port"`
+	Hotspot       bool   `json:"hotspot"`                  // The NetworkManager profile was added
+	Rules         bool   `json:"rules"`                    // The captive iptables rules were applied
+	DNSMasqConfig string `json:"dnsmasq_config,omitempty"` // dnsmasq runs with this config
+}
+
+// readAPState reads the state recorded at path, nil when nothing is recorded
+func readAPState(path string) (*apState, error) {
+	if path == "" {
+		return nil, nil
+	}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read access point state")
+	}
+	var state apState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse access point state %s", path)
+	}
+	return &state, nil
+}
+
+// writeAPState replaces the state at path, the rename keeps a crash from leaving half a file
+func writeAPState(path string, state apState) error {
+	if path == "" {
+		return nil
+	}
+	data, err := json.Marshal(state)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode access point state")
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return errors.Wrap(err, "failed to create access point state directory")
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return errors.Wrap(err, "failed to write access point state")
+	}
+	return errors.Wrap(os.Rename(tmp, path), "failed to write access point state")
+}
+
+// removeAPState forgets the state at path
+func removeAPState(path string) error {
+	if path == "" {
+		return nil
+	}
+	if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return errors.Wrap(err, "failed to remove access point state")
+	}
+	return nil
+}
@@ -5,11 +5,16 @@ import (
 	"embed"
 	"fmt"
 	"log/slog"
+	"net"
+	"net/url"
 	"os"
-	"os/exec"
+	"strconv"
 	"strings"
-	"text/template"
+	"sync"
+	"time"
 
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/godbus/dbus/v5"
 	"github.com/pkg/errors"
 )
 
@@ -28,10 +33,30 @@ type APConfig struct {
 	SSID        string `yaml:"ssid" json:"ssid"`
 	Password    string `yaml:"password" json:"password"`
 	CountryCode string `yaml:"country_code" json:"countryCode"`
-	Security    string `yaml:"security" json:"security"` // "open", "wpa2"
+	Security    string `yaml:"security" json:"security"` // "open", "wpa2", "wpa3" or "wpa2-wpa3", defaults to "wpa2"
+	PMF         string `yaml:"pmf" json:"pmf"`           // "disabled", "optional" or "required", derived from Security when empty
 	Gateway     string `yaml:"gateway" json:"gateway"`
 	DHCPRange   string `yaml:"dhcp_range" json:"dhcpRange"`
 	PortalPort  string `yaml:"portal_port" json:"portalPort"`
+	Channel     int    `yaml:"channel" json:"channel"` // 0 selects the backend default
+	HWMode      string `yaml:"hw_mode" json:"hwMode"`  // "g" (2.4GHz) or "a" (5GHz), derived from Channel when empty
+	Hidden      bool   `yaml:"hidden" json:"hidden"`   // Do not broadcast the SSID
+
+	// CaptivePortalAPI is the https URI of the RFC 8908 API advertised in DHCP option 114, e.g.
+	// "https://portal.example.com/api/captive" served with a valid certificate in front of the
+	// portal. Without it a plain http URI is advertised, which Android and iOS ignore.
+	CaptivePortalAPI string `yaml:"captive_portal_api" json:"captivePortalAPI"`
+}
+
+// Band returns the hw_mode of the access point, deriving it from the channel when unset
+func (c APConfig) Band() string {
+	if c.HWMode != "" {
+		return c.HWMode
+	}
+	if c.Channel > 14 {
+		return "a"
+	}
+	return "g"
 }
 
 func (c APConfig) Validate() error {
@@ -53,15 +78,43 @@ func (c APConfig) Validate() error {
 	if len(c.DHCPRange) == 0 {
 		return errors.Wrap(ErrInvalidAPConfig, "DHCPRange is required")
 	}
-	// Password is only required for secured networks
-	if c.Security != "open" && len(c.Password) == 0 {
-		return errors.Wrap(ErrInvalidAPConfig, "password is required for secured networks")
+	if c.Channel < 0 || c.Channel > 196 {
+		return errors.Wrap(ErrInvalidAPConfig, "channel is out of range")
 	}
-	// For WPA2, password must be at least 8 characters
-	if c.Security == "wpa2" && len(c.Password) < 8 {
-		return errors.Wrap(ErrInvalidAPConfig, "password must be at least 8 characters for WPA2")
+	switch c.HWMode {
+	case "", "a", "b", "g":
+	default:
+		return errors.Wrap(ErrInvalidAPConfig, "hw mode must be one of a, b or g")
 	}
-	return nil
+	if c.HWMode == "a" && c.Channel != 0 && c.Channel <= 14 {
+		return errors.Wrap(ErrInvalidAPConfig, "channel is not valid for 5GHz")
+	}
+	if (c.HWMode == "b" || c.HWMode == "g") && c.Channel > 14 {
+		return errors.Wrap(ErrInvalidAPConfig, "channel is not valid for 2.4GHz")
+	}
+	if c.CaptivePortalAPI != "" {
+		if u, err := url.Parse(c.CaptivePortalAPI); err != nil || u.Scheme != "https" || u.Host == "" {
+			return errors.Wrap(ErrInvalidAPConfig, "captive portal API must be an https URI")
+		}
+	}
+	return c.validateSecurity()
+}
+
+// CaptivePortalAPIPath is where portal.Server serves the RFC 8908 Captive Portal API
+const CaptivePortalAPIPath = "/api/captive"
+
+// CaptivePortalAPIURL returns the RFC 8908 API URI advertised to clients in DHCP option 114,
+// CaptivePortalAPI when set. RFC 8908 requires https, so the fallback http URI on the portal
+// port is only useful to clients that don't enforce it; Android and iOS ignore the option then.
+func (c APConfig) CaptivePortalAPIURL() string {
+	if c.CaptivePortalAPI != "" {
+		return c.CaptivePortalAPI
+	}
+	host := c.Gateway
+	if c.PortalPort != "" && c.PortalPort != "80" {
+		host = net.JoinHostPort(c.Gateway, c.PortalPort)
+	}
+	return "http://" + host + CaptivePortalAPIPath
 }
 
 type APService interface {
@@ -70,80 +123,277 @@ type APService interface {
 	IsRunning() bool
 }
 
+// RecoverableAPService is implemented by services that record what Start set up. Recover
+// tears down whatever a crashed process left behind, call it once on startup.
+type RecoverableAPService interface {
+	APService
+	Recover(ctx context.Context) error
+}
+
+// APServiceOption configures an APService
+type APServiceOption func(*apServiceOptions)
+
+type apServiceOptions struct {
+	runner     command.Runner
+	logger     *slog.Logger
+	dhcp       *DHCPServer
+	dns        *DNSServer
+	bus        *dbus.Conn
+	state      string
+	backoff    time.Duration
+	maxBackoff time.Duration
+}
+
+// WithAPCommandRunner sets the runner used for every system command the service executes
+func WithAPCommandRunner(runner command.Runner) APServiceOption {
+	return func(o *apServiceOptions) {
+		o.runner = runner
+	}
+}
+
+// WithAPLogger sets the logger used by the service
+func WithAPLogger(logger *slog.Logger) APServiceOption {
+	return func(o *apServiceOptions) {
+		o.logger = logger
+	}
+}
+
+// WithDHCPServer hands out addresses with the embedded server instead of dnsmasq.
+// Keep a reference to the server to read its leases.
+func WithDHCPServer(server *DHCPServer) APServiceOption {
+	return func(o *apServiceOptions) {
+		o.dhcp = server
+	}
+}
+
+// WithDNSServer answers client DNS queries with the embedded server instead of dnsmasq.
+// dnsmasq is not started at all when combined with WithDHCPServer.
+func WithDNSServer(server *DNSServer) APServiceOption {
+	return func(o *apServiceOptions) {
+		o.dns = server
+	}
+}
+
+// WithAPDBusConn sets the bus connection used by the D-Bus backends, defaults to the system bus
+func WithAPDBusConn(conn *dbus.Conn) APServiceOption {
+	return func(o *apServiceOptions) {
+		o.bus = conn
+	}
+}
+
+// WithAPStateFile sets where the service records what Start set up, DefaultAPStateFile by
+// default. An empty path disables recovery after a crash.
+func WithAPStateFile(path string) APServiceOption {
+	return func(o *apServiceOptions) {
+		o.state = path
+	}
+}
+
+// WithAPRestartBackoff sets how long the service waits before restarting a child process such
+// as dnsmasq that exited, doubling up to max for repeated exits. 1s up to 1m by default.
+func WithAPRestartBackoff(initial, max time.Duration) APServiceOption {
+	return func(o *apServiceOptions) {
+		o.backoff, o.maxBackoff = initial, max
+	}
+}
+
+func newAPServiceOptions(opts []APServiceOption) apServiceOptions {
+	o := apServiceOptions{
+		runner:     command.NewExecRunner(),
+		logger:     slog.Default().WithGroup("ap_service"),
+		state:      DefaultAPStateFile,
+		backoff:    defaultRestartBackoff,
+		maxBackoff: defaultMaxRestartBackoff,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
+
 type hostAPDService struct {
-	config            APConfig
-	dnsmasqConfigPath string
-	dnsmasqCmd        *exec.Cmd
-	running           bool
-	logger            *slog.Logger
+	mu        sync.Mutex // Guards config, clients, running and state
+	config    APConfig
+	clients   *clientServices
+	monitor   *processMonitor
+	running   bool
+	runner    command.Runner
+	logger    *slog.Logger
+	stateFile string
+	state     apState // The steps Start has completed, mirrored to stateFile
 }
 
-func NewAPService() APService {
+// NewAPService creates an APService that hosts the access point as a NetworkManager hotspot
+// profile. What Start sets up is recorded in the state file, see WithAPStateFile and Recover.
+func NewAPService(opts ...APServiceOption) RecoverableAPService {
+	o := newAPServiceOptions(opts)
+	monitor := newProcessMonitor(o)
 	return &hostAPDService{
-		logger:  slog.Default().WithGroup("ap_service"),
-		running: false,
+		runner:    o.runner,
+		logger:    o.logger,
+		monitor:   monitor,
+		clients:   newClientServices(o, monitor),
+		running:   false,
+		stateFile: o.state,
 	}
 }
 
 func (h *hostAPDService) Start(ctx context.Context, config APConfig) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	if h.running {
 		return ErrServiceAlreadyRunning
 	}
 	if err := config.Validate(); err != nil {
 		return errors.Wrap(err, "invalid access point configuration")
 	}
+	if err := h.recoverPrevious(ctx); err != nil {
+		h.logger.Warn("failed to clean up after a previous run", slog.String("error", err.Error()))
+	}
 	h.config = config
+	h.state = apState{Name: config.Name, Interface: config.Interface, PortalPort: config.PortalPort}
 	h.logger.Info("starting access point service", slog.String("ssid", config.SSID))
 
-	if err := h.prepareInterface(); err != nil {
+	if err := h.prepareInterface(ctx); err != nil {
 		return errors.Wrap(err, "failed to prepare interface")
 	}
-	if err := h.createHotspot(); err != nil {
+	if err := h.createHotspot(ctx); err != nil {
+		h.rollback(ctx)
 		return errors.Wrap(err, "failed to create NetworkManager hotspot")
 	}
-	if err := h.configureNetwork(); err != nil {
+	if err := h.configureNetwork(ctx); err != nil {
+		h.rollback(ctx)
 		return errors.Wrap(err, "failed to configure network")
 	}
-	if err := h.startDNSMasq(); err != nil {
-		return errors.Wrap(err, "failed to start dnsmasq")
+	if err := h.startDNSMasq(ctx); err != nil {
+		h.rollback(ctx)
+		return err
 	}
 
 	h.running = true
 	return nil
 }
 
+// Stop tears the access point down. When the service is not running it removes whatever a
+// crashed process recorded instead, so it is safe to call any number of times.
 func (h *hostAPDService) Stop(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
 	if !h.running {
-		return nil
+		return h.recoverPrevious(ctx)
 	}
 
-	h.stopDNSMasq()
-	h.stopHotspot()
-	h.cleanupNetworkRules()
+	h.stopDNSMasq(ctx)
+	h.stopHotspot(ctx, h.config.Name)
+	h.cleanupNetworkRules(ctx)
+	h.forgetState()
 
 	h.running = false
 	h.logger.Debug("access point service stopped")
 	return nil
 }
 
+// Recover removes the hotspot profile, dnsmasq process, dnsmasq config and iptables rules a
+// previous process recorded in the state file but never stopped, e.g. because it crashed
+func (h *hostAPDService) Recover(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.recoverPrevious(ctx)
+}
+
+// recoverPrevious is Recover with h.mu held
+func (h *hostAPDService) recoverPrevious(ctx context.Context) error {
+	if h.running {
+		return ErrServiceAlreadyRunning
+	}
+	state, err := readAPState(h.stateFile)
+	if err != nil {
+		// Nothing can be recovered from a broken file, don't let it fail every later start
+		removeAPState(h.stateFile)
+		return err
+	}
+	if state == nil {
+		return nil
+	}
+
+	h.logger.Info("removing access point left over from a previous run", slog.String("name", state.Name))
+	if state.DNSMasqConfig != "" {
+		h.runner.RunWithContext(ctx, "sudo", "pkill", "-f", "dnsmasq.*"+state.DNSMasqConfig)
+		if err := os.Remove(state.DNSMasqConfig); err != nil && !errors.Is(err, os.ErrNotExist) {
+			h.logger.Warn("failed to remove dnsmasq config file", slog.String("path", state.DNSMasqConfig), slog.String("error", err.Error()))
+		}
+	}
+	if state.Hotspot {
+		h.stopHotspot(ctx, state.Name)
+	}
+	if state.Rules {
+		removeCaptiveRules(ctx, h.runner, state.Interface, state.PortalPort)
+	}
+	return removeAPState(h.stateFile)
+}
+
+// rollback undoes the steps a failed Start completed, dnsmasq being the last step cleans up
+// after itself
+func (h *hostAPDService) rollback(ctx context.Context) {
+	ctx = context.WithoutCancel(ctx)
+	if h.state.Hotspot {
+		h.stopHotspot(ctx, h.state.Name)
+	}
+	if h.state.Rules {
+		h.cleanupNetworkRules(ctx)
+	}
+	h.forgetState()
+}
+
+// recordState persists a completed step, failures are only logged since the access point
+// works without the file
+func (h *hostAPDService) recordState() {
+	if err := writeAPState(h.stateFile, h.state); err != nil {
+		h.logger.Warn("failed to record access point state", slog.String("path", h.stateFile), slog.String("error", err.Error()))
+	}
+}
+
+func (h *hostAPDService) forgetState() {
+	h.state = apState{}
+	if err := removeAPState(h.stateFile); err != nil {
+		h.logger.Warn("failed to remove access point state", slog.String("path", h.stateFile), slog.String("error", err.Error()))
+	}
+}
+
 func (h *hostAPDService) IsRunning() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
 	return h.running
 }
 
-func (h *hostAPDService) prepareInterface() error {
+// Health reports dnsmasq, the service is degraded while it is restarting
+func (h *hostAPDService) Health() APHealth {
+	h.mu.Lock()
+	running := h.running
+	h.mu.Unlock()
+	return h.monitor.health(running)
+}
+
+func (h *hostAPDService) Events() <-chan APEvent {
+	return h.monitor.events
+}
+
+func (h *hostAPDService) prepareInterface(ctx context.Context) error {
 	// Stop any existing dnsmasq service
-	if err := exec.Command("systemctl", "stop", "dnsmasq").Run(); err != nil {
+	if _, err := h.runner.RunWithContext(ctx, "systemctl", "stop", "dnsmasq"); err != nil {
 		h.logger.Warn("failed to stop system dnsmasq service", slog.String("error", err.Error()))
 	}
 
 	// Ensure the interface is managed by NetworkManager
-	if err := exec.Command("nmcli", "device", "set", h.config.Interface, "managed", "yes").Run(); err != nil {
+	if _, err := h.runner.RunWithContext(ctx, "nmcli", "device", "set", h.config.Interface, "managed", "yes"); err != nil {
 		return errors.Wrap(err, "failed to set interface to managed mode")
 	}
 
 	// Disconnect any existing connections on the interface
-	if o, err := exec.Command("nmcli", "device", "disconnect", h.config.Interface).CombinedOutput(); err != nil {
-		if !strings.Contains(string(o), "This device is not active") {
+	if res, err := h.runner.RunWithContext(ctx, "nmcli", "device", "disconnect", h.config.Interface); err != nil {
+		if !strings.Contains(res.Combined(), "This device is not active") {
 			h.logger.Warn("failed to disconnect interface", slog.String("error", err.Error()))
 		}
 	}
@@ -151,7 +401,7 @@ func (h *hostAPDService) prepareInterface() error {
 	return nil
 }
 
-func (h *hostAPDService) createHotspot() error {
+func (h *hostAPDService) createHotspot(ctx context.Context) error {
 	args := []string{
 		"connection", "add",
 		"type", "wifi",
@@ -164,119 +414,78 @@ func (h *hostAPDService) createHotspot() error {
 		"ipv4.addresses", fmt.Sprintf("%s/24", h.config.Gateway),
 	}
 
-	// Add security settings based on configuration
-	if h.config.Security == "wpa2" && h.config.Password != "" {
-		args = append(args,
-			"wifi-sec.key-mgmt", "wpa-psk",
-			"wifi-sec.proto", "rsn",
-			"wifi-sec.pairwise", "ccmp",
-			"wifi-sec.group", "ccmp",
-			"wifi-sec.psk", h.config.Password,
-		)
-	} else if h.config.Password != "" {
-		args = append(args,
-			"wifi-sec.key-mgmt", "wpa-psk",
-			"wifi-sec.proto", "rsn",
-			"wifi-sec.pairwise", "ccmp",
-			"wifi-sec.group", "ccmp",
-			"wifi-sec.psk", h.config.Password,
-		)
-	}
-
-	cmd := exec.Command("nmcli", args...)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return errors.Wrap(err, string(output))
-	}
-
-	cmd = exec.Command("nmcli", "connection", "up", h.config.Name)
-	if output, err := cmd.CombinedOutput(); err != nil {
-		return fmt.Errorf("failed to activate hotspot: %s, %w", string(output), err)
-	}
-	return nil
-}
-
-func (h *hostAPDService) configureNetwork() error {
-	rules := GetRequiredFirewallRules(h.config.Interface, h.config.PortalPort)
-	for _, rule := range rules {
-		if err := rule.Apply(h.config.Interface); err != nil {
-			h.logger.Warn("failed to apply firewall rule", slog.String("error", err.Error()))
-		}
-	}
-
-	ipTablesRules := CreateIPTablesRules(h.config.Interface, h.config.PortalPort)
-	for _, rule := range ipTablesRules {
-		if err := rule.Apply(); err != nil {
-			h.logger.Warn("failed to apply iptables rule", slog.String("error", err.Error()))
+	if h.config.Channel != 0 {
+		band := "bg"
+		if h.config.Band() == "a" {
+			band = "a"
 		}
+		args = append(args, "wifi.band", band, "wifi.channel", strconv.Itoa(h.config.Channel))
 	}
-
-	return nil
-}
-
-func (h *hostAPDService) startDNSMasq() error {
-	// Stop any existing dnsmasq service
-	if err := exec.Command("sudo", "systemctl", "stop", "dnsmasq").Run(); err != nil {
-		h.logger.Warn("failed to stop system dnsmasq service", slog.String("error", err.Error()))
+	if h.config.Hidden {
+		args = append(args, "wifi.hidden", "yes")
 	}
 
-	tmpl, err := template.ParseFS(templateFiles, "templates/dnsmasq.conf.tmpl")
-	if err != nil {
-		return errors.Wrap(err, "failed to parse dnsmasq template")
+	// Add security settings based on configuration
+	if h.config.SecurityMode() == SecurityWPA2WPA3 {
+		h.logger.Warn("NetworkManager cannot host WPA2/WPA3 transition mode, falling back to WPA2 with optional PMF",
+			slog.String("ssid", h.config.SSID))
 	}
+	args = append(args, nmcliSecurityArgs(h.config)...)
 
-	file, err := os.CreateTemp("", "dnsmasq-*.conf")
-	if err != nil {
-		return errors.Wrap(err, "failed to create dnsmasq config file")
+	// A profile of the same name would make "connection up" ambiguous
+	if _, err := h.runner.RunWithContext(ctx, "nmcli", "connection", "delete", h.config.Name); err == nil {
+		h.logger.Debug("removed existing hotspot profile", slog.String("name", h.config.Name))
 	}
-	defer file.Close()
-
-	if err := tmpl.Execute(file, h.config); err != nil {
-		return errors.Wrap(err, "failed to execute dnsmasq template")
+	if res, err := h.runner.RunWithContext(ctx, "nmcli", args...); err != nil {
+		return errors.Wrap(err, res.Combined())
 	}
+	h.state.Hotspot = true
+	h.recordState()
 
-	h.dnsmasqConfigPath = file.Name()
-
-	h.dnsmasqCmd = exec.Command("sudo", "dnsmasq", "-C", h.dnsmasqConfigPath, "--keep-in-foreground")
-	if err := h.dnsmasqCmd.Start(); err != nil {
-		return fmt.Errorf("failed to start dnsmasq: %w", err)
+	if res, err := h.runner.RunWithContext(ctx, "nmcli", "connection", "up", h.config.Name); err != nil {
+		return fmt.Errorf("failed to activate hotspot: %s, %w", res.Combined(), err)
 	}
+	return nil
+}
 
+func (h *hostAPDService) configureNetwork(ctx context.Context) error {
+	h.state.Rules = true
+	h.recordState()
+	applyCaptiveRules(ctx, h.runner, h.logger, h.config.Interface, h.config.PortalPort)
 	return nil
 }
 
-func (h *hostAPDService) stopHotspot() {
-	if err := exec.Command("nmcli", "connection", "down", h.config.Name).Run(); err != nil {
-		h.logger.Error("failed to disconnect hotspot", slog.String("name", h.config.Name), slog.String("error", err.Error()))
+func (h *hostAPDService) startDNSMasq(ctx context.Context) error {
+	if err := h.clients.start(ctx, h.config); err != nil {
+		return err
 	}
-
-	if err := exec.Command("nmcli", "connection", "delete", h.config.Name).Run(); err != nil {
-		h.logger.Error("failed to delete hotspot connection", slog.String("name", h.config.Name), slog.String("error", err.Error()))
+	if h.clients.dnsmasq.configPath != "" {
+		h.state.DNSMasqConfig = h.clients.dnsmasq.configPath
+		h.recordState()
 	}
+	return nil
 }
 
-func (h *hostAPDService) stopDNSMasq() {
-	if h.dnsmasqCmd != nil && h.dnsmasqCmd.Process != nil {
-		if err := h.dnsmasqCmd.Process.Kill(); err != nil {
-			h.logger.Error("failed to kill dnsmasq process", slog.String("error", err.Error()))
+// stopHotspot deactivates and deletes the hotspot profile, a profile that is already gone is
+// not an error
+func (h *hostAPDService) stopHotspot(ctx context.Context, name string) {
+	if res, err := h.runner.RunWithContext(ctx, "nmcli", "connection", "down", name); err != nil {
+		if !strings.Contains(res.Combined(), "not an active connection") && !strings.Contains(res.Combined(), "unknown connection") {
+			h.logger.Error("failed to disconnect hotspot", slog.String("name", name), slog.String("error", err.Error()))
 		}
-		h.dnsmasqCmd.Wait()
-		h.dnsmasqCmd = nil
 	}
 
-	if h.dnsmasqConfigPath != "" {
-		pattern := "dnsmasq.*" + h.dnsmasqConfigPath
-		exec.Command("pkill", "-f", pattern).Run()
-
-		if err := os.Remove(h.dnsmasqConfigPath); err != nil {
-			h.logger.Error("failed to remove dnsmasq config file", slog.String("path", h.dnsmasqConfigPath), slog.String("error", err.Error()))
+	if res, err := h.runner.RunWithContext(ctx, "nmcli", "connection", "delete", name); err != nil {
+		if !strings.Contains(res.Combined(), "unknown connection") {
+			h.logger.Error("failed to delete hotspot connection", slog.String("name", name), slog.String("error", err.Error()))
 		}
-		h.dnsmasqConfigPath = ""
 	}
 }
 
-func (h *hostAPDService) cleanupNetworkRules() {
-	ipTablesRules := CleanupIPTablesRules(h.config.Interface, h.config.PortalPort)
-	for _, rule := range ipTablesRules {
-		rule.Apply()
-	}
+func (h *hostAPDService) stopDNSMasq(ctx context.Context) {
+	h.clients.stop(ctx)
+}
+
+func (h *hostAPDService) cleanupNetworkRules(ctx context.Context) {
+	removeCaptiveRules(ctx, h.runner, h.config.Interface, h.config.PortalPort)
 }
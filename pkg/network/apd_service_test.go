@@ -0,0 +1,267 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testAPConfig() APConfig {
+	return APConfig{
+		Name:        "test-portal",
+		Interface:   "wlan0",
+		SSID:        "TestPortal",
+		Password:    "12345678",
+		CountryCode: "SE",
+		Security:    "wpa2",
+		Gateway:     "192.168.4.1",
+		DHCPRange:   "192.168.4.2,192.168.4.50",
+		PortalPort:  "8080",
+	}
+}
+
+// newTestAPService creates the NetworkManager access point service with its state file in a
+// temporary directory
+func newTestAPService(t *testing.T, runner command.Runner, opts ...APServiceOption) *hostAPDService {
+	t.Helper()
+	opts = append([]APServiceOption{
+		WithAPCommandRunner(runner),
+		WithAPStateFile(filepath.Join(t.TempDir(), "ap-state.json")),
+	}, opts...)
+	return NewAPService(opts...).(*hostAPDService)
+}
+
+func TestAPService_StartStopLifecycle(t *testing.T) {
+	runner := command.NewFakeRunner()
+	service := newTestAPService(t, runner)
+	ctx := context.Background()
+
+	require.NoError(t, service.Start(ctx, testAPConfig()))
+	assert.True(t, service.IsRunning())
+
+	assert.True(t, runner.Called("nmcli", "device", "set", "wlan0", "managed", "yes"))
+	assert.True(t, runner.Called("nmcli", "connection", "up", "test-portal"))
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-A", "PREROUTING",
+		"-i", "wlan0", "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-ports", "8080"))
+
+	configPath := service.clients.dnsmasq.configPath
+	assert.FileExists(t, configPath)
+	proc := runner.Process("sudo", "dnsmasq", "-C", configPath, "--keep-in-foreground")
+	require.NotNil(t, proc)
+	assert.Equal(t, APHealth{
+		Running:   true,
+		Processes: []ProcessHealth{{Name: "dnsmasq", State: ProcessRunning, PID: proc.Pid()}},
+	}, service.Health())
+	assert.FileExists(t, service.stateFile)
+
+	assert.ErrorIs(t, service.Start(ctx, testAPConfig()), ErrServiceAlreadyRunning)
+
+	require.NoError(t, service.Stop(ctx))
+	assert.False(t, service.IsRunning())
+	assert.True(t, proc.Terminated())
+	assert.True(t, runner.Called("sudo", "pkill", "-f", "dnsmasq.*"+configPath))
+	assert.NoFileExists(t, configPath)
+	assert.True(t, runner.Called("nmcli", "connection", "delete", "test-portal"))
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-D", "PREROUTING",
+		"-i", "wlan0", "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-ports", "8080"))
+	assert.NoFileExists(t, service.stateFile)
+	assert.Empty(t, service.Health().Processes)
+
+	// Stopping again does nothing
+	calls := len(runner.History())
+	require.NoError(t, service.Stop(ctx))
+	assert.Len(t, runner.History(), calls)
+}
+
+func TestAPService_RecoverAfterCrash(t *testing.T) {
+	runner := command.NewFakeRunner()
+	crashed := newTestAPService(t, runner)
+	require.NoError(t, crashed.Start(context.Background(), testAPConfig()))
+	configPath := crashed.clients.dnsmasq.configPath
+
+	// A new process finds the state file of the one that never stopped
+	runner = command.NewFakeRunner()
+	service := newTestAPService(t, runner, WithAPStateFile(crashed.stateFile))
+	require.NoError(t, service.Recover(context.Background()))
+
+	assert.Equal(t, []string{
+		"sudo pkill -f dnsmasq.*" + configPath,
+		"nmcli connection down test-portal",
+		"nmcli connection delete test-portal",
+	}, runner.History()[:3])
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-D", "PREROUTING",
+		"-i", "wlan0", "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-ports", "8080"))
+	assert.NoFileExists(t, configPath)
+	assert.NoFileExists(t, crashed.stateFile)
+
+	// Nothing is left to recover, and Stop without Start is a no-op
+	calls := len(runner.History())
+	require.NoError(t, service.Recover(context.Background()))
+	require.NoError(t, service.Stop(context.Background()))
+	assert.Len(t, runner.History(), calls)
+}
+
+func TestAPService_StartRecoversPreviousRun(t *testing.T) {
+	runner := command.NewFakeRunner()
+	service := newTestAPService(t, runner)
+	require.NoError(t, writeAPState(service.stateFile, apState{Name: "test-portal", Interface: "wlan0", PortalPort: "8080", Hotspot: true}))
+
+	require.NoError(t, service.Start(context.Background(), testAPConfig()))
+	assert.Equal(t, "nmcli connection down test-portal", runner.History()[0])
+	state, err := readAPState(service.stateFile)
+	require.NoError(t, err)
+	assert.Equal(t, service.clients.dnsmasq.configPath, state.DNSMasqConfig)
+	assert.True(t, state.Hotspot)
+	assert.True(t, state.Rules)
+	require.NoError(t, service.Stop(context.Background()))
+}
+
+func TestAPService_HealthDuringStop(t *testing.T) {
+	service := newTestAPService(t, command.NewFakeRunner())
+	ctx := context.Background()
+	require.NoError(t, service.Start(ctx, testAPConfig()))
+
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < 100; i++ {
+			service.Health()
+			service.IsRunning()
+		}
+	}()
+	require.NoError(t, service.Stop(ctx))
+	wg.Wait()
+	assert.False(t, service.Health().Running)
+}
+
+func TestAPService_RecoverDiscardsCorruptState(t *testing.T) {
+	service := newTestAPService(t, command.NewFakeRunner())
+	require.NoError(t, os.WriteFile(service.stateFile, []byte("{"), 0o600))
+
+	assert.Error(t, service.Recover(context.Background()))
+	assert.NoFileExists(t, service.stateFile)
+	assert.NoError(t, service.Recover(context.Background()))
+}
+
+func TestAPService_StartFailsWhenHotspotCannotBeCreated(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddError("nmcli", []string{"connection", "up", "test-portal"},
+		command.Result{Stderr: []byte("Error: no suitable device")}, errors.New("exit status 4"))
+	service := newTestAPService(t, runner)
+
+	err := service.Start(context.Background(), testAPConfig())
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "no suitable device")
+	assert.False(t, service.IsRunning())
+
+	// The profile that was added is removed again
+	history := runner.History()
+	assert.Equal(t, "nmcli connection delete test-portal", history[len(history)-1])
+	assert.False(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-A", "PREROUTING",
+		"-i", "wlan0", "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-ports", "8080"))
+	assert.NoFileExists(t, service.stateFile)
+}
+
+func TestAPService_StartRollsBackWhenClientServicesFail(t *testing.T) {
+	runner := command.NewFakeRunner()
+	service := newTestAPService(t, runner, WithDNSServer(NewDNSServer(WithDNSListenAddr("256.0.0.1:53"))))
+
+	require.Error(t, service.Start(context.Background(), testAPConfig()))
+	assert.False(t, service.IsRunning())
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-D", "PREROUTING",
+		"-i", "wlan0", "-p", "tcp", "--dport", "80", "-j", "REDIRECT", "--to-ports", "8080"))
+	assert.True(t, runner.Called("nmcli", "connection", "down", "test-portal"))
+	assert.Empty(t, service.clients.dnsmasq.configPath)
+	assert.NoFileExists(t, service.stateFile)
+}
+
+func TestAPService_StartPropagatesContext(t *testing.T) {
+	runner := command.NewFakeRunner()
+	service := newTestAPService(t, runner)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+
+	err := service.Start(ctx, testAPConfig())
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.False(t, service.IsRunning())
+}
+
+func TestAPService_InvalidConfig(t *testing.T) {
+	service := newTestAPService(t, command.NewFakeRunner())
+	config := testAPConfig()
+	config.SSID = ""
+
+	assert.ErrorIs(t, service.Start(context.Background(), config), ErrInvalidAPConfig)
+}
+
+func TestDNSMasq_OmitsDHCPWhenEmbeddedServerIsUsed(t *testing.T) {
+	for _, dhcp := range []bool{true, false} {
+		monitor := newProcessMonitor(newAPServiceOptions([]APServiceOption{WithAPCommandRunner(command.NewFakeRunner())}))
+		d := newDNSMasqServer(monitor, dhcp, true)
+		require.NoError(t, d.start(context.Background(), testAPConfig()))
+		rendered, err := os.ReadFile(d.configPath)
+		require.NoError(t, err)
+		assert.Equal(t, dhcp, strings.Contains(string(rendered), "dhcp-range=192.168.4.2,192.168.4.50,12h"))
+		assert.Equal(t, dhcp, strings.Contains(string(rendered), `dhcp-option=114,"http://192.168.4.1:8080/api/captive"`))
+		assert.Contains(t, string(rendered), "address=/#/192.168.4.1")
+		d.stop(context.Background())
+	}
+}
+
+// failingStartRunner fails every long-running command it is asked to start
+type failingStartRunner struct {
+	*command.FakeRunner
+}
+
+func (r *failingStartRunner) StartWithStderr(io.Writer, string, ...string) (command.Process, error) {
+	return nil, errors.New("executable file not found")
+}
+
+func TestDNSMasq_RemovesConfigWhenStartFails(t *testing.T) {
+	tmp := t.TempDir()
+	t.Setenv("TMPDIR", tmp)
+	monitor := newProcessMonitor(newAPServiceOptions([]APServiceOption{
+		WithAPCommandRunner(&failingStartRunner{FakeRunner: command.NewFakeRunner()}),
+	}))
+	d := newDNSMasqServer(monitor, true, true)
+
+	require.Error(t, d.start(context.Background(), testAPConfig()))
+	assert.Empty(t, d.configPath)
+	entries, err := os.ReadDir(tmp)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
+func TestAPConfig_CaptivePortalAPIURL(t *testing.T) {
+	config := testAPConfig()
+	assert.Equal(t, "http://192.168.4.1:8080/api/captive", config.CaptivePortalAPIURL())
+
+	config.PortalPort = ""
+	assert.Equal(t, "http://192.168.4.1/api/captive", config.CaptivePortalAPIURL())
+
+	config.CaptivePortalAPI = "https://portal.example.com/api/captive"
+	require.NoError(t, config.Validate())
+	assert.Equal(t, "https://portal.example.com/api/captive", config.CaptivePortalAPIURL())
+
+	d := newDNSMasqServer(newProcessMonitor(newAPServiceOptions([]APServiceOption{WithAPCommandRunner(command.NewFakeRunner())})), true, true)
+	require.NoError(t, d.start(context.Background(), config))
+	defer d.stop(context.Background())
+	rendered, err := os.ReadFile(d.configPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(rendered), `dhcp-option=114,"https://portal.example.com/api/captive"`)
+
+	for _, uri := range []string{"http://portal.example.com/api/captive", "https:///api/captive", "portal.example.com"} {
+		config.CaptivePortalAPI = uri
+		assert.ErrorIs(t, config.Validate(), ErrInvalidAPConfig, uri)
+	}
+}
@@ -0,0 +1,49 @@
+package network
+
+import (
+	"github.com/pkg/errors"
+)
+
+var ErrUnknownBackend = errors.New("unknown network backend")
+
+// Backend names the system service the interface manager and access point are built on
+type Backend string
+
+const (
+	BackendNMCLI          Backend = "nmcli"          // NetworkManager through nmcli, the default
+	BackendNetworkManager Backend = "networkmanager" // NetworkManager over D-Bus
+	BackendWPASupplicant  Backend = "wpa_supplicant" // wpa_supplicant control sockets, hostapd for the access point
+	BackendIWD            Backend = "iwd"            // iwd over D-Bus
+)
+
+// NewBackendInterfaceManager creates the InterfaceManager of backend, an empty backend selects BackendNMCLI
+func NewBackendInterfaceManager(backend Backend, opts ...InterfaceManagerOption) (InterfaceManager, error) {
+	switch backend {
+	case "", BackendNMCLI:
+		return NewInterfaceManager(opts...), nil
+	case BackendNetworkManager:
+		return NewNMDBusInterfaceManager(opts...)
+	case BackendWPASupplicant:
+		return NewWPASupplicantInterfaceManager(opts...), nil
+	case BackendIWD:
+		return NewIWDInterfaceManager(opts...)
+	default:
+		return nil, errors.Wrap(ErrUnknownBackend, string(backend))
+	}
+}
+
+// NewBackendAPService creates the APService of backend, an empty backend selects BackendNMCLI
+func NewBackendAPService(backend Backend, opts ...APServiceOption) (APService, error) {
+	switch backend {
+	case "", BackendNMCLI:
+		return NewAPService(opts...), nil
+	case BackendNetworkManager:
+		return NewNMDBusAPService(opts...)
+	case BackendWPASupplicant:
+		return NewHostapdAPService(opts...), nil
+	case BackendIWD:
+		return NewIWDAPService(opts...)
+	default:
+		return nil, errors.Wrap(ErrUnknownBackend, string(backend))
+	}
+}
@@ -0,0 +1,30 @@
+package network
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewBackendInterfaceManager(t *testing.T) {
+	im, err := NewBackendInterfaceManager("")
+	require.NoError(t, err)
+	assert.IsType(t, &interfaceManager{}, im)
+
+	im, err = NewBackendInterfaceManager(BackendWPASupplicant, WithInterfaceWPACtrlDir(t.TempDir()))
+	require.NoError(t, err)
+	assert.IsType(t, &wpaSupplicantInterfaceManager{}, im)
+
+	_, err = NewBackendInterfaceManager("connman")
+	assert.ErrorIs(t, err, ErrUnknownBackend)
+}
+
+func TestNewBackendAPService(t *testing.T) {
+	h, err := NewBackendAPService(BackendWPASupplicant)
+	require.NoError(t, err)
+	assert.IsType(t, &hostapdService{}, h)
+
+	_, err = NewBackendAPService("connman")
+	assert.ErrorIs(t, err, ErrUnknownBackend)
+}
@@ -0,0 +1,529 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrNoAddress          = errors.New("no IPv4 address was acquired")
+	ErrGatewayUnreachable = errors.New("default gateway is not reachable")
+	ErrNoConnectivity     = errors.New("connectivity check failed")
+)
+
+// ConnectionStage is a step of a verified connection attempt
+type ConnectionStage string
+
+const (
+	StageAssociate    ConnectionStage = "associate"
+	StageAuthenticate ConnectionStage = "authenticate"
+	StageDHCP         ConnectionStage = "dhcp"
+	StageGateway      ConnectionStage = "gateway"
+	StageConnectivity ConnectionStage = "connectivity"
+)
+
+// ConnectionError reports the stage a verified connection attempt failed in and
+// whether the access point was restored afterwards
+type ConnectionError struct {
+	Stage       ConnectionStage
+	Err         error
+	RolledBack  bool
+	RollbackErr error
+}
+
+func (e *ConnectionError) Error() string {
+	msg := fmt.Sprintf("connection failed during %s: %v", e.Stage, e.Err)
+	if e.RollbackErr != nil {
+		msg += fmt.Sprintf(" (restoring access point failed: %v)", e.RollbackErr)
+	}
+	return msg
+}
+
+func (e *ConnectionError) Unwrap() error {
+	return e.Err
+}
+
+// ConnectionResult describes a verified connection
+type ConnectionResult struct {
+	Interface string        `json:"interface"`
+	SSID      string        `json:"ssid"`
+	Address   string        `json:"address"`
+	Gateway   string        `json:"gateway"`
+	Duration  time.Duration `json:"duration"`
+}
+
+const (
+	defaultDHCPWaitTimeout     = 30 * time.Second
+	defaultGatewayWaitTimeout  = 10 * time.Second
+	defaultConnectivityTimeout = 10 * time.Second
+	defaultConnectPollInterval = time.Second
+	defaultRollbackTimeout     = time.Minute
+)
+
+// ConnectorOption configures a Connector
+type ConnectorOption func(*Connector)
+
+// WithConnectorAP restores the access point described by config through ap when a connection
+// attempt fails. On single radio devices the access point is stopped before connecting.
+func WithConnectorAP(ap APService, config APConfig) ConnectorOption {
+	return func(c *Connector) {
+		c.ap = ap
+		c.apConfig = config
+	}
+}
+
+// WithConnectorVirtualAP moves the access point to the channel of the joined network when plan
+// runs it next to the station on a radio limited to one channel, see FollowStation
+func WithConnectorVirtualAP(virtualAP *VirtualAPManager, plan InterfacePlan) ConnectorOption {
+	return func(c *Connector) {
+		c.virtualAP = virtualAP
+		c.plan = plan
+	}
+}
+
+// WithConnectivityCheck verifies internet access by requesting url and expecting status,
+// e.g. "http://connectivitycheck.gstatic.com/generate_204" and 204. Disabled by default.
+func WithConnectivityCheck(url string, status int) ConnectorOption {
+	return func(c *Connector) {
+		c.checkURL = url
+		c.checkStatus = status
+	}
+}
+
+// WithConnectorTimeouts sets how long each verification stage may take
+func WithConnectorTimeouts(dhcp, gateway, connectivity time.Duration) ConnectorOption {
+	return func(c *Connector) {
+		c.dhcpTimeout = dhcp
+		c.gatewayTimeout = gateway
+		c.checkTimeout = connectivity
+	}
+}
+
+// WithConnectorCommandRunner sets the runner used for the ip and ping commands
+func WithConnectorCommandRunner(runner command.Runner) ConnectorOption {
+	return func(c *Connector) {
+		c.runner = runner
+	}
+}
+
+// WithConnectorHTTPClient sets the client used for the connectivity check
+func WithConnectorHTTPClient(client *http.Client) ConnectorOption {
+	return func(c *Connector) {
+		c.httpClient = client
+	}
+}
+
+// WithConnectorLogger sets the logger used by the connector
+func WithConnectorLogger(logger *slog.Logger) ConnectorOption {
+	return func(c *Connector) {
+		c.logger = logger
+	}
+}
+
+// Connector joins a network and only reports success once the interface has an address,
+// the gateway answers and, optionally, the internet is reachable. A failed attempt removes
+// the connection profile it created and brings the access point back so the user can retry.
+type Connector struct {
+	interfaces     InterfaceManager
+	ap             APService
+	apConfig       APConfig
+	virtualAP      *VirtualAPManager
+	plan           InterfacePlan
+	runner         command.Runner
+	httpClient     *http.Client
+	logger         *slog.Logger
+	checkURL       string
+	checkStatus    int
+	dhcpTimeout    time.Duration
+	gatewayTimeout time.Duration
+	checkTimeout   time.Duration
+	pollInterval   time.Duration
+}
+
+// NewConnector creates a Connector joining networks through interfaces
+func NewConnector(interfaces InterfaceManager, opts ...ConnectorOption) *Connector {
+	c := &Connector{
+		interfaces:     interfaces,
+		runner:         command.NewExecRunner(),
+		httpClient:     &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }},
+		logger:         slog.Default().WithGroup("connector"),
+		dhcpTimeout:    defaultDHCPWaitTimeout,
+		gatewayTimeout: defaultGatewayWaitTimeout,
+		checkTimeout:   defaultConnectivityTimeout,
+		pollInterval:   defaultConnectPollInterval,
+	}
+	for _, opt := range opts {
+		opt(c)
+	}
+	return c
+}
+
+// ConnectionProgress is called each time a connection attempt enters a new stage
+type ConnectionProgress func(stage ConnectionStage)
+
+// progressTracker remembers the current stage and reports changes
+type progressTracker struct {
+	mu       sync.Mutex
+	stage    ConnectionStage
+	progress ConnectionProgress
+}
+
+func (p *progressTracker) enter(stage ConnectionStage) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if stage == p.stage {
+		return
+	}
+	p.stage = stage
+	if p.progress != nil {
+		p.progress(stage)
+	}
+}
+
+func (p *progressTracker) current() ConnectionStage {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stage
+}
+
+// Connect joins ssid on interfaceName and verifies the connection. Failures are returned as
+// *ConnectionError after the access point has been restored.
+func (c *Connector) Connect(ctx context.Context, interfaceName, ssid string, creds Credentials) (*ConnectionResult, error) {
+	return c.ConnectWithProgress(ctx, interfaceName, ssid, creds, nil)
+}
+
+// ConnectWithProgress is Connect reporting every stage the attempt enters to progress
+func (c *Connector) ConnectWithProgress(ctx context.Context, interfaceName, ssid string, creds Credentials, progress ConnectionProgress) (*ConnectionResult, error) {
+	if err := creds.Validate(); err != nil {
+		return nil, err
+	}
+
+	start := time.Now()
+	logger := c.logger.With(slog.String("interface", interfaceName), slog.String("ssid", ssid))
+	tracker := &progressTracker{progress: progress}
+
+	// A single radio cannot host the access point and join a network at the same time
+	if c.sharesRadio(interfaceName) && c.ap.IsRunning() {
+		logger.Info("stopping access point to join network")
+		if err := c.ap.Stop(ctx); err != nil {
+			logger.Warn("failed to stop access point", slog.String("error", err.Error()))
+		}
+	}
+
+	// Profiles saved before the attempt are the user's, a failure only removes the one it created
+	attempt := connectionAttempt{ssid: ssid, existing: c.profileIDs(ssid)}
+
+	tracker.enter(StageAssociate)
+	if err := c.associate(ctx, interfaceName, ssid, creds, tracker); err != nil {
+		return nil, c.fail(ctx, logger, attempt, tracker.current(), err)
+	}
+
+	tracker.enter(StageDHCP)
+	address, err := c.waitForAddress(ctx, interfaceName)
+	if err != nil {
+		return nil, c.fail(ctx, logger, attempt, StageDHCP, err)
+	}
+	logger.Debug("address acquired", slog.String("address", address))
+
+	tracker.enter(StageGateway)
+	gateway, err := c.waitForGateway(ctx, interfaceName)
+	if err != nil {
+		return nil, c.fail(ctx, logger, attempt, StageGateway, err)
+	}
+	logger.Debug("gateway reachable", slog.String("gateway", gateway))
+
+	if c.checkURL != "" {
+		tracker.enter(StageConnectivity)
+		if err := c.checkConnectivity(ctx); err != nil {
+			return nil, c.fail(ctx, logger, attempt, StageConnectivity, err)
+		}
+	}
+
+	c.followStation(ctx, logger, interfaceName)
+
+	result := &ConnectionResult{
+		Interface: interfaceName,
+		SSID:      ssid,
+		Address:   address,
+		Gateway:   gateway,
+		Duration:  time.Since(start),
+	}
+	logger.Info("connection verified",
+		slog.String("address", address),
+		slog.String("gateway", gateway),
+		slog.Duration("duration", result.Duration))
+	return result, nil
+}
+
+// associate joins the network while following the join progress of the backend, so progress
+// tells association, authentication and address configuration apart
+func (c *Connector) associate(ctx context.Context, interfaceName, ssid string, creds Credentials, tracker *progressTracker) error {
+	if interfaceName == "" {
+		return c.interfaces.ConnectWithCredentials(interfaceName, ssid, creds)
+	}
+
+	watchCtx, cancel := context.WithCancel(ctx)
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		c.watchDeviceState(watchCtx, interfaceName, tracker)
+	}()
+
+	err := c.interfaces.ConnectWithCredentials(interfaceName, ssid, creds)
+	cancel()
+	wg.Wait()
+	return err
+}
+
+// watchDeviceState polls the join progress the backend reports until ctx is cancelled
+func (c *Connector) watchDeviceState(ctx context.Context, interfaceName string, tracker *progressTracker) {
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		stage, err := c.interfaces.JoinStage(interfaceName)
+		if err != nil {
+			c.logger.Debug("failed to read join progress", slog.String("interface", interfaceName), slog.String("error", err.Error()))
+			continue
+		}
+		if stage != "" {
+			tracker.enter(stage)
+		}
+	}
+}
+
+// followStation restarts the access point on the channel the station has joined when the
+// radio cannot serve another one
+func (c *Connector) followStation(ctx context.Context, logger *slog.Logger, interfaceName string) {
+	if c.virtualAP == nil || c.ap == nil || !c.plan.SingleChannel || interfaceName != c.plan.Station {
+		return
+	}
+	config := c.virtualAP.FollowStation(ctx, c.plan, c.apConfig)
+	if config.Channel == c.apConfig.Channel {
+		return
+	}
+	logger.Info("restarting access point on the station channel", slog.Int("channel", config.Channel))
+	if c.ap.IsRunning() {
+		if err := c.ap.Stop(ctx); err != nil {
+			logger.Warn("failed to stop access point", slog.String("error", err.Error()))
+			return
+		}
+	}
+	if err := c.ap.Start(ctx, config); err != nil {
+		logger.Warn("failed to restart access point", slog.String("error", err.Error()))
+	}
+}
+
+// profileIDs returns the IDs of the profiles saved for ssid, nil when they cannot be listed
+func (c *Connector) profileIDs(ssid string) map[string]bool {
+	profiles, err := c.interfaces.ListProfiles()
+	if err != nil {
+		c.logger.Warn("failed to list connection profiles", slog.String("error", err.Error()))
+		return nil
+	}
+	ids := make(map[string]bool)
+	for _, profile := range profiles {
+		if profile.SSID == ssid {
+			ids[profile.ID] = true
+		}
+	}
+	return ids
+}
+
+// sharesRadio reports whether the access point runs on interfaceName
+func (c *Connector) sharesRadio(interfaceName string) bool {
+	return c.ap != nil && (interfaceName == "" || interfaceName == c.apConfig.Interface)
+}
+
+// connectionAttempt remembers the profiles saved for ssid before an attempt joined it
+type connectionAttempt struct {
+	ssid     string
+	existing map[string]bool // nil when the profiles could not be listed
+}
+
+// fail removes the connection profile the attempt created and restores the access point
+func (c *Connector) fail(ctx context.Context, logger *slog.Logger, attempt connectionAttempt, stage ConnectionStage, err error) error {
+	logger.Error("connection attempt failed", slog.String("stage", string(stage)), slog.String("error", err.Error()))
+	connErr := &ConnectionError{Stage: stage, Err: err}
+
+	// Roll back even when ctx expired, that is usually why we got here
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), defaultRollbackTimeout)
+	defer cancel()
+
+	c.removeCreatedProfiles(logger, attempt)
+
+	if c.ap == nil || c.ap.IsRunning() {
+		return connErr
+	}
+	logger.Info("restoring access point")
+	if err := c.ap.Start(ctx, c.apConfig); err != nil {
+		connErr.RollbackErr = err
+		return connErr
+	}
+	connErr.RolledBack = true
+	return connErr
+}
+
+// removeCreatedProfiles forgets the profiles for the SSID that were not saved before the attempt.
+// Nothing is removed when the earlier profiles are unknown, they may be the user's.
+func (c *Connector) removeCreatedProfiles(logger *slog.Logger, attempt connectionAttempt) {
+	if attempt.existing == nil {
+		return
+	}
+	for id := range c.profileIDs(attempt.ssid) {
+		if attempt.existing[id] {
+			continue
+		}
+		if err := c.interfaces.ForgetProfile(id); err != nil {
+			logger.Warn("failed to remove connection profile", slog.String("id", id), slog.String("error", err.Error()))
+			continue
+		}
+		logger.Debug("removed connection profile", slog.String("id", id))
+	}
+}
+
+// waitForAddress polls the interface until it has an IPv4 address other than the access point's
+func (c *Connector) waitForAddress(ctx context.Context, interfaceName string) (string, error) {
+	var address string
+	err := c.poll(ctx, c.dhcpTimeout, func(ctx context.Context) bool {
+		args := []string{"-4", "-o", "addr", "show"}
+		if interfaceName != "" {
+			args = append(args, "dev", interfaceName)
+		}
+		res, err := c.runner.RunWithContext(ctx, "ip", args...)
+		if err != nil {
+			return false
+		}
+		address = parseIPv4Address(string(res.Stdout), c.apConfig.Gateway)
+		return address != ""
+	})
+	if err != nil {
+		return "", errors.Wrap(ErrNoAddress, err.Error())
+	}
+	return address, nil
+}
+
+// waitForGateway polls until the default route of the interface answers a ping
+func (c *Connector) waitForGateway(ctx context.Context, interfaceName string) (string, error) {
+	var gateway string
+	err := c.poll(ctx, c.gatewayTimeout, func(ctx context.Context) bool {
+		args := []string{"-4", "route", "show", "default"}
+		if interfaceName != "" {
+			args = append(args, "dev", interfaceName)
+		}
+		res, err := c.runner.RunWithContext(ctx, "ip", args...)
+		if err != nil {
+			return false
+		}
+		if gateway = parseDefaultGateway(string(res.Stdout)); gateway == "" {
+			return false
+		}
+		pingArgs := []string{"-c", "1", "-W", "1"}
+		if interfaceName != "" {
+			pingArgs = append(pingArgs, "-I", interfaceName)
+		}
+		_, err = c.runner.RunWithContext(ctx, "ping", append(pingArgs, gateway)...)
+		return err == nil
+	})
+	if err != nil {
+		if gateway != "" {
+			return "", errors.Wrapf(ErrGatewayUnreachable, "%s: %v", gateway, err)
+		}
+		return "", errors.Wrap(ErrGatewayUnreachable, "no default route")
+	}
+	return gateway, nil
+}
+
+// checkConnectivity requests the check URL and compares the status code
+func (c *Connector) checkConnectivity(ctx context.Context) error {
+	var lastErr error
+	err := c.poll(ctx, c.checkTimeout, func(ctx context.Context) bool {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, c.checkURL, nil)
+		if err != nil {
+			lastErr = err
+			return false
+		}
+		resp, err := c.httpClient.Do(req)
+		if err != nil {
+			lastErr = err
+			return false
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.checkStatus {
+			lastErr = errors.Errorf("%s returned %d, expected %d", c.checkURL, resp.StatusCode, c.checkStatus)
+			return false
+		}
+		return true
+	})
+	if err != nil {
+		if lastErr != nil {
+			return errors.Wrap(ErrNoConnectivity, lastErr.Error())
+		}
+		return errors.Wrap(ErrNoConnectivity, err.Error())
+	}
+	return nil
+}
+
+// poll calls check every poll interval until it succeeds or timeout expires
+func (c *Connector) poll(ctx context.Context, timeout time.Duration, check func(context.Context) bool) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	ticker := time.NewTicker(c.pollInterval)
+	defer ticker.Stop()
+	for {
+		if check(ctx) {
+			return nil
+		}
+		select {
+		case <-ctx.Done():
+			return errors.Wrapf(ctx.Err(), "gave up after %s", timeout)
+		case <-ticker.C:
+		}
+	}
+}
+
+// parseIPv4Address returns the first address in "ip -4 -o addr show" output, skipping exclude
+func parseIPv4Address(output, exclude string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] != "inet" {
+				continue
+			}
+			ip, _, err := net.ParseCIDR(fields[i+1])
+			if err != nil || ip.IsLoopback() || ip.IsLinkLocalUnicast() || ip.String() == exclude {
+				break
+			}
+			return ip.String()
+		}
+	}
+	return ""
+}
+
+// parseDefaultGateway returns the next hop of "ip route show default" output
+func parseDefaultGateway(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "via" && net.ParseIP(fields[i+1]) != nil {
+				return fields[i+1]
+			}
+		}
+	}
+	return ""
+}
@@ -0,0 +1,331 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeAPService records Start and Stop calls
+type fakeAPService struct {
+	running bool
+	starts  int
+	stops   int
+	config  APConfig
+}
+
+func (f *fakeAPService) Start(ctx context.Context, config APConfig) error {
+	f.starts++
+	f.running = true
+	f.config = config
+	return nil
+}
+
+func (f *fakeAPService) Stop(ctx context.Context) error {
+	f.stops++
+	f.running = false
+	return nil
+}
+
+func (f *fakeAPService) IsRunning() bool {
+	return f.running
+}
+
+// profileStore keeps the profiles of an InterfaceManager in memory, every attempt to join a
+// network saves one like NetworkManager does
+type profileStore struct {
+	InterfaceManager
+	mu       sync.Mutex
+	profiles []Profile
+	next     int
+}
+
+func (p *profileStore) ConnectWithCredentials(interfaceName, ssid string, creds Credentials) error {
+	p.mu.Lock()
+	p.next++
+	p.profiles = append(p.profiles, Profile{ID: fmt.Sprintf("uuid-%d", p.next), Name: ssid, SSID: ssid})
+	p.mu.Unlock()
+	return p.InterfaceManager.ConnectWithCredentials(interfaceName, ssid, creds)
+}
+
+func (p *profileStore) ListProfiles() ([]Profile, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return append([]Profile{}, p.profiles...), nil
+}
+
+func (p *profileStore) ForgetProfile(id string) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for i, profile := range p.profiles {
+		if profile.ID == id {
+			p.profiles = append(p.profiles[:i], p.profiles[i+1:]...)
+			return nil
+		}
+	}
+	return ErrProfileNotFound
+}
+
+func (p *profileStore) ids() []string {
+	profiles, _ := p.ListProfiles()
+	ids := []string{}
+	for _, profile := range profiles {
+		ids = append(ids, profile.ID)
+	}
+	return ids
+}
+
+func newTestConnector(runner *command.FakeRunner, ap APService, opts ...ConnectorOption) *Connector {
+	im := &profileStore{InterfaceManager: NewInterfaceManager(WithInterfaceCommandRunner(runner))}
+	opts = append([]ConnectorOption{
+		WithConnectorCommandRunner(runner),
+		WithConnectorAP(ap, testAPConfig()),
+		WithConnectorTimeouts(50*time.Millisecond, 50*time.Millisecond, 50*time.Millisecond),
+	}, opts...)
+	c := NewConnector(im, opts...)
+	c.pollInterval = 5 * time.Millisecond
+	return c
+}
+
+func scriptUplink(runner *command.FakeRunner) {
+	runner.AddScript("ip", []string{"-4", "-o", "addr", "show", "dev", "wlan0"}, command.Result{
+		Stdout: []byte("3: wlan0    inet 192.168.1.57/24 brd 192.168.1.255 scope global dynamic wlan0\\       valid_lft 86391sec\n"),
+	})
+	runner.AddScript("ip", []string{"-4", "route", "show", "default", "dev", "wlan0"}, command.Result{
+		Stdout: []byte("default via 192.168.1.1 proto dhcp src 192.168.1.57 metric 600\n"),
+	})
+}
+
+func TestConnector_VerifiedConnection(t *testing.T) {
+	checks := 0
+	check := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		checks++
+		w.WriteHeader(http.StatusNoContent)
+	}))
+	defer check.Close()
+
+	runner := command.NewFakeRunner()
+	scriptUplink(runner)
+	ap := &fakeAPService{running: true}
+	c := newTestConnector(runner, ap, WithConnectivityCheck(check.URL, http.StatusNoContent))
+
+	result, err := c.Connect(context.Background(), "wlan0", "HomeWiFi", Credentials{Password: "secret123"})
+	require.NoError(t, err)
+	assert.Equal(t, "192.168.1.57", result.Address)
+	assert.Equal(t, "192.168.1.1", result.Gateway)
+	assert.Equal(t, 1, checks)
+	assert.Equal(t, 1, ap.stops)
+	assert.Equal(t, 0, ap.starts)
+	assert.True(t, runner.Called("ping", "-c", "1", "-W", "1", "-I", "wlan0", "192.168.1.1"))
+	assert.Equal(t, []string{"uuid-1"}, c.interfaces.(*profileStore).ids())
+}
+
+func TestConnector_RollsBackOnFailure(t *testing.T) {
+	captive := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "http://login.example.com/", http.StatusFound)
+	}))
+	defer captive.Close()
+
+	tests := []struct {
+		name  string
+		setup func(*command.FakeRunner)
+		stage ConnectionStage
+		err   error
+	}{
+		{
+			name: "wrong password",
+			setup: func(r *command.FakeRunner) {
+				r.AddError("nmcli", []string{"device", "wifi", "connect", "HomeWiFi", "password", "secret123", "ifname", "wlan0"},
+					command.Result{Stderr: []byte("Error: Secrets were required, but not provided.")}, errors.New("exit status 4"))
+			},
+			stage: StageAssociate,
+		},
+		{
+			name:  "no dhcp lease",
+			setup: func(r *command.FakeRunner) {},
+			stage: StageDHCP,
+			err:   ErrNoAddress,
+		},
+		{
+			name: "gateway unreachable",
+			setup: func(r *command.FakeRunner) {
+				scriptUplink(r)
+				r.AddError("ping", []string{"-c", "1", "-W", "1", "-I", "wlan0", "192.168.1.1"}, command.Result{}, errors.New("exit status 1"))
+			},
+			stage: StageGateway,
+			err:   ErrGatewayUnreachable,
+		},
+		{
+			name:  "captive upstream",
+			setup: scriptUplink,
+			stage: StageConnectivity,
+			err:   ErrNoConnectivity,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			runner := command.NewFakeRunner()
+			tt.setup(runner)
+			ap := &fakeAPService{running: true}
+			c := newTestConnector(runner, ap, WithConnectivityCheck(captive.URL, http.StatusNoContent))
+
+			_, err := c.Connect(context.Background(), "wlan0", "HomeWiFi", Credentials{Password: "secret123"})
+			var connErr *ConnectionError
+			require.ErrorAs(t, err, &connErr)
+			assert.Equal(t, tt.stage, connErr.Stage)
+			if tt.err != nil {
+				assert.ErrorIs(t, err, tt.err)
+			}
+			assert.True(t, connErr.RolledBack)
+			assert.True(t, ap.IsRunning())
+			assert.Equal(t, 1, ap.starts)
+			assert.Empty(t, c.interfaces.(*profileStore).ids())
+		})
+	}
+}
+
+func TestConnector_KeepsExistingProfiles(t *testing.T) {
+	runner := command.NewFakeRunner()
+	c := newTestConnector(runner, &fakeAPService{running: true})
+	store := c.interfaces.(*profileStore)
+	store.profiles = []Profile{{ID: "saved", SSID: "HomeWiFi"}, {ID: "other", SSID: "Office"}}
+
+	_, err := c.Connect(context.Background(), "wlan0", "HomeWiFi", Credentials{Password: "secret123"})
+	require.ErrorIs(t, err, ErrNoAddress)
+	assert.Equal(t, []string{"saved", "other"}, store.ids())
+	assert.False(t, runner.Called("nmcli", "connection", "delete", "id", "HomeWiFi"))
+}
+
+func TestConnector_KeepsReplacedProfileOnFailure(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddScript("nmcli", []string{"-g", "connection.uuid", "connection", "show", "id", "Lab"},
+		command.Result{Stdout: []byte("1111\n")})
+	runner.AddError("nmcli", []string{"connection", "up", "id", "Lab (new)"},
+		command.Result{Stderr: []byte("Error: Connection activation failed: Secrets were required, but not provided.")}, errors.New("exit status 4"))
+	c := NewConnector(NewInterfaceManager(WithInterfaceCommandRunner(runner)),
+		WithConnectorCommandRunner(runner),
+		WithConnectorAP(&fakeAPService{running: true}, testAPConfig()))
+
+	_, err := c.Connect(context.Background(), "wlan0", "Lab", Credentials{Hidden: true, Password: "wrongpass"})
+	var connErr *ConnectionError
+	require.ErrorAs(t, err, &connErr)
+	assert.Equal(t, StageAssociate, connErr.Stage)
+	assert.True(t, runner.Called("nmcli", "connection", "add", "type", "wifi", "con-name", "Lab (new)", "ifname", "wlan0",
+		"ssid", "Lab", "802-11-wireless.hidden", "yes", "wifi-sec.key-mgmt", "wpa-psk", "wifi-sec.psk", "wrongpass"))
+	assert.True(t, runner.Called("nmcli", "connection", "delete", "id", "Lab (new)"))
+	assert.False(t, runner.Called("nmcli", "connection", "delete", "uuid", "1111"))
+	assert.False(t, runner.Called("nmcli", "connection", "delete", "id", "Lab"))
+}
+
+func TestConnector_KeepsAPOnSeparateRadio(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddScript("ip", []string{"-4", "-o", "addr", "show", "dev", "wlan1"}, command.Result{
+		Stdout: []byte("4: wlan1    inet 10.0.0.8/24 scope global wlan1\n"),
+	})
+	runner.AddScript("ip", []string{"-4", "route", "show", "default", "dev", "wlan1"}, command.Result{
+		Stdout: []byte("default via 10.0.0.1 proto dhcp metric 600\n"),
+	})
+	ap := &fakeAPService{running: true}
+	c := newTestConnector(runner, ap)
+
+	_, err := c.Connect(context.Background(), "wlan1", "HomeWiFi", Credentials{})
+	require.NoError(t, err)
+	assert.Equal(t, 0, ap.stops)
+}
+
+func TestConnector_MovesVirtualAPToStationChannel(t *testing.T) {
+	runner := command.NewFakeRunner()
+	scriptUplink(runner)
+	runner.AddScript("iw", []string{"dev", "wlan0", "info"}, command.Result{
+		Stdout: []byte("Interface wlan0\n\twiphy 0\n\ttype managed\n\tchannel 36 (5180 MHz), width: 80 MHz, center1: 5210 MHz\n"),
+	})
+	ap := &fakeAPService{running: true}
+	config := testAPConfig()
+	config.Interface = "wlan0ap"
+	config.Channel = 6
+	plan := InterfacePlan{AP: "wlan0ap", Station: "wlan0", Virtual: true, SingleChannel: true}
+	c := newTestConnector(runner, ap,
+		WithConnectorAP(ap, config),
+		WithConnectorVirtualAP(NewVirtualAPManager(WithVirtualAPCommandRunner(runner)), plan))
+
+	_, err := c.Connect(context.Background(), "wlan0", "HomeWiFi", Credentials{Password: "secret123"})
+	require.NoError(t, err)
+	assert.Equal(t, 1, ap.stops)
+	assert.Equal(t, 1, ap.starts)
+	assert.Equal(t, 36, ap.config.Channel)
+	assert.Equal(t, "wlan0ap", ap.config.Interface)
+}
+
+func TestParseIPv4Address(t *testing.T) {
+	output := "1: lo    inet 127.0.0.1/8 scope host lo\n" +
+		"3: wlan0    inet 169.254.3.4/16 scope link wlan0\n" +
+		"3: wlan0    inet 192.168.4.1/24 scope global wlan0\n" +
+		"3: wlan0    inet 192.168.1.57/24 scope global dynamic wlan0\n"
+	assert.Equal(t, "192.168.1.57", parseIPv4Address(output, "192.168.4.1"))
+	assert.Equal(t, "", parseIPv4Address("", ""))
+}
+
+// slowInterfaceManager takes a while to connect so the device state can be observed
+type slowInterfaceManager struct {
+	InterfaceManager
+	delay time.Duration
+	err   error
+}
+
+func (s *slowInterfaceManager) ConnectWithCredentials(interfaceName, ssid string, creds Credentials) error {
+	time.Sleep(s.delay)
+	return s.err
+}
+
+func TestConnector_ReportsProgress(t *testing.T) {
+	runner := command.NewFakeRunner()
+	scriptUplink(runner)
+	runner.AddScript("nmcli", []string{"-g", "GENERAL.STATE", "device", "show", "wlan0"}, command.Result{
+		Stdout: []byte("60 (connecting (need authentication))\n"),
+	})
+	c := newTestConnector(runner, &fakeAPService{running: true})
+	store := c.interfaces
+	c.interfaces = &slowInterfaceManager{InterfaceManager: store, delay: 30 * time.Millisecond}
+
+	var stages []ConnectionStage
+	_, err := c.ConnectWithProgress(context.Background(), "wlan0", "HomeWiFi", Credentials{Password: "secret123"},
+		func(stage ConnectionStage) { stages = append(stages, stage) })
+	require.NoError(t, err)
+	assert.Equal(t, []ConnectionStage{StageAssociate, StageAuthenticate, StageDHCP, StageGateway}, stages)
+
+	// A rejected password fails in the stage the backend was in
+	c.interfaces = &slowInterfaceManager{InterfaceManager: store, delay: 30 * time.Millisecond, err: errors.New("Secrets were required")}
+	_, err = c.Connect(context.Background(), "wlan0", "HomeWiFi", Credentials{Password: "secret123"})
+	var connErr *ConnectionError
+	require.ErrorAs(t, err, &connErr)
+	assert.Equal(t, StageAuthenticate, connErr.Stage)
+}
+
+func TestInterfaceManager_JoinStage(t *testing.T) {
+	tests := []struct {
+		state string
+		stage ConnectionStage
+	}{
+		{"50 (connecting (configuring))", StageAssociate},
+		{"60 (connecting (need authentication))", StageAuthenticate},
+		{"70 (connecting (getting IP configuration))", StageDHCP},
+		{"100 (connected)", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		runner := command.NewFakeRunner()
+		runner.AddScript("nmcli", []string{"-g", "GENERAL.STATE", "device", "show", "wlan0"}, command.Result{Stdout: []byte(tt.state + "\n")})
+		stage, err := NewInterfaceManager(WithInterfaceCommandRunner(runner)).JoinStage("wlan0")
+		require.NoError(t, err, tt.state)
+		assert.Equal(t, tt.stage, stage, tt.state)
+	}
+}
@@ -0,0 +1,136 @@
+package network
+
+import (
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+var ErrInvalidCredentials = errors.New("invalid network credentials")
+
+// EAP methods supported for 802.1X networks
+const (
+	EAPMethodPEAP = "peap"
+	EAPMethodTTLS = "ttls"
+	EAPMethodTLS  = "tls"
+)
+
+// DefaultStateDir holds everything the library persists, packagers create and remove only it
+const DefaultStateDir = "/var/lib/go-wifiportal"
+
+// DefaultCertDir is where certificates for 802.1X connection profiles are stored,
+// NetworkManager reads them again on every reconnect so they must outlive the portal
+const DefaultCertDir = DefaultStateDir + "/certs"
+
+// Credentials holds everything needed to join a network. Personal networks only use
+// Password, 802.1X networks are selected by setting EAPMethod.
+type Credentials struct {
+	Password           string `json:"password,omitempty"`
+	Hidden             bool   `json:"hidden,omitempty"`   // The SSID is not broadcast, so it is probed for directly
+	Security           string `json:"security,omitempty"` // "open", "wpa2" or "wpa3"; for hidden networks, which cannot be scanned
+	Identity           string `json:"identity,omitempty"`
+	AnonymousIdentity  string `json:"anonymous_identity,omitempty"`
+	EAPMethod          string `json:"eap_method,omitempty"`           // "peap", "ttls" or "tls"
+	Phase2             string `json:"phase2,omitempty"`               // Inner authentication for PEAP/TTLS, e.g. "mschapv2"
+	CACert             string `json:"ca_cert,omitempty"`              // PEM encoded CA certificate
+	ClientCert         string `json:"client_cert,omitempty"`          // PEM encoded client certificate for EAP-TLS
+	PrivateKey         string `json:"private_key,omitempty"`          // PEM encoded private key for EAP-TLS
+	PrivateKeyPassword string `json:"private_key_password,omitempty"` // Password of an encrypted PrivateKey
+}
+
+// IsEnterprise reports whether the credentials are for an 802.1X network
+func (c Credentials) IsEnterprise() bool {
+	return c.EAPMethod != ""
+}
+
+// keyMgmt returns the NetworkManager key management of the network: the EAP method decides
+// for 802.1X, otherwise the security type, falling back to WPA-PSK when a password is set
+func (c Credentials) keyMgmt() string {
+	if c.IsEnterprise() {
+		return "wpa-eap"
+	}
+	switch strings.ToLower(c.Security) {
+	case SecurityOpen:
+		return "none"
+	case SecurityWPA3:
+		return "sae"
+	case SecurityWPA2:
+		return "wpa-psk"
+	}
+	if c.Password == "" {
+		return "none"
+	}
+	return "wpa-psk"
+}
+
+// Validate checks that the fields required by the security type and EAP method are present
+func (c Credentials) Validate() error {
+	switch strings.ToLower(c.Security) {
+	case "", SecurityOpen:
+	case SecurityWPA2, SecurityWPA3:
+		if c.Password == "" && !c.IsEnterprise() {
+			return errors.Wrapf(ErrInvalidCredentials, "password is required for %s", strings.ToUpper(c.Security))
+		}
+	default:
+		return errors.Wrapf(ErrInvalidCredentials, "unsupported security type %q", c.Security)
+	}
+	if !c.IsEnterprise() {
+		return nil
+	}
+	if c.Identity == "" {
+		return errors.Wrap(ErrInvalidCredentials, "identity is required for 802.1X networks")
+	}
+	switch strings.ToLower(c.EAPMethod) {
+	case EAPMethodPEAP, EAPMethodTTLS:
+		if c.Password == "" {
+			return errors.Wrapf(ErrInvalidCredentials, "password is required for %s", strings.ToUpper(c.EAPMethod))
+		}
+	case EAPMethodTLS:
+		if c.ClientCert == "" || c.PrivateKey == "" {
+			return errors.Wrap(ErrInvalidCredentials, "client certificate and private key are required for TLS")
+		}
+	default:
+		return errors.Wrapf(ErrInvalidCredentials, "unsupported EAP method %q", c.EAPMethod)
+	}
+	for name, pem := range map[string]string{"CA certificate": c.CACert, "client certificate": c.ClientCert, "private key": c.PrivateKey} {
+		if pem != "" && !strings.Contains(pem, "-----BEGIN ") {
+			return errors.Wrapf(ErrInvalidCredentials, "%s must be PEM encoded", name)
+		}
+	}
+	return nil
+}
+
+// IsEnterpriseSecurity reports whether a scanned security description requires 802.1X
+func IsEnterpriseSecurity(security string) bool {
+	return strings.Contains(strings.ToUpper(security), "802.1X")
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// writeCertFiles stores the PEM blobs of the credentials in dir and returns their paths
+// keyed by the nmcli 802-1x property they belong to
+func writeCertFiles(dir, ssid string, creds Credentials) (map[string]string, error) {
+	files := map[string]string{}
+	blobs := []struct{ property, suffix, pem string }{
+		{"802-1x.ca-cert", "ca.pem", creds.CACert},
+		{"802-1x.client-cert", "client.pem", creds.ClientCert},
+		{"802-1x.private-key", "key.pem", creds.PrivateKey},
+	}
+	for _, blob := range blobs {
+		if blob.pem == "" {
+			continue
+		}
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return nil, errors.Wrap(err, "failed to create certificate directory")
+		}
+		path := filepath.Join(dir, unsafeFileChars.ReplaceAllString(ssid, "_")+"-"+blob.suffix)
+		if err := os.WriteFile(path, []byte(blob.pem), 0o600); err != nil {
+			return nil, errors.Wrapf(err, "failed to write %s", path)
+		}
+		files[blob.property] = path
+	}
+	return files, nil
+}
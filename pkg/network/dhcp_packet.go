@@ -0,0 +1,208 @@
+package network
+
+import (
+	"encoding/binary"
+	"net"
+
+	"github.com/pkg/errors"
+)
+
+// DHCPv4 message types (RFC 2132 section 9.6)
+const (
+	dhcpDiscover byte = 1
+	dhcpOffer    byte = 2
+	dhcpRequest  byte = 3
+	dhcpDecline  byte = 4
+	dhcpAck      byte = 5
+	dhcpNak      byte = 6
+	dhcpRelease  byte = 7
+	dhcpInform   byte = 8
+)
+
+// DHCPv4 option codes used by the embedded server
+const (
+	optSubnetMask       byte = 1
+	optRouter           byte = 3
+	optDNSServers       byte = 6
+	optHostname         byte = 12
+	optRequestedIP      byte = 50
+	optLeaseTime        byte = 51
+	optMessageType      byte = 53
+	optServerID         byte = 54
+	optRenewalTime      byte = 58
+	optRebindingTime    byte = 59
+	optClientID         byte = 61
+	optCaptivePortalURI byte = 114 // RFC 8910
+	optEnd              byte = 255
+	optPad              byte = 0
+)
+
+const (
+	bootRequest     byte = 1
+	bootReply       byte = 2
+	dhcpHeaderLen        = 236
+	dhcpMinLen           = 300
+	dhcpFlagBcast        = 0x8000
+	dhcpMagicCookie      = 0x63825363
+)
+
+var errInvalidDHCPPacket = errors.New("invalid DHCP packet")
+
+// dhcpPacket is a BOOTP/DHCPv4 message (RFC 2131 section 2)
+type dhcpPacket struct {
+	Op      byte
+	HType   byte
+	HLen    byte
+	Hops    byte
+	Xid     uint32
+	Secs    uint16
+	Flags   uint16
+	CIAddr  net.IP
+	YIAddr  net.IP
+	SIAddr  net.IP
+	GIAddr  net.IP
+	CHAddr  net.HardwareAddr
+	Options dhcpOptions
+}
+
+// dhcpOptions keeps options in insertion order so replies are deterministic
+type dhcpOptions []dhcpOptionField
+
+type dhcpOptionField struct {
+	Code  byte
+	Value []byte
+}
+
+func (o dhcpOptions) get(code byte) ([]byte, bool) {
+	for _, f := range o {
+		if f.Code == code {
+			return f.Value, true
+		}
+	}
+	return nil, false
+}
+
+func (o *dhcpOptions) set(code byte, value []byte) {
+	for i, f := range *o {
+		if f.Code == code {
+			(*o)[i].Value = value
+			return
+		}
+	}
+	*o = append(*o, dhcpOptionField{Code: code, Value: value})
+}
+
+func (p *dhcpPacket) messageType() byte {
+	if v, ok := p.Options.get(optMessageType); ok && len(v) == 1 {
+		return v[0]
+	}
+	return 0
+}
+
+func (p *dhcpPacket) ipOption(code byte) net.IP {
+	if v, ok := p.Options.get(code); ok && len(v) == 4 {
+		return net.IP(v).To4()
+	}
+	return nil
+}
+
+func parseDHCPPacket(b []byte) (*dhcpPacket, error) {
+	if len(b) < dhcpHeaderLen+4 {
+		return nil, errors.Wrap(errInvalidDHCPPacket, "packet too short")
+	}
+	p := &dhcpPacket{
+		Op:     b[0],
+		HType:  b[1],
+		HLen:   b[2],
+		Hops:   b[3],
+		Xid:    binary.BigEndian.Uint32(b[4:8]),
+		Secs:   binary.BigEndian.Uint16(b[8:10]),
+		Flags:  binary.BigEndian.Uint16(b[10:12]),
+		CIAddr: net.IP(append([]byte(nil), b[12:16]...)),
+		YIAddr: net.IP(append([]byte(nil), b[16:20]...)),
+		SIAddr: net.IP(append([]byte(nil), b[20:24]...)),
+		GIAddr: net.IP(append([]byte(nil), b[24:28]...)),
+	}
+	if p.HLen > 16 {
+		return nil, errors.Wrap(errInvalidDHCPPacket, "hardware address too long")
+	}
+	p.CHAddr = net.HardwareAddr(append([]byte(nil), b[28:28+int(p.HLen)]...))
+
+	if binary.BigEndian.Uint32(b[dhcpHeaderLen:dhcpHeaderLen+4]) != dhcpMagicCookie {
+		return nil, errors.Wrap(errInvalidDHCPPacket, "missing magic cookie")
+	}
+
+	opts := b[dhcpHeaderLen+4:]
+	for i := 0; i < len(opts); {
+		code := opts[i]
+		if code == optEnd {
+			break
+		}
+		if code == optPad {
+			i++
+			continue
+		}
+		if i+1 >= len(opts) {
+			return nil, errors.Wrap(errInvalidDHCPPacket, "truncated option")
+		}
+		length := int(opts[i+1])
+		if i+2+length > len(opts) {
+			return nil, errors.Wrap(errInvalidDHCPPacket, "truncated option value")
+		}
+		p.Options = append(p.Options, dhcpOptionField{Code: code, Value: append([]byte(nil), opts[i+2:i+2+length]...)})
+		i += 2 + length
+	}
+	return p, nil
+}
+
+func (p *dhcpPacket) marshal() []byte {
+	b := make([]byte, dhcpHeaderLen+4, dhcpMinLen)
+	b[0], b[1], b[2], b[3] = p.Op, p.HType, p.HLen, p.Hops
+	binary.BigEndian.PutUint32(b[4:8], p.Xid)
+	binary.BigEndian.PutUint16(b[8:10], p.Secs)
+	binary.BigEndian.PutUint16(b[10:12], p.Flags)
+	copy(b[12:16], p.CIAddr.To4())
+	copy(b[16:20], p.YIAddr.To4())
+	copy(b[20:24], p.SIAddr.To4())
+	copy(b[24:28], p.GIAddr.To4())
+	copy(b[28:44], p.CHAddr)
+	binary.BigEndian.PutUint32(b[dhcpHeaderLen:], dhcpMagicCookie)
+
+	for _, f := range p.Options {
+		// Values longer than 255 bytes are split per RFC 3396
+		value := f.Value
+		for {
+			n := len(value)
+			if n > 255 {
+				n = 255
+			}
+			b = append(b, f.Code, byte(n))
+			b = append(b, value[:n]...)
+			value = value[n:]
+			if len(value) == 0 {
+				break
+			}
+		}
+	}
+	b = append(b, optEnd)
+	for len(b) < dhcpMinLen {
+		b = append(b, optPad)
+	}
+	return b
+}
+
+func uint32Option(v uint32) []byte {
+	b := make([]byte, 4)
+	binary.BigEndian.PutUint32(b, v)
+	return b
+}
+
+func ipListOption(ips []net.IP) []byte {
+	var b []byte
+	for _, ip := range ips {
+		if v4 := ip.To4(); v4 != nil {
+			b = append(b, v4...)
+		}
+	}
+	return b
+}
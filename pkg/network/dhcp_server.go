@@ -0,0 +1,519 @@
+package network
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrInvalidDHCPRange  = errors.New("invalid DHCP range")
+	ErrDHCPPoolExhausted = errors.New("no free addresses left in DHCP range")
+	ErrDHCPServerRunning = errors.New("DHCP server is already running")
+)
+
+// The access point always uses a /24 around the gateway, see createHotspot
+var dhcpSubnetMask = net.IPv4Mask(255, 255, 255, 0)
+
+const (
+	dhcpServerPort          = 67
+	dhcpClientPort          = 68
+	defaultDHCPLeaseTime    = 12 * time.Hour
+	defaultDHCPOfferTimeout = 30 * time.Second
+	declinedAddressHoldTime = 10 * time.Minute
+)
+
+// DHCPLease is an address handed out by the embedded DHCP server
+type DHCPLease struct {
+	MAC      string    `json:"mac"`
+	IP       string    `json:"ip"`
+	Hostname string    `json:"hostname,omitempty"`
+	Expires  time.Time `json:"expires"`
+}
+
+type dhcpLease struct {
+	DHCPLease
+	ip    net.IP
+	bound bool // false while only offered
+}
+
+// DHCPServerOption configures a DHCPServer
+type DHCPServerOption func(*DHCPServer)
+
+// WithDHCPLeaseTime sets how long bound leases are valid, 12h by default
+func WithDHCPLeaseTime(d time.Duration) DHCPServerOption {
+	return func(s *DHCPServer) {
+		s.leaseTime = d
+	}
+}
+
+// WithDHCPDNSServers overrides the DNS servers advertised to clients, the gateway by default
+func WithDHCPDNSServers(servers ...net.IP) DHCPServerOption {
+	return func(s *DHCPServer) {
+		s.dnsServers = servers
+	}
+}
+
+// WithCaptivePortalURL overrides the URI advertised in DHCP option 114 (RFC 8910), which
+// defaults to APConfig.CaptivePortalAPIURL. Use "{gateway}" as a placeholder for the gateway address.
+func WithCaptivePortalURL(url string) DHCPServerOption {
+	return func(s *DHCPServer) {
+		s.captivePortalURL = url
+	}
+}
+
+// WithDHCPLogger sets the logger used by the server
+func WithDHCPLogger(logger *slog.Logger) DHCPServerOption {
+	return func(s *DHCPServer) {
+		s.logger = logger
+	}
+}
+
+// DHCPServer is an in-process DHCPv4 server serving APConfig.DHCPRange on the access point interface
+type DHCPServer struct {
+	mu               sync.Mutex
+	leaseTime        time.Duration
+	offerTimeout     time.Duration
+	dnsServers       []net.IP
+	captivePortalURL string
+	logger           *slog.Logger
+	now              func() time.Time
+
+	iFace      string
+	serverIP   net.IP
+	portalURI  string
+	advertised []net.IP // DNS servers sent in option 6
+	rangeStart uint32
+	rangeEnd   uint32
+	leases     map[string]*dhcpLease // keyed by MAC
+	declined   map[string]time.Time  // keyed by IP
+
+	conn net.PacketConn
+	done chan struct{}
+}
+
+// NewDHCPServer creates a DHCP server; it is configured from the APConfig passed to Start
+func NewDHCPServer(opts ...DHCPServerOption) *DHCPServer {
+	s := &DHCPServer{
+		leaseTime:    defaultDHCPLeaseTime,
+		offerTimeout: defaultDHCPOfferTimeout,
+		logger:       slog.Default().WithGroup("dhcp_server"),
+		now:          time.Now,
+		leases:       make(map[string]*dhcpLease),
+		declined:     make(map[string]time.Time),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// parseDHCPRange parses "start,end" as used by APConfig.DHCPRange
+func parseDHCPRange(r string) (net.IP, net.IP, error) {
+	parts := strings.Split(r, ",")
+	if len(parts) < 2 {
+		return nil, nil, errors.Wrap(ErrInvalidDHCPRange, r)
+	}
+	start := net.ParseIP(strings.TrimSpace(parts[0])).To4()
+	end := net.ParseIP(strings.TrimSpace(parts[1])).To4()
+	if start == nil || end == nil {
+		return nil, nil, errors.Wrap(ErrInvalidDHCPRange, r)
+	}
+	if ipToUint32(start) > ipToUint32(end) {
+		return nil, nil, errors.Wrapf(ErrInvalidDHCPRange, "%s: start is after end", r)
+	}
+	return start, end, nil
+}
+
+// configure loads the address plan from config without opening any sockets
+func (s *DHCPServer) configure(config APConfig) error {
+	start, end, err := parseDHCPRange(config.DHCPRange)
+	if err != nil {
+		return err
+	}
+	gateway := net.ParseIP(config.Gateway).To4()
+	if gateway == nil {
+		return errors.Wrapf(ErrInvalidAPConfig, "gateway %q is not an IPv4 address", config.Gateway)
+	}
+	subnet := gateway.Mask(dhcpSubnetMask)
+	if !subnet.Equal(start.Mask(dhcpSubnetMask)) || !subnet.Equal(end.Mask(dhcpSubnetMask)) {
+		return errors.Wrapf(ErrInvalidDHCPRange, "%s is not in the gateway subnet %s/24", config.DHCPRange, subnet)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.iFace = config.Interface
+	s.serverIP = gateway
+	s.rangeStart = ipToUint32(start)
+	s.rangeEnd = ipToUint32(end)
+	s.portalURI = config.CaptivePortalAPIURL()
+	if s.captivePortalURL != "" {
+		s.portalURI = strings.ReplaceAll(s.captivePortalURL, "{gateway}", gateway.String())
+	}
+	s.advertised = s.dnsServers
+	if len(s.advertised) == 0 {
+		s.advertised = []net.IP{gateway}
+	}
+	return nil
+}
+
+// Start binds UDP port 67 on the access point interface and serves requests until Stop
+func (s *DHCPServer) Start(ctx context.Context, config APConfig) error {
+	if s.running() {
+		return ErrDHCPServerRunning
+	}
+	if err := s.configure(config); err != nil {
+		return err
+	}
+
+	conn, err := listenDHCP(ctx, config.Interface)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen for DHCP on %s", config.Interface)
+	}
+	done := make(chan struct{})
+	s.mu.Lock()
+	if s.conn != nil {
+		// Another Start won the race
+		s.mu.Unlock()
+		conn.Close()
+		return ErrDHCPServerRunning
+	}
+	s.conn, s.done = conn, done
+	s.mu.Unlock()
+
+	s.logger.Info("DHCP server started",
+		slog.String("interface", config.Interface),
+		slog.String("range", config.DHCPRange))
+	go s.serve(conn, done)
+	return nil
+}
+
+// Stop closes the socket and waits for the serve loop to exit. Leases are kept in memory.
+// The server can be started again even when ctx expires before the loop exits.
+func (s *DHCPServer) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	conn, done := s.conn, s.done
+	s.conn, s.done = nil, nil
+	s.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+
+	err := conn.Close()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.logger.Debug("DHCP server stopped")
+	return err
+}
+
+func (s *DHCPServer) running() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conn != nil
+}
+
+// Leases returns the currently bound, unexpired leases sorted by IP
+func (s *DHCPServer) Leases() []DHCPLease {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var leases []DHCPLease
+	for _, l := range s.leases {
+		if l.bound && now.Before(l.Expires) {
+			leases = append(leases, l.DHCPLease)
+		}
+	}
+	sort.Slice(leases, func(i, j int) bool {
+		return ipToUint32(net.ParseIP(leases[i].IP)) < ipToUint32(net.ParseIP(leases[j].IP))
+	})
+	return leases
+}
+
+// LeaseForIP returns the bound lease for ip, if any
+func (s *DHCPServer) LeaseForIP(ip string) (DHCPLease, bool) {
+	for _, l := range s.Leases() {
+		if l.IP == ip {
+			return l, true
+		}
+	}
+	return DHCPLease{}, false
+}
+
+func (s *DHCPServer) serve(conn net.PacketConn, done chan struct{}) {
+	defer close(done)
+	buf := make([]byte, 1500)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("DHCP read failed", slog.String("error", err.Error()))
+			}
+			return
+		}
+		req, err := parseDHCPPacket(buf[:n])
+		if err != nil {
+			s.logger.Debug("ignoring malformed DHCP packet", slog.String("from", addr.String()), slog.String("error", err.Error()))
+			continue
+		}
+		reply := s.handle(req)
+		if reply == nil {
+			continue
+		}
+		if _, err := conn.WriteTo(reply.marshal(), s.replyAddr(req, reply)); err != nil {
+			s.logger.Warn("failed to send DHCP reply", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// replyAddr picks the destination per RFC 2131 section 4.1
+func (s *DHCPServer) replyAddr(req, reply *dhcpPacket) net.Addr {
+	if !req.GIAddr.Equal(net.IPv4zero) {
+		return &net.UDPAddr{IP: req.GIAddr, Port: dhcpServerPort}
+	}
+	if !req.CIAddr.Equal(net.IPv4zero) && reply.messageType() != dhcpNak {
+		return &net.UDPAddr{IP: req.CIAddr, Port: dhcpClientPort}
+	}
+	// Unicasting to yiaddr would need an ARP entry for a client without an address
+	return &net.UDPAddr{IP: net.IPv4bcast, Port: dhcpClientPort}
+}
+
+// handle processes a single request and returns the reply to send, if any
+func (s *DHCPServer) handle(req *dhcpPacket) *dhcpPacket {
+	if req.Op != bootRequest || len(req.CHAddr) == 0 {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expire()
+	mac := req.CHAddr.String()
+
+	switch req.messageType() {
+	case dhcpDiscover:
+		ip, err := s.allocate(mac, req.ipOption(optRequestedIP))
+		if err != nil {
+			s.logger.Warn("cannot offer address", slog.String("mac", mac), slog.String("error", err.Error()))
+			return nil
+		}
+		lease := s.leases[mac]
+		if lease == nil || !lease.ip.Equal(ip) {
+			lease = &dhcpLease{DHCPLease: DHCPLease{MAC: mac, IP: ip.String()}, ip: ip}
+			s.leases[mac] = lease
+		}
+		if !lease.bound {
+			lease.Expires = s.now().Add(s.offerTimeout)
+		}
+		lease.Hostname = hostnameOption(req, lease.Hostname)
+		return s.reply(req, dhcpOffer, ip)
+
+	case dhcpRequest:
+		return s.handleRequest(req, mac)
+
+	case dhcpDecline:
+		if ip := req.ipOption(optRequestedIP); ip != nil {
+			s.logger.Warn("client declined address", slog.String("mac", mac), slog.String("ip", ip.String()))
+			s.declined[ip.String()] = s.now().Add(declinedAddressHoldTime)
+		}
+		delete(s.leases, mac)
+		return nil
+
+	case dhcpRelease:
+		if lease, ok := s.leases[mac]; ok && lease.ip.Equal(req.CIAddr) {
+			s.logger.Debug("lease released", slog.String("mac", mac), slog.String("ip", lease.IP))
+			delete(s.leases, mac)
+		}
+		return nil
+
+	case dhcpInform:
+		reply := s.reply(req, dhcpAck, net.IPv4zero)
+		reply.Options = removeOptions(reply.Options, optLeaseTime, optRenewalTime, optRebindingTime)
+		return reply
+	}
+	return nil
+}
+
+func (s *DHCPServer) handleRequest(req *dhcpPacket, mac string) *dhcpPacket {
+	serverID := req.ipOption(optServerID)
+	if serverID != nil && !serverID.Equal(s.serverIP) {
+		// The client selected another server's offer
+		if lease, ok := s.leases[mac]; ok && !lease.bound {
+			delete(s.leases, mac)
+		}
+		return nil
+	}
+
+	requested := req.ipOption(optRequestedIP)
+	if requested == nil {
+		// RENEWING/REBINDING clients put their address in ciaddr
+		requested = req.CIAddr.To4()
+	}
+	if requested == nil || requested.Equal(net.IPv4zero) {
+		return s.reply(req, dhcpNak, net.IPv4zero)
+	}
+
+	lease, ok := s.leases[mac]
+	if !ok || !lease.ip.Equal(requested) {
+		// INIT-REBOOT for an address we don't know: grant it if it is free
+		if !s.inRange(requested) || s.ipInUse(requested, mac) {
+			// Address is from another network or taken; tell the client to restart discovery
+			return s.reply(req, dhcpNak, net.IPv4zero)
+		}
+		lease = &dhcpLease{DHCPLease: DHCPLease{MAC: mac, IP: requested.String()}, ip: requested}
+		s.leases[mac] = lease
+	}
+
+	lease.bound = true
+	lease.Expires = s.now().Add(s.leaseTime)
+	lease.Hostname = hostnameOption(req, lease.Hostname)
+	s.logger.Info("lease bound",
+		slog.String("mac", mac),
+		slog.String("ip", lease.IP),
+		slog.String("hostname", lease.Hostname))
+	return s.reply(req, dhcpAck, lease.ip)
+}
+
+func (s *DHCPServer) reply(req *dhcpPacket, msgType byte, yiaddr net.IP) *dhcpPacket {
+	reply := &dhcpPacket{
+		Op:     bootReply,
+		HType:  req.HType,
+		HLen:   req.HLen,
+		Xid:    req.Xid,
+		Flags:  req.Flags,
+		CIAddr: net.IPv4zero,
+		YIAddr: yiaddr,
+		SIAddr: net.IPv4zero,
+		GIAddr: req.GIAddr,
+		CHAddr: req.CHAddr,
+	}
+	if msgType == dhcpAck && yiaddr.Equal(net.IPv4zero) {
+		// DHCPINFORM replies echo the client's address
+		reply.CIAddr = req.CIAddr
+	}
+	reply.Options.set(optMessageType, []byte{msgType})
+	reply.Options.set(optServerID, s.serverIP)
+	if msgType == dhcpNak {
+		return reply
+	}
+
+	leaseSeconds := uint32(s.leaseTime / time.Second)
+	reply.Options.set(optLeaseTime, uint32Option(leaseSeconds))
+	reply.Options.set(optRenewalTime, uint32Option(leaseSeconds/2))
+	reply.Options.set(optRebindingTime, uint32Option(leaseSeconds/8*7))
+	reply.Options.set(optSubnetMask, []byte(dhcpSubnetMask))
+	reply.Options.set(optRouter, s.serverIP)
+	reply.Options.set(optDNSServers, ipListOption(s.advertised))
+	if s.portalURI != "" {
+		reply.Options.set(optCaptivePortalURI, []byte(s.portalURI))
+	}
+	return reply
+}
+
+// allocate returns the address to offer mac: its current lease, the requested address if free, or the lowest free address
+func (s *DHCPServer) allocate(mac string, requested net.IP) (net.IP, error) {
+	if lease, ok := s.leases[mac]; ok {
+		return lease.ip, nil
+	}
+	if requested != nil && s.inRange(requested) && !s.ipInUse(requested, mac) {
+		return requested, nil
+	}
+	for n := s.rangeStart; n <= s.rangeEnd; n++ {
+		ip := uint32ToIP(n)
+		if !s.ipInUse(ip, mac) {
+			return ip, nil
+		}
+	}
+	return nil, ErrDHCPPoolExhausted
+}
+
+func (s *DHCPServer) inRange(ip net.IP) bool {
+	n := ipToUint32(ip)
+	return n >= s.rangeStart && n <= s.rangeEnd && !ip.Equal(s.serverIP)
+}
+
+func (s *DHCPServer) ipInUse(ip net.IP, mac string) bool {
+	if ip.Equal(s.serverIP) {
+		return true
+	}
+	if _, ok := s.declined[ip.String()]; ok {
+		return true
+	}
+	for m, l := range s.leases {
+		if m != mac && l.ip.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// expire drops leases and declined addresses whose time has passed; callers hold s.mu
+func (s *DHCPServer) expire() {
+	now := s.now()
+	for mac, l := range s.leases {
+		if !now.Before(l.Expires) {
+			delete(s.leases, mac)
+		}
+	}
+	for ip, until := range s.declined {
+		if !now.Before(until) {
+			delete(s.declined, ip)
+		}
+	}
+}
+
+func hostnameOption(req *dhcpPacket, fallback string) string {
+	if v, ok := req.Options.get(optHostname); ok && len(v) > 0 {
+		return string(bytes.TrimRight(v, "\x00"))
+	}
+	return fallback
+}
+
+func removeOptions(opts dhcpOptions, codes ...byte) dhcpOptions {
+	var out dhcpOptions
+	for _, f := range opts {
+		if !bytes.Contains(codes, []byte{f.Code}) {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+func ipToUint32(ip net.IP) uint32 {
+	v4 := ip.To4()
+	if v4 == nil {
+		return 0
+	}
+	return binary.BigEndian.Uint32(v4)
+}
+
+func uint32ToIP(n uint32) net.IP {
+	ip := make(net.IP, 4)
+	binary.BigEndian.PutUint32(ip, n)
+	return ip
+}
+
+// String implements fmt.Stringer for debugging output
+func (l DHCPLease) String() string {
+	return fmt.Sprintf("%s %s (%s) until %s", l.MAC, l.IP, l.Hostname, l.Expires.Format(time.RFC3339))
+}
+
+// ResolveMAC returns the MAC address holding a lease for ip, implementing ClientResolver
+func (s *DHCPServer) ResolveMAC(ctx context.Context, ip string) (string, error) {
+	if lease, ok := s.LeaseForIP(ip); ok {
+		return lease.MAC, nil
+	}
+	return "", errors.Wrapf(ErrClientNotResolved, "no DHCP lease for %s", ip)
+}
@@ -0,0 +1,210 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testClientMAC = net.HardwareAddr{0x02, 0x00, 0x00, 0xaa, 0xbb, 0xcc}
+
+func newTestDHCPServer(t *testing.T, dhcpRange string, opts ...DHCPServerOption) (*DHCPServer, *time.Time) {
+	t.Helper()
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	s := NewDHCPServer(opts...)
+	s.now = func() time.Time { return now }
+	config := testAPConfig()
+	config.DHCPRange = dhcpRange
+	require.NoError(t, s.configure(config))
+	return s, &now
+}
+
+func dhcpClientPacket(msgType byte, mac net.HardwareAddr, opts ...dhcpOptionField) *dhcpPacket {
+	p := &dhcpPacket{
+		Op:     bootRequest,
+		HType:  1,
+		HLen:   6,
+		Xid:    0xdeadbeef,
+		Flags:  dhcpFlagBcast,
+		CIAddr: net.IPv4zero,
+		YIAddr: net.IPv4zero,
+		SIAddr: net.IPv4zero,
+		GIAddr: net.IPv4zero,
+		CHAddr: mac,
+	}
+	p.Options.set(optMessageType, []byte{msgType})
+	for _, o := range opts {
+		p.Options.set(o.Code, o.Value)
+	}
+	return p
+}
+
+// roundTrip marshals and parses the packet the way it would cross the wire
+func roundTrip(t *testing.T, p *dhcpPacket) *dhcpPacket {
+	t.Helper()
+	parsed, err := parseDHCPPacket(p.marshal())
+	require.NoError(t, err)
+	return parsed
+}
+
+func TestDHCPServer_DiscoverRequestAck(t *testing.T) {
+	s, _ := newTestDHCPServer(t, "192.168.4.10,192.168.4.20", WithDHCPLeaseTime(time.Hour))
+
+	offer := s.handle(roundTrip(t, dhcpClientPacket(dhcpDiscover, testClientMAC,
+		dhcpOptionField{Code: optHostname, Value: []byte("phone")})))
+	require.NotNil(t, offer)
+	offer = roundTrip(t, offer)
+	assert.Equal(t, dhcpOffer, offer.messageType())
+	assert.Equal(t, "192.168.4.10", offer.YIAddr.String())
+	assert.Equal(t, uint32(0xdeadbeef), offer.Xid)
+	assert.Equal(t, "192.168.4.1", offer.ipOption(optServerID).String())
+	assert.Equal(t, "192.168.4.1", offer.ipOption(optRouter).String())
+	assert.Equal(t, "255.255.255.0", offer.ipOption(optSubnetMask).String())
+	assert.Equal(t, uint32Option(3600), mustOption(t, offer, optLeaseTime))
+	assert.Equal(t, "http://192.168.4.1:8080/api/captive", string(mustOption(t, offer, optCaptivePortalURI)))
+	assert.Empty(t, s.Leases(), "offered addresses are not leases yet")
+
+	ack := s.handle(roundTrip(t, dhcpClientPacket(dhcpRequest, testClientMAC,
+		dhcpOptionField{Code: optRequestedIP, Value: offer.YIAddr.To4()},
+		dhcpOptionField{Code: optServerID, Value: net.IPv4(192, 168, 4, 1).To4()})))
+	require.NotNil(t, ack)
+	assert.Equal(t, dhcpAck, ack.messageType())
+	assert.Equal(t, "192.168.4.10", ack.YIAddr.String())
+
+	leases := s.Leases()
+	require.Len(t, leases, 1)
+	assert.Equal(t, testClientMAC.String(), leases[0].MAC)
+	assert.Equal(t, "192.168.4.10", leases[0].IP)
+	assert.Equal(t, "phone", leases[0].Hostname)
+
+	lease, ok := s.LeaseForIP("192.168.4.10")
+	assert.True(t, ok)
+	assert.Equal(t, leases[0], lease)
+}
+
+func TestDHCPServer_RequestForOtherServerDropsOffer(t *testing.T) {
+	s, _ := newTestDHCPServer(t, "192.168.4.10,192.168.4.20")
+	require.NotNil(t, s.handle(dhcpClientPacket(dhcpDiscover, testClientMAC)))
+
+	reply := s.handle(dhcpClientPacket(dhcpRequest, testClientMAC,
+		dhcpOptionField{Code: optRequestedIP, Value: net.IPv4(10, 0, 0, 5).To4()},
+		dhcpOptionField{Code: optServerID, Value: net.IPv4(10, 0, 0, 1).To4()}))
+	assert.Nil(t, reply)
+	assert.Empty(t, s.leases)
+}
+
+func TestDHCPServer_InitRebootForeignAddressIsRejected(t *testing.T) {
+	s, _ := newTestDHCPServer(t, "192.168.4.10,192.168.4.20")
+
+	reply := s.handle(dhcpClientPacket(dhcpRequest, testClientMAC,
+		dhcpOptionField{Code: optRequestedIP, Value: net.IPv4(10, 0, 0, 5).To4()}))
+	require.NotNil(t, reply)
+	assert.Equal(t, dhcpNak, reply.messageType())
+	assert.Empty(t, s.Leases())
+}
+
+func TestDHCPServer_PoolExhaustionAndRelease(t *testing.T) {
+	s, _ := newTestDHCPServer(t, "192.168.4.10,192.168.4.11")
+	macs := []net.HardwareAddr{
+		{0x02, 0, 0, 0, 0, 1},
+		{0x02, 0, 0, 0, 0, 2},
+		{0x02, 0, 0, 0, 0, 3},
+	}
+
+	for _, mac := range macs[:2] {
+		offer := s.handle(dhcpClientPacket(dhcpDiscover, mac))
+		require.NotNil(t, offer)
+		ack := s.handle(dhcpClientPacket(dhcpRequest, mac,
+			dhcpOptionField{Code: optRequestedIP, Value: offer.YIAddr.To4()}))
+		require.Equal(t, dhcpAck, ack.messageType())
+	}
+	assert.Nil(t, s.handle(dhcpClientPacket(dhcpDiscover, macs[2])), "pool is exhausted")
+
+	release := dhcpClientPacket(dhcpRelease, macs[0])
+	release.CIAddr = net.IPv4(192, 168, 4, 10).To4()
+	assert.Nil(t, s.handle(release))
+
+	offer := s.handle(dhcpClientPacket(dhcpDiscover, macs[2]))
+	require.NotNil(t, offer)
+	assert.Equal(t, "192.168.4.10", offer.YIAddr.String())
+}
+
+func TestDHCPServer_LeasesExpire(t *testing.T) {
+	s, now := newTestDHCPServer(t, "192.168.4.10,192.168.4.20", WithDHCPLeaseTime(time.Minute))
+	offer := s.handle(dhcpClientPacket(dhcpDiscover, testClientMAC))
+	s.handle(dhcpClientPacket(dhcpRequest, testClientMAC,
+		dhcpOptionField{Code: optRequestedIP, Value: offer.YIAddr.To4()}))
+	require.Len(t, s.Leases(), 1)
+
+	*now = now.Add(2 * time.Minute)
+	assert.Empty(t, s.Leases())
+}
+
+func TestDHCPServer_CustomOptions(t *testing.T) {
+	s, _ := newTestDHCPServer(t, "192.168.4.10,192.168.4.20",
+		WithCaptivePortalURL("https://{gateway}:8443/api/captive"),
+		WithDHCPDNSServers(net.IPv4(1, 1, 1, 1)))
+
+	offer := s.handle(dhcpClientPacket(dhcpDiscover, testClientMAC))
+	require.NotNil(t, offer)
+	assert.Equal(t, "https://192.168.4.1:8443/api/captive", string(mustOption(t, offer, optCaptivePortalURI)))
+	assert.Equal(t, "1.1.1.1", offer.ipOption(optDNSServers).String())
+}
+
+func TestDHCPServer_StopTimeoutAllowsRestart(t *testing.T) {
+	s, _ := newTestDHCPServer(t, "192.168.4.10,192.168.4.20")
+	conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	// A serve loop that never exits
+	s.conn, s.done = conn, make(chan struct{})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.ErrorIs(t, s.Stop(ctx), context.Canceled)
+	assert.False(t, s.running())
+	assert.NoError(t, s.Stop(context.Background()))
+}
+
+func TestParseDHCPRange(t *testing.T) {
+	tests := []struct {
+		input   string
+		wantErr bool
+	}{
+		{"192.168.4.2,192.168.4.50", false},
+		{"192.168.4.2, 192.168.4.50", false},
+		{"192.168.4.50,192.168.4.2", true},
+		{"192.168.4.2", true},
+		{"foo,bar", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.input, func(t *testing.T) {
+			_, _, err := parseDHCPRange(tt.input)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrInvalidDHCPRange)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+func TestParseDHCPPacket_Invalid(t *testing.T) {
+	_, err := parseDHCPPacket([]byte{1, 2, 3})
+	assert.ErrorIs(t, err, errInvalidDHCPPacket)
+
+	b := dhcpClientPacket(dhcpDiscover, testClientMAC).marshal()
+	b[dhcpHeaderLen] = 0
+	_, err = parseDHCPPacket(b)
+	assert.ErrorIs(t, err, errInvalidDHCPPacket)
+}
+
+func mustOption(t *testing.T, p *dhcpPacket, code byte) []byte {
+	t.Helper()
+	v, ok := p.Options.get(code)
+	require.True(t, ok, "option %d missing", code)
+	return v
+}
@@ -0,0 +1,15 @@
+//go:build !linux
+
+package network
+
+import (
+	"context"
+	"fmt"
+	"net"
+)
+
+// listenDHCP binds the DHCP server port on all interfaces; binding to a device is Linux only
+func listenDHCP(ctx context.Context, iFace string) (net.PacketConn, error) {
+	var lc net.ListenConfig
+	return lc.ListenPacket(ctx, "udp4", fmt.Sprintf("0.0.0.0:%d", dhcpServerPort))
+}
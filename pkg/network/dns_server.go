@@ -0,0 +1,448 @@
+package network
+
+import (
+	"context"
+	"encoding/binary"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var ErrDNSServerRunning = errors.New("DNS server is already running")
+
+const (
+	dnsPort = 53
+	// Captive answers must not outlive the session, so clients re-resolve once authorized
+	captiveDNSTTL           = 1
+	defaultDNSUpstreamDelay = 3 * time.Second
+	maxDNSMessageSize       = 65535
+)
+
+var defaultDNSUpstreams = []string{"8.8.8.8:53", "8.8.4.4:53"}
+
+// DNSClientPolicy reports whether a client has completed setup and may resolve real addresses
+type DNSClientPolicy func(clientIP net.IP) bool
+
+// DNSServerOption configures a DNSServer
+type DNSServerOption func(*DNSServer)
+
+// WithDNSUpstreams sets the resolvers used for passthrough queries, host:port or host
+func WithDNSUpstreams(upstreams ...string) DNSServerOption {
+	return func(s *DNSServer) {
+		s.upstreams = nil
+		for _, u := range upstreams {
+			if _, _, err := net.SplitHostPort(u); err != nil {
+				u = net.JoinHostPort(u, "53")
+			}
+			s.upstreams = append(s.upstreams, u)
+		}
+	}
+}
+
+// WithDNSAllowList lets every client resolve the given domains and their subdomains
+func WithDNSAllowList(domains ...string) DNSServerOption {
+	return func(s *DNSServer) {
+		for _, d := range domains {
+			s.allowList = append(s.allowList, canonicalDomain(d))
+		}
+	}
+}
+
+// WithDNSClientPolicy forwards all queries from clients the policy authorizes
+func WithDNSClientPolicy(policy DNSClientPolicy) DNSServerOption {
+	return func(s *DNSServer) {
+		s.policy = policy
+	}
+}
+
+// WithDNSListenAddr overrides the listen address, the gateway on port 53 by default
+func WithDNSListenAddr(addr string) DNSServerOption {
+	return func(s *DNSServer) {
+		s.listenAddr = addr
+	}
+}
+
+// WithDNSLogger sets the logger used by the server
+func WithDNSLogger(logger *slog.Logger) DNSServerOption {
+	return func(s *DNSServer) {
+		s.logger = logger
+	}
+}
+
+// DNSServer is an in-process captive DNS responder. Unauthorized clients get the gateway for
+// every A query and empty answers for AAAA/HTTPS/SVCB, allow-listed domains and authorized
+// clients are forwarded to the upstream resolvers.
+type DNSServer struct {
+	mu            sync.Mutex
+	upstreams     []string
+	allowList     []string
+	policy        DNSClientPolicy
+	listenAddr    string
+	upstreamDelay time.Duration
+	logger        *slog.Logger
+
+	gateway    net.IP
+	localNames []string
+
+	udp  net.PacketConn
+	tcp  net.Listener
+	stop chan struct{}   // Closed by Stop
+	wg   *sync.WaitGroup // Goroutines serving udp and tcp
+}
+
+// NewDNSServer creates a DNS server; it is configured from the APConfig passed to Start
+func NewDNSServer(opts ...DNSServerOption) *DNSServer {
+	s := &DNSServer{
+		upstreams:     append([]string(nil), defaultDNSUpstreams...),
+		upstreamDelay: defaultDNSUpstreamDelay,
+		logger:        slog.Default().WithGroup("dns_server"),
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return s
+}
+
+// SetClientPolicy replaces the client policy, e.g. once a session store exists
+func (s *DNSServer) SetClientPolicy(policy DNSClientPolicy) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.policy = policy
+}
+
+func (s *DNSServer) configure(config APConfig) error {
+	gateway := net.ParseIP(config.Gateway).To4()
+	if gateway == nil {
+		return errors.Wrapf(ErrInvalidAPConfig, "gateway %q is not an IPv4 address", config.Gateway)
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.gateway = gateway
+	s.localNames = nil
+	if config.Name != "" {
+		s.localNames = []string{canonicalDomain(config.Name + ".local")}
+	}
+	return nil
+}
+
+// Start listens for UDP and TCP queries until Stop
+func (s *DNSServer) Start(ctx context.Context, config APConfig) error {
+	if s.Addr() != nil {
+		return ErrDNSServerRunning
+	}
+	if err := s.configure(config); err != nil {
+		return err
+	}
+
+	addr := s.listenAddr
+	if addr == "" {
+		addr = net.JoinHostPort(config.Gateway, "53")
+	}
+	var lc net.ListenConfig
+	udp, err := lc.ListenPacket(ctx, "udp", addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen for DNS on udp %s", addr)
+	}
+	tcp, err := lc.Listen(ctx, "tcp", udp.LocalAddr().String())
+	if err != nil {
+		udp.Close()
+		return errors.Wrapf(err, "failed to listen for DNS on tcp %s", addr)
+	}
+	stop, wg := make(chan struct{}), &sync.WaitGroup{}
+	s.mu.Lock()
+	if s.udp != nil {
+		// Another Start won the race
+		s.mu.Unlock()
+		udp.Close()
+		tcp.Close()
+		return ErrDNSServerRunning
+	}
+	s.udp, s.tcp, s.stop, s.wg = udp, tcp, stop, wg
+	s.mu.Unlock()
+
+	wg.Add(2)
+	go s.serveUDP(udp, wg)
+	go s.serveTCP(tcp, wg, stop)
+
+	s.logger.Info("DNS server started", slog.String("address", udp.LocalAddr().String()))
+	return nil
+}
+
+// Addr returns the UDP address the server listens on, nil when stopped
+func (s *DNSServer) Addr() net.Addr {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.udp == nil {
+		return nil
+	}
+	return s.udp.LocalAddr()
+}
+
+// Stop closes the listeners and waits for in-flight queries. The server can be started again
+// even when ctx expires before they finish.
+func (s *DNSServer) Stop(ctx context.Context) error {
+	s.mu.Lock()
+	udp, tcp, stop, wg := s.udp, s.tcp, s.stop, s.wg
+	s.udp, s.tcp, s.stop, s.wg = nil, nil, nil, nil
+	s.mu.Unlock()
+	if udp == nil {
+		return nil
+	}
+	close(stop)
+	udp.Close()
+	tcp.Close()
+
+	done := make(chan struct{})
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	s.logger.Debug("DNS server stopped")
+	return nil
+}
+
+func (s *DNSServer) serveUDP(conn net.PacketConn, wg *sync.WaitGroup) {
+	defer wg.Done()
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("DNS read failed", slog.String("error", err.Error()))
+			}
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			resp := s.handle(clientIP(addr), query, "udp")
+			if resp != nil {
+				conn.WriteTo(resp, addr)
+			}
+		}()
+	}
+}
+
+func (s *DNSServer) serveTCP(l net.Listener, wg *sync.WaitGroup, stop chan struct{}) {
+	defer wg.Done()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if !errors.Is(err, net.ErrClosed) {
+				s.logger.Error("DNS accept failed", slog.String("error", err.Error()))
+			}
+			return
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			s.serveTCPConn(conn, stop)
+		}()
+	}
+}
+
+func (s *DNSServer) serveTCPConn(conn net.Conn, stop chan struct{}) {
+	for {
+		conn.SetDeadline(time.Now().Add(10 * time.Second))
+		query, err := readTCPMessage(conn)
+		if err != nil {
+			return
+		}
+		resp := s.handle(clientIP(conn.RemoteAddr()), query, "tcp")
+		if resp == nil {
+			return
+		}
+		if err := writeTCPMessage(conn, resp); err != nil {
+			return
+		}
+		select {
+		case <-stop:
+			return
+		default:
+		}
+	}
+}
+
+// handle answers a single query from client; transport selects how upstreams are contacted
+func (s *DNSServer) handle(client net.IP, query []byte, transport string) []byte {
+	var p dnsmessage.Parser
+	header, err := p.Start(query)
+	if err != nil || header.Response {
+		return nil
+	}
+	q, err := p.Question()
+	if err != nil {
+		return s.reply(header, nil, dnsmessage.RCodeFormatError, nil)
+	}
+	name := canonicalDomain(q.Name.String())
+
+	s.mu.Lock()
+	gateway, policy := s.gateway, s.policy
+	local := matchesDomain(name, s.localNames)
+	allowed := matchesDomain(name, s.allowList)
+	s.mu.Unlock()
+
+	if !local && (allowed || (policy != nil && policy(client))) {
+		resp, err := s.forward(query, transport)
+		if err != nil {
+			s.logger.Warn("DNS upstream failed", slog.String("name", name), slog.String("error", err.Error()))
+			return s.reply(header, &q, dnsmessage.RCodeServerFailure, nil)
+		}
+		return resp
+	}
+
+	if q.Class != dnsmessage.ClassINET || header.OpCode != 0 {
+		return s.reply(header, &q, dnsmessage.RCodeNotImplemented, nil)
+	}
+	switch q.Type {
+	case dnsmessage.TypeA:
+		var a [4]byte
+		copy(a[:], gateway)
+		return s.reply(header, &q, dnsmessage.RCodeSuccess, &dnsmessage.AResource{A: a})
+	default:
+		// AAAA, HTTPS, SVCB and everything else: the name exists but has no such record,
+		// so clients fall back to the captive IPv4 address instead of erroring out
+		return s.reply(header, &q, dnsmessage.RCodeSuccess, nil)
+	}
+}
+
+func (s *DNSServer) reply(req dnsmessage.Header, q *dnsmessage.Question, rcode dnsmessage.RCode, answer *dnsmessage.AResource) []byte {
+	b := dnsmessage.NewBuilder(make([]byte, 0, 512), dnsmessage.Header{
+		ID:                 req.ID,
+		Response:           true,
+		OpCode:             req.OpCode,
+		Authoritative:      true,
+		RecursionDesired:   req.RecursionDesired,
+		RecursionAvailable: true,
+		RCode:              rcode,
+	})
+	b.EnableCompression()
+	if q != nil {
+		if err := b.StartQuestions(); err != nil {
+			return nil
+		}
+		if err := b.Question(*q); err != nil {
+			return nil
+		}
+		if answer != nil {
+			if err := b.StartAnswers(); err != nil {
+				return nil
+			}
+			rh := dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: captiveDNSTTL}
+			if err := b.AResource(rh, *answer); err != nil {
+				return nil
+			}
+		}
+	}
+	msg, err := b.Finish()
+	if err != nil {
+		s.logger.Error("failed to build DNS response", slog.String("error", err.Error()))
+		return nil
+	}
+	return msg
+}
+
+// forward relays the raw query to each upstream in turn and returns the first answer
+func (s *DNSServer) forward(query []byte, transport string) ([]byte, error) {
+	s.mu.Lock()
+	upstreams := append([]string(nil), s.upstreams...)
+	s.mu.Unlock()
+
+	var lastErr error = errors.New("no upstream resolvers configured")
+	for _, upstream := range upstreams {
+		resp, err := exchangeDNS(upstream, query, transport, s.upstreamDelay)
+		if err == nil {
+			return resp, nil
+		}
+		lastErr = errors.Wrap(err, upstream)
+	}
+	return nil, lastErr
+}
+
+func exchangeDNS(upstream string, query []byte, transport string, timeout time.Duration) ([]byte, error) {
+	conn, err := net.DialTimeout(transport, upstream, timeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+
+	if transport == "tcp" {
+		if err := writeTCPMessage(conn, query); err != nil {
+			return nil, err
+		}
+		return readTCPMessage(conn)
+	}
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, maxDNSMessageSize)
+	for {
+		n, err := conn.Read(buf)
+		if err != nil {
+			return nil, err
+		}
+		// Ignore stray datagrams that don't answer this query
+		if n >= 2 && buf[0] == query[0] && buf[1] == query[1] {
+			return buf[:n], nil
+		}
+	}
+}
+
+func readTCPMessage(r io.Reader) ([]byte, error) {
+	var length [2]byte
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, binary.BigEndian.Uint16(length[:]))
+	if _, err := io.ReadFull(r, msg); err != nil {
+		return nil, err
+	}
+	return msg, nil
+}
+
+func writeTCPMessage(w io.Writer, msg []byte) error {
+	b := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(b, uint16(len(msg)))
+	copy(b[2:], msg)
+	_, err := w.Write(b)
+	return err
+}
+
+func clientIP(addr net.Addr) net.IP {
+	switch a := addr.(type) {
+	case *net.UDPAddr:
+		return a.IP
+	case *net.TCPAddr:
+		return a.IP
+	}
+	host, _, _ := net.SplitHostPort(addr.String())
+	return net.ParseIP(host)
+}
+
+func canonicalDomain(name string) string {
+	return strings.ToLower(strings.TrimSuffix(strings.TrimSpace(name), "."))
+}
+
+// matchesDomain reports whether name equals or is a subdomain of any of domains
+func matchesDomain(name string, domains []string) bool {
+	for _, d := range domains {
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package network
+
+import (
+	"context"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/dns/dnsmessage"
+)
+
+var testDNSClient = net.IPv4(192, 168, 4, 23)
+
+// fakeUpstream answers every A query with 93.184.216.34
+func fakeUpstream(t *testing.T) string {
+	t.Helper()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var p dnsmessage.Parser
+			h, err := p.Start(buf[:n])
+			if err != nil {
+				continue
+			}
+			q, _ := p.Question()
+			b := dnsmessage.NewBuilder(nil, dnsmessage.Header{ID: h.ID, Response: true})
+			b.StartQuestions()
+			b.Question(q)
+			b.StartAnswers()
+			b.AResource(dnsmessage.ResourceHeader{Name: q.Name, Class: dnsmessage.ClassINET, TTL: 300},
+				dnsmessage.AResource{A: [4]byte{93, 184, 216, 34}})
+			msg, _ := b.Finish()
+			conn.WriteTo(msg, addr)
+		}
+	}()
+	return conn.LocalAddr().String()
+}
+
+func newTestDNSServer(t *testing.T, opts ...DNSServerOption) *DNSServer {
+	t.Helper()
+	s := NewDNSServer(opts...)
+	s.upstreamDelay = 500 * time.Millisecond
+	require.NoError(t, s.configure(testAPConfig()))
+	return s
+}
+
+func dnsQuery(t *testing.T, name string, qtype dnsmessage.Type) []byte {
+	t.Helper()
+	msg := dnsmessage.Message{
+		Header: dnsmessage.Header{ID: 4242, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{
+			Name:  dnsmessage.MustNewName(name),
+			Type:  qtype,
+			Class: dnsmessage.ClassINET,
+		}},
+	}
+	b, err := msg.Pack()
+	require.NoError(t, err)
+	return b
+}
+
+func parseDNSResponse(t *testing.T, b []byte) dnsmessage.Message {
+	t.Helper()
+	require.NotNil(t, b)
+	var msg dnsmessage.Message
+	require.NoError(t, msg.Unpack(b))
+	assert.True(t, msg.Header.Response)
+	assert.Equal(t, uint16(4242), msg.Header.ID)
+	return msg
+}
+
+func answerA(t *testing.T, msg dnsmessage.Message) string {
+	t.Helper()
+	require.Len(t, msg.Answers, 1)
+	a, ok := msg.Answers[0].Body.(*dnsmessage.AResource)
+	require.True(t, ok)
+	return net.IP(a.A[:]).String()
+}
+
+func TestDNSServer_CaptiveAnswers(t *testing.T) {
+	s := newTestDNSServer(t)
+
+	tests := []struct {
+		name  string
+		qtype dnsmessage.Type
+		want  string // empty means NOERROR without answers
+	}{
+		{"captive.apple.com.", dnsmessage.TypeA, "192.168.4.1"},
+		{"connectivitycheck.gstatic.com.", dnsmessage.TypeA, "192.168.4.1"},
+		{"www.msftconnecttest.com.", dnsmessage.TypeAAAA, ""},
+		{"captive.apple.com.", dnsmessage.Type(65), ""}, // HTTPS
+		{"example.com.", dnsmessage.Type(64), ""},       // SVCB
+		{"example.com.", dnsmessage.TypeMX, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name+" "+tt.qtype.String(), func(t *testing.T) {
+			msg := parseDNSResponse(t, s.handle(testDNSClient, dnsQuery(t, tt.name, tt.qtype), "udp"))
+			assert.Equal(t, dnsmessage.RCodeSuccess, msg.Header.RCode)
+			if tt.want == "" {
+				assert.Empty(t, msg.Answers)
+				return
+			}
+			assert.Equal(t, tt.want, answerA(t, msg))
+			assert.Equal(t, uint32(captiveDNSTTL), msg.Answers[0].Header.TTL)
+		})
+	}
+}
+
+func TestDNSServer_AllowListIsForwarded(t *testing.T) {
+	s := newTestDNSServer(t, WithDNSUpstreams(fakeUpstream(t)), WithDNSAllowList("Example.com."))
+
+	msg := parseDNSResponse(t, s.handle(testDNSClient, dnsQuery(t, "cdn.example.com.", dnsmessage.TypeA), "udp"))
+	assert.Equal(t, "93.184.216.34", answerA(t, msg))
+
+	msg = parseDNSResponse(t, s.handle(testDNSClient, dnsQuery(t, "notexample.com.", dnsmessage.TypeA), "udp"))
+	assert.Equal(t, "192.168.4.1", answerA(t, msg))
+}
+
+func TestDNSServer_AuthorizedClientsAreForwarded(t *testing.T) {
+	authorized := net.IPv4(192, 168, 4, 99)
+	s := newTestDNSServer(t, WithDNSUpstreams(fakeUpstream(t)),
+		WithDNSClientPolicy(func(ip net.IP) bool { return ip.Equal(authorized) }))
+
+	msg := parseDNSResponse(t, s.handle(authorized, dnsQuery(t, "example.org.", dnsmessage.TypeA), "udp"))
+	assert.Equal(t, "93.184.216.34", answerA(t, msg))
+
+	msg = parseDNSResponse(t, s.handle(testDNSClient, dnsQuery(t, "example.org.", dnsmessage.TypeA), "udp"))
+	assert.Equal(t, "192.168.4.1", answerA(t, msg))
+
+	// The portal's own name always points at the gateway
+	msg = parseDNSResponse(t, s.handle(authorized, dnsQuery(t, "setup.test-portal.local.", dnsmessage.TypeA), "udp"))
+	assert.Equal(t, "192.168.4.1", answerA(t, msg))
+}
+
+func TestDNSServer_UpstreamFailure(t *testing.T) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer conn.Close() // never answers
+	s := newTestDNSServer(t, WithDNSUpstreams(conn.LocalAddr().String()), WithDNSAllowList("example.com"))
+
+	msg := parseDNSResponse(t, s.handle(testDNSClient, dnsQuery(t, "example.com.", dnsmessage.TypeA), "udp"))
+	assert.Equal(t, dnsmessage.RCodeServerFailure, msg.Header.RCode)
+}
+
+func TestDNSServer_StartServesUDPAndTCP(t *testing.T) {
+	s := NewDNSServer(WithDNSListenAddr("127.0.0.1:0"))
+	ctx := context.Background()
+	require.NoError(t, s.Start(ctx, testAPConfig()))
+	defer s.Stop(ctx)
+	assert.ErrorIs(t, s.Start(ctx, testAPConfig()), ErrDNSServerRunning)
+
+	for _, transport := range []string{"udp", "tcp"} {
+		t.Run(transport, func(t *testing.T) {
+			resp, err := exchangeDNS(s.Addr().String(), dnsQuery(t, "neverssl.com.", dnsmessage.TypeA), transport, time.Second)
+			require.NoError(t, err)
+			assert.Equal(t, "192.168.4.1", answerA(t, parseDNSResponse(t, resp)))
+		})
+	}
+
+	require.NoError(t, s.Stop(ctx))
+	assert.Nil(t, s.Addr())
+}
+
+func TestDNSServer_StopTimeoutAllowsRestart(t *testing.T) {
+	s := NewDNSServer(WithDNSListenAddr("127.0.0.1:0"))
+	ctx := context.Background()
+	require.NoError(t, s.Start(ctx, testAPConfig()))
+
+	// A query that never finishes keeps Stop waiting
+	stuck := s.wg
+	stuck.Add(1)
+	defer stuck.Done()
+
+	timeout, cancel := context.WithTimeout(ctx, 20*time.Millisecond)
+	defer cancel()
+	assert.ErrorIs(t, s.Stop(timeout), context.DeadlineExceeded)
+	assert.Nil(t, s.Addr())
+	assert.NoError(t, s.Stop(ctx))
+
+	require.NoError(t, s.Start(ctx, testAPConfig()))
+	require.NoError(t, s.Stop(ctx))
+}
@@ -0,0 +1,136 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+	"os"
+	"text/template"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+// dnsmasqTemplateData is the view of an APConfig rendered into dnsmasq.conf.tmpl
+type dnsmasqTemplateData struct {
+	APConfig
+	DHCP bool // false when the embedded DHCPServer hands out addresses
+	DNS  bool // false when the embedded DNSServer answers queries
+}
+
+// dnsmasqServer runs dnsmasq in the foreground with a config rendered from dnsmasq.conf.tmpl
+type dnsmasqServer struct {
+	runner     command.Runner
+	logger     *slog.Logger
+	monitor    *processMonitor
+	dhcp       bool
+	dns        bool
+	configPath string
+	child      *childProcess
+}
+
+func newDNSMasqServer(monitor *processMonitor, dhcp, dns bool) *dnsmasqServer {
+	return &dnsmasqServer{runner: monitor.runner, logger: monitor.logger, monitor: monitor, dhcp: dhcp, dns: dns}
+}
+
+func (d *dnsmasqServer) start(ctx context.Context, config APConfig) error {
+	// Stop any existing dnsmasq service
+	if _, err := d.runner.RunWithContext(ctx, "sudo", "systemctl", "stop", "dnsmasq"); err != nil {
+		d.logger.Warn("failed to stop system dnsmasq service", slog.String("error", err.Error()))
+	}
+
+	tmpl, err := template.ParseFS(templateFiles, "templates/dnsmasq.conf.tmpl")
+	if err != nil {
+		return errors.Wrap(err, "failed to parse dnsmasq template")
+	}
+
+	file, err := os.CreateTemp("", "dnsmasq-*.conf")
+	if err != nil {
+		return errors.Wrap(err, "failed to create dnsmasq config file")
+	}
+	defer file.Close()
+
+	if err := tmpl.Execute(file, dnsmasqTemplateData{APConfig: config, DHCP: d.dhcp, DNS: d.dns}); err != nil {
+		os.Remove(file.Name())
+		return errors.Wrap(err, "failed to execute dnsmasq template")
+	}
+
+	child, err := d.monitor.start("dnsmasq", "sudo", "dnsmasq", "-C", file.Name(), "--keep-in-foreground")
+	if err != nil {
+		os.Remove(file.Name())
+		return err
+	}
+	d.configPath = file.Name()
+	d.child = child
+
+	return nil
+}
+
+func (d *dnsmasqServer) stop(ctx context.Context) {
+	if d.child != nil {
+		d.child.stop()
+		d.child = nil
+	}
+
+	if d.configPath != "" {
+		pattern := "dnsmasq.*" + d.configPath
+		d.runner.RunWithContext(ctx, "sudo", "pkill", "-f", pattern)
+
+		if err := os.Remove(d.configPath); err != nil {
+			d.logger.Error("failed to remove dnsmasq config file", slog.String("path", d.configPath), slog.String("error", err.Error()))
+		}
+		d.configPath = ""
+	}
+}
+
+// clientServices hands out addresses and names to access point clients. dnsmasq covers
+// whatever the embedded DHCP and DNS servers are not configured to serve.
+type clientServices struct {
+	dnsmasq *dnsmasqServer
+	dhcp    *DHCPServer
+	dns     *DNSServer
+	logger  *slog.Logger
+}
+
+func newClientServices(o apServiceOptions, monitor *processMonitor) *clientServices {
+	return &clientServices{
+		dnsmasq: newDNSMasqServer(monitor, o.dhcp == nil, o.dns == nil),
+		dhcp:    o.dhcp,
+		dns:     o.dns,
+		logger:  o.logger,
+	}
+}
+
+func (c *clientServices) start(ctx context.Context, config APConfig) error {
+	if c.dnsmasq.dhcp || c.dnsmasq.dns {
+		if err := c.dnsmasq.start(ctx, config); err != nil {
+			return errors.Wrap(err, "failed to start dnsmasq")
+		}
+	}
+	if c.dhcp != nil {
+		if err := c.dhcp.Start(ctx, config); err != nil {
+			c.stop(ctx)
+			return errors.Wrap(err, "failed to start DHCP server")
+		}
+	}
+	if c.dns != nil {
+		if err := c.dns.Start(ctx, config); err != nil {
+			c.stop(ctx)
+			return errors.Wrap(err, "failed to start DNS server")
+		}
+	}
+	return nil
+}
+
+func (c *clientServices) stop(ctx context.Context) {
+	if c.dns != nil {
+		if err := c.dns.Stop(ctx); err != nil {
+			c.logger.Error("failed to stop DNS server", slog.String("error", err.Error()))
+		}
+	}
+	if c.dhcp != nil {
+		if err := c.dhcp.Stop(ctx); err != nil {
+			c.logger.Error("failed to stop DHCP server", slog.String("error", err.Error()))
+		}
+	}
+	c.dnsmasq.stop(ctx)
+}
@@ -0,0 +1,289 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+var ErrHostapdExited = errors.New("hostapd exited unexpectedly")
+
+const (
+	defaultHostapdChannel      = 6
+	defaultHostapdStartupGrace = 2 * time.Second
+)
+
+// hostapdTemplateData is the view of an APConfig rendered into hostapd.conf.tmpl
+type hostapdTemplateData struct {
+	Interface     string
+	SSID          string
+	Password      string
+	CountryCode   string
+	HWMode        string
+	Channel       int
+	Hidden        bool
+	IEEE80211N    bool
+	IEEE80211AC   bool
+	WPA           int
+	KeyMgmt       string
+	IEEE80211W    int
+	SAEPassword   string // Set instead of Password for SAE-only networks, which allow longer passwords
+	SAERequireMFP bool   // Transition mode: SAE clients must use PMF even though it is optional for PSK clients
+}
+
+func newHostapdTemplateData(config APConfig) (hostapdTemplateData, error) {
+	for name, value := range map[string]string{"ssid": config.SSID, "password": config.Password, "interface": config.Interface} {
+		if strings.ContainsAny(value, "\r\n") {
+			return hostapdTemplateData{}, errors.Wrapf(ErrInvalidAPConfig, "%s must not contain line breaks", name)
+		}
+	}
+
+	data := hostapdTemplateData{
+		Interface:   config.Interface,
+		SSID:        config.SSID,
+		Password:    config.Password,
+		CountryCode: strings.ToUpper(config.CountryCode),
+		HWMode:      config.Band(),
+		Channel:     config.Channel,
+		Hidden:      config.Hidden,
+		IEEE80211N:  config.Band() != "b",
+		IEEE80211AC: config.Band() == "a",
+	}
+	if data.Channel == 0 {
+		if data.HWMode == "a" {
+			data.Channel = 36
+		} else {
+			data.Channel = defaultHostapdChannel
+		}
+	}
+
+	if config.SecurityMode() == SecurityOpen {
+		data.Password = ""
+		return data, nil
+	}
+
+	data.WPA = 2
+	data.IEEE80211W = hostapdIEEE80211W(config.PMFMode())
+	switch config.SecurityMode() {
+	case SecurityWPA3:
+		data.KeyMgmt = "SAE"
+		data.SAEPassword = config.Password
+		data.Password = ""
+	case SecurityWPA2WPA3:
+		data.KeyMgmt = "WPA-PSK SAE"
+		data.SAERequireMFP = true
+	default:
+		data.KeyMgmt = "WPA-PSK"
+	}
+	return data, nil
+}
+
+// hostapdService runs the access point with hostapd directly instead of NetworkManager,
+// assigning the gateway address with ip and serving DHCP/DNS with dnsmasq or the embedded servers.
+type hostapdService struct {
+	mu           sync.Mutex
+	config       APConfig
+	configPath   string
+	hostapd      *childProcess
+	monitor      *processMonitor
+	clients      *clientServices
+	running      bool
+	runner       command.Runner
+	logger       *slog.Logger
+	startupGrace time.Duration
+}
+
+// NewHostapdAPService creates an APService backed by hostapd, for systems without NetworkManager
+func NewHostapdAPService(opts ...APServiceOption) APService {
+	o := newAPServiceOptions(opts)
+	monitor := newProcessMonitor(o)
+	return &hostapdService{
+		runner:       o.runner,
+		logger:       o.logger,
+		monitor:      monitor,
+		clients:      newClientServices(o, monitor),
+		startupGrace: defaultHostapdStartupGrace,
+	}
+}
+
+func (h *hostapdService) Start(ctx context.Context, config APConfig) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running {
+		return ErrServiceAlreadyRunning
+	}
+	if err := config.Validate(); err != nil {
+		return errors.Wrap(err, "invalid access point configuration")
+	}
+	h.config = config
+	h.logger.Info("starting hostapd access point service", slog.String("ssid", config.SSID))
+
+	if err := h.prepareInterface(ctx); err != nil {
+		return errors.Wrap(err, "failed to prepare interface")
+	}
+	if err := h.startHostapd(ctx); err != nil {
+		h.releaseInterface(ctx)
+		return errors.Wrap(err, "failed to start hostapd")
+	}
+	applyCaptiveRules(ctx, h.runner, h.logger, h.config.Interface, h.config.PortalPort)
+	if err := h.clients.start(ctx, h.config); err != nil {
+		removeCaptiveRules(ctx, h.runner, h.config.Interface, h.config.PortalPort)
+		h.stopHostapd(ctx)
+		h.releaseInterface(ctx)
+		return err
+	}
+
+	h.running = true
+	return nil
+}
+
+func (h *hostapdService) Stop(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.running {
+		return nil
+	}
+
+	h.clients.stop(ctx)
+	h.stopHostapd(ctx)
+	removeCaptiveRules(ctx, h.runner, h.config.Interface, h.config.PortalPort)
+	h.releaseInterface(ctx)
+
+	h.running = false
+	h.logger.Debug("hostapd access point service stopped")
+	return nil
+}
+
+// IsRunning reports whether the service was started and hostapd is up, it is not while
+// hostapd waits to be restarted
+func (h *hostapdService) IsRunning() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.running && h.hostapd != nil && h.hostapd.running()
+}
+
+// Health reports hostapd and dnsmasq, the service is degraded while either is restarting
+func (h *hostapdService) Health() APHealth {
+	h.mu.Lock()
+	running := h.running
+	h.mu.Unlock()
+	return h.monitor.health(running)
+}
+
+func (h *hostapdService) Events() <-chan APEvent {
+	return h.monitor.events
+}
+
+func (h *hostapdService) prepareInterface(ctx context.Context) error {
+	iFace := h.config.Interface
+
+	// Release the interface from NetworkManager when it is installed; minimal images won't have it
+	if _, err := h.runner.RunWithContext(ctx, "nmcli", "device", "set", iFace, "managed", "no"); err != nil {
+		h.logger.Debug("could not release interface from NetworkManager", slog.String("error", err.Error()))
+	}
+	if _, err := h.runner.RunWithContext(ctx, "sudo", "rfkill", "unblock", "wlan"); err != nil {
+		h.logger.Debug("failed to unblock wlan", slog.String("error", err.Error()))
+	}
+
+	steps := [][]string{
+		{"ip", "link", "set", iFace, "down"},
+		{"ip", "addr", "flush", "dev", iFace},
+		{"ip", "addr", "add", fmt.Sprintf("%s/24", h.config.Gateway), "dev", iFace},
+		{"ip", "link", "set", iFace, "up"},
+	}
+	for _, step := range steps {
+		if res, err := h.runner.RunWithContext(ctx, "sudo", step...); err != nil {
+			return errors.Wrapf(err, "%s: %s", strings.Join(step, " "), res.Combined())
+		}
+	}
+	return nil
+}
+
+func (h *hostapdService) releaseInterface(ctx context.Context) {
+	if _, err := h.runner.RunWithContext(ctx, "sudo", "ip", "addr", "flush", "dev", h.config.Interface); err != nil {
+		h.logger.Warn("failed to flush interface addresses", slog.String("interface", h.config.Interface), slog.String("error", err.Error()))
+	}
+}
+
+func (h *hostapdService) writeConfig() error {
+	data, err := newHostapdTemplateData(h.config)
+	if err != nil {
+		return err
+	}
+
+	tmpl, err := template.ParseFS(templateFiles, "templates/hostapd.conf.tmpl")
+	if err != nil {
+		return errors.Wrap(err, "failed to parse hostapd template")
+	}
+
+	file, err := os.CreateTemp("", "hostapd-*.conf")
+	if err != nil {
+		return errors.Wrap(err, "failed to create hostapd config file")
+	}
+	defer file.Close()
+
+	if err := tmpl.Execute(file, data); err != nil {
+		os.Remove(file.Name())
+		return errors.Wrap(err, "failed to execute hostapd template")
+	}
+
+	h.configPath = file.Name()
+	return nil
+}
+
+func (h *hostapdService) startHostapd(ctx context.Context) error {
+	if err := h.writeConfig(); err != nil {
+		return err
+	}
+
+	hostapd, err := h.monitor.start("hostapd", "sudo", "hostapd", h.configPath)
+	if err != nil {
+		h.removeConfig()
+		return err
+	}
+	h.hostapd = hostapd
+
+	// hostapd exits almost immediately on a bad config or unsupported driver
+	select {
+	case <-ctx.Done():
+		h.stopHostapd(context.Background())
+		return ctx.Err()
+	case <-time.After(h.startupGrace):
+	}
+	if health := hostapd.health(); health.State != ProcessRunning || health.Restarts > 0 {
+		h.stopHostapd(ctx)
+		return errors.Wrapf(ErrHostapdExited, "during startup: %s", health.LastError)
+	}
+	return nil
+}
+
+func (h *hostapdService) stopHostapd(ctx context.Context) {
+	if h.hostapd != nil {
+		h.hostapd.stop()
+		h.hostapd = nil
+	}
+	if h.configPath != "" {
+		h.runner.RunWithContext(ctx, "sudo", "pkill", "-f", "hostapd.*"+h.configPath)
+	}
+	h.removeConfig()
+}
+
+func (h *hostapdService) removeConfig() {
+	if h.configPath == "" {
+		return
+	}
+	if err := os.Remove(h.configPath); err != nil {
+		h.logger.Error("failed to remove hostapd config file", slog.String("path", h.configPath), slog.String("error", err.Error()))
+	}
+	h.configPath = ""
+}
@@ -0,0 +1,202 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"io"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestHostapdService(runner command.Runner) *hostapdService {
+	h := NewHostapdAPService(WithAPCommandRunner(runner)).(*hostapdService)
+	h.startupGrace = 10 * time.Millisecond
+	return h
+}
+
+func TestHostapdTemplateData(t *testing.T) {
+	tests := []struct {
+		name     string
+		mutate   func(*APConfig)
+		expected hostapdTemplateData
+	}{
+		{
+			name:   "wpa2 defaults",
+			mutate: func(c *APConfig) {},
+			expected: hostapdTemplateData{
+				HWMode: "g", Channel: 6, IEEE80211N: true,
+				WPA: 2, KeyMgmt: "WPA-PSK", Password: "12345678",
+			},
+		},
+		{
+			name: "wpa3 on 5GHz",
+			mutate: func(c *APConfig) {
+				c.Security = "wpa3"
+				c.Channel = 44
+			},
+			expected: hostapdTemplateData{
+				HWMode: "a", Channel: 44, IEEE80211N: true, IEEE80211AC: true,
+				WPA: 2, KeyMgmt: "SAE", IEEE80211W: 2, SAEPassword: "12345678",
+			},
+		},
+		{
+			name: "wpa2/wpa3 transition",
+			mutate: func(c *APConfig) {
+				c.Security = "wpa2-wpa3"
+			},
+			expected: hostapdTemplateData{
+				HWMode: "g", Channel: 6, IEEE80211N: true,
+				WPA: 2, KeyMgmt: "WPA-PSK SAE", IEEE80211W: 1, SAERequireMFP: true, Password: "12345678",
+			},
+		},
+		{
+			name: "wpa2 with required pmf",
+			mutate: func(c *APConfig) {
+				c.PMF = "required"
+			},
+			expected: hostapdTemplateData{
+				HWMode: "g", Channel: 6, IEEE80211N: true,
+				WPA: 2, KeyMgmt: "WPA-PSK", IEEE80211W: 2, Password: "12345678",
+			},
+		},
+		{
+			name: "open hidden network",
+			mutate: func(c *APConfig) {
+				c.Security = "open"
+				c.Hidden = true
+				c.HWMode = "a"
+			},
+			expected: hostapdTemplateData{
+				HWMode: "a", Channel: 36, IEEE80211N: true, IEEE80211AC: true, Hidden: true,
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testAPConfig()
+			tt.mutate(&config)
+			data, err := newHostapdTemplateData(config)
+			require.NoError(t, err)
+
+			tt.expected.Interface = "wlan0"
+			tt.expected.SSID = "TestPortal"
+			tt.expected.CountryCode = "SE"
+			assert.Equal(t, tt.expected, data)
+		})
+	}
+}
+
+func TestHostapdTemplateData_RejectsLineBreaks(t *testing.T) {
+	config := testAPConfig()
+	config.SSID = "evil\nwpa=0"
+
+	_, err := newHostapdTemplateData(config)
+	assert.ErrorIs(t, err, ErrInvalidAPConfig)
+}
+
+func TestHostapdService_StartStopLifecycle(t *testing.T) {
+	runner := command.NewFakeRunner()
+	h := newTestHostapdService(runner)
+	ctx := context.Background()
+	config := testAPConfig()
+	config.Hidden = true
+
+	require.NoError(t, h.Start(ctx, config))
+	assert.True(t, h.IsRunning())
+	assert.True(t, runner.Called("sudo", "ip", "addr", "add", "192.168.4.1/24", "dev", "wlan0"))
+
+	configPath := h.configPath
+	rendered, err := os.ReadFile(configPath)
+	require.NoError(t, err)
+	assert.Contains(t, string(rendered), "ssid=TestPortal\n")
+	assert.Contains(t, string(rendered), "country_code=SE\n")
+	assert.Contains(t, string(rendered), "ignore_broadcast_ssid=1\n")
+	assert.Contains(t, string(rendered), "wpa_key_mgmt=WPA-PSK\n")
+
+	hostapd := runner.Process("sudo", "hostapd", configPath)
+	require.NotNil(t, hostapd)
+
+	require.NoError(t, h.Stop(ctx))
+	assert.False(t, h.IsRunning())
+	assert.True(t, hostapd.Terminated())
+	assert.True(t, runner.Called("sudo", "pkill", "-f", "hostapd.*"+configPath))
+	assert.NoFileExists(t, configPath)
+	assert.True(t, runner.Called("sudo", "ip", "addr", "flush", "dev", "wlan0"))
+}
+
+func TestHostapdService_DetectsUnexpectedExit(t *testing.T) {
+	runner := command.NewFakeRunner()
+	h := NewHostapdAPService(WithAPCommandRunner(runner), WithAPRestartBackoff(time.Hour, time.Hour)).(*hostapdService)
+	h.startupGrace = 10 * time.Millisecond
+
+	require.NoError(t, h.Start(context.Background(), testAPConfig()))
+	runner.Process("sudo", "hostapd", h.configPath).Exit(errors.New("exit status 1"))
+
+	assert.Eventually(t, func() bool { return !h.IsRunning() }, time.Second, 5*time.Millisecond)
+	health := h.Health()
+	assert.True(t, health.Running)
+	assert.True(t, health.Degraded)
+	assert.Equal(t, ProcessHealth{Name: "hostapd", State: ProcessRestarting, LastError: "exit status 1"}, health.Processes[0])
+	assert.Equal(t, APEventProcessExited, (<-h.Events()).Type)
+	require.NoError(t, h.Stop(context.Background()))
+}
+
+func TestHostapdService_RestartsHostapd(t *testing.T) {
+	runner := command.NewFakeRunner()
+	h := NewHostapdAPService(WithAPCommandRunner(runner), WithAPRestartBackoff(time.Millisecond, time.Millisecond)).(*hostapdService)
+	h.startupGrace = 10 * time.Millisecond
+
+	require.NoError(t, h.Start(context.Background(), testAPConfig()))
+	first := runner.Process("sudo", "hostapd", h.configPath)
+	first.Exit(errors.New("exit status 1"))
+
+	assert.Eventually(t, func() bool {
+		return runner.Process("sudo", "hostapd", h.configPath) != first && h.IsRunning()
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 1, h.Health().Processes[0].Restarts)
+	restarted := runner.Process("sudo", "hostapd", h.configPath)
+
+	require.NoError(t, h.Stop(context.Background()))
+	assert.True(t, restarted.Exited())
+}
+
+func TestHostapdService_StartFailsWhenHostapdExits(t *testing.T) {
+	runner := &exitingRunner{FakeRunner: command.NewFakeRunner()}
+	h := NewHostapdAPService(WithAPCommandRunner(runner), WithAPRestartBackoff(time.Hour, time.Hour)).(*hostapdService)
+	h.startupGrace = 10 * time.Millisecond
+
+	err := h.Start(context.Background(), testAPConfig())
+	assert.ErrorIs(t, err, ErrHostapdExited)
+	assert.Contains(t, err.Error(), "nl80211: Could not configure driver mode")
+	assert.False(t, h.IsRunning())
+	assert.Empty(t, h.Health().Processes)
+}
+
+// exitingRunner starts processes that exit right away, like hostapd with an unsupported driver
+type exitingRunner struct {
+	*command.FakeRunner
+}
+
+func (r *exitingRunner) StartWithStderr(stderr io.Writer, cmd string, args ...string) (command.Process, error) {
+	proc, err := r.FakeRunner.StartWithStderr(stderr, cmd, args...)
+	if err == nil {
+		proc.(*command.FakeProcess).Exit(errors.New("nl80211: Could not configure driver mode"))
+	}
+	return proc, err
+}
+
+func TestHostapdService_StartFailsWhenInterfaceSetupFails(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddError("sudo", []string{"ip", "link", "set", "wlan0", "up"}, command.Result{}, errors.New("exit status 2"))
+	h := newTestHostapdService(runner)
+
+	err := h.Start(context.Background(), testAPConfig())
+	require.Error(t, err)
+	assert.False(t, h.IsRunning())
+}
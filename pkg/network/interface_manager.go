@@ -4,27 +4,39 @@ import (
 	"log/slog"
 	"net"
 	"os/exec"
+	"path"
 	"strconv"
 	"strings"
 
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/godbus/dbus/v5"
 	"github.com/pkg/errors"
 )
 
 type WirelessInterface struct {
-	Name       string `json:"name"`
-	SupportAP  bool   `json:"support_ap"`
-	InUse      bool   `json:"in_use"`
-	MACAddress string `json:"mac_address"`
+	Name         string           `json:"name"`
+	SupportAP    bool             `json:"support_ap"`
+	InUse        bool             `json:"in_use"`
+	MACAddress   string           `json:"mac_address"`
+	Phy          string           `json:"phy,omitempty"`
+	Driver       string           `json:"driver,omitempty"`
+	Uplink       bool             `json:"uplink"`                 // Carries the default route
+	Capabilities *PhyCapabilities `json:"capabilities,omitempty"` // nil when iw is unavailable
 }
 
 type WirelessNetwork struct {
-	SSID        string `json:"ssid"`
-	DisplayName string `json:"display_name"` // Human-readable name (same as SSID for now)
-	BSSID       string `json:"bssid"`
-	Signal      int    `json:"signal"`
-	Security    string `json:"security"`
-	Frequency   string `json:"frequency"`
-	Channel     string `json:"channel"`
+	SSID         string          `json:"ssid"`
+	DisplayName  string          `json:"display_name"` // Human-readable name (same as SSID for now)
+	BSSID        string          `json:"bssid"`
+	Signal       int             `json:"signal"`        // Signal quality in percent
+	SignalDBm    int             `json:"signal_dbm"`    // Estimated from Signal when the backend only reports a percentage
+	Security     string          `json:"security"`      // Security as nmcli describes it, e.g. "WPA1 WPA2"
+	SecurityType NetworkSecurity `json:"security_type"` // Strongest security the network offers
+	Enterprise   bool            `json:"enterprise"`    // Requires 802.1X credentials
+	Frequency    string          `json:"frequency"`
+	Channel      string          `json:"channel"`
+	Band         string          `json:"band,omitempty"`     // Band24GHz, Band5GHz or Band6GHz
+	MaxRate      int             `json:"max_rate,omitempty"` // Maximum bit rate in Mbit/s
 }
 
 var ErrAllAccessPointsInUse = errors.New("all wireless access points are currently in use")
@@ -35,18 +47,112 @@ var ErrConnectionFailed = errors.New("failed to connect to network")
 type InterfaceManager interface {
 	ListWirelessInterfaces() ([]WirelessInterface, error)
 	GetBestAPInterface() (*WirelessInterface, error)
+	RankAPInterfaces() ([]InterfaceScore, error)
 	ListAvailableNetworks(interfaceName string) ([]WirelessNetwork, error)
 	ConnectToNetwork(interfaceName, ssid, password string) error
+	ConnectWithCredentials(interfaceName, ssid string, creds Credentials) error
+	ListProfiles() ([]Profile, error)
+	UpdateProfile(id string, update ProfileUpdate) error
+	ForgetProfile(id string) error
+	UpdateProfileCredentials(id string, creds Credentials) error
+	SaveProfile(interfaceName, ssid string, creds Credentials, priority int) error
+	// JoinStage reports how far interfaceName has got joining a network, "" when it is not joining one
+	JoinStage(interfaceName string) (ConnectionStage, error)
+}
+
+// InterfaceManagerOption configures an InterfaceManager
+type InterfaceManagerOption func(*interfaceManagerOptions)
+
+type interfaceManagerOptions struct {
+	runner  command.Runner
+	logger  *slog.Logger
+	certDir string
+	policy  SelectionPolicy
+	bus     *dbus.Conn
+	ctrlDir string
+	iwdDir  string
+}
+
+// WithInterfaceCommandRunner sets the runner used for every system command the manager executes
+func WithInterfaceCommandRunner(runner command.Runner) InterfaceManagerOption {
+	return func(o *interfaceManagerOptions) {
+		o.runner = runner
+	}
+}
+
+// WithInterfaceLogger sets the logger used by the manager
+func WithInterfaceLogger(logger *slog.Logger) InterfaceManagerOption {
+	return func(o *interfaceManagerOptions) {
+		o.logger = logger
+	}
+}
+
+// WithInterfaceCertDir sets where certificates of 802.1X connection profiles are stored
+func WithInterfaceCertDir(dir string) InterfaceManagerOption {
+	return func(o *interfaceManagerOptions) {
+		o.certDir = dir
+	}
+}
+
+// WithInterfaceSelectionPolicy sets how GetBestAPInterface picks the access point interface,
+// defaults to DefaultSelectionPolicy
+func WithInterfaceSelectionPolicy(policy SelectionPolicy) InterfaceManagerOption {
+	return func(o *interfaceManagerOptions) {
+		o.policy = policy
+	}
+}
+
+// WithInterfaceDBusConn sets the bus connection used by the D-Bus backends, defaults to the system bus
+func WithInterfaceDBusConn(conn *dbus.Conn) InterfaceManagerOption {
+	return func(o *interfaceManagerOptions) {
+		o.bus = conn
+	}
+}
+
+// WithInterfaceWPACtrlDir sets the wpa_supplicant control socket directory, defaults to DefaultWPACtrlDir
+func WithInterfaceWPACtrlDir(dir string) InterfaceManagerOption {
+	return func(o *interfaceManagerOptions) {
+		o.ctrlDir = dir
+	}
+}
+
+// WithInterfaceIWDStateDir sets where iwd keeps its network profiles, defaults to DefaultIWDStateDir
+func WithInterfaceIWDStateDir(dir string) InterfaceManagerOption {
+	return func(o *interfaceManagerOptions) {
+		o.iwdDir = dir
+	}
+}
+
+func newInterfaceManagerOptions(opts []InterfaceManagerOption) interfaceManagerOptions {
+	o := interfaceManagerOptions{
+		runner:  command.NewExecRunner(),
+		logger:  slog.Default().With("component", "interface_manager"),
+		certDir: DefaultCertDir,
+		policy:  DefaultSelectionPolicy(),
+		ctrlDir: DefaultWPACtrlDir,
+		iwdDir:  DefaultIWDStateDir,
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
 }
 
 type interfaceManager struct {
-	logger *slog.Logger
+	runner  command.Runner
+	logger  *slog.Logger
+	certDir string
+	policy  SelectionPolicy
 }
 
 // NewInterfaceManager creates a new instance of InterfaceManager
-func NewInterfaceManager() InterfaceManager {
+func NewInterfaceManager(opts ...InterfaceManagerOption) InterfaceManager {
+	o := newInterfaceManagerOptions(opts)
 	return &interfaceManager{
-		logger: slog.Default().With("component", "interface_manager"),
+		runner:  o.runner,
+		logger:  o.logger,
+		certDir: o.certDir,
+		policy:  o.policy,
 	}
 }
 
@@ -56,104 +162,143 @@ func (im *interfaceManager) ListWirelessInterfaces() ([]WirelessInterface, error
 		return nil, errors.Wrap(err, "failed to list network interfaces")
 	}
 	var wirelessInterfaces []WirelessInterface
+	probe := newPhyProbe(im.runner, im.logger, im.supportsAPMode)
+	uplink := im.uplinkInterface()
 	for _, i := range interfaces {
 		if im.isWireless(i.Name) {
-			wirelessInterfaces = append(wirelessInterfaces, WirelessInterface{
+			wirelessInterfaces = append(wirelessInterfaces, probe.describe(WirelessInterface{
 				Name:       i.Name,
 				MACAddress: i.HardwareAddr.String(),
 				InUse:      i.Flags&net.FlagUp != 0,
-				SupportAP:  im.supportsAPMode(i.Name),
-			})
+				Uplink:     i.Name == uplink,
+				Driver:     im.driver(i.Name),
+			}))
 		}
 	}
 	return wirelessInterfaces, nil
 }
 
+// GetBestAPInterface returns the interface ranked highest by the selection policy. When the
+// best interface is in use it is returned together with ErrAllAccessPointsInUse.
 func (im *interfaceManager) GetBestAPInterface() (*WirelessInterface, error) {
+	scores, err := im.RankAPInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	return bestAPInterface(scores, im.logger)
+}
+
+// RankAPInterfaces scores every wireless interface with the selection policy, best first
+func (im *interfaceManager) RankAPInterfaces() ([]InterfaceScore, error) {
 	interfaces, err := im.ListWirelessInterfaces()
 	if err != nil {
 		return nil, err
 	}
-	// Check after unused interfaces that support AP mode
-	for _, i := range interfaces {
-		if i.SupportAP && !i.InUse {
-			return &i, nil
-		}
+	return im.policy.Rank(interfaces), nil
+}
+
+// bestAPInterface picks the first interface of a ranking that is not excluded
+func bestAPInterface(scores []InterfaceScore, logger *slog.Logger) (*WirelessInterface, error) {
+	for _, score := range scores {
+		logger.Debug("scored interface", slog.String("interface", score.Interface.Name),
+			slog.Int("score", score.Score), slog.Bool("excluded", score.Excluded), slog.Any("reasons", score.Reasons))
 	}
-	// return any interface that supports AP modem but return an error
-	for _, i := range interfaces {
-		if i.SupportAP {
-			return &i, ErrAllAccessPointsInUse
-		}
+	if len(scores) == 0 || scores[0].Excluded {
+		return nil, ErrNoAccessPointFound
+	}
+	best := scores[0]
+	logger.Info("selected AP interface", slog.String("interface", best.Interface.Name),
+		slog.Int("score", best.Score), slog.String("reasons", strings.Join(best.Reasons, ", ")))
+	if best.Interface.InUse {
+		return &best.Interface, ErrAllAccessPointsInUse
 	}
-	return nil, ErrNoAccessPointFound
+	return &best.Interface, nil
 }
 
 func (im *interfaceManager) ListAvailableNetworks(interfaceName string) ([]WirelessNetwork, error) {
 	im.logger.Info("scanning for networks", slog.String("interface", interfaceName))
-	
-	// Check if nmcli is available
-	if _, err := exec.LookPath("nmcli"); err != nil {
-		return nil, errors.New("nmcli (NetworkManager) is not installed or not available in PATH")
-	}
-	
+
 	// First try to rescan/refresh
-	rescanCmd := exec.Command("nmcli", "device", "wifi", "rescan")
+	rescanArgs := []string{"device", "wifi", "rescan"}
 	if interfaceName != "" {
-		rescanCmd.Args = append(rescanCmd.Args, "ifname", interfaceName)
+		rescanArgs = append(rescanArgs, "ifname", interfaceName)
 	}
-	if err := rescanCmd.Run(); err != nil {
+	if _, err := im.runner.Run("nmcli", rescanArgs...); err != nil {
+		if errors.Is(err, exec.ErrNotFound) {
+			return nil, errors.New("nmcli (NetworkManager) is not installed or not available in PATH")
+		}
 		im.logger.Warn("failed to rescan networks", slog.String("error", err.Error()))
 	}
-	
+
 	// Use nmcli to list available networks
-	cmd := exec.Command("nmcli", "-t", "-f", "SSID,BSSID,MODE,CHAN,FREQ,RATE,SIGNAL,BARS,SECURITY", "device", "wifi", "list")
+	listArgs := []string{"-t", "-f", "SSID,BSSID,MODE,CHAN,FREQ,RATE,SIGNAL,BARS,SECURITY", "device", "wifi", "list"}
+	args := listArgs
 	if interfaceName != "" {
-		cmd.Args = append(cmd.Args, "ifname", interfaceName)
+		args = append(append([]string(nil), listArgs...), "ifname", interfaceName)
 	}
-	
-	output, err := cmd.Output()
+
+	res, err := im.runner.Run("nmcli", args...)
 	if err != nil {
 		// If interface-specific command fails, try without interface specification
 		if interfaceName != "" {
-			im.logger.Warn("failed to scan with specific interface, trying all interfaces", 
+			im.logger.Warn("failed to scan with specific interface, trying all interfaces",
 				slog.String("interface", interfaceName),
 				slog.String("error", err.Error()))
-			cmd = exec.Command("nmcli", "-t", "-f", "SSID,BSSID,MODE,CHAN,FREQ,RATE,SIGNAL,BARS,SECURITY", "device", "wifi", "list")
-			output, err = cmd.Output()
+			res, err = im.runner.Run("nmcli", listArgs...)
 		}
 		if err != nil {
 			return nil, errors.Wrapf(err, "failed to scan for networks (interface: %s)", interfaceName)
 		}
 	}
-	
-	im.logger.Debug("nmcli output", slog.String("output", string(output)))
-	return im.parseNetworkList(string(output))
+
+	im.logger.Debug("nmcli output", slog.String("output", string(res.Stdout)))
+	return im.parseNetworkList(string(res.Stdout))
 }
 
 func (im *interfaceManager) ConnectToNetwork(interfaceName, ssid, password string) error {
+	return im.ConnectWithCredentials(interfaceName, ssid, Credentials{Password: password})
+}
+
+func (im *interfaceManager) ConnectWithCredentials(interfaceName, ssid string, creds Credentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+
 	im.logger.Info("attempting to connect to network", 
 		slog.String("interface", interfaceName), 
-		slog.String("ssid", ssid))
+		slog.String("ssid", ssid),
+		slog.Bool("enterprise", creds.IsEnterprise()),
+		slog.Bool("hidden", creds.Hidden))
 
 	// First, check if there's already a connection to this SSID
 	if err := im.disconnectExistingConnection(ssid); err != nil {
 		im.logger.Warn("failed to disconnect existing connection", slog.String("error", err.Error()))
 	}
 
+	if creds.IsEnterprise() || creds.Hidden {
+		if err := im.connectProfile(interfaceName, ssid, creds); err != nil {
+			return err
+		}
+		im.logger.Info("successfully connected to network", 
+			slog.String("interface", interfaceName), 
+			slog.String("ssid", ssid))
+		return nil
+	}
+
 	// Connect to the network using nmcli
-	var cmd *exec.Cmd
+	password := creds.Password
+	var args []string
 	if password == "" {
 		// Open network (no password)
-		cmd = exec.Command("nmcli", "device", "wifi", "connect", ssid, "ifname", interfaceName)
+		args = []string{"device", "wifi", "connect", ssid, "ifname", interfaceName}
 	} else {
 		// Secured network (with password)
-		cmd = exec.Command("nmcli", "device", "wifi", "connect", ssid, "password", password, "ifname", interfaceName)
+		args = []string{"device", "wifi", "connect", ssid, "password", password, "ifname", interfaceName}
 	}
 
-	output, err := cmd.CombinedOutput()
+	res, err := im.runner.Run("nmcli", args...)
 	if err != nil {
-		return errors.Wrapf(err, "failed to connect to network %s on interface %s: %s", ssid, interfaceName, string(output))
+		return errors.Wrapf(err, "failed to connect to network %s on interface %s: %s", ssid, interfaceName, res.Combined())
 	}
 
 	im.logger.Info("successfully connected to network", 
@@ -163,15 +308,173 @@ func (im *interfaceManager) ConnectToNetwork(interfaceName, ssid, password strin
 	return nil
 }
 
+// JoinStage maps the NetworkManager device state, e.g. "60 (connecting (need authentication))"
+func (im *interfaceManager) JoinStage(interfaceName string) (ConnectionStage, error) {
+	res, err := im.runner.Run("nmcli", "-g", "GENERAL.STATE", "device", "show", interfaceName)
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read state of device %s: %s", interfaceName, res.Combined())
+	}
+	fields := strings.Fields(string(res.Stdout))
+	if len(fields) == 0 {
+		return "", nil
+	}
+	code, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return "", errors.Errorf("unexpected state of device %s: %s", interfaceName, res.Stdout)
+	}
+	return nmDeviceStateStage(code), nil
+}
+
+// nmDeviceStateStage maps a NetworkManager device state code to the stage of a connection attempt
+func nmDeviceStateStage(code int) ConnectionStage {
+	switch {
+	case code == 40 || code == 50: // prepare, config
+		return StageAssociate
+	case code == 60: // need-auth
+		return StageAuthenticate
+	case code >= 70 && code <= 90: // ip-config, ip-check, secondaries
+		return StageDHCP
+	}
+	return ""
+}
+
+// connectProfile creates a connection profile and activates it. It is used for networks
+// "nmcli device wifi connect" cannot join reliably: 802.1X networks, since it cannot carry
+// EAP settings, and hidden networks, whose security cannot be learnt from a scan.
+func (im *interfaceManager) connectProfile(interfaceName, ssid string, creds Credentials) error {
+	// Earlier profiles of the network are only replaced once the new one is up, a wrong
+	// password must not cost a profile that worked
+	previous := im.profileUUIDs(ssid)
+	name := newProfileName(ssid, previous)
+	args, err := im.profileArgs(interfaceName, name, ssid, creds)
+	if err != nil {
+		return err
+	}
+	if err := im.activateProfile(interfaceName, name, ssid, args); err != nil {
+		return err
+	}
+	im.replaceProfiles(name, ssid, previous)
+	return nil
+}
+
+// profileUUIDs returns the UUIDs of the profiles named name, none when there are none
+func (im *interfaceManager) profileUUIDs(name string) []string {
+	res, err := im.runner.Run("nmcli", "-g", "connection.uuid", "connection", "show", "id", name)
+	if err != nil {
+		return nil
+	}
+	return strings.Fields(string(res.Stdout))
+}
+
+// newProfileName returns the name a new profile for ssid is added under, one that does not
+// clash with the profiles it replaces
+func newProfileName(ssid string, previous []string) string {
+	if len(previous) == 0 {
+		return ssid
+	}
+	return ssid + " (new)"
+}
+
+// replaceProfiles removes the previous profiles of ssid and gives the new profile their name
+func (im *interfaceManager) replaceProfiles(name, ssid string, previous []string) {
+	for _, id := range previous {
+		if _, err := im.runner.Run("nmcli", "connection", "delete", "uuid", id); err != nil {
+			im.logger.Warn("failed to remove previous connection profile",
+				slog.String("id", id), slog.String("error", err.Error()))
+			continue
+		}
+		im.logger.Debug("removed previous connection profile", slog.String("id", id), slog.String("ssid", ssid))
+	}
+	if name == ssid {
+		return
+	}
+	if _, err := im.runner.Run("nmcli", "connection", "modify", "id", name, "connection.id", ssid); err != nil {
+		im.logger.Warn("failed to rename connection profile",
+			slog.String("name", name), slog.String("error", err.Error()))
+	}
+}
+
+// profileArgs returns the nmcli args adding a station profile for ssid named name
+func (im *interfaceManager) profileArgs(interfaceName, name, ssid string, creds Credentials) ([]string, error) {
+	args := []string{"connection", "add", "type", "wifi", "con-name", name}
+	if interfaceName != "" {
+		args = append(args, "ifname", interfaceName)
+	}
+	args = append(args, "ssid", ssid)
+	if creds.Hidden {
+		args = append(args, "802-11-wireless.hidden", "yes")
+	}
+
+	switch keyMgmt := creds.keyMgmt(); keyMgmt {
+	case "wpa-psk", "sae":
+		args = append(args, "wifi-sec.key-mgmt", keyMgmt, "wifi-sec.psk", creds.Password)
+	case "wpa-eap":
+		eapArgs, err := im.eapArgs(ssid, creds)
+		if err != nil {
+			return nil, err
+		}
+		args = append(args, eapArgs...)
+	}
+	return args, nil
+}
+
+// eapArgs returns the 802-1x settings of a profile, storing its certificates in the cert dir
+func (im *interfaceManager) eapArgs(ssid string, creds Credentials) ([]string, error) {
+	certs, err := writeCertFiles(im.certDir, ssid, creds)
+	if err != nil {
+		return nil, err
+	}
+
+	args := []string{
+		"wifi-sec.key-mgmt", "wpa-eap",
+		"802-1x.eap", strings.ToLower(creds.EAPMethod),
+		"802-1x.identity", creds.Identity,
+	}
+	if creds.AnonymousIdentity != "" {
+		args = append(args, "802-1x.anonymous-identity", creds.AnonymousIdentity)
+	}
+	if creds.Phase2 != "" {
+		args = append(args, "802-1x.phase2-auth", strings.ToLower(creds.Phase2))
+	}
+	if creds.Password != "" {
+		args = append(args, "802-1x.password", creds.Password)
+	}
+	for _, property := range []string{"802-1x.ca-cert", "802-1x.client-cert", "802-1x.private-key"} {
+		if path, ok := certs[property]; ok {
+			args = append(args, property, path)
+		}
+	}
+	if _, ok := certs["802-1x.private-key"]; ok {
+		args = append(args, "802-1x.private-key-password", creds.PrivateKeyPassword)
+	}
+	return args, nil
+}
+
+// activateProfile adds the connection profile described by the nmcli args and brings it up,
+// a profile that does not come up is removed again
+func (im *interfaceManager) activateProfile(interfaceName, name, ssid string, args []string) error {
+	if res, err := im.runner.Run("nmcli", args...); err != nil {
+		return errors.Wrapf(err, "failed to create connection profile for %s: %s", ssid, res.Combined())
+	}
+	res, err := im.runner.Run("nmcli", "connection", "up", "id", name)
+	if err == nil {
+		return nil
+	}
+	if _, err := im.runner.Run("nmcli", "connection", "delete", "id", name); err != nil {
+		im.logger.Warn("failed to remove connection profile",
+			slog.String("name", name), slog.String("error", err.Error()))
+	}
+	return errors.Wrapf(err, "failed to connect to network %s on interface %s: %s", ssid, interfaceName, res.Combined())
+}
+
 func (im *interfaceManager) disconnectExistingConnection(ssid string) error {
 	// Get list of active connections
-	cmd := exec.Command("nmcli", "connection", "show", "--active")
-	output, err := cmd.Output()
+	res, err := im.runner.Run("nmcli", "connection", "show", "--active")
 	if err != nil {
 		return errors.Wrap(err, "failed to list active connections")
 	}
 
-	lines := strings.Split(string(output), "\n")
+	lines := strings.Split(string(res.Stdout), "\n")
 	for _, line := range lines {
 		if strings.Contains(line, ssid) {
 			// Extract connection name (first field)
@@ -179,8 +482,7 @@ func (im *interfaceManager) disconnectExistingConnection(ssid string) error {
 			if len(fields) > 0 {
 				connectionName := fields[0]
 				// Disconnect the existing connection
-				disconnectCmd := exec.Command("nmcli", "connection", "down", connectionName)
-				if err := disconnectCmd.Run(); err != nil {
+				if _, err := im.runner.Run("nmcli", "connection", "down", connectionName); err != nil {
 					return errors.Wrapf(err, "failed to disconnect existing connection %s", connectionName)
 				}
 				im.logger.Debug("disconnected existing connection", slog.String("connection", connectionName))
@@ -191,112 +493,121 @@ func (im *interfaceManager) disconnectExistingConnection(ssid string) error {
 	return nil
 }
 
+// parseNetworkList parses `nmcli -t -f SSID,BSSID,MODE,CHAN,FREQ,RATE,SIGNAL,BARS,SECURITY device wifi list`
 func (im *interfaceManager) parseNetworkList(output string) ([]WirelessNetwork, error) {
 	var networks []WirelessNetwork
-	lines := strings.Split(output, "\n")
-	
-	// Parse nmcli tabular output format (-t flag)
-	// Format: SSID:BSSID:MODE:CHAN:FREQ:RATE:SIGNAL:BARS:SECURITY
-	for _, line := range lines {
-		line = strings.TrimSpace(line)
-		if line == "" {
+	for _, line := range strings.Split(output, "\n") {
+		if strings.TrimSpace(line) == "" {
 			continue
 		}
-		
-		// Split by colon (tabular format)
-		fields := strings.Split(line, ":")
+		fields := splitTerse(line)
 		if len(fields) < 9 {
-			// Try space-separated format as fallback
-			fields = strings.Fields(line)
-			if len(fields) < 7 {
-				continue
-			}
+			im.logger.Debug("skipping malformed network line", slog.String("line", line))
+			continue
 		}
-		
+
 		// Skip hidden networks (empty SSID)
 		ssid := fields[0]
 		if ssid == "" || ssid == "--" {
 			continue
 		}
-		
-		// Extract network information
-		network := WirelessNetwork{
-			SSID:        ssid,
-			DisplayName: ssid, // Use SSID as display name
-			BSSID:       fields[1],
+
+		security := strings.TrimSpace(fields[8])
+		if security == "" || security == "--" {
+			security = "none"
 		}
-		
-		// Parse channel (field 3)
-		if len(fields) > 3 {
-			network.Channel = fields[3]
+		network := WirelessNetwork{
+			SSID:         ssid,
+			DisplayName:  ssid,
+			BSSID:        fields[1],
+			Channel:      fields[3],
+			Frequency:    fields[4],
+			Security:     security,
+			SecurityType: normalizeSecurity(security),
+			Enterprise:   IsEnterpriseSecurity(security),
 		}
-		
-		// Parse frequency (field 4)
-		if len(fields) > 4 {
-			network.Frequency = fields[4]
+		if frequency, ok := parseLeadingInt(fields[4]); ok {
+			network.Band = bandName(frequency)
 		}
-		
-		// Parse signal strength (field 6)
-		if len(fields) > 6 {
-			signalStr := fields[6]
-			// Remove dBm suffix and convert
-			signalStr = strings.TrimSpace(strings.TrimSuffix(signalStr, "dBm"))
-			if signal, err := strconv.Atoi(signalStr); err == nil {
-				// Convert dBm to percentage (rough approximation)
-				// -30dBm = 100%, -67dBm = 50%, -90dBm = 0%
-				if signal >= -30 {
-					network.Signal = 100
-				} else if signal <= -90 {
-					network.Signal = 0
-				} else {
-					network.Signal = int(((float64(signal) + 90) / 60) * 100)
-				}
-			}
+		if rate, ok := parseLeadingInt(fields[5]); ok {
+			network.MaxRate = rate
 		}
-		
-		// Parse security (field 8)
-		if len(fields) > 8 {
-			security := fields[8]
-			if security == "" || security == "--" {
-				network.Security = "none"
-			} else {
-				network.Security = security
-			}
-		} else {
-			network.Security = "unknown"
+		// SIGNAL is already a percentage
+		if signal, ok := parseLeadingInt(fields[6]); ok {
+			network.Signal = signal
+			network.SignalDBm = percentToDBm(signal)
 		}
-		
+
 		networks = append(networks, network)
 	}
-	
+
 	im.logger.Debug("parsed networks", slog.Int("count", len(networks)))
 	return networks, nil
 }
 
-func (im *interfaceManager) isWireless(i string) bool {
-	cmd := exec.Command("test", "-d", "/sys/class/net/"+i+"/wireless")
-	err := cmd.Run()
-	return err == nil
+// dBmToPercent converts a signal level to a rough percentage: -30dBm = 100%, -90dBm = 0%
+func dBmToPercent(signal int) int {
+	if signal >= -30 {
+		return 100
+	}
+	if signal <= -90 {
+		return 0
+	}
+	return int(((float64(signal) + 90) / 60) * 100)
 }
 
-func (im *interfaceManager) supportsAPMode(i string) bool {
-	// Check if interface supports AP mode using nmcli
-	cmd := exec.Command("nmcli", "device", "wifi", "list", "ifname", i)
-	if err := cmd.Run(); err != nil {
-		im.logger.Debug("interface does not support wifi", slog.String("interface", i))
-		return false
+// uplinkInterface returns the interface of the default route, if any
+func (im *interfaceManager) uplinkInterface() string {
+	return DefaultRouteInterface(im.runner)
+}
+
+// driver returns the kernel driver bound to the interface, e.g. "brcmfmac"
+func (im *interfaceManager) driver(i string) string {
+	return interfaceDriver(im.runner, i)
+}
+
+// DefaultRouteInterface returns the interface of the IPv4 default route, wired or wireless, if any
+func DefaultRouteInterface(runner command.Runner) string {
+	result, err := runner.Run("ip", "-4", "route", "show", "default")
+	if err != nil {
+		return ""
 	}
+	for _, line := range strings.Split(string(result.Stdout), "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "dev" {
+				return fields[i+1]
+			}
+		}
+	}
+	return ""
+}
 
-	// If nmcli can list wifi for this interface, it likely supports AP mode
-	// NetworkManager generally supports AP mode on most modern wifi interfaces
-	return true
+// interfaceDriver returns the kernel driver bound to an interface from sysfs
+func interfaceDriver(runner command.Runner, i string) string {
+	result, err := runner.Run("readlink", "/sys/class/net/"+i+"/device/driver")
+	if err != nil {
+		return ""
+	}
+	link := strings.TrimSpace(string(result.Stdout))
+	if link == "" {
+		return ""
+	}
+	return path.Base(link)
 }
 
-func containsAPMode(iwOutput string) bool {
-	// Simplified check for AP mode support
-	return contains(iwOutput, "AP")
+func (im *interfaceManager) isWireless(i string) bool {
+	_, err := im.runner.Run("test", "-d", "/sys/class/net/"+i+"/wireless")
+	return err == nil
 }
 
-func contains(s, substr string) bool {
-	return len(s) >= len(substr) && (s == substr || len(s) > len(substr) && (s[0:len(substr)] == substr || contains(s[1:], substr)))
+// supportsAPMode asks NetworkManager whether the device can host an access point, used when
+// iw is not installed
+func (im *interfaceManager) supportsAPMode(i string) bool {
+	result, err := im.runner.Run("nmcli", "-g", "WIFI-PROPERTIES.AP", "device", "show", i)
+	if err != nil {
+		im.logger.Debug("could not query AP support", slog.String("interface", i), slog.String("error", err.Error()))
+		return false
+	}
+	return strings.TrimSpace(string(result.Stdout)) == "yes"
 }
@@ -1,10 +1,11 @@
 package network
 
 import (
+	"context"
 	"log/slog"
-	"os/exec"
 	"strings"
 
+	"github.com/AnteWall/go-wifiportal/pkg/command"
 	"github.com/pkg/errors"
 )
 
@@ -17,10 +18,15 @@ func NewIPTablesRule(args ...string) IPTablesRule {
 }
 
 func (r IPTablesRule) Apply() error {
+	return r.ApplyWith(context.Background(), command.NewExecRunner())
+}
+
+// ApplyWith applies the rule using the given runner
+func (r IPTablesRule) ApplyWith(ctx context.Context, runner command.Runner) error {
 	args := append([]string{"iptables-legacy"}, r.args...)
-	if i, err := exec.Command("sudo", args...).CombinedOutput(); err != nil {
-		slog.Error(strings.Join(args, " "), slog.String("output", string(i)), slog.String("error", err.Error()))
-		return errors.Wrap(err, string(i))
+	if res, err := runner.RunWithContext(ctx, "sudo", args...); err != nil {
+		slog.Error(strings.Join(args, " "), slog.String("output", res.Combined()), slog.String("error", err.Error()))
+		return errors.Wrap(err, res.Combined())
 	}
 	return nil
 }
@@ -63,3 +69,59 @@ func CleanupIPTablesRules(iFace, portalPort string) []IPTablesRule {
 			"-i", iFace, "-p", "tcp", "--dport", "53", "-j", "ACCEPT"),
 	}
 }
+
+// applyCaptiveRules opens the portal, DHCP and DNS ports on iFace and redirects HTTP to the portal.
+// Failures are logged rather than returned since ufw or iptables may legitimately be absent.
+func applyCaptiveRules(ctx context.Context, runner command.Runner, logger *slog.Logger, iFace, portalPort string) {
+	for _, rule := range GetRequiredFirewallRules(iFace, portalPort) {
+		if err := rule.ApplyWith(ctx, runner, iFace); err != nil {
+			logger.Warn("failed to apply firewall rule", slog.String("error", err.Error()))
+		}
+	}
+
+	for _, rule := range CreateIPTablesRules(iFace, portalPort) {
+		if err := rule.ApplyWith(ctx, runner); err != nil {
+			logger.Warn("failed to apply iptables rule", slog.String("error", err.Error()))
+		}
+	}
+}
+
+// removeCaptiveRules deletes the iptables rules added by applyCaptiveRules
+func removeCaptiveRules(ctx context.Context, runner command.Runner, iFace, portalPort string) {
+	for _, rule := range CleanupIPTablesRules(iFace, portalPort) {
+		rule.ApplyWith(ctx, runner)
+	}
+}
+
+// clientMatch matches a client by MAC address when known and by source address otherwise
+func clientMatch(mac, ip string) []string {
+	if mac != "" {
+		return []string{"-m", "mac", "--mac-source", mac}
+	}
+	return []string{"-s", ip}
+}
+
+// CreateClientExceptionRules lets an authorized client bypass the portal redirect and reach the uplink
+func CreateClientExceptionRules(iFace, mac, ip string) []IPTablesRule {
+	match := clientMatch(mac, ip)
+	return []IPTablesRule{
+		// Skip the REDIRECT rule for this client; -I puts it ahead of the redirect
+		NewIPTablesRule(append(append([]string{"-t", "nat", "-I", "PREROUTING", "-i", iFace}, match...),
+			"-j", "RETURN")...),
+
+		// Allow the client's traffic to be forwarded
+		NewIPTablesRule(append(append([]string{"-I", "FORWARD", "-i", iFace}, match...),
+			"-j", "ACCEPT")...),
+	}
+}
+
+func CleanupClientExceptionRules(iFace, mac, ip string) []IPTablesRule {
+	match := clientMatch(mac, ip)
+	return []IPTablesRule{
+		NewIPTablesRule(append(append([]string{"-t", "nat", "-D", "PREROUTING", "-i", iFace}, match...),
+			"-j", "RETURN")...),
+
+		NewIPTablesRule(append(append([]string{"-D", "FORWARD", "-i", iFace}, match...),
+			"-j", "ACCEPT")...),
+	}
+}
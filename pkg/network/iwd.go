@@ -0,0 +1,788 @@
+package network
+
+import (
+	"context"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+// iwd D-Bus names, see https://git.kernel.org/pub/scm/network/wireless/iwd.git/tree/doc
+const (
+	iwdBusName                = "net.connman.iwd"
+	iwdManagerPath            = dbus.ObjectPath("/net/connman/iwd")
+	iwdAgentPath              = dbus.ObjectPath("/wifiportal/iwd/agent")
+	iwdAdapterInterface       = "net.connman.iwd.Adapter"
+	iwdDeviceInterface        = "net.connman.iwd.Device"
+	iwdStationInterface       = "net.connman.iwd.Station"
+	iwdNetworkInterface       = "net.connman.iwd.Network"
+	iwdKnownNetworkInterface  = "net.connman.iwd.KnownNetwork"
+	iwdBSSInterface           = "net.connman.iwd.BasicServiceSet"
+	iwdAccessPointInterface   = "net.connman.iwd.AccessPoint"
+	iwdAgentManagerInterface  = "net.connman.iwd.AgentManager"
+	iwdAgentInterface         = "net.connman.iwd.Agent"
+	iwdObjectManagerInterface = "org.freedesktop.DBus.ObjectManager"
+	iwdErrorCanceled          = "net.connman.iwd.Agent.Error.Canceled"
+)
+
+// DefaultIWDStateDir is where iwd keeps its network profiles
+const DefaultIWDStateDir = "/var/lib/iwd"
+
+const (
+	defaultIWDScanTimeout    = 15 * time.Second
+	defaultIWDConnectTimeout = 60 * time.Second
+	iwdScanPollInterval      = 250 * time.Millisecond
+)
+
+// iwdErrorReasons describes the errors iwd methods return
+var iwdErrorReasons = map[string]string{
+	"net.connman.iwd.Aborted":       "connection aborted",
+	"net.connman.iwd.Busy":          "device is busy",
+	"net.connman.iwd.InvalidFormat": "invalid passphrase format",
+	"net.connman.iwd.NotSupported":  "operation not supported",
+	"net.connman.iwd.NotConfigured": "network is not configured",
+	"net.connman.iwd.NotFound":      "network not found",
+	"net.connman.iwd.NoAgent":       "no agent registered to provide secrets",
+	"net.connman.iwd.Timeout":       "connection timed out",
+}
+
+// iwdObjects is the reply of GetManagedObjects: interfaces and their properties by object path
+type iwdObjects map[dbus.ObjectPath]map[string]map[string]dbus.Variant
+
+// iwdClient wraps the iwd D-Bus API used by the interface manager and AP service
+type iwdClient struct {
+	conn        *dbus.Conn
+	logger      *slog.Logger
+	scanTimeout time.Duration
+}
+
+func newIWDClient(conn *dbus.Conn, logger *slog.Logger) (*iwdClient, error) {
+	if conn == nil {
+		var err error
+		if conn, err = dbus.ConnectSystemBus(); err != nil {
+			return nil, errors.Wrap(err, "failed to connect to the system bus")
+		}
+	}
+	return &iwdClient{conn: conn, logger: logger, scanTimeout: defaultIWDScanTimeout}, nil
+}
+
+func (c *iwdClient) object(path dbus.ObjectPath) dbus.BusObject {
+	return c.conn.Object(iwdBusName, path)
+}
+
+// objects returns every object iwd exports
+func (c *iwdClient) objects() (iwdObjects, error) {
+	var objects iwdObjects
+	if err := c.object("/").Call(iwdObjectManagerInterface+".GetManagedObjects", 0).Store(&objects); err != nil {
+		return nil, errors.Wrap(err, "failed to list iwd objects")
+	}
+	return objects, nil
+}
+
+// devices returns the paths of all wireless devices in a stable order
+func (o iwdObjects) devices() []dbus.ObjectPath {
+	var devices []dbus.ObjectPath
+	for path, ifaces := range o {
+		if _, ok := ifaces[iwdDeviceInterface]; ok {
+			devices = append(devices, path)
+		}
+	}
+	sort.Slice(devices, func(i, j int) bool { return devices[i] < devices[j] })
+	return devices
+}
+
+// iwdProperty returns a property of an object, or the zero value when it is missing
+func iwdProperty[T any](o iwdObjects, path dbus.ObjectPath, iface, name string) T {
+	value, _ := o[path][iface][name].Value().(T)
+	return value
+}
+
+// device returns the device named interfaceName, or the first one when it is empty
+func (c *iwdClient) device(interfaceName string) (dbus.ObjectPath, error) {
+	objects, err := c.objects()
+	if err != nil {
+		return "", err
+	}
+	devices := objects.devices()
+	if len(devices) == 0 {
+		return "", ErrNoAccessPointFound
+	}
+	if interfaceName == "" {
+		return devices[0], nil
+	}
+	for _, device := range devices {
+		if iwdProperty[string](objects, device, iwdDeviceInterface, "Name") == interfaceName {
+			return device, nil
+		}
+	}
+	return "", errors.Errorf("unknown device %s", interfaceName)
+}
+
+// requestScan asks iwd to scan and waits until it is done
+func (c *iwdClient) requestScan(device dbus.ObjectPath) error {
+	obj := c.object(device)
+	if err := obj.Call(iwdStationInterface+".Scan", 0).Err; err != nil {
+		// A scan already in progress is just as good
+		var dbusErr dbus.Error
+		if !errors.As(err, &dbusErr) || (dbusErr.Name != "net.connman.iwd.Busy" && dbusErr.Name != "net.connman.iwd.InProgress") {
+			return errors.Wrap(err, "failed to request scan")
+		}
+	}
+	deadline := time.Now().Add(c.scanTimeout)
+	for time.Now().Before(deadline) {
+		scanning, err := nmProperty[bool](obj, iwdStationInterface+".Scanning")
+		if err != nil {
+			return err
+		}
+		if !scanning {
+			return nil
+		}
+		time.Sleep(iwdScanPollInterval)
+	}
+	return errors.New("timed out waiting for scan results")
+}
+
+// networks returns the networks seen by device, strongest first
+func (c *iwdClient) networks(device dbus.ObjectPath) ([]WirelessNetwork, error) {
+	var ordered []struct {
+		Path   dbus.ObjectPath
+		Signal int16
+	}
+	if err := c.object(device).Call(iwdStationInterface+".GetOrderedNetworks", 0).Store(&ordered); err != nil {
+		return nil, errors.Wrap(err, "failed to list networks")
+	}
+	objects, err := c.objects()
+	if err != nil {
+		return nil, err
+	}
+
+	networks := make([]WirelessNetwork, 0, len(ordered))
+	for _, entry := range ordered {
+		ssid := iwdProperty[string](objects, entry.Path, iwdNetworkInterface, "Name")
+		if ssid == "" {
+			continue
+		}
+		security := iwdSecurityString(iwdProperty[string](objects, entry.Path, iwdNetworkInterface, "Type"))
+		network := WirelessNetwork{
+			SSID:         ssid,
+			DisplayName:  ssid,
+			Signal:       dBmToPercent(int(entry.Signal) / 100),
+			SignalDBm:    int(entry.Signal) / 100,
+			Security:     security,
+			SecurityType: normalizeSecurity(security),
+			Enterprise:   IsEnterpriseSecurity(security),
+		}
+		// Older iwd releases do not list the access points of a network
+		if bss := iwdProperty[[]dbus.ObjectPath](objects, entry.Path, iwdNetworkInterface, "ExtendedServiceSet"); len(bss) > 0 {
+			network.BSSID = iwdProperty[string](objects, bss[0], iwdBSSInterface, "Address")
+		}
+		networks = append(networks, network)
+	}
+	return networks, nil
+}
+
+// network returns the network ssid seen by device
+func (c *iwdClient) network(device dbus.ObjectPath, ssid string) (dbus.ObjectPath, bool, error) {
+	objects, err := c.objects()
+	if err != nil {
+		return "", false, err
+	}
+	for path, ifaces := range objects {
+		props, ok := ifaces[iwdNetworkInterface]
+		if !ok {
+			continue
+		}
+		name, _ := props["Name"].Value().(string)
+		owner, _ := props["Device"].Value().(dbus.ObjectPath)
+		if name == ssid && owner == device {
+			return path, true, nil
+		}
+	}
+	return "", false, nil
+}
+
+// forget removes the known network profile of network, so iwd asks for new secrets
+func (c *iwdClient) forget(network dbus.ObjectPath) error {
+	known, err := nmProperty[dbus.ObjectPath](c.object(network), iwdNetworkInterface+".KnownNetwork")
+	if err != nil || known == "" || known == "/" {
+		// The property is absent for networks iwd does not know
+		return nil
+	}
+	if err := c.object(known).Call(iwdKnownNetworkInterface+".Forget", 0).Err; err != nil {
+		return errors.Wrap(err, "failed to forget known network")
+	}
+	return nil
+}
+
+// iwdSecurityString describes an iwd network type the way the nmcli SECURITY column does
+func iwdSecurityString(networkType string) string {
+	switch networkType {
+	case "open":
+		return "none"
+	case "psk":
+		return "WPA2"
+	case "8021x":
+		return "WPA2 802.1X"
+	case "wep":
+		return "WEP"
+	default:
+		return strings.ToUpper(networkType)
+	}
+}
+
+// iwdTypeSecurity maps an iwd network type to its security
+func iwdTypeSecurity(networkType string) NetworkSecurity {
+	switch networkType {
+	case "psk":
+		return NetworkSecurityWPA2PSK
+	case "8021x":
+		return NetworkSecurity8021X
+	case "wep":
+		return NetworkSecurityWEP
+	default:
+		return NetworkSecurityOpen
+	}
+}
+
+// iwdProfileType returns the network type, and so the profile extension, of creds
+func iwdProfileType(creds Credentials) string {
+	switch creds.keyMgmt() {
+	case "wpa-eap":
+		return "8021x"
+	case "wpa-psk", "sae":
+		return "psk"
+	default:
+		return "open"
+	}
+}
+
+// iwdError returns the reason of a failed iwd method call
+func iwdError(err error) string {
+	var dbusErr dbus.Error
+	if errors.As(err, &dbusErr) {
+		if reason, ok := iwdErrorReasons[dbusErr.Name]; ok {
+			return reason
+		}
+	}
+	return err.Error()
+}
+
+// iwdProfileName returns the file name iwd uses for the profile of ssid
+func iwdProfileName(ssid, extension string) string {
+	for _, r := range ssid {
+		if !(r >= 'a' && r <= 'z' || r >= 'A' && r <= 'Z' || r >= '0' && r <= '9' || r == '-' || r == '_' || r == ' ') {
+			return "=" + hex.EncodeToString([]byte(ssid)) + "." + extension
+		}
+	}
+	return ssid + "." + extension
+}
+
+// iwdEAPProfile renders the provisioning file of an 802.1X network, iwd cannot take the EAP
+// settings from an agent
+func iwdEAPProfile(creds Credentials, certs map[string]string) string {
+	method := strings.ToUpper(creds.EAPMethod)
+	var b strings.Builder
+	b.WriteString("[Security]\n")
+	fmt.Fprintf(&b, "EAP-Method=%s\n", method)
+
+	outer := creds.Identity
+	if creds.AnonymousIdentity != "" {
+		outer = creds.AnonymousIdentity
+	}
+	fmt.Fprintf(&b, "EAP-Identity=%s\n", outer)
+	if path, ok := certs["802-1x.ca-cert"]; ok {
+		fmt.Fprintf(&b, "EAP-%s-CACert=%s\n", method, path)
+	}
+
+	if creds.EAPMethod == EAPMethodTLS {
+		if path, ok := certs["802-1x.client-cert"]; ok {
+			fmt.Fprintf(&b, "EAP-TLS-ClientCert=%s\n", path)
+		}
+		if path, ok := certs["802-1x.private-key"]; ok {
+			fmt.Fprintf(&b, "EAP-TLS-ClientKey=%s\n", path)
+			if creds.PrivateKeyPassword != "" {
+				fmt.Fprintf(&b, "EAP-TLS-ClientKeyPassphrase=%s\n", creds.PrivateKeyPassword)
+			}
+		}
+		return b.String()
+	}
+
+	if creds.Phase2 != "" {
+		fmt.Fprintf(&b, "EAP-%s-Phase2-Method=%s\n", method, iwdPhase2Method(creds.EAPMethod, creds.Phase2))
+	}
+	fmt.Fprintf(&b, "EAP-%s-Phase2-Identity=%s\n", method, creds.Identity)
+	if creds.Password != "" {
+		fmt.Fprintf(&b, "EAP-%s-Phase2-Password=%s\n", method, creds.Password)
+	}
+	return b.String()
+}
+
+// iwdPhase2Method names the inner method, TTLS runs the non-EAP methods tunneled
+func iwdPhase2Method(eapMethod, phase2 string) string {
+	if eapMethod == EAPMethodTTLS {
+		switch strings.ToLower(phase2) {
+		case "pap":
+			return "Tunneled-PAP"
+		case "chap":
+			return "Tunneled-CHAP"
+		case "mschap":
+			return "Tunneled-MSCHAP"
+		case "mschapv2":
+			return "Tunneled-MSCHAPv2"
+		}
+	}
+	return strings.ToUpper(phase2)
+}
+
+// iwdAgent hands the credentials of the network being connected to iwd
+type iwdAgent struct {
+	network dbus.ObjectPath // Empty while connecting to a hidden network, whose path is not known yet
+	creds   Credentials
+
+	mu    sync.Mutex
+	asked bool
+}
+
+func (a *iwdAgent) secretsFor(network dbus.ObjectPath) *dbus.Error {
+	if a.network != "" && network != a.network {
+		return dbus.NewError(iwdErrorCanceled, []any{"unexpected network"})
+	}
+	a.mu.Lock()
+	a.asked = true
+	a.mu.Unlock()
+	return nil
+}
+
+func (a *iwdAgent) wasAsked() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return a.asked
+}
+
+func (a *iwdAgent) Release() *dbus.Error {
+	return nil
+}
+
+func (a *iwdAgent) RequestPassphrase(network dbus.ObjectPath) (string, *dbus.Error) {
+	return a.creds.Password, a.secretsFor(network)
+}
+
+func (a *iwdAgent) RequestPrivateKeyPassphrase(network dbus.ObjectPath) (string, *dbus.Error) {
+	return a.creds.PrivateKeyPassword, a.secretsFor(network)
+}
+
+func (a *iwdAgent) RequestUserNameAndPassword(network dbus.ObjectPath) (string, string, *dbus.Error) {
+	return a.creds.Identity, a.creds.Password, a.secretsFor(network)
+}
+
+func (a *iwdAgent) RequestUserPassword(network dbus.ObjectPath, user string) (string, *dbus.Error) {
+	return a.creds.Password, a.secretsFor(network)
+}
+
+func (a *iwdAgent) Cancel(reason string) *dbus.Error {
+	return nil
+}
+
+// iwdInterfaceManager implements InterfaceManager on the iwd D-Bus API
+type iwdInterfaceManager struct {
+	mu             sync.Mutex // Serializes connection attempts, they share the agent
+	client         *iwdClient
+	runner         command.Runner
+	logger         *slog.Logger
+	certDir        string
+	stateDir       string
+	policy         SelectionPolicy
+	connectTimeout time.Duration
+}
+
+// NewIWDInterfaceManager creates an InterfaceManager that talks to iwd over D-Bus. It connects
+// to the system bus unless WithInterfaceDBusConn is given.
+func NewIWDInterfaceManager(opts ...InterfaceManagerOption) (InterfaceManager, error) {
+	o := newInterfaceManagerOptions(opts)
+	client, err := newIWDClient(o.bus, o.logger)
+	if err != nil {
+		return nil, err
+	}
+	return &iwdInterfaceManager{
+		client:         client,
+		runner:         o.runner,
+		logger:         o.logger,
+		certDir:        o.certDir,
+		stateDir:       o.iwdDir,
+		policy:         o.policy,
+		connectTimeout: defaultIWDConnectTimeout,
+	}, nil
+}
+
+func (im *iwdInterfaceManager) ListWirelessInterfaces() ([]WirelessInterface, error) {
+	objects, err := im.client.objects()
+	if err != nil {
+		return nil, err
+	}
+
+	// The adapter's supported modes decide AP support when iw is unavailable
+	supportAP := make(map[string]bool)
+	probe := newPhyProbe(im.runner, im.logger, func(name string) bool { return supportAP[name] })
+	uplink := DefaultRouteInterface(im.runner)
+
+	devices := objects.devices()
+	interfaces := make([]WirelessInterface, 0, len(devices))
+	for _, device := range devices {
+		name := iwdProperty[string](objects, device, iwdDeviceInterface, "Name")
+		adapter := iwdProperty[dbus.ObjectPath](objects, device, iwdDeviceInterface, "Adapter")
+		modes := iwdProperty[[]string](objects, adapter, iwdAdapterInterface, "SupportedModes")
+		supportAP[name] = slices.Contains(modes, "ap")
+
+		state := iwdProperty[string](objects, device, iwdStationInterface, "State")
+		interfaces = append(interfaces, probe.describe(WirelessInterface{
+			Name:       name,
+			MACAddress: iwdProperty[string](objects, device, iwdDeviceInterface, "Address"),
+			InUse:      iwdProperty[string](objects, device, iwdDeviceInterface, "Mode") == "ap" || (state != "" && state != "disconnected"),
+			Uplink:     name == uplink,
+			Driver:     interfaceDriver(im.runner, name),
+		}))
+	}
+	return interfaces, nil
+}
+
+func (im *iwdInterfaceManager) GetBestAPInterface() (*WirelessInterface, error) {
+	scores, err := im.RankAPInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	return bestAPInterface(scores, im.logger)
+}
+
+func (im *iwdInterfaceManager) RankAPInterfaces() ([]InterfaceScore, error) {
+	interfaces, err := im.ListWirelessInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	return im.policy.Rank(interfaces), nil
+}
+
+func (im *iwdInterfaceManager) ListAvailableNetworks(interfaceName string) ([]WirelessNetwork, error) {
+	im.logger.Info("scanning for networks", slog.String("interface", interfaceName))
+	device, err := im.client.device(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+	if err := im.client.requestScan(device); err != nil {
+		// Scans are refused while connecting, the cached results are still useful
+		im.logger.Warn("failed to rescan networks", slog.String("error", err.Error()))
+	}
+	networks, err := im.client.networks(device)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to scan for networks (interface: %s)", interfaceName)
+	}
+	im.logger.Debug("found networks", slog.Int("count", len(networks)))
+	return networks, nil
+}
+
+func (im *iwdInterfaceManager) ConnectToNetwork(interfaceName, ssid, password string) error {
+	return im.ConnectWithCredentials(interfaceName, ssid, Credentials{Password: password})
+}
+
+func (im *iwdInterfaceManager) ConnectWithCredentials(interfaceName, ssid string, creds Credentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	im.logger.Info("attempting to connect to network",
+		slog.String("interface", interfaceName),
+		slog.String("ssid", ssid),
+		slog.Bool("enterprise", creds.IsEnterprise()),
+		slog.Bool("hidden", creds.Hidden))
+
+	im.mu.Lock()
+	defer im.mu.Unlock()
+
+	device, err := im.client.device(interfaceName)
+	if err != nil {
+		return err
+	}
+	network, found, err := im.client.network(device, ssid)
+	if err != nil {
+		return err
+	}
+	if !found && !creds.Hidden {
+		if err := im.client.requestScan(device); err != nil {
+			im.logger.Warn("failed to rescan networks", slog.String("error", err.Error()))
+		}
+		if network, found, err = im.client.network(device, ssid); err != nil {
+			return err
+		}
+		if !found {
+			return errors.Wrap(ErrNetworkNotFound, ssid)
+		}
+	}
+	// Forget the profile of an earlier attempt, iwd would reuse its secrets
+	if found {
+		if err := im.client.forget(network); err != nil {
+			im.logger.Warn("failed to remove existing network", slog.String("error", err.Error()))
+		}
+	}
+
+	profile := ""
+	if creds.IsEnterprise() {
+		if profile, err = im.writeEAPProfile(ssid, creds); err != nil {
+			return err
+		}
+	}
+
+	agent := &iwdAgent{network: network, creds: creds}
+	if err := im.registerAgent(agent); err != nil {
+		return err
+	}
+	defer im.unregisterAgent()
+
+	ctx, cancel := context.WithTimeout(context.Background(), im.connectTimeout)
+	defer cancel()
+	if found {
+		err = im.client.object(network).CallWithContext(ctx, iwdNetworkInterface+".Connect", 0).Err
+	} else {
+		err = im.client.object(device).CallWithContext(ctx, iwdStationInterface+".ConnectHiddenNetwork", 0, ssid).Err
+	}
+	if err != nil {
+		if profile != "" {
+			os.Remove(profile)
+		}
+		reason := iwdError(err)
+		if agent.wasAsked() {
+			reason = "secrets were required, but not provided or wrong"
+		}
+		return errors.Wrapf(errors.Wrap(ErrConnectionFailed, reason), "failed to connect to network %s on interface %s", ssid, interfaceName)
+	}
+
+	im.logger.Info("successfully connected to network",
+		slog.String("interface", interfaceName),
+		slog.String("ssid", ssid))
+	return nil
+}
+
+// writeEAPProfile writes the provisioning file of an 802.1X network and returns its path
+func (im *iwdInterfaceManager) writeEAPProfile(ssid string, creds Credentials) (string, error) {
+	certs, err := writeCertFiles(im.certDir, ssid, creds)
+	if err != nil {
+		return "", err
+	}
+	return im.writeProfile(ssid, "8021x", iwdEAPProfile(creds, certs))
+}
+
+// writeProfile writes a provisioning file to the state directory and returns its path
+func (im *iwdInterfaceManager) writeProfile(ssid, extension, content string) (string, error) {
+	if err := os.MkdirAll(im.stateDir, 0o700); err != nil {
+		return "", errors.Wrap(err, "failed to create iwd state directory")
+	}
+	path := filepath.Join(im.stateDir, iwdProfileName(ssid, extension))
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		return "", errors.Wrap(err, "failed to write iwd network profile")
+	}
+	return path, nil
+}
+
+func (im *iwdInterfaceManager) registerAgent(agent *iwdAgent) error {
+	if err := im.client.conn.Export(agent, iwdAgentPath, iwdAgentInterface); err != nil {
+		return errors.Wrap(err, "failed to export agent")
+	}
+	if err := im.client.object(iwdManagerPath).Call(iwdAgentManagerInterface+".RegisterAgent", 0, iwdAgentPath).Err; err != nil {
+		im.client.conn.Export(nil, iwdAgentPath, iwdAgentInterface)
+		return errors.Wrap(err, "failed to register agent")
+	}
+	return nil
+}
+
+func (im *iwdInterfaceManager) unregisterAgent() {
+	if err := im.client.object(iwdManagerPath).Call(iwdAgentManagerInterface+".UnregisterAgent", 0, iwdAgentPath).Err; err != nil {
+		im.logger.Debug("failed to unregister agent", slog.String("error", err.Error()))
+	}
+	im.client.conn.Export(nil, iwdAgentPath, iwdAgentInterface)
+}
+
+// iwdKnownNetworkPath returns the object path of the known network with profile id, ids are
+// the paths relative to the manager so they can be used in URLs
+func iwdKnownNetworkPath(id string) dbus.ObjectPath {
+	return iwdManagerPath + "/" + dbus.ObjectPath(id)
+}
+
+// knownNetwork returns the properties of the known network with profile id
+func (im *iwdInterfaceManager) knownNetwork(id string) (map[string]dbus.Variant, error) {
+	objects, err := im.client.objects()
+	if err != nil {
+		return nil, err
+	}
+	props, ok := objects[iwdKnownNetworkPath(id)][iwdKnownNetworkInterface]
+	if !ok {
+		return nil, errors.Wrap(ErrProfileNotFound, id)
+	}
+	return props, nil
+}
+
+// JoinStage maps the State of the station, iwd does not tell association and authentication apart
+func (im *iwdInterfaceManager) JoinStage(interfaceName string) (ConnectionStage, error) {
+	device, err := im.client.device(interfaceName)
+	if err != nil {
+		return "", err
+	}
+	state, err := nmProperty[string](im.client.object(device), iwdStationInterface+".State")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read state of station %s", interfaceName)
+	}
+	switch state {
+	case "connecting":
+		return StageAssociate, nil
+	case "connected":
+		return StageDHCP, nil
+	}
+	return "", nil
+}
+
+// ListProfiles returns the networks iwd knows, it has no priorities and tries the most recently
+// used network first
+func (im *iwdInterfaceManager) ListProfiles() ([]Profile, error) {
+	objects, err := im.client.objects()
+	if err != nil {
+		return nil, err
+	}
+	active := make(map[dbus.ObjectPath]bool)
+	for path := range objects {
+		if iwdProperty[bool](objects, path, iwdNetworkInterface, "Connected") {
+			active[iwdProperty[dbus.ObjectPath](objects, path, iwdNetworkInterface, "KnownNetwork")] = true
+		}
+	}
+
+	profiles := []Profile{}
+	for path, ifaces := range objects {
+		props, ok := ifaces[iwdKnownNetworkInterface]
+		if !ok {
+			continue
+		}
+		name, _ := props["Name"].Value().(string)
+		networkType, _ := props["Type"].Value().(string)
+		hidden, _ := props["Hidden"].Value().(bool)
+		autoConnect, ok := props["AutoConnect"].Value().(bool)
+		if !ok {
+			autoConnect = true
+		}
+		profiles = append(profiles, Profile{
+			ID:          strings.TrimPrefix(string(path), string(iwdManagerPath)+"/"),
+			Name:        name,
+			SSID:        name,
+			Security:    iwdTypeSecurity(networkType),
+			Hidden:      hidden,
+			AutoConnect: autoConnect,
+			Active:      active[path],
+		})
+	}
+	sortProfiles(profiles)
+	return profiles, nil
+}
+
+func (im *iwdInterfaceManager) UpdateProfile(id string, update ProfileUpdate) error {
+	if _, err := im.knownNetwork(id); err != nil {
+		return err
+	}
+	if update.Priority != nil {
+		return errors.Wrap(ErrNotSupported, "iwd has no network priorities")
+	}
+	if update.AutoConnect != nil {
+		obj := im.client.object(iwdKnownNetworkPath(id))
+		if err := obj.SetProperty(iwdKnownNetworkInterface+".AutoConnect", dbus.MakeVariant(*update.AutoConnect)); err != nil {
+			return errors.Wrapf(err, "failed to update known network %s", id)
+		}
+	}
+	im.logger.Info("updated known network", slog.String("id", id))
+	return nil
+}
+
+func (im *iwdInterfaceManager) ForgetProfile(id string) error {
+	if _, err := im.knownNetwork(id); err != nil {
+		return err
+	}
+	if err := im.client.object(iwdKnownNetworkPath(id)).Call(iwdKnownNetworkInterface+".Forget", 0).Err; err != nil {
+		return errors.Wrapf(err, "failed to forget known network %s", id)
+	}
+	im.logger.Info("removed known network", slog.String("id", id))
+	return nil
+}
+
+// UpdateProfileCredentials rewrites the provisioning file of a known network, iwd reloads it.
+// A network that changes type gets a new profile, so the old one is forgotten.
+func (im *iwdInterfaceManager) UpdateProfileCredentials(id string, creds Credentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	props, err := im.knownNetwork(id)
+	if err != nil {
+		return err
+	}
+	ssid, _ := props["Name"].Value().(string)
+	previousType, _ := props["Type"].Value().(string)
+
+	networkType := iwdProfileType(creds)
+	if networkType != previousType {
+		if err := im.ForgetProfile(id); err != nil {
+			return err
+		}
+	}
+
+	if err := im.provision(ssid, creds); err != nil {
+		return err
+	}
+	im.logger.Info("updated known network credentials", slog.String("id", id), slog.String("ssid", ssid))
+	return nil
+}
+
+// SaveProfile writes the provisioning file of ssid, iwd joins it on its own. iwd has no
+// priorities, it ranks known networks by signal and when they were last used.
+func (im *iwdInterfaceManager) SaveProfile(interfaceName, ssid string, creds Credentials, priority int) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	networkType := iwdProfileType(creds)
+	// A profile of another type would be a second known network with the same name
+	for _, extension := range []string{"psk", "8021x", "open"} {
+		if extension == networkType {
+			continue
+		}
+		if err := os.Remove(filepath.Join(im.stateDir, iwdProfileName(ssid, extension))); err != nil && !os.IsNotExist(err) {
+			im.logger.Warn("failed to remove existing profile", slog.String("error", err.Error()))
+		}
+	}
+	if err := im.provision(ssid, creds); err != nil {
+		return err
+	}
+	im.logger.Info("saved known network", slog.String("ssid", ssid), slog.Int("priority", priority))
+	return nil
+}
+
+// provision writes the provisioning file matching creds
+func (im *iwdInterfaceManager) provision(ssid string, creds Credentials) error {
+	networkType := iwdProfileType(creds)
+	var content strings.Builder
+	switch networkType {
+	case "8021x":
+		certs, err := writeCertFiles(im.certDir, ssid, creds)
+		if err != nil {
+			return err
+		}
+		content.WriteString(iwdEAPProfile(creds, certs))
+	case "psk":
+		fmt.Fprintf(&content, "[Security]\nPassphrase=%s\n", creds.Password)
+	}
+	if creds.Hidden {
+		content.WriteString("[Settings]\nHidden=true\n")
+	}
+	_, err := im.writeProfile(ssid, networkType, content.String())
+	return err
+}
@@ -0,0 +1,170 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"strings"
+	"sync"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+// iwdAPService implements APService with the access point mode of iwd. iwd only hosts
+// WPA2-Personal networks and picks the channel itself.
+type iwdAPService struct {
+	mu      sync.Mutex
+	client  *iwdClient
+	config  APConfig
+	clients *clientServices
+	monitor *processMonitor
+	runner  command.Runner
+	logger  *slog.Logger
+	running bool
+	device  dbus.ObjectPath
+}
+
+// NewIWDAPService creates an APService that switches an iwd device to access point mode.
+// It connects to the system bus unless WithAPDBusConn is given.
+func NewIWDAPService(opts ...APServiceOption) (APService, error) {
+	o := newAPServiceOptions(opts)
+	monitor := newProcessMonitor(o)
+	client, err := newIWDClient(o.bus, o.logger)
+	if err != nil {
+		return nil, err
+	}
+	return &iwdAPService{
+		client:  client,
+		clients: newClientServices(o, monitor),
+		monitor: monitor,
+		runner:  o.runner,
+		logger:  o.logger,
+	}, nil
+}
+
+func (h *iwdAPService) Start(ctx context.Context, config APConfig) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running {
+		return ErrServiceAlreadyRunning
+	}
+	if err := config.Validate(); err != nil {
+		return errors.Wrap(err, "invalid access point configuration")
+	}
+	switch config.SecurityMode() {
+	case SecurityOpen, SecurityWPA3:
+		return errors.Wrapf(ErrInvalidAPConfig, "iwd cannot host %s access points", config.SecurityMode())
+	case SecurityWPA2WPA3:
+		h.logger.Warn("iwd cannot host WPA2/WPA3 transition mode, falling back to WPA2",
+			slog.String("ssid", config.SSID))
+	}
+	if config.Channel != 0 || config.Hidden {
+		h.logger.Warn("iwd picks the access point channel itself and always broadcasts the SSID",
+			slog.String("ssid", config.SSID))
+	}
+	h.config = config
+	h.logger.Info("starting access point service", slog.String("ssid", config.SSID))
+
+	device, err := h.client.device(config.Interface)
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare interface")
+	}
+	if err := h.setMode(device, "ap"); err != nil {
+		return errors.Wrap(err, "failed to prepare interface")
+	}
+	if err := h.client.object(device).CallWithContext(ctx, iwdAccessPointInterface+".Start", 0, config.SSID, config.Password).Err; err != nil {
+		h.setMode(device, "station")
+		return errors.Wrapf(err, "failed to start iwd access point: %s", iwdError(err))
+	}
+	h.device = device
+
+	if err := h.assignGateway(ctx); err != nil {
+		h.stopAccessPoint(context.WithoutCancel(ctx))
+		return errors.Wrap(err, "failed to prepare interface")
+	}
+	applyCaptiveRules(ctx, h.runner, h.logger, config.Interface, config.PortalPort)
+	if err := h.clients.start(ctx, config); err != nil {
+		removeCaptiveRules(ctx, h.runner, config.Interface, config.PortalPort)
+		h.stopAccessPoint(context.WithoutCancel(ctx))
+		return err
+	}
+
+	h.running = true
+	return nil
+}
+
+func (h *iwdAPService) Stop(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.running {
+		return nil
+	}
+
+	h.clients.stop(ctx)
+	removeCaptiveRules(ctx, h.runner, h.config.Interface, h.config.PortalPort)
+	h.stopAccessPoint(ctx)
+
+	h.running = false
+	h.logger.Debug("access point service stopped")
+	return nil
+}
+
+// IsRunning reports whether the service was started and iwd still runs the access point
+func (h *iwdAPService) IsRunning() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.running {
+		return false
+	}
+	started, err := nmProperty[bool](h.client.object(h.device), iwdAccessPointInterface+".Started")
+	return err == nil && started
+}
+
+// Health reports dnsmasq, which is not started when the embedded DHCP and DNS servers replace it
+func (h *iwdAPService) Health() APHealth {
+	h.mu.Lock()
+	running := h.running
+	h.mu.Unlock()
+	return h.monitor.health(running)
+}
+
+func (h *iwdAPService) Events() <-chan APEvent {
+	return h.monitor.events
+}
+
+func (h *iwdAPService) setMode(device dbus.ObjectPath, mode string) error {
+	return h.client.object(device).SetProperty(iwdDeviceInterface+".Mode", dbus.MakeVariant(mode))
+}
+
+// assignGateway gives the interface the gateway address, iwd only does so itself when its
+// network configuration is enabled
+func (h *iwdAPService) assignGateway(ctx context.Context) error {
+	steps := [][]string{
+		{"ip", "addr", "flush", "dev", h.config.Interface},
+		{"ip", "addr", "add", fmt.Sprintf("%s/24", h.config.Gateway), "dev", h.config.Interface},
+	}
+	for _, step := range steps {
+		if res, err := h.runner.RunWithContext(ctx, "sudo", step...); err != nil {
+			return errors.Wrapf(err, "%s: %s", strings.Join(step, " "), res.Combined())
+		}
+	}
+	return nil
+}
+
+// stopAccessPoint stops the access point and returns the device to station mode
+func (h *iwdAPService) stopAccessPoint(ctx context.Context) {
+	if err := h.client.object(h.device).CallWithContext(ctx, iwdAccessPointInterface+".Stop", 0).Err; err != nil {
+		h.logger.Error("failed to stop access point", slog.String("ssid", h.config.SSID), slog.String("error", err.Error()))
+	}
+	if err := h.setMode(h.device, "station"); err != nil {
+		h.logger.Warn("failed to return interface to station mode", slog.String("interface", h.config.Interface), slog.String("error", err.Error()))
+	}
+	if _, err := h.runner.RunWithContext(ctx, "sudo", "ip", "addr", "flush", "dev", h.config.Interface); err != nil {
+		h.logger.Warn("failed to flush interface addresses", slog.String("interface", h.config.Interface), slog.String("error", err.Error()))
+	}
+}
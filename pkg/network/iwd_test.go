@@ -0,0 +1,515 @@
+package network
+
+import (
+	"context"
+	"encoding/hex"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeIWD is a stand-in for the parts of the iwd D-Bus API the backend uses
+type fakeIWD struct {
+	t    *testing.T
+	conn *dbus.Conn
+
+	mu          sync.Mutex
+	props       map[dbus.ObjectPath]*prop.Properties
+	ifaces      map[dbus.ObjectPath][]string
+	signals     map[dbus.ObjectPath]int16 // Network signal strength in 100 * dBm
+	passphrases map[string]string         // SSID to the passphrase that connects
+	agent       dbus.Sender
+	agentPath   dbus.ObjectPath
+	forgotten   []string
+	hidden      []string
+	scans       int
+}
+
+func newFakeIWD(t *testing.T, address string) *fakeIWD {
+	t.Helper()
+	f := &fakeIWD{
+		t:           t,
+		conn:        dialTestBus(t, address),
+		props:       make(map[dbus.ObjectPath]*prop.Properties),
+		ifaces:      make(map[dbus.ObjectPath][]string),
+		signals:     make(map[dbus.ObjectPath]int16),
+		passphrases: make(map[string]string),
+	}
+	require.NoError(t, f.conn.Export(fakeIWDRoot{f}, "/", iwdObjectManagerInterface))
+	require.NoError(t, f.conn.Export(fakeIWDAgentManager{f}, iwdManagerPath, iwdAgentManagerInterface))
+
+	reply, err := f.conn.RequestName(iwdBusName, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+	return f
+}
+
+func (f *fakeIWD) export(path dbus.ObjectPath, props prop.Map) *prop.Properties {
+	exported, err := prop.Export(f.conn, path, props)
+	require.NoError(f.t, err)
+	f.props[path] = exported
+	for iface := range props {
+		f.ifaces[path] = append(f.ifaces[path], iface)
+	}
+	return exported
+}
+
+// locked runs fn with the fake's state locked, the race detector cannot see the ordering D-Bus replies imply
+func (f *fakeIWD) locked(fn func()) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	fn()
+}
+
+func (f *fakeIWD) get(path dbus.ObjectPath, iface, name string) any {
+	f.mu.Lock()
+	props := f.props[path]
+	f.mu.Unlock()
+	return props.GetMust(iface, name)
+}
+
+func (f *fakeIWD) set(path dbus.ObjectPath, iface, name string, value any) {
+	f.mu.Lock()
+	props := f.props[path]
+	f.mu.Unlock()
+	props.SetMust(iface, name, value)
+}
+
+// addDevice registers an adapter with one device in station mode
+func (f *fakeIWD) addDevice(name string, modes ...string) dbus.ObjectPath {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	adapter := dbus.ObjectPath("/net/connman/iwd/0")
+	device := adapter + "/4"
+	f.export(adapter, prop.Map{iwdAdapterInterface: {
+		"Name":           {Value: "phy0"},
+		"Powered":        {Value: true},
+		"SupportedModes": {Value: modes},
+	}})
+	f.export(device, prop.Map{
+		iwdDeviceInterface: {
+			"Name":    {Value: name},
+			"Address": {Value: "b8:27:eb:12:34:56"},
+			"Powered": {Value: true},
+			"Adapter": {Value: adapter},
+			"Mode":    {Value: "station", Writable: true},
+		},
+		iwdStationInterface: {
+			"State":    {Value: "disconnected"},
+			"Scanning": {Value: false},
+		},
+		iwdAccessPointInterface: {
+			"Started": {Value: false},
+			"Name":    {Value: ""},
+		},
+	})
+	require.NoError(f.t, f.conn.Export(fakeIWDStation{f, device}, device, iwdStationInterface))
+	require.NoError(f.t, f.conn.Export(fakeIWDAccessPoint{f, device}, device, iwdAccessPointInterface))
+	return device
+}
+
+// addNetwork makes a network visible to device, known networks remember knownPassphrase
+func (f *fakeIWD) addNetwork(device dbus.ObjectPath, ssid, networkType string, signal int16, passphrase, knownPassphrase string) dbus.ObjectPath {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	id := hex.EncodeToString([]byte(ssid)) + "_" + networkType
+	path := device + dbus.ObjectPath("/"+id)
+	bss := path + "/b827eb000001"
+	known := dbus.ObjectPath("/")
+	if knownPassphrase != "" {
+		known = dbus.ObjectPath("/net/connman/iwd/" + id)
+		f.export(known, prop.Map{iwdKnownNetworkInterface: {
+			"Name":        {Value: ssid},
+			"Type":        {Value: networkType},
+			"Hidden":      {Value: false},
+			"AutoConnect": {Value: true, Writable: true},
+		}})
+		require.NoError(f.t, f.conn.Export(fakeIWDKnownNetwork{f, known, path}, known, iwdKnownNetworkInterface))
+	}
+	f.export(bss, prop.Map{iwdBSSInterface: {"Address": {Value: "b8:27:eb:00:00:01"}}})
+	f.export(path, prop.Map{iwdNetworkInterface: {
+		"Name":               {Value: ssid},
+		"Type":               {Value: networkType},
+		"Device":             {Value: device},
+		"Connected":          {Value: false},
+		"KnownNetwork":       {Value: known},
+		"ExtendedServiceSet": {Value: []dbus.ObjectPath{bss}},
+	}})
+	f.signals[path] = signal
+	require.NoError(f.t, f.conn.Export(fakeIWDNetwork{f, path, ssid, knownPassphrase}, path, iwdNetworkInterface))
+	f.passphrases[ssid] = passphrase
+	return path
+}
+
+// askPassphrase requests the passphrase of network from the registered agent
+func (f *fakeIWD) askPassphrase(network dbus.ObjectPath) (string, *dbus.Error) {
+	f.mu.Lock()
+	agent, agentPath := f.agent, f.agentPath
+	f.mu.Unlock()
+	if agent == "" {
+		return "", dbus.NewError("net.connman.iwd.NoAgent", nil)
+	}
+	var passphrase string
+	if err := f.conn.Object(string(agent), agentPath).Call(iwdAgentInterface+".RequestPassphrase", 0, network).Store(&passphrase); err != nil {
+		return "", dbus.NewError("net.connman.iwd.Aborted", nil)
+	}
+	return passphrase, nil
+}
+
+type fakeIWDRoot struct{ f *fakeIWD }
+
+func (r fakeIWDRoot) GetManagedObjects() (map[dbus.ObjectPath]map[string]map[string]dbus.Variant, *dbus.Error) {
+	r.f.mu.Lock()
+	defer r.f.mu.Unlock()
+	objects := make(map[dbus.ObjectPath]map[string]map[string]dbus.Variant)
+	for path, ifaces := range r.f.ifaces {
+		objects[path] = make(map[string]map[string]dbus.Variant)
+		for _, iface := range ifaces {
+			props, err := r.f.props[path].GetAll(iface)
+			if err != nil {
+				return nil, err
+			}
+			objects[path][iface] = props
+		}
+	}
+	return objects, nil
+}
+
+type fakeIWDAgentManager struct{ f *fakeIWD }
+
+func (m fakeIWDAgentManager) RegisterAgent(sender dbus.Sender, path dbus.ObjectPath) *dbus.Error {
+	m.f.mu.Lock()
+	defer m.f.mu.Unlock()
+	if m.f.agent != "" {
+		return dbus.NewError("net.connman.iwd.AlreadyExists", nil)
+	}
+	m.f.agent, m.f.agentPath = sender, path
+	return nil
+}
+
+func (m fakeIWDAgentManager) UnregisterAgent(sender dbus.Sender, path dbus.ObjectPath) *dbus.Error {
+	m.f.mu.Lock()
+	defer m.f.mu.Unlock()
+	m.f.agent, m.f.agentPath = "", ""
+	return nil
+}
+
+type fakeIWDStation struct {
+	f    *fakeIWD
+	path dbus.ObjectPath
+}
+
+func (s fakeIWDStation) Scan() *dbus.Error {
+	s.f.mu.Lock()
+	s.f.scans++
+	s.f.mu.Unlock()
+	s.f.set(s.path, iwdStationInterface, "Scanning", true)
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		s.f.set(s.path, iwdStationInterface, "Scanning", false)
+	}()
+	return nil
+}
+
+func (s fakeIWDStation) GetOrderedNetworks() ([]struct {
+	Path   dbus.ObjectPath
+	Signal int16
+}, *dbus.Error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	var networks []struct {
+		Path   dbus.ObjectPath
+		Signal int16
+	}
+	for path, signal := range s.f.signals {
+		if s.f.props[path].GetMust(iwdNetworkInterface, "Device") == s.path {
+			networks = append(networks, struct {
+				Path   dbus.ObjectPath
+				Signal int16
+			}{path, signal})
+		}
+	}
+	sort.Slice(networks, func(i, j int) bool { return networks[i].Signal > networks[j].Signal })
+	return networks, nil
+}
+
+func (s fakeIWDStation) ConnectHiddenNetwork(ssid string) *dbus.Error {
+	passphrase, err := s.f.askPassphrase(s.path + dbus.ObjectPath("/"+hex.EncodeToString([]byte(ssid))+"_psk"))
+	if err != nil {
+		return err
+	}
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	if passphrase != s.f.passphrases[ssid] {
+		return dbus.NewError("net.connman.iwd.Failed", []any{"Operation failed"})
+	}
+	s.f.hidden = append(s.f.hidden, ssid)
+	return nil
+}
+
+type fakeIWDNetwork struct {
+	f     *fakeIWD
+	path  dbus.ObjectPath
+	ssid  string
+	known string
+}
+
+func (n fakeIWDNetwork) Connect() *dbus.Error {
+	passphrase := n.known
+	networkType := n.f.get(n.path, iwdNetworkInterface, "Type")
+	if n.f.get(n.path, iwdNetworkInterface, "KnownNetwork") == dbus.ObjectPath("/") && networkType == "psk" {
+		var err *dbus.Error
+		if passphrase, err = n.f.askPassphrase(n.path); err != nil {
+			return err
+		}
+	}
+	n.f.mu.Lock()
+	expected := n.f.passphrases[n.ssid]
+	n.f.mu.Unlock()
+	if networkType == "psk" && passphrase != expected {
+		return dbus.NewError("net.connman.iwd.Failed", []any{"Operation failed"})
+	}
+	n.f.set(n.path, iwdNetworkInterface, "Connected", true)
+	return nil
+}
+
+type fakeIWDKnownNetwork struct {
+	f       *fakeIWD
+	path    dbus.ObjectPath
+	network dbus.ObjectPath
+}
+
+func (k fakeIWDKnownNetwork) Forget() *dbus.Error {
+	k.f.set(k.network, iwdNetworkInterface, "KnownNetwork", dbus.ObjectPath("/"))
+	k.f.mu.Lock()
+	defer k.f.mu.Unlock()
+	k.f.forgotten = append(k.f.forgotten, string(k.path))
+	delete(k.f.ifaces, k.path)
+	return nil
+}
+
+type fakeIWDAccessPoint struct {
+	f    *fakeIWD
+	path dbus.ObjectPath
+}
+
+func (a fakeIWDAccessPoint) Start(ssid, psk string) *dbus.Error {
+	if a.f.get(a.path, iwdDeviceInterface, "Mode") != "ap" {
+		return dbus.NewError("net.connman.iwd.NotAvailable", nil)
+	}
+	a.f.set(a.path, iwdAccessPointInterface, "Started", true)
+	a.f.set(a.path, iwdAccessPointInterface, "Name", ssid)
+	return nil
+}
+
+func (a fakeIWDAccessPoint) Stop() *dbus.Error {
+	a.f.set(a.path, iwdAccessPointInterface, "Started", false)
+	return nil
+}
+
+func newTestIWD(t *testing.T) (*fakeIWD, *dbus.Conn) {
+	address := startTestBus(t)
+	return newFakeIWD(t, address), dialTestBus(t, address)
+}
+
+func TestIWDInterfaceManager_ListWirelessInterfaces(t *testing.T) {
+	fake, conn := newTestIWD(t)
+	fake.addDevice("wlan0", "station", "ap")
+
+	im, err := NewIWDInterfaceManager(WithInterfaceDBusConn(conn), WithInterfaceCommandRunner(command.NewFakeRunner()))
+	require.NoError(t, err)
+
+	interfaces, err := im.ListWirelessInterfaces()
+	require.NoError(t, err)
+	require.Len(t, interfaces, 1)
+	assert.Equal(t, "wlan0", interfaces[0].Name)
+	assert.Equal(t, "b8:27:eb:12:34:56", interfaces[0].MACAddress)
+	assert.True(t, interfaces[0].SupportAP)
+	assert.False(t, interfaces[0].InUse)
+}
+
+func TestIWDInterfaceManager_ListAvailableNetworks(t *testing.T) {
+	fake, conn := newTestIWD(t)
+	wlan0 := fake.addDevice("wlan0", "station")
+	fake.addNetwork(wlan0, "Corp", "8021x", -7000, "", "")
+	fake.addNetwork(wlan0, "Home", "psk", -5500, "secret123", "")
+	fake.addNetwork(wlan0, "Café:Guest", "open", -6000, "", "")
+
+	im, err := NewIWDInterfaceManager(WithInterfaceDBusConn(conn))
+	require.NoError(t, err)
+
+	networks, err := im.ListAvailableNetworks("wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, []WirelessNetwork{
+		{SSID: "Home", DisplayName: "Home", BSSID: "b8:27:eb:00:00:01", Signal: 58, SignalDBm: -55, Security: "WPA2", SecurityType: NetworkSecurityWPA2PSK},
+		{SSID: "Café:Guest", DisplayName: "Café:Guest", BSSID: "b8:27:eb:00:00:01", Signal: 50, SignalDBm: -60, Security: "none", SecurityType: NetworkSecurityOpen},
+		{SSID: "Corp", DisplayName: "Corp", BSSID: "b8:27:eb:00:00:01", Signal: 33, SignalDBm: -70, Security: "WPA2 802.1X", SecurityType: NetworkSecurity8021X, Enterprise: true},
+	}, networks)
+	fake.locked(func() { assert.Equal(t, 1, fake.scans) })
+
+	_, err = im.ListAvailableNetworks("wlan9")
+	assert.Error(t, err)
+}
+
+func TestIWDInterfaceManager_Connect(t *testing.T) {
+	fake, conn := newTestIWD(t)
+	wlan0 := fake.addDevice("wlan0", "station")
+	home := fake.addNetwork(wlan0, "Home", "psk", -5500, "secret123", "old-password")
+
+	im, err := NewIWDInterfaceManager(WithInterfaceDBusConn(conn))
+	require.NoError(t, err)
+
+	// The known network is forgotten so the agent is asked for the new passphrase
+	require.NoError(t, im.ConnectToNetwork("wlan0", "Home", "secret123"))
+	assert.Equal(t, true, fake.get(home, iwdNetworkInterface, "Connected"))
+	fake.locked(func() {
+		assert.Len(t, fake.forgotten, 1)
+		assert.Empty(t, fake.agent)
+	})
+
+	err = im.ConnectToNetwork("wlan0", "Home", "wrong-password")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrConnectionFailed)
+	assert.Contains(t, err.Error(), "secrets were required")
+
+	err = im.ConnectToNetwork("wlan0", "Missing", "secret123")
+	assert.ErrorIs(t, err, ErrNetworkNotFound)
+}
+
+func TestIWDInterfaceManager_ConnectHidden(t *testing.T) {
+	fake, conn := newTestIWD(t)
+	fake.addDevice("wlan0", "station")
+	fake.locked(func() { fake.passphrases["Hidden"] = "secret123" })
+
+	im, err := NewIWDInterfaceManager(WithInterfaceDBusConn(conn))
+	require.NoError(t, err)
+
+	require.NoError(t, im.ConnectWithCredentials("wlan0", "Hidden", Credentials{Password: "secret123", Hidden: true}))
+	fake.locked(func() { assert.Equal(t, []string{"Hidden"}, fake.hidden) })
+}
+
+func TestIWDInterfaceManager_ConnectEnterprise(t *testing.T) {
+	fake, conn := newTestIWD(t)
+	wlan0 := fake.addDevice("wlan0", "station")
+	corp := fake.addNetwork(wlan0, "Corp Wi-Fi", "8021x", -6000, "", "")
+	certDir, stateDir := t.TempDir(), t.TempDir()
+
+	im, err := NewIWDInterfaceManager(WithInterfaceDBusConn(conn), WithInterfaceCertDir(certDir), WithInterfaceIWDStateDir(stateDir))
+	require.NoError(t, err)
+
+	require.NoError(t, im.ConnectWithCredentials("wlan0", "Corp Wi-Fi", Credentials{
+		EAPMethod:         EAPMethodTTLS,
+		Phase2:            "mschapv2",
+		Identity:          "alice",
+		AnonymousIdentity: "anonymous",
+		Password:          "p@ss",
+		CACert:            testPEM,
+	}))
+	assert.Equal(t, true, fake.get(corp, iwdNetworkInterface, "Connected"))
+
+	profile, err := os.ReadFile(filepath.Join(stateDir, iwdProfileName("Corp Wi-Fi", "8021x")))
+	require.NoError(t, err)
+	assert.Contains(t, string(profile), "EAP-Method=TTLS\n")
+	assert.Contains(t, string(profile), "EAP-Identity=anonymous\n")
+	assert.Contains(t, string(profile), "EAP-TTLS-CACert="+certDir)
+	assert.Contains(t, string(profile), "EAP-TTLS-Phase2-Method=Tunneled-MSCHAPv2\n")
+	assert.Contains(t, string(profile), "EAP-TTLS-Phase2-Identity=alice\n")
+	assert.Contains(t, string(profile), "EAP-TTLS-Phase2-Password=p@ss\n")
+}
+
+func TestIWDInterfaceManager_Profiles(t *testing.T) {
+	fake, conn := newTestIWD(t)
+	wlan0 := fake.addDevice("wlan0", "station")
+	home := fake.addNetwork(wlan0, "Home", "psk", -5500, "secret123", "secret123")
+	fake.addNetwork(wlan0, "Cafe", "open", -7000, "", "")
+	fake.set(home, iwdNetworkInterface, "Connected", true)
+	stateDir := t.TempDir()
+
+	im, err := NewIWDInterfaceManager(WithInterfaceDBusConn(conn), WithInterfaceIWDStateDir(stateDir))
+	require.NoError(t, err)
+
+	profiles, err := im.ListProfiles()
+	require.NoError(t, err)
+	id := hex.EncodeToString([]byte("Home")) + "_psk"
+	assert.Equal(t, []Profile{
+		{ID: id, Name: "Home", SSID: "Home", Security: NetworkSecurityWPA2PSK, AutoConnect: true, Active: true},
+	}, profiles)
+
+	priority, autoConnect := 5, false
+	assert.ErrorIs(t, im.UpdateProfile(id, ProfileUpdate{Priority: &priority}), ErrNotSupported)
+	require.NoError(t, im.UpdateProfile(id, ProfileUpdate{AutoConnect: &autoConnect}))
+	assert.Equal(t, false, fake.get(iwdKnownNetworkPath(id), iwdKnownNetworkInterface, "AutoConnect"))
+
+	require.NoError(t, im.UpdateProfileCredentials(id, Credentials{Password: "newsecret"}))
+	profile, err := os.ReadFile(filepath.Join(stateDir, "Home.psk"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Security]\nPassphrase=newsecret\n", string(profile))
+	fake.locked(func() { assert.Empty(t, fake.forgotten) })
+
+	// Moving to another network type replaces the profile
+	require.NoError(t, im.UpdateProfileCredentials(id, Credentials{Hidden: true}))
+	profile, err = os.ReadFile(filepath.Join(stateDir, "Home.open"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Settings]\nHidden=true\n", string(profile))
+	fake.locked(func() { assert.Equal(t, []string{string(iwdKnownNetworkPath(id))}, fake.forgotten) })
+
+	assert.ErrorIs(t, im.ForgetProfile(id), ErrProfileNotFound)
+
+	// Saving replaces a profile of another type
+	require.NoError(t, im.SaveProfile("wlan0", "Home", Credentials{Password: "hotspot123"}, 3))
+	profile, err = os.ReadFile(filepath.Join(stateDir, "Home.psk"))
+	require.NoError(t, err)
+	assert.Equal(t, "[Security]\nPassphrase=hotspot123\n", string(profile))
+	assert.NoFileExists(t, filepath.Join(stateDir, "Home.open"))
+}
+
+func TestIWDAPService_StartStop(t *testing.T) {
+	fake, conn := newTestIWD(t)
+	wlan0 := fake.addDevice("wlan0", "station", "ap")
+	runner := command.NewFakeRunner()
+
+	h, err := NewIWDAPService(WithAPDBusConn(conn), WithAPCommandRunner(runner))
+	require.NoError(t, err)
+
+	config := APConfig{
+		Name: "go-wifiportal", Interface: "wlan0", SSID: "Setup", Password: "12345678", CountryCode: "SE",
+		Security: SecurityOpen, Gateway: "192.168.4.1", DHCPRange: "192.168.4.2,192.168.4.50", PortalPort: "8080",
+	}
+	assert.ErrorIs(t, h.Start(context.Background(), config), ErrInvalidAPConfig)
+
+	config.Security = SecurityWPA2
+	require.NoError(t, h.Start(context.Background(), config))
+	assert.True(t, h.IsRunning())
+	assert.Equal(t, "ap", fake.get(wlan0, iwdDeviceInterface, "Mode"))
+	assert.Equal(t, "Setup", fake.get(wlan0, iwdAccessPointInterface, "Name"))
+	assert.True(t, runner.Called("sudo", "ip", "addr", "add", "192.168.4.1/24", "dev", "wlan0"))
+	assert.NotNil(t, h.(*iwdAPService).clients.dnsmasq.child)
+
+	assert.ErrorIs(t, h.Start(context.Background(), config), ErrServiceAlreadyRunning)
+
+	require.NoError(t, h.Stop(context.Background()))
+	assert.False(t, h.IsRunning())
+	assert.Equal(t, false, fake.get(wlan0, iwdAccessPointInterface, "Started"))
+	assert.Equal(t, "station", fake.get(wlan0, iwdDeviceInterface, "Mode"))
+}
+
+func TestIWDProfileName(t *testing.T) {
+	assert.Equal(t, "Home Office.psk", iwdProfileName("Home Office", "psk"))
+	assert.Equal(t, "=436166c3a9.8021x", iwdProfileName("Café", "8021x"))
+}
+
+func TestIWDEAPProfile_TLS(t *testing.T) {
+	profile := iwdEAPProfile(Credentials{EAPMethod: EAPMethodTLS, Identity: "device", PrivateKeyPassword: "pw"},
+		map[string]string{"802-1x.client-cert": "/certs/client.pem", "802-1x.private-key": "/certs/key.pem"})
+	assert.Equal(t, "[Security]\nEAP-Method=TLS\nEAP-Identity=device\n"+
+		"EAP-TLS-ClientCert=/certs/client.pem\nEAP-TLS-ClientKey=/certs/key.pem\nEAP-TLS-ClientKeyPassphrase=pw\n", profile)
+}
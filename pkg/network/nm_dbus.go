@@ -0,0 +1,893 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+// NetworkManager D-Bus names, see https://networkmanager.dev/docs/api/latest/spec.html
+const (
+	nmBusName               = "org.freedesktop.NetworkManager"
+	nmObjectPath            = dbus.ObjectPath("/org/freedesktop/NetworkManager")
+	nmSettingsPath          = dbus.ObjectPath("/org/freedesktop/NetworkManager/Settings")
+	nmInterface             = "org.freedesktop.NetworkManager"
+	nmDeviceInterface       = "org.freedesktop.NetworkManager.Device"
+	nmWirelessInterface     = "org.freedesktop.NetworkManager.Device.Wireless"
+	nmAccessPointInterface  = "org.freedesktop.NetworkManager.AccessPoint"
+	nmSettingsInterface     = "org.freedesktop.NetworkManager.Settings"
+	nmConnectionInterface   = "org.freedesktop.NetworkManager.Settings.Connection"
+	nmActiveConnInterface   = "org.freedesktop.NetworkManager.Connection.Active"
+	nmDeviceTypeWiFi        = 2
+	nmWiFiDeviceCapAP       = 0x40
+	nmDeviceStateActivating = 40
+	nmDeviceStateActivated  = 100
+	nmDeviceStateDeactivate = 110
+)
+
+// NMActiveConnectionState values
+const (
+	nmActiveStateActivating   = 1
+	nmActiveStateActivated    = 2
+	nmActiveStateDeactivating = 3
+	nmActiveStateDeactivated  = 4
+)
+
+// NM80211ApFlags and NM80211ApSecurityFlags bits used to describe a network's security
+const (
+	nmAPFlagPrivacy         = 0x1
+	nmAPSecKeyMgmtPSK       = 0x100
+	nmAPSecKeyMgmt8021X     = 0x200
+	nmAPSecKeyMgmtSAE       = 0x400
+	nmAPSecKeyMgmtOWE       = 0x800
+	nmAPSecKeyMgmtOWETM     = 0x1000
+	nmAPSecKeyMgmtEAPSuiteB = 0x2000
+)
+
+const (
+	defaultNMActivationTimeout = 90 * time.Second
+	defaultNMScanTimeout       = 15 * time.Second
+	nmScanPollInterval         = 250 * time.Millisecond
+)
+
+// nmActiveStateReasons names the NMActiveConnectionStateReason values
+var nmActiveStateReasons = map[uint32]string{
+	2:  "disconnected by user",
+	3:  "device disconnected",
+	4:  "service stopped",
+	5:  "IP configuration invalid",
+	6:  "connection timed out",
+	9:  "secrets were required, but not provided",
+	10: "login failed",
+	11: "connection removed",
+	12: "dependency failed",
+	14: "device removed",
+}
+
+// nmSettings is the a{sa{sv}} settings dictionary of a NetworkManager connection
+type nmSettings map[string]map[string]dbus.Variant
+
+// nmClient wraps the NetworkManager D-Bus API used by the interface manager and AP service
+type nmClient struct {
+	conn              *dbus.Conn
+	logger            *slog.Logger
+	activationTimeout time.Duration
+	scanTimeout       time.Duration
+}
+
+func newNMClient(conn *dbus.Conn, logger *slog.Logger) (*nmClient, error) {
+	if conn == nil {
+		var err error
+		if conn, err = dbus.ConnectSystemBus(); err != nil {
+			return nil, errors.Wrap(err, "failed to connect to the system bus")
+		}
+	}
+	return &nmClient{
+		conn:              conn,
+		logger:            logger,
+		activationTimeout: defaultNMActivationTimeout,
+		scanTimeout:       defaultNMScanTimeout,
+	}, nil
+}
+
+func (c *nmClient) object(path dbus.ObjectPath) dbus.BusObject {
+	return c.conn.Object(nmBusName, path)
+}
+
+// nmProperty reads a property and checks its type
+func nmProperty[T any](obj dbus.BusObject, name string) (T, error) {
+	var zero T
+	v, err := obj.GetProperty(name)
+	if err != nil {
+		return zero, errors.Wrapf(err, "failed to read %s of %s", name, obj.Path())
+	}
+	value, ok := v.Value().(T)
+	if !ok {
+		return zero, errors.Errorf("unexpected type %s of %s", v.Signature(), name)
+	}
+	return value, nil
+}
+
+// wifiDevices returns the object paths of all wireless devices
+func (c *nmClient) wifiDevices() ([]dbus.ObjectPath, error) {
+	var devices []dbus.ObjectPath
+	if err := c.object(nmObjectPath).Call(nmInterface+".GetDevices", 0).Store(&devices); err != nil {
+		return nil, errors.Wrap(err, "failed to list devices")
+	}
+	var wifi []dbus.ObjectPath
+	for _, device := range devices {
+		deviceType, err := nmProperty[uint32](c.object(device), nmDeviceInterface+".DeviceType")
+		if err != nil {
+			return nil, err
+		}
+		if deviceType == nmDeviceTypeWiFi {
+			wifi = append(wifi, device)
+		}
+	}
+	return wifi, nil
+}
+
+// device returns the wireless device named interfaceName, or the first one when it is empty
+func (c *nmClient) device(interfaceName string) (dbus.ObjectPath, error) {
+	if interfaceName == "" {
+		devices, err := c.wifiDevices()
+		if err != nil {
+			return "", err
+		}
+		if len(devices) == 0 {
+			return "", ErrNoAccessPointFound
+		}
+		return devices[0], nil
+	}
+	var device dbus.ObjectPath
+	if err := c.object(nmObjectPath).Call(nmInterface+".GetDeviceByIpIface", 0, interfaceName).Store(&device); err != nil {
+		return "", errors.Wrapf(err, "unknown device %s", interfaceName)
+	}
+	return device, nil
+}
+
+// connections returns the settings of every saved connection profile
+func (c *nmClient) connections() (map[dbus.ObjectPath]nmSettings, error) {
+	var paths []dbus.ObjectPath
+	if err := c.object(nmSettingsPath).Call(nmSettingsInterface+".ListConnections", 0).Store(&paths); err != nil {
+		return nil, errors.Wrap(err, "failed to list connections")
+	}
+	connections := make(map[dbus.ObjectPath]nmSettings, len(paths))
+	for _, path := range paths {
+		var settings nmSettings
+		if err := c.object(path).Call(nmConnectionInterface+".GetSettings", 0).Store(&settings); err != nil {
+			return nil, errors.Wrapf(err, "failed to read connection %s", path)
+		}
+		connections[path] = settings
+	}
+	return connections, nil
+}
+
+// connectionsByID returns the saved connection profiles with the given id
+func (c *nmClient) connectionsByID(id string) ([]dbus.ObjectPath, error) {
+	connections, err := c.connections()
+	if err != nil {
+		return nil, err
+	}
+	var matches []dbus.ObjectPath
+	for path, settings := range connections {
+		if connID, ok := settings["connection"]["id"].Value().(string); ok && connID == id {
+			matches = append(matches, path)
+		}
+	}
+	return matches, nil
+}
+
+// connectionByUUID returns the saved connection profile with the given uuid
+func (c *nmClient) connectionByUUID(uuid string) (dbus.ObjectPath, nmSettings, error) {
+	connections, err := c.connections()
+	if err != nil {
+		return "", nil, err
+	}
+	for path, settings := range connections {
+		if connUUID, ok := settings["connection"]["uuid"].Value().(string); ok && connUUID == uuid {
+			return path, settings, nil
+		}
+	}
+	return "", nil, errors.Wrap(ErrProfileNotFound, uuid)
+}
+
+// activeProfiles returns the paths of the connection profiles that are active
+func (c *nmClient) activeProfiles() (map[dbus.ObjectPath]bool, error) {
+	actives, err := nmProperty[[]dbus.ObjectPath](c.object(nmObjectPath), nmInterface+".ActiveConnections")
+	if err != nil {
+		return nil, err
+	}
+	profiles := make(map[dbus.ObjectPath]bool, len(actives))
+	for _, active := range actives {
+		profile, err := nmProperty[dbus.ObjectPath](c.object(active), nmActiveConnInterface+".Connection")
+		if err != nil {
+			// Active connections disappear while they deactivate
+			continue
+		}
+		profiles[profile] = true
+	}
+	return profiles, nil
+}
+
+// withSecrets adds the secrets of a profile to its settings, GetSettings leaves them out and
+// Update would clear them otherwise
+func (c *nmClient) withSecrets(path dbus.ObjectPath, settings nmSettings) nmSettings {
+	for _, setting := range []string{"802-11-wireless-security", "802-1x"} {
+		if _, ok := settings[setting]; !ok {
+			continue
+		}
+		var secrets nmSettings
+		if err := c.object(path).Call(nmConnectionInterface+".GetSecrets", 0, setting).Store(&secrets); err != nil {
+			c.logger.Debug("failed to read connection secrets", slog.String("setting", setting), slog.String("error", err.Error()))
+			continue
+		}
+		for key, value := range secrets[setting] {
+			settings[setting][key] = value
+		}
+	}
+	return settings
+}
+
+// updateConnection replaces the settings of a saved profile
+func (c *nmClient) updateConnection(path dbus.ObjectPath, settings nmSettings) error {
+	if err := c.object(path).Call(nmConnectionInterface+".Update", 0, settings).Err; err != nil {
+		return errors.Wrapf(err, "failed to update connection %s", path)
+	}
+	return nil
+}
+
+// addConnection saves a connection profile without activating it
+func (c *nmClient) addConnection(settings nmSettings) (dbus.ObjectPath, error) {
+	var path dbus.ObjectPath
+	if err := c.object(nmSettingsPath).Call(nmSettingsInterface+".AddConnection", 0, settings).Store(&path); err != nil {
+		return "", errors.Wrap(err, "failed to add connection")
+	}
+	return path, nil
+}
+
+// deleteConnections removes every saved profile with the given id, deactivating it first
+func (c *nmClient) deleteConnections(id string) error {
+	connections, err := c.connectionsByID(id)
+	if err != nil {
+		return err
+	}
+	for _, path := range connections {
+		if err := c.object(path).Call(nmConnectionInterface+".Delete", 0).Err; err != nil {
+			return errors.Wrapf(err, "failed to delete connection %s", id)
+		}
+		c.logger.Debug("removed previous connection profile", slog.String("id", id))
+	}
+	return nil
+}
+
+// activate adds a connection profile for device and waits until NetworkManager reports it
+// activated. It returns the paths of the profile and of the active connection.
+func (c *nmClient) activate(ctx context.Context, settings nmSettings, device dbus.ObjectPath) (dbus.ObjectPath, dbus.ObjectPath, error) {
+	match := []dbus.MatchOption{dbus.WithMatchInterface(nmActiveConnInterface), dbus.WithMatchMember("StateChanged")}
+	if err := c.conn.AddMatchSignalContext(ctx, match...); err != nil {
+		return "", "", errors.Wrap(err, "failed to subscribe to connection state")
+	}
+	defer c.conn.RemoveMatchSignal(match...)
+	signals := make(chan *dbus.Signal, 16)
+	c.conn.Signal(signals)
+	defer c.conn.RemoveSignal(signals)
+
+	var profile, active dbus.ObjectPath
+	call := c.object(nmObjectPath).CallWithContext(ctx, nmInterface+".AddAndActivateConnection", 0, settings, device, dbus.ObjectPath("/"))
+	if err := call.Store(&profile, &active); err != nil {
+		return "", "", errors.Wrapf(ErrConnectionFailed, "failed to activate connection: %s", err)
+	}
+	if err := c.waitActivated(ctx, active, signals); err != nil {
+		return profile, active, err
+	}
+	return profile, active, nil
+}
+
+// waitActivated follows the StateChanged signals of an active connection until it is activated
+func (c *nmClient) waitActivated(ctx context.Context, active dbus.ObjectPath, signals <-chan *dbus.Signal) error {
+	state, err := nmProperty[uint32](c.object(active), nmActiveConnInterface+".State")
+	if err == nil && state == nmActiveStateActivated {
+		return nil
+	}
+	for {
+		select {
+		case <-ctx.Done():
+			return errors.Wrap(ErrConnectionFailed, "timed out waiting for the connection to activate")
+		case sig, ok := <-signals:
+			if !ok {
+				return errors.Wrap(ErrConnectionFailed, "lost connection to NetworkManager")
+			}
+			if sig.Path != active || sig.Name != nmActiveConnInterface+".StateChanged" || len(sig.Body) < 2 {
+				continue
+			}
+			state, _ := sig.Body[0].(uint32)
+			reason, _ := sig.Body[1].(uint32)
+			c.logger.Debug("active connection state changed", slog.Any("state", state), slog.Any("reason", reason))
+			switch state {
+			case nmActiveStateActivated:
+				return nil
+			case nmActiveStateDeactivating, nmActiveStateDeactivated:
+				return errors.Wrap(ErrConnectionFailed, nmActiveStateReason(reason))
+			}
+		}
+	}
+}
+
+func nmActiveStateReason(reason uint32) string {
+	if text, ok := nmActiveStateReasons[reason]; ok {
+		return text
+	}
+	return "reason " + strconv.FormatUint(uint64(reason), 10)
+}
+
+// deactivate takes down an active connection and removes its profile
+func (c *nmClient) deactivate(ctx context.Context, active, profile dbus.ObjectPath) error {
+	var errs []string
+	if active != "" {
+		if err := c.object(nmObjectPath).CallWithContext(ctx, nmInterface+".DeactivateConnection", 0, active).Err; err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if profile != "" {
+		if err := c.object(profile).CallWithContext(ctx, nmConnectionInterface+".Delete", 0).Err; err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.Errorf("failed to remove connection: %s", strings.Join(errs, "; "))
+	}
+	return nil
+}
+
+// requestScan asks the device for a new scan and waits until LastScan changes
+func (c *nmClient) requestScan(device dbus.ObjectPath) error {
+	obj := c.object(device)
+	before, lastScanErr := nmProperty[int64](obj, nmWirelessInterface+".LastScan")
+	if err := obj.Call(nmWirelessInterface+".RequestScan", 0, map[string]dbus.Variant{}).Err; err != nil {
+		return errors.Wrap(err, "failed to request scan")
+	}
+	if lastScanErr != nil {
+		// NetworkManager older than 1.12 does not report when a scan finished
+		return nil
+	}
+
+	deadline := time.Now().Add(c.scanTimeout)
+	for time.Now().Before(deadline) {
+		if last, err := nmProperty[int64](obj, nmWirelessInterface+".LastScan"); err == nil && last != before {
+			return nil
+		}
+		time.Sleep(nmScanPollInterval)
+	}
+	return errors.New("timed out waiting for scan results")
+}
+
+// accessPoints returns the networks a device currently sees
+func (c *nmClient) accessPoints(device dbus.ObjectPath) ([]WirelessNetwork, error) {
+	var paths []dbus.ObjectPath
+	if err := c.object(device).Call(nmWirelessInterface+".GetAllAccessPoints", 0).Store(&paths); err != nil {
+		return nil, errors.Wrap(err, "failed to list access points")
+	}
+	var networks []WirelessNetwork
+	for _, path := range paths {
+		var props map[string]dbus.Variant
+		if err := c.object(path).Call("org.freedesktop.DBus.Properties.GetAll", 0, nmAccessPointInterface).Store(&props); err != nil {
+			// Access points disappear while scanning
+			c.logger.Debug("could not read access point", slog.String("path", string(path)), slog.String("error", err.Error()))
+			continue
+		}
+		network, ok := nmAccessPointNetwork(props)
+		if ok {
+			networks = append(networks, network)
+		}
+	}
+	return networks, nil
+}
+
+// nmAccessPointNetwork converts the properties of an AccessPoint object, skipping hidden ones
+func nmAccessPointNetwork(props map[string]dbus.Variant) (WirelessNetwork, bool) {
+	ssid, _ := props["Ssid"].Value().([]byte)
+	if len(ssid) == 0 {
+		return WirelessNetwork{}, false
+	}
+	bssid, _ := props["HwAddress"].Value().(string)
+	strength, _ := props["Strength"].Value().(byte)
+	frequency, _ := props["Frequency"].Value().(uint32)
+	flags, _ := props["Flags"].Value().(uint32)
+	wpaFlags, _ := props["WpaFlags"].Value().(uint32)
+	rsnFlags, _ := props["RsnFlags"].Value().(uint32)
+	maxBitrate, _ := props["MaxBitrate"].Value().(uint32)
+
+	security := nmSecurityString(flags, wpaFlags, rsnFlags)
+	network := WirelessNetwork{
+		SSID:         string(ssid),
+		DisplayName:  string(ssid),
+		BSSID:        bssid,
+		Signal:       int(strength),
+		SignalDBm:    percentToDBm(int(strength)),
+		Security:     security,
+		SecurityType: normalizeSecurity(security),
+		Enterprise:   IsEnterpriseSecurity(security),
+		MaxRate:      int(maxBitrate / 1000),
+	}
+	if frequency > 0 {
+		network.Frequency = strconv.FormatUint(uint64(frequency), 10) + " MHz"
+		network.Band = bandName(int(frequency))
+		if channel := frequencyToChannel(int(frequency)); channel > 0 {
+			network.Channel = strconv.Itoa(channel)
+		}
+	}
+	return network, true
+}
+
+// nmSecurityString describes access point security the way the nmcli SECURITY column does
+func nmSecurityString(flags, wpaFlags, rsnFlags uint32) string {
+	var parts []string
+	if flags&nmAPFlagPrivacy != 0 && wpaFlags == 0 && rsnFlags == 0 {
+		parts = append(parts, "WEP")
+	}
+	if wpaFlags != 0 {
+		parts = append(parts, "WPA1")
+	}
+	if rsnFlags&(nmAPSecKeyMgmtPSK|nmAPSecKeyMgmt8021X) != 0 {
+		parts = append(parts, "WPA2")
+	}
+	if rsnFlags&nmAPSecKeyMgmtSAE != 0 {
+		parts = append(parts, "WPA3")
+	}
+	if rsnFlags&(nmAPSecKeyMgmtOWE|nmAPSecKeyMgmtOWETM) != 0 {
+		parts = append(parts, "OWE")
+	}
+	if (wpaFlags|rsnFlags)&(nmAPSecKeyMgmt8021X|nmAPSecKeyMgmtEAPSuiteB) != 0 {
+		parts = append(parts, "802.1X")
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// frequencyToChannel returns the channel number of a frequency in MHz, or 0 when unknown
+func frequencyToChannel(frequency int) int {
+	switch {
+	case frequency == 2484:
+		return 14
+	case frequency >= 2412 && frequency <= 2472:
+		return (frequency - 2407) / 5
+	case frequency >= 5955 && frequency <= 7115:
+		return (frequency - 5950) / 5
+	case frequency >= 5000 && frequency < 5955:
+		return (frequency - 5000) / 5
+	default:
+		return 0
+	}
+}
+
+// nmCertPath encodes a certificate path the way the 802-1x cert properties expect it
+func nmCertPath(path string) []byte {
+	return append([]byte("file://"+path), 0)
+}
+
+// nmStationSettings builds the connection profile used to join ssid
+func nmStationSettings(interfaceName, ssid string, creds Credentials, certs map[string]string) nmSettings {
+	settings := nmSettings{
+		"connection": {
+			"id":          dbus.MakeVariant(ssid),
+			"type":        dbus.MakeVariant("802-11-wireless"),
+			"autoconnect": dbus.MakeVariant(true),
+		},
+		"802-11-wireless": {
+			"ssid": dbus.MakeVariant([]byte(ssid)),
+			"mode": dbus.MakeVariant("infrastructure"),
+		},
+		"ipv4": {"method": dbus.MakeVariant("auto")},
+		"ipv6": {"method": dbus.MakeVariant("auto")},
+	}
+	if interfaceName != "" {
+		settings["connection"]["interface-name"] = dbus.MakeVariant(interfaceName)
+	}
+	if creds.Hidden {
+		settings["802-11-wireless"]["hidden"] = dbus.MakeVariant(true)
+	}
+
+	switch keyMgmt := creds.keyMgmt(); keyMgmt {
+	case "wpa-psk", "sae":
+		settings["802-11-wireless-security"] = map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant(keyMgmt),
+			"psk":      dbus.MakeVariant(creds.Password),
+		}
+	case "wpa-eap":
+		settings["802-11-wireless-security"] = map[string]dbus.Variant{"key-mgmt": dbus.MakeVariant(keyMgmt)}
+		eap := map[string]dbus.Variant{
+			"eap":      dbus.MakeVariant([]string{strings.ToLower(creds.EAPMethod)}),
+			"identity": dbus.MakeVariant(creds.Identity),
+		}
+		if creds.AnonymousIdentity != "" {
+			eap["anonymous-identity"] = dbus.MakeVariant(creds.AnonymousIdentity)
+		}
+		if creds.Phase2 != "" {
+			eap["phase2-auth"] = dbus.MakeVariant(strings.ToLower(creds.Phase2))
+		}
+		if creds.Password != "" {
+			eap["password"] = dbus.MakeVariant(creds.Password)
+		}
+		for property, path := range certs {
+			eap[strings.TrimPrefix(property, "802-1x.")] = dbus.MakeVariant(nmCertPath(path))
+		}
+		if _, ok := certs["802-1x.private-key"]; ok {
+			eap["private-key-password"] = dbus.MakeVariant(creds.PrivateKeyPassword)
+		}
+		settings["802-1x"] = eap
+	}
+	return settings
+}
+
+// nmAPSettings builds the connection profile of a hotspot, matching the nmcli based service
+func nmAPSettings(config APConfig) nmSettings {
+	wireless := map[string]dbus.Variant{
+		"ssid": dbus.MakeVariant([]byte(config.SSID)),
+		"mode": dbus.MakeVariant("ap"),
+	}
+	if config.Channel != 0 {
+		band := "bg"
+		if config.Band() == "a" {
+			band = "a"
+		}
+		wireless["band"] = dbus.MakeVariant(band)
+		wireless["channel"] = dbus.MakeVariant(uint32(config.Channel))
+	}
+	if config.Hidden {
+		wireless["hidden"] = dbus.MakeVariant(true)
+	}
+
+	settings := nmSettings{
+		"connection": {
+			"id":             dbus.MakeVariant(config.Name),
+			"type":           dbus.MakeVariant("802-11-wireless"),
+			"interface-name": dbus.MakeVariant(config.Interface),
+			"autoconnect":    dbus.MakeVariant(true),
+		},
+		"802-11-wireless": wireless,
+		"ipv4": {
+			"method": dbus.MakeVariant("manual"),
+			"address-data": dbus.MakeVariant([]map[string]dbus.Variant{{
+				"address": dbus.MakeVariant(config.Gateway),
+				"prefix":  dbus.MakeVariant(uint32(24)),
+			}}),
+		},
+	}
+
+	if mode := config.SecurityMode(); mode != SecurityOpen {
+		keyMgmt := "wpa-psk"
+		if mode == SecurityWPA3 {
+			keyMgmt = "sae"
+		}
+		pmf, _ := strconv.Atoi(nmcliPMF(config.PMFMode()))
+		settings["802-11-wireless-security"] = map[string]dbus.Variant{
+			"key-mgmt": dbus.MakeVariant(keyMgmt),
+			"proto":    dbus.MakeVariant([]string{"rsn"}),
+			"pairwise": dbus.MakeVariant([]string{"ccmp"}),
+			"group":    dbus.MakeVariant([]string{"ccmp"}),
+			"pmf":      dbus.MakeVariant(int32(pmf)),
+			"psk":      dbus.MakeVariant(config.Password),
+		}
+	}
+	return settings
+}
+
+// nmDBusInterfaceManager implements InterfaceManager on the NetworkManager D-Bus API
+type nmDBusInterfaceManager struct {
+	client  *nmClient
+	logger  *slog.Logger
+	certDir string
+	policy  SelectionPolicy
+}
+
+// NewNMDBusInterfaceManager creates an InterfaceManager that talks to NetworkManager over
+// D-Bus instead of parsing nmcli output. It connects to the system bus unless
+// WithInterfaceDBusConn is given.
+func NewNMDBusInterfaceManager(opts ...InterfaceManagerOption) (InterfaceManager, error) {
+	o := newInterfaceManagerOptions(opts)
+	client, err := newNMClient(o.bus, o.logger)
+	if err != nil {
+		return nil, err
+	}
+	return &nmDBusInterfaceManager{
+		client:  client,
+		logger:  o.logger,
+		certDir: o.certDir,
+		policy:  o.policy,
+	}, nil
+}
+
+func (im *nmDBusInterfaceManager) ListWirelessInterfaces() ([]WirelessInterface, error) {
+	devices, err := im.client.wifiDevices()
+	if err != nil {
+		return nil, err
+	}
+	uplinks := im.uplinkDevices()
+
+	interfaces := make([]WirelessInterface, 0, len(devices))
+	for _, device := range devices {
+		obj := im.client.object(device)
+		name, err := nmProperty[string](obj, nmDeviceInterface+".Interface")
+		if err != nil {
+			return nil, err
+		}
+		state, _ := nmProperty[uint32](obj, nmDeviceInterface+".State")
+		driver, _ := nmProperty[string](obj, nmDeviceInterface+".Driver")
+		mac, _ := nmProperty[string](obj, nmWirelessInterface+".HwAddress")
+		caps, _ := nmProperty[uint32](obj, nmWirelessInterface+".WirelessCapabilities")
+		interfaces = append(interfaces, WirelessInterface{
+			Name:       name,
+			MACAddress: mac,
+			Driver:     driver,
+			InUse:      state >= nmDeviceStateActivating && state <= nmDeviceStateDeactivate,
+			SupportAP:  caps&nmWiFiDeviceCapAP != 0,
+			Uplink:     uplinks[device],
+		})
+	}
+	return interfaces, nil
+}
+
+// uplinkDevices returns the devices of the primary connection, which holds the default route
+func (im *nmDBusInterfaceManager) uplinkDevices() map[dbus.ObjectPath]bool {
+	uplinks := make(map[dbus.ObjectPath]bool)
+	primary, err := nmProperty[dbus.ObjectPath](im.client.object(nmObjectPath), nmInterface+".PrimaryConnection")
+	if err != nil || primary == "/" || primary == "" {
+		return uplinks
+	}
+	devices, err := nmProperty[[]dbus.ObjectPath](im.client.object(primary), nmActiveConnInterface+".Devices")
+	if err != nil {
+		return uplinks
+	}
+	for _, device := range devices {
+		uplinks[device] = true
+	}
+	return uplinks
+}
+
+func (im *nmDBusInterfaceManager) GetBestAPInterface() (*WirelessInterface, error) {
+	scores, err := im.RankAPInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	return bestAPInterface(scores, im.logger)
+}
+
+func (im *nmDBusInterfaceManager) RankAPInterfaces() ([]InterfaceScore, error) {
+	interfaces, err := im.ListWirelessInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	return im.policy.Rank(interfaces), nil
+}
+
+func (im *nmDBusInterfaceManager) ListAvailableNetworks(interfaceName string) ([]WirelessNetwork, error) {
+	im.logger.Info("scanning for networks", slog.String("interface", interfaceName))
+
+	var devices []dbus.ObjectPath
+	if interfaceName == "" {
+		var err error
+		if devices, err = im.client.wifiDevices(); err != nil {
+			return nil, err
+		}
+	} else {
+		device, err := im.client.device(interfaceName)
+		if err != nil {
+			return nil, err
+		}
+		devices = []dbus.ObjectPath{device}
+	}
+
+	var networks []WirelessNetwork
+	for _, device := range devices {
+		if err := im.client.requestScan(device); err != nil {
+			// Scans are refused while the device is activating, the cached results are still useful
+			im.logger.Warn("failed to rescan networks", slog.String("error", err.Error()))
+		}
+		found, err := im.client.accessPoints(device)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to scan for networks (interface: %s)", interfaceName)
+		}
+		networks = append(networks, found...)
+	}
+	im.logger.Debug("found networks", slog.Int("count", len(networks)))
+	return networks, nil
+}
+
+func (im *nmDBusInterfaceManager) ConnectToNetwork(interfaceName, ssid, password string) error {
+	return im.ConnectWithCredentials(interfaceName, ssid, Credentials{Password: password})
+}
+
+func (im *nmDBusInterfaceManager) ConnectWithCredentials(interfaceName, ssid string, creds Credentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	im.logger.Info("attempting to connect to network",
+		slog.String("interface", interfaceName),
+		slog.String("ssid", ssid),
+		slog.Bool("enterprise", creds.IsEnterprise()),
+		slog.Bool("hidden", creds.Hidden))
+
+	device, err := im.client.device(interfaceName)
+	if err != nil {
+		return err
+	}
+	// Replace the profile of an earlier attempt, activating it takes the device over
+	if err := im.client.deleteConnections(ssid); err != nil {
+		im.logger.Warn("failed to remove existing connection", slog.String("error", err.Error()))
+	}
+
+	var certs map[string]string
+	if creds.IsEnterprise() {
+		if certs, err = writeCertFiles(im.certDir, ssid, creds); err != nil {
+			return err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), im.client.activationTimeout)
+	defer cancel()
+	if _, _, err := im.client.activate(ctx, nmStationSettings(interfaceName, ssid, creds, certs), device); err != nil {
+		return errors.Wrapf(err, "failed to connect to network %s on interface %s", ssid, interfaceName)
+	}
+
+	im.logger.Info("successfully connected to network",
+		slog.String("interface", interfaceName),
+		slog.String("ssid", ssid))
+	return nil
+}
+
+// JoinStage maps the State property of the device, it uses the codes nmcli reports
+func (im *nmDBusInterfaceManager) JoinStage(interfaceName string) (ConnectionStage, error) {
+	device, err := im.client.device(interfaceName)
+	if err != nil {
+		return "", err
+	}
+	state, err := nmProperty[uint32](im.client.object(device), nmDeviceInterface+".State")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read state of device %s", interfaceName)
+	}
+	return nmDeviceStateStage(int(state)), nil
+}
+
+// ListProfiles returns the saved station profiles, access point profiles are left out
+func (im *nmDBusInterfaceManager) ListProfiles() ([]Profile, error) {
+	connections, err := im.client.connections()
+	if err != nil {
+		return nil, err
+	}
+	active, err := im.client.activeProfiles()
+	if err != nil {
+		im.logger.Warn("failed to read active connections", slog.String("error", err.Error()))
+	}
+
+	profiles := []Profile{}
+	for path, settings := range connections {
+		wireless, ok := settings["802-11-wireless"]
+		if !ok {
+			continue
+		}
+		if mode, _ := wireless["mode"].Value().(string); mode == "ap" {
+			continue
+		}
+		ssid, _ := wireless["ssid"].Value().([]byte)
+		hidden, _ := wireless["hidden"].Value().(bool)
+		keyMgmt, _ := settings["802-11-wireless-security"]["key-mgmt"].Value().(string)
+		name, _ := settings["connection"]["id"].Value().(string)
+		uuid, _ := settings["connection"]["uuid"].Value().(string)
+		priority, _ := settings["connection"]["autoconnect-priority"].Value().(int32)
+		autoConnect, ok := settings["connection"]["autoconnect"].Value().(bool)
+		if !ok {
+			autoConnect = true
+		}
+		profiles = append(profiles, Profile{
+			ID:          uuid,
+			Name:        name,
+			SSID:        string(ssid),
+			Security:    keyMgmtSecurity(keyMgmt),
+			Hidden:      hidden,
+			AutoConnect: autoConnect,
+			Priority:    int(priority),
+			Active:      active[path],
+		})
+	}
+	sortProfiles(profiles)
+	return profiles, nil
+}
+
+func (im *nmDBusInterfaceManager) UpdateProfile(id string, update ProfileUpdate) error {
+	path, settings, err := im.client.connectionByUUID(id)
+	if err != nil {
+		return err
+	}
+	if update.AutoConnect != nil {
+		settings["connection"]["autoconnect"] = dbus.MakeVariant(*update.AutoConnect)
+	}
+	if update.Priority != nil {
+		settings["connection"]["autoconnect-priority"] = dbus.MakeVariant(int32(*update.Priority))
+	}
+	if err := im.client.updateConnection(path, im.client.withSecrets(path, settings)); err != nil {
+		return err
+	}
+	im.logger.Info("updated connection profile", slog.String("id", id))
+	return nil
+}
+
+func (im *nmDBusInterfaceManager) ForgetProfile(id string) error {
+	path, _, err := im.client.connectionByUUID(id)
+	if err != nil {
+		return err
+	}
+	if err := im.client.object(path).Call(nmConnectionInterface+".Delete", 0).Err; err != nil {
+		return errors.Wrapf(err, "failed to delete connection %s", id)
+	}
+	im.logger.Info("removed connection profile", slog.String("id", id))
+	return nil
+}
+
+// UpdateProfileCredentials replaces the security settings of a profile
+func (im *nmDBusInterfaceManager) UpdateProfileCredentials(id string, creds Credentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	path, settings, err := im.client.connectionByUUID(id)
+	if err != nil {
+		return err
+	}
+	if _, ok := settings["802-11-wireless"]; !ok {
+		return errors.Wrapf(ErrProfileNotFound, "%s is not a Wi-Fi profile", id)
+	}
+	ssid, _ := settings["802-11-wireless"]["ssid"].Value().([]byte)
+
+	var certs map[string]string
+	if creds.IsEnterprise() {
+		if certs, err = writeCertFiles(im.certDir, string(ssid), creds); err != nil {
+			return err
+		}
+	}
+	replacement := nmStationSettings("", string(ssid), creds, certs)
+	settings["802-11-wireless"]["hidden"] = dbus.MakeVariant(creds.Hidden)
+	for _, setting := range []string{"802-11-wireless-security", "802-1x"} {
+		delete(settings, setting)
+		if values, ok := replacement[setting]; ok {
+			settings[setting] = values
+		}
+	}
+	if err := im.client.updateConnection(path, settings); err != nil {
+		return err
+	}
+	im.logger.Info("updated connection profile credentials", slog.String("id", id), slog.String("ssid", string(ssid)))
+	return nil
+}
+
+// SaveProfile adds an autoconnect profile for ssid without joining it, replacing earlier
+// profiles of the same name
+func (im *nmDBusInterfaceManager) SaveProfile(interfaceName, ssid string, creds Credentials, priority int) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	if err := im.client.deleteConnections(ssid); err != nil {
+		im.logger.Warn("failed to remove existing connection", slog.String("error", err.Error()))
+	}
+
+	var certs map[string]string
+	if creds.IsEnterprise() {
+		var err error
+		if certs, err = writeCertFiles(im.certDir, ssid, creds); err != nil {
+			return err
+		}
+	}
+	settings := nmStationSettings(interfaceName, ssid, creds, certs)
+	settings["connection"]["autoconnect-priority"] = dbus.MakeVariant(int32(priority))
+	if _, err := im.client.addConnection(settings); err != nil {
+		return errors.Wrapf(err, "failed to save network %s", ssid)
+	}
+	im.logger.Info("saved connection profile", slog.String("ssid", ssid), slog.Int("priority", priority))
+	return nil
+}
@@ -0,0 +1,129 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/godbus/dbus/v5"
+	"github.com/pkg/errors"
+)
+
+// nmDBusAPService implements APService by activating a NetworkManager hotspot profile over D-Bus
+type nmDBusAPService struct {
+	mu      sync.Mutex
+	client  *nmClient
+	config  APConfig
+	clients *clientServices
+	monitor *processMonitor
+	runner  command.Runner
+	logger  *slog.Logger
+	running bool
+	profile dbus.ObjectPath
+	active  dbus.ObjectPath
+}
+
+// NewNMDBusAPService creates an APService that manages the NetworkManager hotspot over D-Bus.
+// It connects to the system bus unless WithAPDBusConn is given.
+func NewNMDBusAPService(opts ...APServiceOption) (APService, error) {
+	o := newAPServiceOptions(opts)
+	monitor := newProcessMonitor(o)
+	client, err := newNMClient(o.bus, o.logger)
+	if err != nil {
+		return nil, err
+	}
+	return &nmDBusAPService{
+		client:  client,
+		clients: newClientServices(o, monitor),
+		monitor: monitor,
+		runner:  o.runner,
+		logger:  o.logger,
+	}, nil
+}
+
+func (h *nmDBusAPService) Start(ctx context.Context, config APConfig) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.running {
+		return ErrServiceAlreadyRunning
+	}
+	if err := config.Validate(); err != nil {
+		return errors.Wrap(err, "invalid access point configuration")
+	}
+	h.config = config
+	h.logger.Info("starting access point service", slog.String("ssid", config.SSID))
+
+	device, err := h.client.device(config.Interface)
+	if err != nil {
+		return errors.Wrap(err, "failed to prepare interface")
+	}
+	if err := h.client.object(device).SetProperty(nmDeviceInterface+".Managed", dbus.MakeVariant(true)); err != nil {
+		return errors.Wrap(err, "failed to set interface to managed mode")
+	}
+	if err := h.client.deleteConnections(config.Name); err != nil {
+		h.logger.Warn("failed to remove existing hotspot profile", slog.String("error", err.Error()))
+	}
+
+	if config.SecurityMode() == SecurityWPA2WPA3 {
+		h.logger.Warn("NetworkManager cannot host WPA2/WPA3 transition mode, falling back to WPA2 with optional PMF",
+			slog.String("ssid", config.SSID))
+	}
+	activateCtx, cancel := context.WithTimeout(ctx, h.client.activationTimeout)
+	defer cancel()
+	profile, active, err := h.client.activate(activateCtx, nmAPSettings(config), device)
+	if err != nil {
+		h.client.deactivate(context.WithoutCancel(ctx), active, profile)
+		return errors.Wrap(err, "failed to create NetworkManager hotspot")
+	}
+	h.profile, h.active = profile, active
+
+	applyCaptiveRules(ctx, h.runner, h.logger, config.Interface, config.PortalPort)
+	if err := h.clients.start(ctx, config); err != nil {
+		removeCaptiveRules(ctx, h.runner, config.Interface, config.PortalPort)
+		h.client.deactivate(context.WithoutCancel(ctx), active, profile)
+		return err
+	}
+
+	h.running = true
+	return nil
+}
+
+func (h *nmDBusAPService) Stop(ctx context.Context) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if !h.running {
+		return nil
+	}
+
+	h.clients.stop(ctx)
+	if err := h.client.deactivate(ctx, h.active, h.profile); err != nil {
+		h.logger.Error("failed to remove hotspot", slog.String("name", h.config.Name), slog.String("error", err.Error()))
+	}
+	removeCaptiveRules(ctx, h.runner, h.config.Interface, h.config.PortalPort)
+
+	h.running = false
+	h.profile, h.active = "", ""
+	h.logger.Debug("access point service stopped")
+	return nil
+}
+
+func (h *nmDBusAPService) IsRunning() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.running
+}
+
+// Health reports the dnsmasq process serving hotspot clients
+func (h *nmDBusAPService) Health() APHealth {
+	h.mu.Lock()
+	running := h.running
+	h.mu.Unlock()
+	return h.monitor.health(running)
+}
+
+func (h *nmDBusAPService) Events() <-chan APEvent {
+	return h.monitor.events
+}
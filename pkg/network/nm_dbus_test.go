@@ -0,0 +1,519 @@
+package network
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/godbus/dbus/v5"
+	"github.com/godbus/dbus/v5/prop"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeNetworkManager is a stand-in for the parts of the NetworkManager D-Bus API the backend uses
+type fakeNetworkManager struct {
+	t     *testing.T
+	conn  *dbus.Conn
+	props *prop.Properties
+
+	mu          sync.Mutex
+	devices     map[string]dbus.ObjectPath
+	deviceList  []dbus.ObjectPath
+	deviceProps map[dbus.ObjectPath]*prop.Properties
+	aps         map[dbus.ObjectPath][]dbus.ObjectPath
+	profiles    map[dbus.ObjectPath]nmSettings
+	active      map[dbus.ObjectPath]*prop.Properties
+	deactivated []dbus.ObjectPath
+	failures    map[string]uint32 // Connection id to the state reason its activation fails with
+	nextID      int
+}
+
+func newFakeNetworkManager(t *testing.T, address string) *fakeNetworkManager {
+	t.Helper()
+	f := &fakeNetworkManager{
+		t:           t,
+		conn:        dialTestBus(t, address),
+		devices:     make(map[string]dbus.ObjectPath),
+		deviceProps: make(map[dbus.ObjectPath]*prop.Properties),
+		aps:         make(map[dbus.ObjectPath][]dbus.ObjectPath),
+		profiles:    make(map[dbus.ObjectPath]nmSettings),
+		active:      make(map[dbus.ObjectPath]*prop.Properties),
+		failures:    make(map[string]uint32),
+	}
+	require.NoError(t, f.conn.Export(fakeNMRoot{f}, nmObjectPath, nmInterface))
+	require.NoError(t, f.conn.Export(fakeNMSettings{f}, nmSettingsPath, nmSettingsInterface))
+	var err error
+	f.props, err = prop.Export(f.conn, nmObjectPath, prop.Map{nmInterface: {
+		"PrimaryConnection": {Value: dbus.ObjectPath("/")},
+		"ActiveConnections": {Value: []dbus.ObjectPath{}},
+	}})
+	require.NoError(t, err)
+
+	reply, err := f.conn.RequestName(nmBusName, dbus.NameFlagDoNotQueue)
+	require.NoError(t, err)
+	require.Equal(t, dbus.RequestNameReplyPrimaryOwner, reply)
+	return f
+}
+
+func (f *fakeNetworkManager) path(kind string) dbus.ObjectPath {
+	f.nextID++
+	return dbus.ObjectPath(fmt.Sprintf("/org/freedesktop/NetworkManager/%s/%d", kind, f.nextID))
+}
+
+// addDevice registers a device, deviceType 2 is Wi-Fi
+func (f *fakeNetworkManager) addDevice(name string, deviceType uint32, state uint32, capabilities uint32) dbus.ObjectPath {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := f.path("Devices")
+	require.NoError(f.t, f.conn.Export(fakeNMDevice{f, path}, path, nmWirelessInterface))
+	props, err := prop.Export(f.conn, path, prop.Map{
+		nmDeviceInterface: {
+			"Interface":  {Value: name},
+			"DeviceType": {Value: deviceType},
+			"State":      {Value: state},
+			"Driver":     {Value: "brcmfmac"},
+			"Managed":    {Value: false, Writable: true},
+		},
+		nmWirelessInterface: {
+			"HwAddress":            {Value: "B8:27:EB:12:34:56"},
+			"WirelessCapabilities": {Value: capabilities},
+			"LastScan":             {Value: int64(1000)},
+		},
+	})
+	require.NoError(f.t, err)
+	f.devices[name] = path
+	f.deviceList = append(f.deviceList, path)
+	f.deviceProps[path] = props
+	return path
+}
+
+// addAccessPoint makes an access point visible to a device
+func (f *fakeNetworkManager) addAccessPoint(device dbus.ObjectPath, ssid []byte, bssid string, strength byte, frequency, flags, wpaFlags, rsnFlags uint32) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	path := f.path("AccessPoint")
+	_, err := prop.Export(f.conn, path, prop.Map{nmAccessPointInterface: {
+		"Ssid":      {Value: ssid},
+		"HwAddress": {Value: bssid},
+		"Strength":  {Value: strength},
+		"Frequency": {Value: frequency},
+		"Flags":     {Value: flags},
+		"WpaFlags":  {Value: wpaFlags},
+		"RsnFlags":  {Value: rsnFlags},
+	}})
+	require.NoError(f.t, err)
+	f.aps[device] = append(f.aps[device], path)
+}
+
+func (f *fakeNetworkManager) addProfile(settings nmSettings) dbus.ObjectPath {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.addProfileLocked(settings)
+}
+
+func (f *fakeNetworkManager) addProfileLocked(settings nmSettings) dbus.ObjectPath {
+	path := f.path("Settings")
+	// NetworkManager assigns the uuid of profiles added without one
+	if _, ok := settings["connection"]["uuid"]; !ok && settings["connection"] != nil {
+		settings["connection"]["uuid"] = dbus.MakeVariant(fmt.Sprintf("uuid-%d", f.nextID))
+	}
+	require.NoError(f.t, f.conn.Export(fakeNMConnection{f, path}, path, nmConnectionInterface))
+	f.profiles[path] = settings
+	return path
+}
+
+func (f *fakeNetworkManager) profileIDs() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	var ids []string
+	for _, settings := range f.profiles {
+		ids = append(ids, settings["connection"]["id"].Value().(string))
+	}
+	return ids
+}
+
+func (f *fakeNetworkManager) profile(id string) nmSettings {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, settings := range f.profiles {
+		if settings["connection"]["id"].Value().(string) == id {
+			return settings
+		}
+	}
+	return nil
+}
+
+func (f *fakeNetworkManager) updateActiveConnectionsLocked() {
+	actives := []dbus.ObjectPath{}
+	for path := range f.active {
+		actives = append(actives, path)
+	}
+	f.props.SetMust(nmInterface, "ActiveConnections", actives)
+}
+
+type fakeNMRoot struct{ f *fakeNetworkManager }
+
+func (r fakeNMRoot) GetDevices() ([]dbus.ObjectPath, *dbus.Error) {
+	r.f.mu.Lock()
+	defer r.f.mu.Unlock()
+	return append([]dbus.ObjectPath{}, r.f.deviceList...), nil
+}
+
+func (r fakeNMRoot) GetDeviceByIpIface(name string) (dbus.ObjectPath, *dbus.Error) {
+	r.f.mu.Lock()
+	defer r.f.mu.Unlock()
+	if path, ok := r.f.devices[name]; ok {
+		return path, nil
+	}
+	return "", dbus.NewError("org.freedesktop.NetworkManager.UnknownDevice", []any{"No device found for the requested iface."})
+}
+
+func (r fakeNMRoot) AddAndActivateConnection(settings map[string]map[string]dbus.Variant, device, _ dbus.ObjectPath) (dbus.ObjectPath, dbus.ObjectPath, *dbus.Error) {
+	f := r.f
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	profile := f.addProfileLocked(settings)
+	active := f.path("ActiveConnection")
+	props, err := prop.Export(f.conn, active, prop.Map{nmActiveConnInterface: {
+		"State":      {Value: uint32(nmActiveStateActivating)},
+		"Devices":    {Value: []dbus.ObjectPath{device}},
+		"Connection": {Value: profile},
+	}})
+	if err != nil {
+		return "", "", dbus.MakeFailedError(err)
+	}
+	f.active[active] = props
+	f.updateActiveConnectionsLocked()
+
+	state, reason := uint32(nmActiveStateActivated), uint32(1)
+	if failure, ok := f.failures[settings["connection"]["id"].Value().(string)]; ok {
+		state, reason = nmActiveStateDeactivated, failure
+	}
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		props.SetMust(nmActiveConnInterface, "State", state)
+		f.conn.Emit(active, nmActiveConnInterface+".StateChanged", state, reason)
+	}()
+	return profile, active, nil
+}
+
+func (r fakeNMRoot) DeactivateConnection(active dbus.ObjectPath) *dbus.Error {
+	r.f.mu.Lock()
+	defer r.f.mu.Unlock()
+	if _, ok := r.f.active[active]; !ok {
+		return dbus.NewError("org.freedesktop.NetworkManager.ConnectionNotActive", []any{"Not active"})
+	}
+	delete(r.f.active, active)
+	r.f.updateActiveConnectionsLocked()
+	r.f.deactivated = append(r.f.deactivated, active)
+	return nil
+}
+
+type fakeNMSettings struct{ f *fakeNetworkManager }
+
+func (s fakeNMSettings) ListConnections() ([]dbus.ObjectPath, *dbus.Error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	var paths []dbus.ObjectPath
+	for path := range s.f.profiles {
+		paths = append(paths, path)
+	}
+	return paths, nil
+}
+
+func (s fakeNMSettings) AddConnection(settings map[string]map[string]dbus.Variant) (dbus.ObjectPath, *dbus.Error) {
+	s.f.mu.Lock()
+	defer s.f.mu.Unlock()
+	return s.f.addProfileLocked(settings), nil
+}
+
+type fakeNMConnection struct {
+	f    *fakeNetworkManager
+	path dbus.ObjectPath
+}
+
+func (c fakeNMConnection) GetSettings() (map[string]map[string]dbus.Variant, *dbus.Error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	settings, ok := c.f.profiles[c.path]
+	if !ok {
+		return nil, dbus.NewError("org.freedesktop.DBus.Error.UnknownObject", nil)
+	}
+	// Like NetworkManager, secrets are only returned by GetSecrets
+	public := make(map[string]map[string]dbus.Variant)
+	for name, setting := range settings {
+		public[name] = make(map[string]dbus.Variant)
+		for key, value := range setting {
+			if !fakeNMSecrets[key] {
+				public[name][key] = value
+			}
+		}
+	}
+	return public, nil
+}
+
+var fakeNMSecrets = map[string]bool{"psk": true, "password": true, "private-key-password": true}
+
+func (c fakeNMConnection) GetSecrets(setting string) (map[string]map[string]dbus.Variant, *dbus.Error) {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	secrets := map[string]dbus.Variant{}
+	for key, value := range c.f.profiles[c.path][setting] {
+		if fakeNMSecrets[key] {
+			secrets[key] = value
+		}
+	}
+	return map[string]map[string]dbus.Variant{setting: secrets}, nil
+}
+
+func (c fakeNMConnection) Update(settings map[string]map[string]dbus.Variant) *dbus.Error {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	if _, ok := c.f.profiles[c.path]; !ok {
+		return dbus.NewError("org.freedesktop.DBus.Error.UnknownObject", nil)
+	}
+	c.f.profiles[c.path] = settings
+	return nil
+}
+
+func (c fakeNMConnection) Delete() *dbus.Error {
+	c.f.mu.Lock()
+	defer c.f.mu.Unlock()
+	delete(c.f.profiles, c.path)
+	c.f.conn.Export(nil, c.path, nmConnectionInterface)
+	return nil
+}
+
+type fakeNMDevice struct {
+	f    *fakeNetworkManager
+	path dbus.ObjectPath
+}
+
+func (d fakeNMDevice) GetAllAccessPoints() ([]dbus.ObjectPath, *dbus.Error) {
+	d.f.mu.Lock()
+	defer d.f.mu.Unlock()
+	return append([]dbus.ObjectPath{}, d.f.aps[d.path]...), nil
+}
+
+func (d fakeNMDevice) RequestScan(map[string]dbus.Variant) *dbus.Error {
+	d.f.mu.Lock()
+	props := d.f.deviceProps[d.path]
+	d.f.mu.Unlock()
+	last := props.GetMust(nmWirelessInterface, "LastScan").(int64)
+	props.SetMust(nmWirelessInterface, "LastScan", last+1)
+	return nil
+}
+
+func newTestNMDBus(t *testing.T) (*fakeNetworkManager, *dbus.Conn) {
+	address := startTestBus(t)
+	return newFakeNetworkManager(t, address), dialTestBus(t, address)
+}
+
+func TestNMDBusInterfaceManager_ListWirelessInterfaces(t *testing.T) {
+	fake, conn := newTestNMDBus(t)
+	fake.addDevice("eth0", 1, nmDeviceStateActivated, 0)
+	wlan0 := fake.addDevice("wlan0", nmDeviceTypeWiFi, nmDeviceStateActivated, nmWiFiDeviceCapAP)
+	fake.addDevice("wlan1", nmDeviceTypeWiFi, 30, 0)
+	_, err := prop.Export(fake.conn, "/org/freedesktop/NetworkManager/ActiveConnection/99", prop.Map{nmActiveConnInterface: {
+		"Devices": {Value: []dbus.ObjectPath{wlan0}},
+	}})
+	require.NoError(t, err)
+	fake.props.SetMust(nmInterface, "PrimaryConnection", dbus.ObjectPath("/org/freedesktop/NetworkManager/ActiveConnection/99"))
+
+	im, err := NewNMDBusInterfaceManager(WithInterfaceDBusConn(conn))
+	require.NoError(t, err)
+
+	interfaces, err := im.ListWirelessInterfaces()
+	require.NoError(t, err)
+	assert.Equal(t, []WirelessInterface{
+		{Name: "wlan0", SupportAP: true, InUse: true, Uplink: true, MACAddress: "B8:27:EB:12:34:56", Driver: "brcmfmac"},
+		{Name: "wlan1", MACAddress: "B8:27:EB:12:34:56", Driver: "brcmfmac"},
+	}, interfaces)
+
+	best, err := im.GetBestAPInterface()
+	assert.ErrorIs(t, err, ErrAllAccessPointsInUse)
+	assert.Equal(t, "wlan0", best.Name)
+}
+
+func TestNMDBusInterfaceManager_ListAvailableNetworks(t *testing.T) {
+	fake, conn := newTestNMDBus(t)
+	wlan0 := fake.addDevice("wlan0", nmDeviceTypeWiFi, 30, nmWiFiDeviceCapAP)
+	fake.addAccessPoint(wlan0, []byte("Café:Guest"), "AA:BB:CC:DD:EE:01", 72, 2437, 0, 0, 0)
+	fake.addAccessPoint(wlan0, []byte("Home"), "AA:BB:CC:DD:EE:02", 55, 5180, nmAPFlagPrivacy, 0, nmAPSecKeyMgmtPSK|nmAPSecKeyMgmtSAE)
+	fake.addAccessPoint(wlan0, []byte("Corp"), "AA:BB:CC:DD:EE:03", 40, 2412, nmAPFlagPrivacy, nmAPSecKeyMgmt8021X, nmAPSecKeyMgmt8021X)
+	fake.addAccessPoint(wlan0, nil, "AA:BB:CC:DD:EE:04", 90, 2412, nmAPFlagPrivacy, 0, nmAPSecKeyMgmtPSK)
+
+	im, err := NewNMDBusInterfaceManager(WithInterfaceDBusConn(conn))
+	require.NoError(t, err)
+
+	networks, err := im.ListAvailableNetworks("wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, []WirelessNetwork{
+		{SSID: "Café:Guest", DisplayName: "Café:Guest", BSSID: "AA:BB:CC:DD:EE:01", Signal: 72, SignalDBm: -47, Security: "none", SecurityType: NetworkSecurityOpen, Frequency: "2437 MHz", Channel: "6", Band: Band24GHz},
+		{SSID: "Home", DisplayName: "Home", BSSID: "AA:BB:CC:DD:EE:02", Signal: 55, SignalDBm: -57, Security: "WPA2 WPA3", SecurityType: NetworkSecuritySAE, Frequency: "5180 MHz", Channel: "36", Band: Band5GHz},
+		{SSID: "Corp", DisplayName: "Corp", BSSID: "AA:BB:CC:DD:EE:03", Signal: 40, SignalDBm: -66, Security: "WPA1 WPA2 802.1X", SecurityType: NetworkSecurity8021X, Enterprise: true, Frequency: "2412 MHz", Channel: "1", Band: Band24GHz},
+	}, networks)
+	assert.Equal(t, int64(1001), fake.deviceProps[wlan0].GetMust(nmWirelessInterface, "LastScan"))
+
+	_, err = im.ListAvailableNetworks("wlan9")
+	assert.Error(t, err)
+}
+
+func TestNMDBusInterfaceManager_Connect(t *testing.T) {
+	fake, conn := newTestNMDBus(t)
+	fake.addDevice("wlan0", nmDeviceTypeWiFi, 30, nmWiFiDeviceCapAP)
+	fake.addProfile(nmSettings{"connection": {"id": dbus.MakeVariant("Home")}})
+	fake.addProfile(nmSettings{"connection": {"id": dbus.MakeVariant("Home Office")}})
+
+	im, err := NewNMDBusInterfaceManager(WithInterfaceDBusConn(conn))
+	require.NoError(t, err)
+
+	require.NoError(t, im.ConnectWithCredentials("wlan0", "Home", Credentials{Password: "secret123", Hidden: true}))
+	assert.ElementsMatch(t, []string{"Home", "Home Office"}, fake.profileIDs())
+
+	settings := fake.profile("Home")
+	require.NotNil(t, settings)
+	assert.Equal(t, []byte("Home"), settings["802-11-wireless"]["ssid"].Value())
+	assert.Equal(t, true, settings["802-11-wireless"]["hidden"].Value())
+	assert.Equal(t, "wlan0", settings["connection"]["interface-name"].Value())
+	assert.Equal(t, "wpa-psk", settings["802-11-wireless-security"]["key-mgmt"].Value())
+	assert.Equal(t, "secret123", settings["802-11-wireless-security"]["psk"].Value())
+}
+
+func TestNMDBusInterfaceManager_ConnectEnterprise(t *testing.T) {
+	fake, conn := newTestNMDBus(t)
+	fake.addDevice("wlan0", nmDeviceTypeWiFi, 30, nmWiFiDeviceCapAP)
+	certDir := t.TempDir()
+
+	im, err := NewNMDBusInterfaceManager(WithInterfaceDBusConn(conn), WithInterfaceCertDir(certDir))
+	require.NoError(t, err)
+
+	require.NoError(t, im.ConnectWithCredentials("wlan0", "Corp", Credentials{
+		EAPMethod: "PEAP", Phase2: "MSCHAPV2", Identity: "alice", Password: "hunter2",
+		CACert: "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n",
+	}))
+
+	eap := fake.profile("Corp")["802-1x"]
+	assert.Equal(t, []string{"peap"}, eap["eap"].Value())
+	assert.Equal(t, "mschapv2", eap["phase2-auth"].Value())
+	assert.Equal(t, "alice", eap["identity"].Value())
+	caCert, ok := eap["ca-cert"].Value().([]byte)
+	require.True(t, ok)
+	assert.Regexp(t, "^file://"+certDir+"/.+\x00$", string(caCert))
+}
+
+func TestNMDBusInterfaceManager_ConnectFailure(t *testing.T) {
+	fake, conn := newTestNMDBus(t)
+	fake.addDevice("wlan0", nmDeviceTypeWiFi, 30, nmWiFiDeviceCapAP)
+	fake.failures["Home"] = 9
+
+	im, err := NewNMDBusInterfaceManager(WithInterfaceDBusConn(conn))
+	require.NoError(t, err)
+
+	err = im.ConnectToNetwork("wlan0", "Home", "wrong-password")
+	assert.ErrorIs(t, err, ErrConnectionFailed)
+	assert.Contains(t, err.Error(), "secrets were required")
+}
+
+func TestNMDBusInterfaceManager_Profiles(t *testing.T) {
+	fake, conn := newTestNMDBus(t)
+	fake.addDevice("wlan0", nmDeviceTypeWiFi, 30, nmWiFiDeviceCapAP)
+	fake.addProfile(nmAPSettings(APConfig{Name: "go-wifiportal", Interface: "wlan0", SSID: "GoWiFiPortal", Password: "12345678", Security: "wpa2", Gateway: "192.168.4.1"}))
+	fake.addProfile(nmSettings{"connection": {"id": dbus.MakeVariant("Wired"), "type": dbus.MakeVariant("802-3-ethernet")}})
+	office := nmStationSettings("", "Office", Credentials{Password: "officepass"}, nil)
+	office["connection"]["autoconnect-priority"] = dbus.MakeVariant(int32(10))
+	fake.addProfile(office)
+
+	im, err := NewNMDBusInterfaceManager(WithInterfaceDBusConn(conn))
+	require.NoError(t, err)
+	require.NoError(t, im.ConnectWithCredentials("wlan0", "Home", Credentials{Password: "secret123"}))
+
+	profiles, err := im.ListProfiles()
+	require.NoError(t, err)
+	require.Len(t, profiles, 2)
+	assert.Equal(t, Profile{ID: profiles[0].ID, Name: "Office", SSID: "Office", Security: NetworkSecurityWPA2PSK, AutoConnect: true, Priority: 10}, profiles[0])
+	assert.Equal(t, Profile{ID: profiles[1].ID, Name: "Home", SSID: "Home", Security: NetworkSecurityWPA2PSK, AutoConnect: true, Active: true}, profiles[1])
+	officeID, homeID := profiles[0].ID, profiles[1].ID
+
+	// Updates keep the secrets GetSettings leaves out
+	priority, autoConnect := 20, false
+	require.NoError(t, im.UpdateProfile(homeID, ProfileUpdate{Priority: &priority, AutoConnect: &autoConnect}))
+	home := fake.profile("Home")
+	assert.Equal(t, int32(20), home["connection"]["autoconnect-priority"].Value())
+	assert.Equal(t, false, home["connection"]["autoconnect"].Value())
+	assert.Equal(t, "secret123", home["802-11-wireless-security"]["psk"].Value())
+
+	require.NoError(t, im.UpdateProfileCredentials(homeID, Credentials{Hidden: true}))
+	home = fake.profile("Home")
+	assert.NotContains(t, home, "802-11-wireless-security")
+	assert.Equal(t, true, home["802-11-wireless"]["hidden"].Value())
+	assert.Equal(t, int32(20), home["connection"]["autoconnect-priority"].Value())
+
+	require.NoError(t, im.ForgetProfile(officeID))
+	assert.ElementsMatch(t, []string{"go-wifiportal", "Wired", "Home"}, fake.profileIDs())
+	assert.ErrorIs(t, im.ForgetProfile(officeID), ErrProfileNotFound)
+
+	require.NoError(t, im.SaveProfile("wlan0", "Hotspot", Credentials{Password: "hotspot123"}, 5))
+	hotspot := fake.profile("Hotspot")
+	assert.Equal(t, int32(5), hotspot["connection"]["autoconnect-priority"].Value())
+	assert.Equal(t, "hotspot123", hotspot["802-11-wireless-security"]["psk"].Value())
+	profiles, err = im.ListProfiles()
+	require.NoError(t, err)
+	assert.Equal(t, []string{"Home", "Hotspot"}, KnownSSIDs(profiles))
+	assert.False(t, profiles[1].Active)
+}
+
+func TestNMDBusAPService_StartStop(t *testing.T) {
+	fake, conn := newTestNMDBus(t)
+	wlan0 := fake.addDevice("wlan0", nmDeviceTypeWiFi, 30, nmWiFiDeviceCapAP)
+	fake.addProfile(nmSettings{"connection": {"id": dbus.MakeVariant("go-wifiportal")}})
+	runner := command.NewFakeRunner()
+
+	h, err := NewNMDBusAPService(WithAPDBusConn(conn), WithAPCommandRunner(runner))
+	require.NoError(t, err)
+
+	config := APConfig{
+		Name: "go-wifiportal", Interface: "wlan0", SSID: "Setup", Password: "12345678", CountryCode: "SE",
+		Security: SecurityWPA3, Gateway: "192.168.4.1", DHCPRange: "192.168.4.2,192.168.4.50", PortalPort: "8080", Channel: 36,
+	}
+	require.NoError(t, h.Start(context.Background(), config))
+	assert.True(t, h.IsRunning())
+	assert.Equal(t, true, fake.deviceProps[wlan0].GetMust(nmDeviceInterface, "Managed"))
+	assert.Equal(t, []string{"go-wifiportal"}, fake.profileIDs())
+
+	settings := fake.profile("go-wifiportal")
+	assert.Equal(t, "ap", settings["802-11-wireless"]["mode"].Value())
+	assert.Equal(t, "a", settings["802-11-wireless"]["band"].Value())
+	assert.Equal(t, uint32(36), settings["802-11-wireless"]["channel"].Value())
+	assert.Equal(t, "sae", settings["802-11-wireless-security"]["key-mgmt"].Value())
+	assert.Equal(t, int32(3), settings["802-11-wireless-security"]["pmf"].Value())
+	assert.Equal(t, "manual", settings["ipv4"]["method"].Value())
+	assert.NotNil(t, h.(*nmDBusAPService).clients.dnsmasq.child)
+
+	assert.ErrorIs(t, h.Start(context.Background(), config), ErrServiceAlreadyRunning)
+
+	require.NoError(t, h.Stop(context.Background()))
+	assert.False(t, h.IsRunning())
+	assert.Empty(t, fake.profileIDs())
+	assert.Len(t, fake.deactivated, 1)
+}
+
+func TestNMSecurityString(t *testing.T) {
+	assert.Equal(t, "none", nmSecurityString(0, 0, 0))
+	assert.Equal(t, "WEP", nmSecurityString(nmAPFlagPrivacy, 0, 0))
+	assert.Equal(t, "WPA2", nmSecurityString(nmAPFlagPrivacy, 0, nmAPSecKeyMgmtPSK))
+	assert.Equal(t, "WPA3", nmSecurityString(nmAPFlagPrivacy, 0, nmAPSecKeyMgmtSAE))
+	assert.Equal(t, "OWE", nmSecurityString(0, 0, nmAPSecKeyMgmtOWE))
+	assert.Equal(t, "WPA2 802.1X", nmSecurityString(nmAPFlagPrivacy, 0, nmAPSecKeyMgmt8021X))
+}
+
+func TestFrequencyToChannel(t *testing.T) {
+	for frequency, channel := range map[int]int{2412: 1, 2472: 13, 2484: 14, 5180: 36, 5825: 165, 5955: 1, 6115: 33, 60480: 0} {
+		assert.Equal(t, channel, frequencyToChannel(frequency), "frequency %d", frequency)
+	}
+}
@@ -0,0 +1,417 @@
+package network
+
+import (
+	"log/slog"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+// Band names reported in WirelessBand.Name
+const (
+	Band24GHz = "2.4GHz"
+	Band5GHz  = "5GHz"
+	Band6GHz  = "6GHz"
+	Band60GHz = "60GHz"
+)
+
+// PhyCapabilities describes what a wireless radio supports, as reported by "iw phy <phy> info"
+type PhyCapabilities struct {
+	Phy           string                 `json:"phy"`
+	Modes         []string               `json:"modes"`
+	Bands         []WirelessBand         `json:"bands"`
+	MaxAPStations int                    `json:"max_ap_stations,omitempty"` // 0 when the driver does not report a limit
+	Combinations  []InterfaceCombination `json:"combinations,omitempty"`
+	Regulatory    RegulatoryDomain       `json:"regulatory"`
+}
+
+// WirelessBand is a frequency band and the channels the radio may use in it
+type WirelessBand struct {
+	Name     string            `json:"name"`
+	Channels []WirelessChannel `json:"channels"`
+}
+
+// WirelessChannel is a single channel of a band
+type WirelessChannel struct {
+	Number      int     `json:"number"`
+	Frequency   int     `json:"frequency"` // MHz
+	MaxPowerDBm float64 `json:"max_power_dbm,omitempty"`
+	Disabled    bool    `json:"disabled,omitempty"`
+	NoIR        bool    `json:"no_ir,omitempty"` // No initiating radiation, an AP may not beacon here
+	Radar       bool    `json:"radar,omitempty"` // DFS channel
+}
+
+// RegulatoryDomain is the regulatory domain applied to a radio
+type RegulatoryDomain struct {
+	Country     string `json:"country"`
+	DFSRegion   string `json:"dfs_region,omitempty"`
+	SelfManaged bool   `json:"self_managed,omitempty"`
+}
+
+// SupportsMode reports whether the radio supports an interface mode such as "AP" or "managed"
+func (c *PhyCapabilities) SupportsMode(mode string) bool {
+	return containsFold(c.Modes, mode)
+}
+
+// SupportsBand reports whether the radio has a usable access point channel in band
+func (c *PhyCapabilities) SupportsBand(band string) bool {
+	for _, b := range c.Bands {
+		if b.Name == band && len(b.APChannels()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// CanHostAP reports whether the radio supports AP mode and may beacon on at least one channel
+func (c *PhyCapabilities) CanHostAP() bool {
+	if !c.SupportsMode("AP") {
+		return false
+	}
+	if len(c.Bands) == 0 {
+		return true
+	}
+	for _, b := range c.Bands {
+		if len(b.APChannels()) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// SupportsConcurrentAPStation reports whether a managed and an AP interface may run at once
+func (c *PhyCapabilities) SupportsConcurrentAPStation() bool {
+	return c.concurrentCombination() != nil
+}
+
+func (c *PhyCapabilities) concurrentCombination() *InterfaceCombination {
+	for _, combination := range c.Combinations {
+		if combination.Allows("managed", "AP") {
+			return &combination
+		}
+	}
+	return nil
+}
+
+// APChannels returns the channels an access point may be started on
+func (b WirelessBand) APChannels() []WirelessChannel {
+	var channels []WirelessChannel
+	for _, ch := range b.Channels {
+		if !ch.Disabled && !ch.NoIR {
+			channels = append(channels, ch)
+		}
+	}
+	return channels
+}
+
+// InterfaceLimit caps how many interfaces of the listed types may exist at once
+type InterfaceLimit struct {
+	Types []string `json:"types"`
+	Max   int      `json:"max"`
+}
+
+// InterfaceCombination is one of the "valid interface combinations" a phy advertises
+type InterfaceCombination struct {
+	Limits   []InterfaceLimit `json:"limits"`
+	Total    int              `json:"total"`
+	Channels int              `json:"channels"`
+}
+
+var (
+	combinationLimitRe    = regexp.MustCompile(`#\{\s*([^}]*)\}\s*<=\s*(\d+)`)
+	combinationTotalRe    = regexp.MustCompile(`total\s*<=\s*(\d+)`)
+	combinationChannelsRe = regexp.MustCompile(`#channels\s*<=\s*(\d+)`)
+)
+
+// Allows reports whether interfaces of the given types, e.g. "managed" and "AP", may coexist
+func (c InterfaceCombination) Allows(types ...string) bool {
+	if len(types) > c.Total {
+		return false
+	}
+	used := make([]int, len(c.Limits))
+	return c.assign(types, used)
+}
+
+// assign places each interface type into a limit with spare capacity, backtracking on conflicts
+func (c InterfaceCombination) assign(types []string, used []int) bool {
+	if len(types) == 0 {
+		return true
+	}
+	for i, limit := range c.Limits {
+		if used[i] >= limit.Max || !containsFold(limit.Types, types[0]) {
+			continue
+		}
+		used[i]++
+		if c.assign(types[1:], used) {
+			return true
+		}
+		used[i]--
+	}
+	return false
+}
+
+// parseInterfaceCombinations extracts the valid interface combinations from "iw phy <phy> info"
+func parseInterfaceCombinations(output string) []InterfaceCombination {
+	var entries []string
+	inSection := false
+	sectionIndent := 0
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+		if strings.HasPrefix(trimmed, "valid interface combinations:") {
+			inSection = true
+			sectionIndent = indent
+			continue
+		}
+		if !inSection || trimmed == "" {
+			continue
+		}
+		if indent <= sectionIndent {
+			break
+		}
+		if strings.HasPrefix(trimmed, "*") {
+			entries = append(entries, strings.TrimSpace(strings.TrimPrefix(trimmed, "*")))
+		} else if len(entries) > 0 {
+			entries[len(entries)-1] += " " + trimmed
+		}
+	}
+
+	combinations := make([]InterfaceCombination, 0, len(entries))
+	for _, entry := range entries {
+		var combination InterfaceCombination
+		for _, m := range combinationLimitRe.FindAllStringSubmatch(entry, -1) {
+			max, _ := strconv.Atoi(m[2])
+			var types []string
+			for _, t := range strings.Split(m[1], ",") {
+				types = append(types, strings.TrimSpace(t))
+			}
+			combination.Limits = append(combination.Limits, InterfaceLimit{Types: types, Max: max})
+		}
+		if m := combinationTotalRe.FindStringSubmatch(entry); m != nil {
+			combination.Total, _ = strconv.Atoi(m[1])
+		}
+		if m := combinationChannelsRe.FindStringSubmatch(entry); m != nil {
+			combination.Channels, _ = strconv.Atoi(m[1])
+		}
+		if len(combination.Limits) > 0 {
+			combinations = append(combinations, combination)
+		}
+	}
+	return combinations
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+var (
+	phyFrequencyRe     = regexp.MustCompile(`^\*\s*([\d.]+)\s*MHz\s*\[(\d+)\](.*)$`)
+	phyPowerRe         = regexp.MustCompile(`\(([\d.]+)\s*dBm\)`)
+	phyMaxAPStationsRe = regexp.MustCompile(`^Maximum associated stations in AP mode:\s*(\d+)`)
+	phyBandRe          = regexp.MustCompile(`^Band \d+:$`)
+	regCountryRe       = regexp.MustCompile(`^country (\S+?):\s*(\S*)`)
+)
+
+// parsePhyInfo parses the output of "iw phy <phy> info", the regulatory domain is filled in separately
+func parsePhyInfo(output string) PhyCapabilities {
+	caps := PhyCapabilities{Combinations: parseInterfaceCombinations(output)}
+
+	var band *WirelessBand
+	section, sectionIndent := "", 0
+	inFrequencies, frequenciesIndent := false, 0
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		if trimmed == "" {
+			continue
+		}
+		indent := len(line) - len(strings.TrimLeft(line, " \t"))
+
+		if section != "" && indent <= sectionIndent {
+			section, band, inFrequencies = "", nil, false
+		}
+		if inFrequencies && indent <= frequenciesIndent {
+			inFrequencies = false
+		}
+
+		switch {
+		case strings.HasPrefix(trimmed, "Wiphy "):
+			caps.Phy = strings.TrimSpace(strings.TrimPrefix(trimmed, "Wiphy "))
+		case phyBandRe.MatchString(trimmed):
+			caps.Bands = append(caps.Bands, WirelessBand{})
+			band = &caps.Bands[len(caps.Bands)-1]
+			section, sectionIndent = "band", indent
+		case trimmed == "Supported interface modes:":
+			section, sectionIndent = "modes", indent
+		case section == "band" && trimmed == "Frequencies:":
+			inFrequencies, frequenciesIndent = true, indent
+		case inFrequencies:
+			if ch, ok := parsePhyChannel(trimmed); ok {
+				band.Channels = append(band.Channels, ch)
+			}
+		case section == "modes" && strings.HasPrefix(trimmed, "*"):
+			caps.Modes = append(caps.Modes, strings.TrimSpace(strings.TrimPrefix(trimmed, "*")))
+		default:
+			if m := phyMaxAPStationsRe.FindStringSubmatch(trimmed); m != nil {
+				caps.MaxAPStations, _ = strconv.Atoi(m[1])
+			}
+		}
+	}
+
+	for i := range caps.Bands {
+		if len(caps.Bands[i].Channels) > 0 {
+			caps.Bands[i].Name = bandName(caps.Bands[i].Channels[0].Frequency)
+		}
+	}
+	return caps
+}
+
+// parsePhyChannel parses a frequency line such as "* 5260 MHz [52] (20.0 dBm) (no IR, radar detection)"
+func parsePhyChannel(line string) (WirelessChannel, bool) {
+	m := phyFrequencyRe.FindStringSubmatch(line)
+	if m == nil {
+		return WirelessChannel{}, false
+	}
+	frequency, err := strconv.ParseFloat(m[1], 64)
+	if err != nil {
+		return WirelessChannel{}, false
+	}
+	number, _ := strconv.Atoi(m[2])
+	ch := WirelessChannel{Number: number, Frequency: int(frequency)}
+
+	flags := m[3]
+	if p := phyPowerRe.FindStringSubmatch(flags); p != nil {
+		ch.MaxPowerDBm, _ = strconv.ParseFloat(p[1], 64)
+	}
+	ch.Disabled = strings.Contains(flags, "disabled")
+	// Older iw versions print "passive scanning" and "no IBSS" instead of "no IR"
+	ch.NoIR = strings.Contains(flags, "no IR") || strings.Contains(flags, "passive scanning")
+	ch.Radar = strings.Contains(flags, "radar detection")
+	return ch, true
+}
+
+func bandName(frequency int) string {
+	switch {
+	case frequency < 3000:
+		return Band24GHz
+	case frequency < 5925:
+		return Band5GHz
+	case frequency < 7200:
+		return Band6GHz
+	default:
+		return Band60GHz
+	}
+}
+
+// parseRegulatory parses "iw reg get" into the global domain and the domains of self-managed
+// phys, keyed by phy name, e.g. "phy0"
+func parseRegulatory(output string) (RegulatoryDomain, map[string]RegulatoryDomain) {
+	var global RegulatoryDomain
+	phys := make(map[string]RegulatoryDomain)
+	current := ""
+	for _, line := range strings.Split(output, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case trimmed == "global":
+			current = ""
+		case strings.HasPrefix(trimmed, "phy#"):
+			current = "phy" + strings.TrimPrefix(strings.Fields(trimmed)[0], "phy#")
+		default:
+			m := regCountryRe.FindStringSubmatch(trimmed)
+			if m == nil {
+				continue
+			}
+			domain := RegulatoryDomain{Country: m[1], DFSRegion: strings.TrimPrefix(m[2], "DFS-")}
+			if domain.DFSRegion == "UNSET" {
+				domain.DFSRegion = ""
+			}
+			if current == "" {
+				global = domain
+			} else {
+				domain.SelfManaged = true
+				phys[current] = domain
+			}
+		}
+	}
+	return global, phys
+}
+
+// phyProbe reads radio capabilities, caching them per phy since several interfaces may share one.
+// fallback decides AP support when iw is unavailable.
+type phyProbe struct {
+	runner      command.Runner
+	logger      *slog.Logger
+	fallback    func(interfaceName string) bool
+	phys        map[string]*PhyCapabilities
+	regLoaded   bool
+	global      RegulatoryDomain
+	selfManaged map[string]RegulatoryDomain
+}
+
+func newPhyProbe(runner command.Runner, logger *slog.Logger, fallback func(string) bool) *phyProbe {
+	return &phyProbe{runner: runner, logger: logger, fallback: fallback, phys: make(map[string]*PhyCapabilities)}
+}
+
+// describe fills in the phy, capabilities and AP support of iface
+func (p *phyProbe) describe(iface WirelessInterface) WirelessInterface {
+	caps, err := p.capabilities(iface.Name)
+	if err != nil {
+		p.logger.Debug("could not read phy capabilities",
+			slog.String("interface", iface.Name), slog.String("error", err.Error()))
+		if p.fallback != nil {
+			iface.SupportAP = p.fallback(iface.Name)
+		}
+		return iface
+	}
+	iface.Phy = caps.Phy
+	iface.Capabilities = caps
+	iface.SupportAP = caps.CanHostAP()
+	return iface
+}
+
+func (p *phyProbe) capabilities(interfaceName string) (*PhyCapabilities, error) {
+	result, err := p.runner.Run("iw", "dev", interfaceName, "info")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get info of %s", interfaceName)
+	}
+	phy := parseWiphy(string(result.Stdout))
+	if phy == "" {
+		return nil, errors.Errorf("no wiphy reported for %s", interfaceName)
+	}
+	if caps, ok := p.phys[phy]; ok {
+		return caps, nil
+	}
+
+	result, err = p.runner.Run("iw", "phy", phy, "info")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get info of %s", phy)
+	}
+	caps := parsePhyInfo(string(result.Stdout))
+	caps.Phy = phy
+	caps.Regulatory = p.regulatory(phy)
+	p.phys[phy] = &caps
+	return &caps, nil
+}
+
+func (p *phyProbe) regulatory(phy string) RegulatoryDomain {
+	if !p.regLoaded {
+		p.regLoaded = true
+		result, err := p.runner.Run("iw", "reg", "get")
+		if err != nil {
+			p.logger.Debug("could not read regulatory domain", slog.String("error", err.Error()))
+		} else {
+			p.global, p.selfManaged = parseRegulatory(string(result.Stdout))
+		}
+	}
+	if domain, ok := p.selfManaged[phy]; ok {
+		return domain
+	}
+	return p.global
+}
@@ -0,0 +1,214 @@
+package network
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const dualBandPhyInfo = `Wiphy phy1
+	wiphy index: 1
+	max # scan SSIDs: 4
+	Band 1:
+		Capabilities: 0x1862
+			HT20/HT40
+		Frequencies:
+			* 2412.0 MHz [1] (20.0 dBm)
+			* 2467.0 MHz [12] (20.0 dBm) (no IR)
+			* 2484.0 MHz [14] (disabled)
+	Band 2:
+		Frequencies:
+			* 5180.0 MHz [36] (23.0 dBm)
+			* 5260.0 MHz [52] (20.0 dBm) (no IR, radar detection)
+	Supported interface modes:
+		 * IBSS
+		 * managed
+		 * AP
+		 * AP/VLAN
+		 * monitor
+	Maximum associated stations in AP mode: 32
+	valid interface combinations:
+		 * #{ managed } <= 2048, #{ AP, mesh point } <= 8,
+		   total <= 2048, #channels <= 1
+`
+
+func TestParsePhyInfo(t *testing.T) {
+	caps := parsePhyInfo(dualBandPhyInfo)
+
+	assert.Equal(t, "phy1", caps.Phy)
+	assert.Equal(t, []string{"IBSS", "managed", "AP", "AP/VLAN", "monitor"}, caps.Modes)
+	assert.Equal(t, 32, caps.MaxAPStations)
+	require.Len(t, caps.Bands, 2)
+	assert.Equal(t, WirelessBand{Name: Band24GHz, Channels: []WirelessChannel{
+		{Number: 1, Frequency: 2412, MaxPowerDBm: 20},
+		{Number: 12, Frequency: 2467, MaxPowerDBm: 20, NoIR: true},
+		{Number: 14, Frequency: 2484, Disabled: true},
+	}}, caps.Bands[0])
+	assert.Equal(t, Band5GHz, caps.Bands[1].Name)
+	assert.Equal(t, WirelessChannel{Number: 52, Frequency: 5260, MaxPowerDBm: 20, NoIR: true, Radar: true}, caps.Bands[1].Channels[1])
+	assert.Equal(t, []WirelessChannel{{Number: 36, Frequency: 5180, MaxPowerDBm: 23}}, caps.Bands[1].APChannels())
+
+	assert.True(t, caps.CanHostAP())
+	assert.True(t, caps.SupportsBand(Band5GHz))
+	assert.False(t, caps.SupportsBand(Band6GHz))
+	assert.True(t, caps.SupportsConcurrentAPStation())
+}
+
+func TestPhyCapabilities_CanHostAP(t *testing.T) {
+	assert.False(t, (&PhyCapabilities{Modes: []string{"managed", "monitor"}}).CanHostAP())
+	assert.True(t, (&PhyCapabilities{Modes: []string{"managed", "AP"}}).CanHostAP())
+
+	noIR := &PhyCapabilities{
+		Modes: []string{"managed", "AP"},
+		Bands: []WirelessBand{{Name: Band5GHz, Channels: []WirelessChannel{{Number: 36, Frequency: 5180, NoIR: true}}}},
+	}
+	assert.False(t, noIR.CanHostAP())
+}
+
+func TestParseRegulatory(t *testing.T) {
+	global, phys := parseRegulatory(`global
+country SE: DFS-ETSI
+	(2400 - 2483 @ 40), (N/A, 20), (N/A)
+	(5170 - 5250 @ 80), (N/A, 23), (N/A), NO-OUTDOOR, AUTO-BW
+
+phy#1 (self-managed)
+country US: DFS-FCC
+	(2402 - 2472 @ 40), (6, 22), (N/A), AUTO-BW, NO-HT40MINUS
+
+phy#2 (self-managed)
+country 00: DFS-UNSET
+`)
+	assert.Equal(t, RegulatoryDomain{Country: "SE", DFSRegion: "ETSI"}, global)
+	assert.Equal(t, map[string]RegulatoryDomain{
+		"phy1": {Country: "US", DFSRegion: "FCC", SelfManaged: true},
+		"phy2": {Country: "00", SelfManaged: true},
+	}, phys)
+}
+
+const brcmfmacPhyInfo = `Wiphy phy0
+	max # scan SSIDs: 10
+	Supported interface modes:
+		 * IBSS
+		 * managed
+		 * AP
+		 * P2P-client
+		 * P2P-GO
+		 * P2P-device
+	valid interface combinations:
+		 * #{ managed } <= 1, #{ P2P-device } <= 1, #{ P2P-client, P2P-GO } <= 1,
+		   total <= 3, #channels <= 2
+		 * #{ managed } <= 1, #{ AP } <= 1, #{ P2P-client } <= 1, #{ P2P-device } <= 1,
+		   total <= 4, #channels <= 1
+	Device supports scan flush.
+`
+
+const noConcurrencyPhyInfo = `Wiphy phy1
+	valid interface combinations:
+		 * #{ managed, AP } <= 1,
+		   total <= 1, #channels <= 1
+	HT Capability overrides:
+`
+
+func TestParseInterfaceCombinations(t *testing.T) {
+	combinations := parseInterfaceCombinations(brcmfmacPhyInfo)
+	require.Len(t, combinations, 2)
+	assert.Equal(t, InterfaceCombination{
+		Limits: []InterfaceLimit{
+			{Types: []string{"managed"}, Max: 1},
+			{Types: []string{"AP"}, Max: 1},
+			{Types: []string{"P2P-client"}, Max: 1},
+			{Types: []string{"P2P-device"}, Max: 1},
+		},
+		Total:    4,
+		Channels: 1,
+	}, combinations[1])
+	assert.Equal(t, 2, combinations[0].Channels)
+
+	assert.Empty(t, parseInterfaceCombinations("Wiphy phy0\n\tSupported interface modes:\n\t\t * managed\n"))
+}
+
+func TestInterfaceCombinationAllows(t *testing.T) {
+	tests := []struct {
+		name        string
+		combination InterfaceCombination
+		types       []string
+		allowed     bool
+	}{
+		{
+			name:        "separate limits",
+			combination: InterfaceCombination{Limits: []InterfaceLimit{{Types: []string{"managed"}, Max: 1}, {Types: []string{"AP"}, Max: 1}}, Total: 2},
+			types:       []string{"managed", "AP"},
+			allowed:     true,
+		},
+		{
+			name:        "shared limit with room",
+			combination: InterfaceCombination{Limits: []InterfaceLimit{{Types: []string{"managed", "AP"}, Max: 2}}, Total: 2},
+			types:       []string{"managed", "AP"},
+			allowed:     true,
+		},
+		{
+			name:        "shared limit full",
+			combination: InterfaceCombination{Limits: []InterfaceLimit{{Types: []string{"managed", "AP"}, Max: 1}}, Total: 2},
+			types:       []string{"managed", "AP"},
+		},
+		{
+			name:        "total too low",
+			combination: InterfaceCombination{Limits: []InterfaceLimit{{Types: []string{"managed"}, Max: 1}, {Types: []string{"AP"}, Max: 1}}, Total: 1},
+			types:       []string{"managed", "AP"},
+		},
+		{
+			name:        "no AP",
+			combination: InterfaceCombination{Limits: []InterfaceLimit{{Types: []string{"managed"}, Max: 2}}, Total: 2},
+			types:       []string{"managed", "AP"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.allowed, tt.combination.Allows(tt.types...))
+		})
+	}
+}
+
+func TestPhyProbe_Describe(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddScript("iw", []string{"dev", "wlan1", "info"}, command.Result{Stdout: []byte("Interface wlan1\n\twiphy 1\n")})
+	runner.AddScript("iw", []string{"dev", "wlan1ap", "info"}, command.Result{Stdout: []byte("Interface wlan1ap\n\twiphy 1\n")})
+	runner.AddScript("iw", []string{"phy", "phy1", "info"}, command.Result{Stdout: []byte(dualBandPhyInfo)})
+	runner.AddScript("iw", []string{"reg", "get"}, command.Result{Stdout: []byte("global\ncountry SE: DFS-ETSI\n")})
+	im := NewInterfaceManager(WithInterfaceCommandRunner(runner)).(*interfaceManager)
+	probe := newPhyProbe(im.runner, im.logger, im.supportsAPMode)
+
+	iface := probe.describe(WirelessInterface{Name: "wlan1"})
+	assert.True(t, iface.SupportAP)
+	assert.Equal(t, "phy1", iface.Phy)
+	require.NotNil(t, iface.Capabilities)
+	assert.Equal(t, RegulatoryDomain{Country: "SE", DFSRegion: "ETSI"}, iface.Capabilities.Regulatory)
+
+	// Interfaces on the same radio reuse the parsed capabilities
+	assert.Same(t, iface.Capabilities, probe.describe(WirelessInterface{Name: "wlan1ap"}).Capabilities)
+	phyQueries := 0
+	for _, call := range runner.History() {
+		if call == "iw phy phy1 info" {
+			phyQueries++
+		}
+	}
+	assert.Equal(t, 1, phyQueries)
+}
+
+func TestPhyProbe_FallsBackToNetworkManager(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddError("iw", []string{"dev", "wlan0", "info"}, command.Result{ExitCode: 127}, errors.New("executable file not found"))
+	runner.AddScript("nmcli", []string{"-g", "WIFI-PROPERTIES.AP", "device", "show", "wlan0"}, command.Result{Stdout: []byte("yes\n")})
+	runner.AddError("iw", []string{"dev", "wlan1", "info"}, command.Result{ExitCode: 127}, errors.New("executable file not found"))
+	runner.AddScript("nmcli", []string{"-g", "WIFI-PROPERTIES.AP", "device", "show", "wlan1"}, command.Result{Stdout: []byte("no\n")})
+	im := NewInterfaceManager(WithInterfaceCommandRunner(runner)).(*interfaceManager)
+	probe := newPhyProbe(im.runner, im.logger, im.supportsAPMode)
+
+	iface := probe.describe(WirelessInterface{Name: "wlan0"})
+	assert.True(t, iface.SupportAP)
+	assert.Nil(t, iface.Capabilities)
+	assert.False(t, probe.describe(WirelessInterface{Name: "wlan1"}).SupportAP)
+}
@@ -0,0 +1,337 @@
+package network
+
+import (
+	"bytes"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+const (
+	defaultRestartBackoff    = time.Second
+	defaultMaxRestartBackoff = time.Minute
+	defaultStopTimeout       = 5 * time.Second
+	apEventBuffer            = 32
+)
+
+// ProcessState is the state of a child process of an access point service
+type ProcessState string
+
+const (
+	ProcessRunning    ProcessState = "running"
+	ProcessRestarting ProcessState = "restarting" // Exited, waiting for the backoff to restart it
+)
+
+// ProcessHealth describes a child process such as dnsmasq or hostapd
+type ProcessHealth struct {
+	Name      string       `json:"name"`
+	State     ProcessState `json:"state"`
+	PID       int          `json:"pid,omitempty"`
+	Restarts  int          `json:"restarts"`
+	LastError string       `json:"last_error,omitempty"` // Why it last exited or failed to restart
+	Stderr    string       `json:"stderr,omitempty"`     // The last line it wrote to stderr
+}
+
+// APHealth reports whether an access point service and its child processes are up
+type APHealth struct {
+	Running   bool            `json:"running"`
+	Degraded  bool            `json:"degraded"` // Running, but a child process is down
+	Processes []ProcessHealth `json:"processes"`
+}
+
+// APEventType is the kind of an APEvent
+type APEventType string
+
+const (
+	APEventProcessExited    APEventType = "process_exited"
+	APEventProcessRestarted APEventType = "process_restarted"
+	APEventRestartFailed    APEventType = "restart_failed"
+)
+
+// APEvent reports a change in the health of an access point service
+type APEvent struct {
+	Type    APEventType `json:"type"`
+	Process string      `json:"process"`
+	Error   string      `json:"error,omitempty"`
+	Time    time.Time   `json:"time"`
+}
+
+// MonitoredAPService is implemented by services that supervise child processes, restarting
+// them with exponential backoff when they exit
+type MonitoredAPService interface {
+	APService
+	Health() APHealth
+	// Events delivers health changes, they are dropped while the channel is full
+	Events() <-chan APEvent
+}
+
+// processMonitor starts the child processes of an access point service and restarts them
+// when they exit without being stopped
+type processMonitor struct {
+	runner     command.Runner
+	logger     *slog.Logger
+	backoff    time.Duration
+	maxBackoff time.Duration
+	// stopTimeout is how long a stopped process may take to exit on SIGTERM before it is killed
+	stopTimeout time.Duration
+	events      chan APEvent
+
+	mu       sync.Mutex
+	children []*childProcess
+}
+
+func newProcessMonitor(o apServiceOptions) *processMonitor {
+	return &processMonitor{
+		runner:      o.runner,
+		logger:      o.logger,
+		backoff:     o.backoff,
+		maxBackoff:  o.maxBackoff,
+		stopTimeout: defaultStopTimeout,
+		events:      make(chan APEvent, apEventBuffer),
+	}
+}
+
+// start launches cmd and supervises it until the returned child is stopped
+func (m *processMonitor) start(name, cmd string, args ...string) (*childProcess, error) {
+	c := &childProcess{
+		name:    name,
+		cmd:     cmd,
+		args:    args,
+		monitor: m,
+		stopCh:  make(chan struct{}),
+		done:    make(chan struct{}),
+	}
+	proc, err := c.launch()
+	if err != nil {
+		return nil, err
+	}
+	c.proc = proc
+	c.state = ProcessRunning
+
+	m.mu.Lock()
+	m.children = append(m.children, c)
+	m.mu.Unlock()
+	go c.supervise(proc)
+	return c, nil
+}
+
+// health reports the children of a service that is running or not
+func (m *processMonitor) health(running bool) APHealth {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	health := APHealth{Running: running, Processes: []ProcessHealth{}}
+	for _, c := range m.children {
+		process := c.health()
+		health.Processes = append(health.Processes, process)
+		if running && process.State != ProcessRunning {
+			health.Degraded = true
+		}
+	}
+	return health
+}
+
+func (m *processMonitor) remove(c *childProcess) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for i, child := range m.children {
+		if child == c {
+			m.children = append(m.children[:i], m.children[i+1:]...)
+			return
+		}
+	}
+}
+
+func (m *processMonitor) emit(eventType APEventType, name string, err error) {
+	event := APEvent{Type: eventType, Process: name, Time: time.Now()}
+	if err != nil {
+		event.Error = err.Error()
+	}
+	select {
+	case m.events <- event:
+	default:
+		m.logger.Debug("dropped access point event", slog.String("type", string(eventType)), slog.String("process", name))
+	}
+}
+
+// childProcess is a command kept alive by a processMonitor
+type childProcess struct {
+	name    string
+	cmd     string
+	args    []string
+	monitor *processMonitor
+	stopCh  chan struct{}
+	done    chan struct{} // Closed once supervise returns
+
+	mu        sync.Mutex
+	proc      command.Process
+	state     ProcessState
+	stopped   bool
+	restarts  int
+	lastError string
+	stderr    string
+}
+
+// launch starts the command with its stderr logged
+func (c *childProcess) launch() (command.Process, error) {
+	proc, err := c.monitor.runner.StartWithStderr(&stderrLogger{child: c}, c.cmd, c.args...)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to start %s", c.name)
+	}
+	return proc, nil
+}
+
+// supervise waits for the process and restarts it until stop is called. The backoff doubles
+// with every restart and is reset once the process has run for the maximum backoff.
+func (c *childProcess) supervise(proc command.Process) {
+	defer close(c.done)
+	m := c.monitor
+	backoff := m.backoff
+	for {
+		started := time.Now()
+		err := proc.Wait()
+		select {
+		case <-c.stopCh:
+			return
+		default:
+		}
+		if err == nil {
+			err = errors.New("exited with status 0")
+		}
+		m.logger.Error("child process exited unexpectedly", slog.String("process", c.name), slog.String("error", err.Error()))
+		c.setState(ProcessRestarting, err)
+		m.emit(APEventProcessExited, c.name, err)
+		if time.Since(started) >= m.maxBackoff {
+			backoff = m.backoff
+		}
+
+		for {
+			select {
+			case <-c.stopCh:
+				return
+			case <-time.After(backoff):
+			}
+			backoff = min(backoff*2, m.maxBackoff)
+			if proc, err = c.launch(); err == nil {
+				break
+			}
+			m.logger.Error("failed to restart child process", slog.String("process", c.name), slog.String("error", err.Error()))
+			c.setState(ProcessRestarting, err)
+			m.emit(APEventRestartFailed, c.name, err)
+		}
+
+		c.mu.Lock()
+		if c.stopped {
+			// stop ran while restarting and missed this process
+			c.mu.Unlock()
+			exited := make(chan struct{})
+			go func() {
+				proc.Wait()
+				close(exited)
+			}()
+			c.terminate(proc, exited)
+			return
+		}
+		c.proc = proc
+		c.state = ProcessRunning
+		c.restarts++
+		c.mu.Unlock()
+		m.logger.Info("restarted child process", slog.String("process", c.name), slog.Int("pid", proc.Pid()))
+		m.emit(APEventProcessRestarted, c.name, nil)
+	}
+}
+
+// stop terminates the process and waits until it is no longer supervised
+func (c *childProcess) stop() {
+	c.mu.Lock()
+	if c.stopped {
+		c.mu.Unlock()
+		return
+	}
+	c.stopped = true
+	proc := c.proc
+	close(c.stopCh)
+	c.mu.Unlock()
+
+	c.terminate(proc, c.done)
+	c.monitor.remove(c)
+}
+
+// terminate sends SIGTERM, which sudo forwards to the command it runs, and waits for exited.
+// A process still running after the stop timeout is killed; that only ends sudo, so callers
+// still pkill the command.
+func (c *childProcess) terminate(proc command.Process, exited <-chan struct{}) {
+	logger := c.monitor.logger.With(slog.String("process", c.name))
+	if err := proc.Terminate(); err != nil {
+		logger.Debug("failed to terminate child process", slog.String("error", err.Error()))
+	}
+	select {
+	case <-exited:
+		return
+	case <-time.After(c.monitor.stopTimeout):
+	}
+	logger.Warn("child process did not exit on SIGTERM, killing it")
+	if err := proc.Kill(); err != nil {
+		logger.Debug("failed to kill child process", slog.String("error", err.Error()))
+	}
+	<-exited
+}
+
+// running reports whether the process is up rather than waiting to be restarted
+func (c *childProcess) running() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.stopped && c.state == ProcessRunning
+}
+
+func (c *childProcess) setState(state ProcessState, err error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.state = state
+	if err != nil {
+		c.lastError = err.Error()
+	}
+}
+
+func (c *childProcess) health() ProcessHealth {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	health := ProcessHealth{
+		Name:      c.name,
+		State:     c.state,
+		Restarts:  c.restarts,
+		LastError: c.lastError,
+		Stderr:    c.stderr,
+	}
+	if c.state == ProcessRunning {
+		health.PID = c.proc.Pid()
+	}
+	return health
+}
+
+// stderrLogger logs every line a child process writes to stderr
+type stderrLogger struct {
+	child *childProcess
+	buf   []byte
+}
+
+func (w *stderrLogger) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			return len(p), nil
+		}
+		line := string(bytes.TrimSpace(w.buf[:i]))
+		w.buf = w.buf[i+1:]
+		if line == "" {
+			continue
+		}
+		w.child.monitor.logger.Warn(line, slog.String("process", w.child.name), slog.String("stream", "stderr"))
+		w.child.mu.Lock()
+		w.child.stderr = line
+		w.child.mu.Unlock()
+	}
+}
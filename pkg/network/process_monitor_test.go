@@ -0,0 +1,152 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestProcessMonitor(runner command.Runner, opts ...APServiceOption) *processMonitor {
+	opts = append([]APServiceOption{
+		WithAPCommandRunner(runner),
+		WithAPLogger(slog.New(slog.DiscardHandler)),
+		WithAPRestartBackoff(time.Millisecond, 4*time.Millisecond),
+	}, opts...)
+	return newProcessMonitor(newAPServiceOptions(opts))
+}
+
+func nextEvent(t *testing.T, m *processMonitor) APEvent {
+	t.Helper()
+	select {
+	case event := <-m.events:
+		return event
+	case <-time.After(time.Second):
+		t.Fatal("no access point event")
+		return APEvent{}
+	}
+}
+
+func TestProcessMonitor_Restarts(t *testing.T) {
+	runner := command.NewFakeRunner()
+	m := newTestProcessMonitor(runner)
+	child, err := m.start("dnsmasq", "dnsmasq", "--keep-in-foreground")
+	require.NoError(t, err)
+
+	for i := 1; i <= 3; i++ {
+		runner.Process("dnsmasq", "--keep-in-foreground").Exit(errors.New("exit status 2"))
+		exited := nextEvent(t, m)
+		assert.Equal(t, APEventProcessExited, exited.Type)
+		assert.Equal(t, "dnsmasq", exited.Process)
+		assert.Equal(t, "exit status 2", exited.Error)
+		assert.Equal(t, APEventProcessRestarted, nextEvent(t, m).Type)
+		assert.Equal(t, i, child.health().Restarts)
+	}
+	assert.True(t, child.running())
+	assert.False(t, m.health(true).Degraded)
+
+	child.stop()
+	assert.True(t, runner.Process("dnsmasq", "--keep-in-foreground").Terminated())
+	assert.Empty(t, m.health(false).Processes)
+}
+
+func TestProcessMonitor_KillsWhenTerminateIgnored(t *testing.T) {
+	runner := command.NewFakeRunner()
+	m := newTestProcessMonitor(runner)
+	m.stopTimeout = 10 * time.Millisecond
+	child, err := m.start("hostapd", "hostapd", "hostapd.conf")
+	require.NoError(t, err)
+
+	proc := runner.Process("hostapd", "hostapd.conf")
+	proc.IgnoreTerminate()
+	child.stop()
+	assert.True(t, proc.Terminated())
+	assert.ErrorIs(t, proc.Wait(), command.ErrFakeProcessKilled)
+}
+
+func TestProcessMonitor_RetriesFailedRestart(t *testing.T) {
+	runner := command.NewFakeRunner()
+	m := newTestProcessMonitor(runner)
+	child, err := m.start("dnsmasq", "dnsmasq")
+	require.NoError(t, err)
+
+	runner.AddError("dnsmasq", nil, command.Result{}, errors.New("permission denied"))
+	runner.Process("dnsmasq").Exit(errors.New("exit status 5"))
+	assert.Equal(t, APEventProcessExited, nextEvent(t, m).Type)
+	failed := nextEvent(t, m)
+	assert.Equal(t, APEventRestartFailed, failed.Type)
+	assert.Contains(t, failed.Error, "permission denied")
+
+	health := m.health(true)
+	assert.True(t, health.Degraded)
+	assert.Equal(t, ProcessRestarting, health.Processes[0].State)
+
+	runner.AddError("dnsmasq", nil, command.Result{}, nil)
+	require.Eventually(t, child.running, time.Second, time.Millisecond)
+	child.stop()
+}
+
+func TestProcessMonitor_StopDuringBackoff(t *testing.T) {
+	runner := command.NewFakeRunner()
+	m := newTestProcessMonitor(runner, WithAPRestartBackoff(time.Hour, time.Hour))
+	child, err := m.start("hostapd", "hostapd", "hostapd.conf")
+	require.NoError(t, err)
+
+	runner.Process("hostapd", "hostapd.conf").Exit(nil)
+	exited := nextEvent(t, m)
+	assert.Equal(t, "exited with status 0", exited.Error)
+	assert.False(t, child.running())
+
+	stopped := make(chan struct{})
+	go func() {
+		child.stop()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Fatal("stop waited for the restart backoff")
+	}
+	assert.Len(t, runner.History(), 1)
+}
+
+// syncBuffer is a bytes.Buffer safe for the concurrent writes of a logger
+type syncBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestProcessMonitor_LogsStderr(t *testing.T) {
+	var logs syncBuffer
+	runner := command.NewFakeRunner()
+	m := newTestProcessMonitor(runner, WithAPLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	child, err := m.start("dnsmasq", "dnsmasq")
+	require.NoError(t, err)
+	defer child.stop()
+
+	proc := runner.Process("dnsmasq")
+	proc.WriteStderr("dnsmasq: failed to create listening socket for 192.168.4.1: Address in use\n\ndnsmasq: FAILED")
+	assert.Equal(t, "dnsmasq: failed to create listening socket for 192.168.4.1: Address in use", child.health().Stderr)
+	proc.WriteStderr(" to start up\n")
+	assert.Equal(t, "dnsmasq: FAILED to start up", child.health().Stderr)
+
+	assert.Contains(t, logs.String(), `level=WARN msg="dnsmasq: FAILED to start up" process=dnsmasq stream=stderr`)
+}
@@ -0,0 +1,206 @@
+package network
+
+import (
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+var ErrProfileNotFound = errors.New("connection profile not found")
+var ErrNotSupported = errors.New("not supported by the network backend")
+
+// Profile is a saved Wi-Fi network the device joins on its own
+type Profile struct {
+	ID          string          `json:"id"` // Backend specific, e.g. the NetworkManager connection UUID
+	Name        string          `json:"name"`
+	SSID        string          `json:"ssid"`
+	Security    NetworkSecurity `json:"security"`
+	Hidden      bool            `json:"hidden"`
+	AutoConnect bool            `json:"autoconnect"`
+	Priority    int             `json:"priority"` // Profiles with a higher priority are tried first
+	Active      bool            `json:"active"`
+}
+
+// ProfileUpdate changes how a profile is joined, nil fields are left as they are
+type ProfileUpdate struct {
+	Priority    *int  `json:"priority,omitempty"`
+	AutoConnect *bool `json:"autoconnect,omitempty"`
+}
+
+// KnownSSIDs returns the SSIDs of profiles, e.g. for GroupNetworks
+func KnownSSIDs(profiles []Profile) []string {
+	ssids := make([]string, 0, len(profiles))
+	for _, profile := range profiles {
+		ssids = append(ssids, profile.SSID)
+	}
+	return ssids
+}
+
+// sortProfiles orders profiles the way they are tried: highest priority first, then by name
+func sortProfiles(profiles []Profile) {
+	sort.SliceStable(profiles, func(a, b int) bool {
+		if profiles[a].Priority != profiles[b].Priority {
+			return profiles[a].Priority > profiles[b].Priority
+		}
+		return profiles[a].Name < profiles[b].Name
+	})
+}
+
+// keyMgmtSecurity maps a NetworkManager key-mgmt value to the security of the profile, an empty
+// value means the profile has no security settings
+func keyMgmtSecurity(keyMgmt string) NetworkSecurity {
+	switch strings.ToLower(keyMgmt) {
+	case "":
+		return NetworkSecurityOpen
+	case "none", "ieee8021x":
+		return NetworkSecurityWEP
+	case "wpa-psk":
+		return NetworkSecurityWPA2PSK
+	case "sae":
+		return NetworkSecuritySAE
+	case "owe":
+		return NetworkSecurityOWE
+	default:
+		return NetworkSecurity8021X
+	}
+}
+
+// ListProfiles returns the saved station profiles, access point profiles such as the portal
+// hotspot are left out
+func (im *interfaceManager) ListProfiles() ([]Profile, error) {
+	res, err := im.runner.Run("nmcli", "-t", "-f", "NAME,UUID,TYPE,AUTOCONNECT,AUTOCONNECT-PRIORITY,ACTIVE", "connection", "show")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to list connection profiles: %s", res.Combined())
+	}
+
+	profiles := []Profile{}
+	for _, line := range strings.Split(string(res.Stdout), "\n") {
+		fields := splitTerse(line)
+		if len(fields) < 6 || fields[2] != "802-11-wireless" {
+			continue
+		}
+		res, err := im.runner.Run("nmcli", "-g", "802-11-wireless.ssid,802-11-wireless.mode,802-11-wireless.hidden,802-11-wireless-security.key-mgmt",
+			"connection", "show", "uuid", fields[1])
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read connection profile %s: %s", fields[0], res.Combined())
+		}
+		values := strings.Split(strings.TrimRight(string(res.Stdout), "\n"), "\n")
+		for len(values) < 4 {
+			values = append(values, "")
+		}
+		if values[1] == "ap" {
+			continue
+		}
+		priority, _ := strconv.Atoi(fields[4])
+		profiles = append(profiles, Profile{
+			ID:          fields[1],
+			Name:        fields[0],
+			SSID:        values[0],
+			Security:    keyMgmtSecurity(values[3]),
+			Hidden:      values[2] == "yes",
+			AutoConnect: fields[3] == "yes",
+			Priority:    priority,
+			Active:      fields[5] == "yes",
+		})
+	}
+	sortProfiles(profiles)
+	return profiles, nil
+}
+
+func (im *interfaceManager) UpdateProfile(id string, update ProfileUpdate) error {
+	args := []string{"connection", "modify", "uuid", id}
+	if update.AutoConnect != nil {
+		args = append(args, "connection.autoconnect", nmcliBool(*update.AutoConnect))
+	}
+	if update.Priority != nil {
+		args = append(args, "connection.autoconnect-priority", strconv.Itoa(*update.Priority))
+	}
+	if len(args) == 4 {
+		return nil
+	}
+	if res, err := im.runner.Run("nmcli", args...); err != nil {
+		return profileError(err, res, "update", id)
+	}
+	im.logger.Info("updated connection profile", slog.String("id", id))
+	return nil
+}
+
+func (im *interfaceManager) ForgetProfile(id string) error {
+	if res, err := im.runner.Run("nmcli", "connection", "delete", "uuid", id); err != nil {
+		return profileError(err, res, "delete", id)
+	}
+	im.logger.Info("removed connection profile", slog.String("id", id))
+	return nil
+}
+
+// UpdateProfileCredentials replaces the security settings of a profile, the previous ones are
+// removed so a network can move e.g. from a passphrase to 802.1X
+func (im *interfaceManager) UpdateProfileCredentials(id string, creds Credentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	res, err := im.runner.Run("nmcli", "-g", "802-11-wireless.ssid", "connection", "show", "uuid", id)
+	if err != nil {
+		return profileError(err, res, "read", id)
+	}
+	ssid := strings.TrimSpace(string(res.Stdout))
+
+	args := []string{"connection", "modify", "uuid", id, "802-11-wireless.hidden", nmcliBool(creds.Hidden)}
+	switch keyMgmt := creds.keyMgmt(); keyMgmt {
+	case "wpa-psk", "sae":
+		args = append(args, "wifi-sec.key-mgmt", keyMgmt, "wifi-sec.psk", creds.Password, "remove", "802-1x")
+	case "wpa-eap":
+		eapArgs, err := im.eapArgs(ssid, creds)
+		if err != nil {
+			return err
+		}
+		args = append(args, eapArgs...)
+	default:
+		args = append(args, "remove", "802-11-wireless-security", "remove", "802-1x")
+	}
+	if res, err := im.runner.Run("nmcli", args...); err != nil {
+		return profileError(err, res, "update", id)
+	}
+	im.logger.Info("updated connection profile credentials", slog.String("id", id), slog.String("ssid", ssid))
+	return nil
+}
+
+// SaveProfile adds an autoconnect profile for ssid without joining it. Earlier profiles of the
+// same name are replaced once the new one is saved.
+func (im *interfaceManager) SaveProfile(interfaceName, ssid string, creds Credentials, priority int) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	previous := im.profileUUIDs(ssid)
+	name := newProfileName(ssid, previous)
+	args, err := im.profileArgs(interfaceName, name, ssid, creds)
+	if err != nil {
+		return err
+	}
+	args = append(args, "connection.autoconnect-priority", strconv.Itoa(priority))
+	if res, err := im.runner.Run("nmcli", args...); err != nil {
+		return errors.Wrapf(err, "failed to create connection profile for %s: %s", ssid, res.Combined())
+	}
+	im.replaceProfiles(name, ssid, previous)
+	im.logger.Info("saved connection profile", slog.String("ssid", ssid), slog.Int("priority", priority))
+	return nil
+}
+
+// profileError reports a failed nmcli profile command, ErrProfileNotFound when the profile is gone
+func profileError(err error, res command.Result, action, id string) error {
+	if strings.Contains(res.Combined(), "unknown connection") {
+		return errors.Wrap(ErrProfileNotFound, id)
+	}
+	return errors.Wrapf(err, "failed to %s connection profile %s: %s", action, id, res.Combined())
+}
+
+func nmcliBool(value bool) string {
+	if value {
+		return "yes"
+	}
+	return "no"
+}
@@ -0,0 +1,115 @@
+package network
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const nmcliProfileFields = "802-11-wireless.ssid,802-11-wireless.mode,802-11-wireless.hidden,802-11-wireless-security.key-mgmt"
+
+func TestInterfaceManager_ListProfiles(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddScript("nmcli", []string{"-t", "-f", "NAME,UUID,TYPE,AUTOCONNECT,AUTOCONNECT-PRIORITY,ACTIVE", "connection", "show"},
+		command.Result{Stdout: []byte("Wired connection 1:1111:802-3-ethernet:yes:0:yes\n" +
+			"Home:2222:802-11-wireless:yes:10:yes\n" +
+			"go-wifiportal:3333:802-11-wireless:yes:0:no\n" +
+			"Office\\: 2F:4444:802-11-wireless:no:0:no\n" +
+			"Cafe:5555:802-11-wireless:yes:0:no\n")})
+	runner.AddScript("nmcli", []string{"-g", nmcliProfileFields, "connection", "show", "uuid", "2222"},
+		command.Result{Stdout: []byte("Home\ninfrastructure\nno\nsae\n")})
+	runner.AddScript("nmcli", []string{"-g", nmcliProfileFields, "connection", "show", "uuid", "3333"},
+		command.Result{Stdout: []byte("GoWiFiPortal\nap\nno\nwpa-psk\n")})
+	runner.AddScript("nmcli", []string{"-g", nmcliProfileFields, "connection", "show", "uuid", "4444"},
+		command.Result{Stdout: []byte("Office\ninfrastructure\nyes\nwpa-eap\n")})
+	runner.AddScript("nmcli", []string{"-g", nmcliProfileFields, "connection", "show", "uuid", "5555"},
+		command.Result{Stdout: []byte("Cafe\ninfrastructure\nno\n\n")})
+
+	im := NewInterfaceManager(WithInterfaceCommandRunner(runner))
+	profiles, err := im.ListProfiles()
+	require.NoError(t, err)
+	assert.Equal(t, []Profile{
+		{ID: "2222", Name: "Home", SSID: "Home", Security: NetworkSecuritySAE, AutoConnect: true, Priority: 10, Active: true},
+		{ID: "5555", Name: "Cafe", SSID: "Cafe", Security: NetworkSecurityOpen, AutoConnect: true},
+		{ID: "4444", Name: "Office: 2F", SSID: "Office", Security: NetworkSecurity8021X, Hidden: true},
+	}, profiles)
+	assert.Equal(t, []string{"Home", "Cafe", "Office"}, KnownSSIDs(profiles))
+}
+
+func TestInterfaceManager_UpdateProfile(t *testing.T) {
+	runner := command.NewFakeRunner()
+	im := NewInterfaceManager(WithInterfaceCommandRunner(runner))
+
+	priority, autoConnect := 5, false
+	require.NoError(t, im.UpdateProfile("2222", ProfileUpdate{Priority: &priority, AutoConnect: &autoConnect}))
+	assert.True(t, runner.Called("nmcli", "connection", "modify", "uuid", "2222",
+		"connection.autoconnect", "no", "connection.autoconnect-priority", "5"))
+
+	runner.AddError("nmcli", []string{"connection", "modify", "uuid", "9999", "connection.autoconnect-priority", "5"},
+		command.Result{Stderr: []byte("Error: unknown connection '9999'.")}, errors.New("exit status 10"))
+	err := im.UpdateProfile("9999", ProfileUpdate{Priority: &priority})
+	assert.ErrorIs(t, err, ErrProfileNotFound)
+}
+
+func TestInterfaceManager_ForgetProfile(t *testing.T) {
+	runner := command.NewFakeRunner()
+	im := NewInterfaceManager(WithInterfaceCommandRunner(runner))
+
+	require.NoError(t, im.ForgetProfile("2222"))
+	assert.True(t, runner.Called("nmcli", "connection", "delete", "uuid", "2222"))
+}
+
+func TestInterfaceManager_UpdateProfileCredentials(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddScript("nmcli", []string{"-g", "802-11-wireless.ssid", "connection", "show", "uuid", "2222"},
+		command.Result{Stdout: []byte("Home\n")})
+	im := NewInterfaceManager(WithInterfaceCommandRunner(runner), WithInterfaceCertDir(t.TempDir()))
+
+	require.NoError(t, im.UpdateProfileCredentials("2222", Credentials{Password: "newsecret"}))
+	assert.True(t, runner.Called("nmcli", "connection", "modify", "uuid", "2222", "802-11-wireless.hidden", "no",
+		"wifi-sec.key-mgmt", "wpa-psk", "wifi-sec.psk", "newsecret", "remove", "802-1x"))
+
+	require.NoError(t, im.UpdateProfileCredentials("2222", Credentials{Hidden: true}))
+	assert.True(t, runner.Called("nmcli", "connection", "modify", "uuid", "2222", "802-11-wireless.hidden", "yes",
+		"remove", "802-11-wireless-security", "remove", "802-1x"))
+
+	err := im.UpdateProfileCredentials("2222", Credentials{Security: SecurityWPA3})
+	assert.ErrorIs(t, err, ErrInvalidCredentials)
+}
+
+func TestInterfaceManager_SaveProfile(t *testing.T) {
+	runner := command.NewFakeRunner()
+	im := NewInterfaceManager(WithInterfaceCommandRunner(runner))
+
+	require.NoError(t, im.SaveProfile("wlan0", "Hotspot", Credentials{Security: SecurityWPA3, Password: "hotspot123"}, 4))
+	assert.Equal(t, []string{
+		"nmcli -g connection.uuid connection show id Hotspot",
+		"nmcli connection add type wifi con-name Hotspot ifname wlan0 ssid Hotspot wifi-sec.key-mgmt sae wifi-sec.psk hotspot123 connection.autoconnect-priority 4",
+	}, runner.History())
+}
+
+func TestInterfaceManager_SaveProfileReplacesPrevious(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddScript("nmcli", []string{"-g", "connection.uuid", "connection", "show", "id", "Hotspot"},
+		command.Result{Stdout: []byte("1111\n")})
+	im := NewInterfaceManager(WithInterfaceCommandRunner(runner))
+
+	require.NoError(t, im.SaveProfile("", "Hotspot", Credentials{Password: "hotspot123"}, 1))
+	assert.Equal(t, []string{
+		"nmcli -g connection.uuid connection show id Hotspot",
+		"nmcli connection add type wifi con-name Hotspot (new) ssid Hotspot wifi-sec.key-mgmt wpa-psk wifi-sec.psk hotspot123 connection.autoconnect-priority 1",
+		"nmcli connection delete uuid 1111",
+		"nmcli connection modify id Hotspot (new) connection.id Hotspot",
+	}, runner.History())
+}
+
+func TestKeyMgmtSecurity(t *testing.T) {
+	assert.Equal(t, NetworkSecurityOpen, keyMgmtSecurity(""))
+	assert.Equal(t, NetworkSecurityWEP, keyMgmtSecurity("none"))
+	assert.Equal(t, NetworkSecurityWPA2PSK, keyMgmtSecurity("wpa-psk"))
+	assert.Equal(t, NetworkSecuritySAE, keyMgmtSecurity("sae"))
+	assert.Equal(t, NetworkSecurity8021X, keyMgmtSecurity("wpa-eap"))
+}
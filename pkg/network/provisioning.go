@@ -0,0 +1,199 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+
+	"github.com/pkg/errors"
+)
+
+// ProvisionedNetwork is a network of a fallback list, it takes the same JSON fields as a
+// connection request
+type ProvisionedNetwork struct {
+	SSID string `json:"ssid"`
+	Credentials
+}
+
+// ProvisioningStatus reports which saved network is in use
+type ProvisioningStatus struct {
+	Active   *Profile  `json:"active"`   // nil while no saved network is joined
+	Fallback bool      `json:"fallback"` // Active is not the preferred network
+	Networks []Profile `json:"networks"` // Autoconnect profiles in the order they are tried
+}
+
+// ProvisionerOption configures a Provisioner
+type ProvisionerOption func(*Provisioner)
+
+// WithProvisionerConnector verifies each connection attempt through connector
+func WithProvisionerConnector(connector *Connector) ProvisionerOption {
+	return func(p *Provisioner) {
+		p.connector = connector
+	}
+}
+
+// WithProvisionerBasePriority sets the priority of the last network of a list, the networks
+// before it get consecutive higher priorities. Defaults to 0, so the list ranks above profiles
+// saved with the default priority.
+func WithProvisionerBasePriority(priority int) ProvisionerOption {
+	return func(p *Provisioner) {
+		p.basePriority = priority
+	}
+}
+
+// WithProvisionerLogger sets the logger used by the provisioner
+func WithProvisionerLogger(logger *slog.Logger) ProvisionerOption {
+	return func(p *Provisioner) {
+		p.logger = logger
+	}
+}
+
+// Provisioner saves an ordered list of networks as profiles whose priorities follow the list,
+// so the backend falls back to the next network on its own when one goes away
+type Provisioner struct {
+	interfaces   InterfaceManager
+	connector    *Connector
+	basePriority int
+	logger       *slog.Logger
+}
+
+// NewProvisioner creates a Provisioner saving profiles through interfaces
+func NewProvisioner(interfaces InterfaceManager, opts ...ProvisionerOption) *Provisioner {
+	p := &Provisioner{
+		interfaces: interfaces,
+		logger:     slog.Default().WithGroup("provisioner"),
+	}
+	for _, opt := range opts {
+		opt(p)
+	}
+	return p
+}
+
+// Validate checks a list before anything is changed
+func (p *Provisioner) Validate(networks []ProvisionedNetwork) error {
+	if len(networks) == 0 {
+		return errors.Wrap(ErrInvalidCredentials, "at least one network is required")
+	}
+	seen := make(map[string]bool, len(networks))
+	for _, network := range networks {
+		if network.SSID == "" {
+			return errors.Wrap(ErrInvalidCredentials, "network name is required")
+		}
+		if seen[network.SSID] {
+			return errors.Wrapf(ErrInvalidCredentials, "network %s is listed twice", network.SSID)
+		}
+		seen[network.SSID] = true
+		if err := network.Credentials.Validate(); err != nil {
+			return errors.Wrap(err, network.SSID)
+		}
+	}
+	return nil
+}
+
+// Provision joins the first network of the list that works, trying them in order, and then
+// saves every network with a priority matching its position. Nothing is saved when no network
+// can be joined, the error of the last attempt is returned then.
+func (p *Provisioner) Provision(ctx context.Context, interfaceName string, networks []ProvisionedNetwork, progress ConnectionProgress) (*ConnectionResult, error) {
+	if err := p.Validate(networks); err != nil {
+		return nil, err
+	}
+
+	var result *ConnectionResult
+	var err error
+	for _, network := range networks {
+		if result, err = p.connect(ctx, interfaceName, network, progress); err == nil {
+			break
+		}
+		p.logger.Warn("failed to join network, trying the next one",
+			slog.String("ssid", network.SSID),
+			slog.String("error", err.Error()))
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "none of the %d networks could be joined", len(networks))
+	}
+
+	if err := p.save(interfaceName, networks, result.SSID); err != nil {
+		return result, err
+	}
+	return result, nil
+}
+
+// connect joins network, verifying the connection when a Connector is configured
+func (p *Provisioner) connect(ctx context.Context, interfaceName string, network ProvisionedNetwork, progress ConnectionProgress) (*ConnectionResult, error) {
+	if p.connector != nil {
+		return p.connector.ConnectWithProgress(ctx, interfaceName, network.SSID, network.Credentials, progress)
+	}
+	if progress != nil {
+		progress(StageAssociate)
+	}
+	if err := p.interfaces.ConnectWithCredentials(interfaceName, network.SSID, network.Credentials); err != nil {
+		return nil, err
+	}
+	return &ConnectionResult{Interface: interfaceName, SSID: network.SSID}, nil
+}
+
+// save stores the networks with descending priorities. The joined network already has a
+// profile, it is updated in place so the connection stays up.
+func (p *Provisioner) save(interfaceName string, networks []ProvisionedNetwork, joined string) error {
+	profiles, err := p.interfaces.ListProfiles()
+	if err != nil {
+		return err
+	}
+	joinedID := ""
+	for _, profile := range profiles {
+		if profile.SSID == joined {
+			joinedID = profile.ID
+			break
+		}
+	}
+
+	for i, network := range networks {
+		priority := p.basePriority + len(networks) - 1 - i
+		if network.SSID == joined && joinedID != "" {
+			if err := p.updateJoined(joinedID, priority); err != nil {
+				return errors.Wrapf(err, "failed to update network %s", network.SSID)
+			}
+			continue
+		}
+		if err := p.interfaces.SaveProfile(interfaceName, network.SSID, network.Credentials, priority); err != nil {
+			return errors.Wrapf(err, "failed to save network %s", network.SSID)
+		}
+	}
+	p.logger.Info("provisioned networks", slog.Int("count", len(networks)), slog.String("joined", joined))
+	return nil
+}
+
+// updateJoined sets the priority of the joined profile, backends without priorities order
+// known networks themselves and only need it to be joined on its own
+func (p *Provisioner) updateJoined(id string, priority int) error {
+	autoConnect := true
+	err := p.interfaces.UpdateProfile(id, ProfileUpdate{Priority: &priority, AutoConnect: &autoConnect})
+	if errors.Is(err, ErrNotSupported) {
+		err = p.interfaces.UpdateProfile(id, ProfileUpdate{AutoConnect: &autoConnect})
+	}
+	return err
+}
+
+// Status returns the profile in use and whether it is a fallback. The profiles are tried in
+// priority order, so the first autoconnect profile is the preferred network.
+func (p *Provisioner) Status() (ProvisioningStatus, error) {
+	profiles, err := p.interfaces.ListProfiles()
+	if err != nil {
+		return ProvisioningStatus{}, err
+	}
+	status := ProvisioningStatus{Networks: []Profile{}}
+	for _, profile := range profiles {
+		if !profile.AutoConnect {
+			continue
+		}
+		status.Networks = append(status.Networks, profile)
+		if profile.Active && status.Active == nil {
+			active := profile
+			status.Active = &active
+			status.Fallback = len(status.Networks) > 1
+		}
+	}
+	return status, nil
+}
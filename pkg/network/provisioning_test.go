@@ -0,0 +1,88 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var testProvisionedNetworks = []ProvisionedNetwork{
+	{SSID: "Site", Credentials: Credentials{Password: "sitepass123"}},
+	{SSID: "Hotspot", Credentials: Credentials{Password: "hotspot123"}},
+	{SSID: "Backup", Credentials: Credentials{Security: SecurityOpen}},
+}
+
+func TestProvisioner_Provision(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddError("nmcli", []string{"device", "wifi", "connect", "Site", "password", "sitepass123", "ifname", "wlan0"},
+		command.Result{Stderr: []byte("Error: No network with SSID 'Site' found.")}, errors.New("exit status 10"))
+	runner.AddScript("nmcli", []string{"-t", "-f", "NAME,UUID,TYPE,AUTOCONNECT,AUTOCONNECT-PRIORITY,ACTIVE", "connection", "show"},
+		command.Result{Stdout: []byte("Hotspot:2222:802-11-wireless:yes:0:yes\n")})
+	runner.AddScript("nmcli", []string{"-g", nmcliProfileFields, "connection", "show", "uuid", "2222"},
+		command.Result{Stdout: []byte("Hotspot\ninfrastructure\nno\nwpa-psk\n")})
+	p := NewProvisioner(NewInterfaceManager(WithInterfaceCommandRunner(runner)))
+
+	var stages []ConnectionStage
+	result, err := p.Provision(context.Background(), "wlan0", testProvisionedNetworks, func(stage ConnectionStage) {
+		stages = append(stages, stage)
+	})
+	require.NoError(t, err)
+	assert.Equal(t, "Hotspot", result.SSID)
+	assert.Equal(t, []ConnectionStage{StageAssociate, StageAssociate}, stages)
+
+	// The joined profile keeps running, the others are added around it
+	assert.True(t, runner.Called("nmcli", "connection", "add", "type", "wifi", "con-name", "Site", "ifname", "wlan0", "ssid", "Site",
+		"wifi-sec.key-mgmt", "wpa-psk", "wifi-sec.psk", "sitepass123", "connection.autoconnect-priority", "2"))
+	assert.True(t, runner.Called("nmcli", "connection", "modify", "uuid", "2222",
+		"connection.autoconnect", "yes", "connection.autoconnect-priority", "1"))
+	assert.True(t, runner.Called("nmcli", "connection", "add", "type", "wifi", "con-name", "Backup", "ifname", "wlan0", "ssid", "Backup",
+		"connection.autoconnect-priority", "0"))
+	assert.False(t, runner.Called("nmcli", "connection", "delete", "uuid", "2222"))
+}
+
+func TestProvisioner_ProvisionFailure(t *testing.T) {
+	runner := command.NewFakeRunner()
+	for _, network := range testProvisionedNetworks[:2] {
+		runner.AddError("nmcli", []string{"device", "wifi", "connect", network.SSID, "password", network.Password, "ifname", "wlan0"},
+			command.Result{}, errors.New("exit status 10"))
+	}
+	p := NewProvisioner(NewInterfaceManager(WithInterfaceCommandRunner(runner)))
+
+	_, err := p.Provision(context.Background(), "wlan0", testProvisionedNetworks[:2], nil)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "none of the 2 networks could be joined")
+	for _, call := range runner.History() {
+		assert.False(t, strings.Contains(call, "connection add"), call)
+	}
+}
+
+func TestProvisioner_Validate(t *testing.T) {
+	p := NewProvisioner(NewInterfaceManager(WithInterfaceCommandRunner(command.NewFakeRunner())))
+	assert.NoError(t, p.Validate(testProvisionedNetworks))
+	assert.ErrorIs(t, p.Validate(nil), ErrInvalidCredentials)
+	assert.ErrorIs(t, p.Validate([]ProvisionedNetwork{{SSID: ""}}), ErrInvalidCredentials)
+	assert.ErrorIs(t, p.Validate([]ProvisionedNetwork{{SSID: "Site"}, {SSID: "Site"}}), ErrInvalidCredentials)
+	assert.ErrorIs(t, p.Validate([]ProvisionedNetwork{{SSID: "Site", Credentials: Credentials{Security: SecurityWPA2}}}), ErrInvalidCredentials)
+}
+
+func TestProvisioner_Status(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddScript("nmcli", []string{"-t", "-f", "NAME,UUID,TYPE,AUTOCONNECT,AUTOCONNECT-PRIORITY,ACTIVE", "connection", "show"},
+		command.Result{Stdout: []byte("Site:1111:802-11-wireless:yes:2:no\n" +
+			"Hotspot:2222:802-11-wireless:yes:1:yes\n" +
+			"Old:3333:802-11-wireless:no:5:no\n")})
+	p := NewProvisioner(NewInterfaceManager(WithInterfaceCommandRunner(runner)))
+
+	status, err := p.Status()
+	require.NoError(t, err)
+	require.NotNil(t, status.Active)
+	assert.Equal(t, "2222", status.Active.ID)
+	assert.True(t, status.Fallback)
+	require.Len(t, status.Networks, 2)
+	assert.Equal(t, "1111", status.Networks[0].ID)
+}
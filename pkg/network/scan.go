@@ -0,0 +1,149 @@
+package network
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// NetworkSecurity is the normalized security of a scanned network
+type NetworkSecurity string
+
+const (
+	NetworkSecurityOpen    NetworkSecurity = "open"
+	NetworkSecurityWEP     NetworkSecurity = "wep"
+	NetworkSecurityWPAPSK  NetworkSecurity = "wpa-psk"
+	NetworkSecurityWPA2PSK NetworkSecurity = "wpa2-psk"
+	NetworkSecuritySAE     NetworkSecurity = "sae"
+	NetworkSecurityOWE     NetworkSecurity = "owe"
+	NetworkSecurity8021X   NetworkSecurity = "802.1x"
+)
+
+// normalizeSecurity maps a security description such as "WPA1 WPA2" or "WPA2 802.1X" to the
+// strongest method the network offers, so a WPA2/WPA3 transition network is NetworkSecuritySAE
+func normalizeSecurity(security string) NetworkSecurity {
+	has := make(map[string]bool)
+	for _, token := range strings.Fields(strings.ToUpper(security)) {
+		has[token] = true
+	}
+	switch {
+	case has["802.1X"] || has["EAP"]:
+		return NetworkSecurity8021X
+	case has["WPA3"] || has["SAE"]:
+		return NetworkSecuritySAE
+	case has["WPA2"] || has["RSN"]:
+		return NetworkSecurityWPA2PSK
+	case has["WPA1"] || has["WPA"]:
+		return NetworkSecurityWPAPSK
+	case has["OWE"]:
+		return NetworkSecurityOWE
+	case has["WEP"]:
+		return NetworkSecurityWEP
+	default:
+		return NetworkSecurityOpen
+	}
+}
+
+// percentToDBm estimates the signal level of a percentage, the inverse of dBmToPercent
+func percentToDBm(percent int) int {
+	return percent*60/100 - 90
+}
+
+// splitTerse splits a line of `nmcli -t` output. nmcli escapes ':' and '\' inside values with
+// a backslash, so SSIDs and BSSIDs may contain "\:".
+func splitTerse(line string) []string {
+	var fields []string
+	var field strings.Builder
+	for i := 0; i < len(line); i++ {
+		switch {
+		case line[i] == '\\' && i+1 < len(line):
+			i++
+			field.WriteByte(line[i])
+		case line[i] == ':':
+			fields = append(fields, field.String())
+			field.Reset()
+		default:
+			field.WriteByte(line[i])
+		}
+	}
+	return append(fields, field.String())
+}
+
+// parseLeadingInt parses the number at the start of values such as "2437 MHz" or "130 Mbit/s"
+func parseLeadingInt(value string) (int, bool) {
+	number, _, _ := strings.Cut(strings.TrimSpace(value), " ")
+	n, err := strconv.Atoi(number)
+	return n, err == nil
+}
+
+// NetworkGroup is one SSID with every access point that broadcasts it, e.g. the nodes of a
+// mesh network
+type NetworkGroup struct {
+	SSID         string            `json:"ssid"`
+	DisplayName  string            `json:"display_name"`
+	Signal       int               `json:"signal"` // Of the strongest access point
+	SignalDBm    int               `json:"signal_dbm"`
+	Security     string            `json:"security"`
+	SecurityType NetworkSecurity   `json:"security_type"`
+	Enterprise   bool              `json:"enterprise"`
+	Bands        []string          `json:"bands"`
+	Known        bool              `json:"known"`         // Credentials for the network are saved
+	AccessPoints []WirelessNetwork `json:"access_points"` // Strongest first
+}
+
+var bandOrder = []string{Band24GHz, Band5GHz, Band6GHz, Band60GHz}
+
+// GroupNetworks merges the access points of each SSID into one group. Known networks come first,
+// then the strongest signal, with ties broken by SSID so the order stays stable between scans.
+func GroupNetworks(networks []WirelessNetwork, known []string) []NetworkGroup {
+	isKnown := make(map[string]bool, len(known))
+	for _, ssid := range known {
+		isKnown[ssid] = true
+	}
+
+	var groups []NetworkGroup
+	index := make(map[string]int)
+	for _, network := range networks {
+		i, ok := index[network.SSID]
+		if !ok {
+			i = len(groups)
+			index[network.SSID] = i
+			groups = append(groups, NetworkGroup{SSID: network.SSID, DisplayName: network.DisplayName, Known: isKnown[network.SSID]})
+		}
+		groups[i].AccessPoints = append(groups[i].AccessPoints, network)
+	}
+
+	for i := range groups {
+		group := &groups[i]
+		sort.SliceStable(group.AccessPoints, func(a, b int) bool {
+			return group.AccessPoints[a].Signal > group.AccessPoints[b].Signal
+		})
+		strongest := group.AccessPoints[0]
+		group.Signal = strongest.Signal
+		group.SignalDBm = strongest.SignalDBm
+		group.Security = strongest.Security
+		group.SecurityType = strongest.SecurityType
+		group.Enterprise = strongest.Enterprise
+
+		group.Bands = []string{}
+		for _, band := range bandOrder {
+			for _, ap := range group.AccessPoints {
+				if ap.Band == band {
+					group.Bands = append(group.Bands, band)
+					break
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(groups, func(a, b int) bool {
+		if groups[a].Known != groups[b].Known {
+			return groups[a].Known
+		}
+		if groups[a].Signal != groups[b].Signal {
+			return groups[a].Signal > groups[b].Signal
+		}
+		return groups[a].SSID < groups[b].SSID
+	})
+	return groups
+}
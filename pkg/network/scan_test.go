@@ -0,0 +1,109 @@
+package network
+
+import (
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+var updateGolden = flag.Bool("update", false, "rewrite the golden files in testdata")
+
+// TestParseNetworkList_Golden parses captured `nmcli -t device wifi list` output and compares
+// the networks to the .golden file next to it, run with -update to regenerate them
+func TestParseNetworkList_Golden(t *testing.T) {
+	inputs, err := filepath.Glob("testdata/nmcli_wifi_list/*.txt")
+	require.NoError(t, err)
+	require.NotEmpty(t, inputs)
+
+	im := NewInterfaceManager(WithInterfaceCommandRunner(command.NewFakeRunner())).(*interfaceManager)
+	for _, input := range inputs {
+		t.Run(filepath.Base(input), func(t *testing.T) {
+			output, err := os.ReadFile(input)
+			require.NoError(t, err)
+			networks, err := im.parseNetworkList(string(output))
+			require.NoError(t, err)
+			got, err := json.MarshalIndent(networks, "", "  ")
+			require.NoError(t, err)
+
+			golden := strings.TrimSuffix(input, ".txt") + ".golden"
+			if *updateGolden {
+				require.NoError(t, os.WriteFile(golden, append(got, '\n'), 0o644))
+			}
+			want, err := os.ReadFile(golden)
+			require.NoError(t, err)
+			assert.JSONEq(t, string(want), string(got))
+		})
+	}
+}
+
+func TestSplitTerse(t *testing.T) {
+	assert.Equal(t, []string{"a:b", `c\`, "", "d"}, splitTerse(`a\:b:c\\::d`))
+	assert.Equal(t, []string{""}, splitTerse(""))
+}
+
+func TestNormalizeSecurity(t *testing.T) {
+	tests := map[string]NetworkSecurity{
+		"":                 NetworkSecurityOpen,
+		"none":             NetworkSecurityOpen,
+		"WEP":              NetworkSecurityWEP,
+		"WPA1":             NetworkSecurityWPAPSK,
+		"WPA1 WPA2":        NetworkSecurityWPA2PSK,
+		"WPA2":             NetworkSecurityWPA2PSK,
+		"WPA2 WPA3":        NetworkSecuritySAE,
+		"WPA3":             NetworkSecuritySAE,
+		"OWE":              NetworkSecurityOWE,
+		"WPA2 802.1X":      NetworkSecurity8021X,
+		"WPA1 WPA2 802.1X": NetworkSecurity8021X,
+	}
+	for security, want := range tests {
+		assert.Equal(t, want, normalizeSecurity(security), security)
+	}
+}
+
+func TestPercentToDBm(t *testing.T) {
+	for _, dBm := range []int{-90, -72, -60, -30} {
+		assert.Equal(t, dBm, percentToDBm(dBmToPercent(dBm)))
+	}
+}
+
+func TestGroupNetworks(t *testing.T) {
+	networks := []WirelessNetwork{
+		{SSID: "Cafe", BSSID: "AA:00:00:00:00:01", Signal: 80, Security: "none", SecurityType: NetworkSecurityOpen, Band: Band24GHz},
+		{SSID: "Mesh", BSSID: "BB:00:00:00:00:01", Signal: 40, Security: "WPA2", SecurityType: NetworkSecurityWPA2PSK, Band: Band24GHz},
+		{SSID: "Mesh", BSSID: "BB:00:00:00:00:02", Signal: 65, Security: "WPA2 WPA3", SecurityType: NetworkSecuritySAE, Band: Band5GHz},
+		{SSID: "Mesh", BSSID: "BB:00:00:00:00:03", Signal: 30, Security: "WPA2", SecurityType: NetworkSecurityWPA2PSK, Band: Band24GHz},
+		{SSID: "Attic", BSSID: "CC:00:00:00:00:01", Signal: 80, Security: "WPA2", SecurityType: NetworkSecurityWPA2PSK, Band: Band6GHz},
+		{SSID: "Garage", BSSID: "DD:00:00:00:00:01", Signal: 10, Security: "WPA2", SecurityType: NetworkSecurityWPA2PSK, Band: Band24GHz},
+	}
+
+	groups := GroupNetworks(networks, []string{"Garage", "Elsewhere"})
+	var order []string
+	for _, group := range groups {
+		order = append(order, group.SSID)
+	}
+	// Known first, then by signal with equal signals ordered by SSID
+	assert.Equal(t, []string{"Garage", "Attic", "Cafe", "Mesh"}, order)
+
+	garage := groups[0]
+	assert.True(t, garage.Known)
+	assert.False(t, groups[1].Known)
+
+	mesh := groups[3]
+	assert.Equal(t, 65, mesh.Signal)
+	assert.Equal(t, NetworkSecuritySAE, mesh.SecurityType)
+	assert.Equal(t, "WPA2 WPA3", mesh.Security)
+	assert.Equal(t, []string{Band24GHz, Band5GHz}, mesh.Bands)
+	require.Len(t, mesh.AccessPoints, 3)
+	assert.Equal(t, "BB:00:00:00:00:02", mesh.AccessPoints[0].BSSID)
+	assert.Equal(t, "BB:00:00:00:00:01", mesh.AccessPoints[1].BSSID)
+	assert.Equal(t, "BB:00:00:00:00:03", mesh.AccessPoints[2].BSSID)
+
+	assert.Empty(t, GroupNetworks(nil, nil))
+}
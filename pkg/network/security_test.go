@@ -0,0 +1,80 @@
+package network
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPConfig_ValidateSecurity(t *testing.T) {
+	tests := []struct {
+		name     string
+		security string
+		pmf      string
+		password string
+		wantErr  string
+	}{
+		{name: "default is wpa2", password: "12345678"},
+		{name: "open without password", security: "open"},
+		{name: "open with pmf", security: "open", pmf: "optional", wantErr: "pmf requires a secured network"},
+		{name: "wpa2 short password", security: "wpa2", password: "1234567", wantErr: "at least 8 characters"},
+		{name: "wpa2 long password", security: "wpa2", password: strings.Repeat("z", 64), wantErr: "at most 63 characters"},
+		{name: "wpa2 hex psk", security: "wpa2", password: strings.Repeat("0f", 32)},
+		{name: "wpa2 non ascii", security: "wpa2", password: "lösenord1", wantErr: "printable ASCII"},
+		{name: "wpa2 missing password", security: "WPA2", wantErr: "password is required"},
+		{name: "wpa3", security: "wpa3", password: "12345678"},
+		{name: "wpa3 long password", security: "wpa3", password: strings.Repeat("a", 100)},
+		{name: "wpa3 without pmf", security: "wpa3", pmf: "optional", password: "12345678", wantErr: "pmf must be required"},
+		{name: "transition", security: "wpa2-wpa3", password: "12345678"},
+		{name: "transition long password", security: "wpa2-wpa3", password: strings.Repeat("z", 64), wantErr: "at most 63 characters"},
+		{name: "transition hex psk", security: "wpa2-wpa3", password: strings.Repeat("0f", 32), wantErr: "at most 63 characters"},
+		{name: "transition pmf disabled", security: "wpa2-wpa3", pmf: "disabled", password: "12345678", wantErr: "cannot be disabled"},
+		{name: "unknown mode", security: "wep", password: "12345678", wantErr: "unsupported security mode"},
+		{name: "unknown pmf", security: "wpa2", pmf: "sometimes", password: "12345678", wantErr: "pmf must be one of"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			config := testAPConfig()
+			config.Security = tt.security
+			config.PMF = tt.pmf
+			config.Password = tt.password
+
+			err := config.Validate()
+			if tt.wantErr == "" {
+				assert.NoError(t, err)
+				return
+			}
+			require.ErrorIs(t, err, ErrInvalidAPConfig)
+			assert.Contains(t, err.Error(), tt.wantErr)
+		})
+	}
+}
+
+func TestNmcliSecurityArgs(t *testing.T) {
+	tests := []struct {
+		security string
+		keyMgmt  string
+		pmf      string
+	}{
+		{"wpa2", "wpa-psk", "1"},
+		{"wpa3", "sae", "3"},
+		{"wpa2-wpa3", "wpa-psk", "2"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.security, func(t *testing.T) {
+			config := testAPConfig()
+			config.Security = tt.security
+			args := strings.Join(nmcliSecurityArgs(config), " ")
+			assert.Contains(t, args, "wifi-sec.key-mgmt "+tt.keyMgmt+" ")
+			assert.Contains(t, args, "wifi-sec.pmf "+tt.pmf+" ")
+			assert.Contains(t, args, "wifi-sec.psk 12345678")
+		})
+	}
+
+	config := testAPConfig()
+	config.Security = "open"
+	assert.Empty(t, nmcliSecurityArgs(config))
+}
@@ -0,0 +1,169 @@
+package network
+
+import (
+	"fmt"
+	"path"
+	"sort"
+	"strings"
+)
+
+// SelectionRule scores one aspect of an interface for hosting the access point. It returns
+// the points awarded, a human readable reason and whether the interface must never be picked.
+// Rules returning no points and no reason are left out of the explanation.
+type SelectionRule func(iface WirelessInterface) (points int, reason string, exclude bool)
+
+// SelectionPolicy ranks wireless interfaces by the sum of its rules' points
+type SelectionPolicy struct {
+	Rules []SelectionRule
+}
+
+// InterfaceScore explains how a policy rated an interface
+type InterfaceScore struct {
+	Interface WirelessInterface `json:"interface"`
+	Score     int               `json:"score"`
+	Excluded  bool              `json:"excluded"`
+	Reasons   []string          `json:"reasons"`
+}
+
+// NewSelectionPolicy creates a policy from rules, evaluated in order
+func NewSelectionPolicy(rules ...SelectionRule) SelectionPolicy {
+	return SelectionPolicy{Rules: rules}
+}
+
+// DefaultSelectionPolicy picks AP capable interfaces, preferring ones that are not in use. The
+// uplink stays eligible so single radio devices still get an access point, add ExcludeUplink
+// to never take it over.
+func DefaultSelectionPolicy() SelectionPolicy {
+	return NewSelectionPolicy(RequireAPSupport(), PreferUnused(100))
+}
+
+// With returns a copy of the policy with rules appended
+func (p SelectionPolicy) With(rules ...SelectionRule) SelectionPolicy {
+	return SelectionPolicy{Rules: append(append([]SelectionRule(nil), p.Rules...), rules...)}
+}
+
+// Score rates a single interface
+func (p SelectionPolicy) Score(iface WirelessInterface) InterfaceScore {
+	score := InterfaceScore{Interface: iface, Reasons: []string{}}
+	for _, rule := range p.Rules {
+		points, reason, exclude := rule(iface)
+		score.Score += points
+		if exclude {
+			score.Excluded = true
+		}
+		if reason == "" && points == 0 {
+			continue
+		}
+		if points != 0 {
+			reason = fmt.Sprintf("%s (%+d)", reason, points)
+		}
+		score.Reasons = append(score.Reasons, reason)
+	}
+	return score
+}
+
+// Rank scores interfaces, best first. Excluded interfaces are sorted last and ties keep the
+// order the interfaces were listed in.
+func (p SelectionPolicy) Rank(interfaces []WirelessInterface) []InterfaceScore {
+	scores := make([]InterfaceScore, 0, len(interfaces))
+	for _, iface := range interfaces {
+		scores = append(scores, p.Score(iface))
+	}
+	sort.SliceStable(scores, func(i, j int) bool {
+		if scores[i].Excluded != scores[j].Excluded {
+			return !scores[i].Excluded
+		}
+		return scores[i].Score > scores[j].Score
+	})
+	return scores
+}
+
+// RequireAPSupport excludes interfaces whose radio cannot host an access point
+func RequireAPSupport() SelectionRule {
+	return func(iface WirelessInterface) (int, string, bool) {
+		if !iface.SupportAP {
+			return 0, "does not support AP mode", true
+		}
+		return 0, "", false
+	}
+}
+
+// PreferUnused awards points to interfaces that are not up
+func PreferUnused(points int) SelectionRule {
+	return func(iface WirelessInterface) (int, string, bool) {
+		if iface.InUse {
+			return 0, "in use", false
+		}
+		return points, "not in use", false
+	}
+}
+
+// PreferBand awards points to interfaces that can start an access point in band, e.g. Band5GHz
+func PreferBand(band string, points int) SelectionRule {
+	return func(iface WirelessInterface) (int, string, bool) {
+		if iface.Capabilities == nil || !iface.Capabilities.SupportsBand(band) {
+			return 0, "", false
+		}
+		return points, "supports " + band, false
+	}
+}
+
+// PreferDriver awards points to interfaces bound to one of the kernel drivers, e.g. "mt76x2u"
+func PreferDriver(points int, drivers ...string) SelectionRule {
+	return func(iface WirelessInterface) (int, string, bool) {
+		if iface.Driver == "" || !containsFold(drivers, iface.Driver) {
+			return 0, "", false
+		}
+		return points, "uses driver " + iface.Driver, false
+	}
+}
+
+// PreferName awards points to interfaces whose name matches a shell pattern, e.g. "wlx*"
+func PreferName(pattern string, points int) SelectionRule {
+	return func(iface WirelessInterface) (int, string, bool) {
+		if !matchName(pattern, iface.Name) {
+			return 0, "", false
+		}
+		return points, "name matches " + pattern, false
+	}
+}
+
+// PreferConcurrentAPStation awards points to interfaces whose radio can host the access point
+// next to a station interface, see VirtualAPManager
+func PreferConcurrentAPStation(points int) SelectionRule {
+	return func(iface WirelessInterface) (int, string, bool) {
+		if iface.Capabilities == nil || !iface.Capabilities.SupportsConcurrentAPStation() {
+			return 0, "", false
+		}
+		return points, "supports concurrent AP and station", false
+	}
+}
+
+// ExcludeInterfaces never picks interfaces whose name matches one of the shell patterns
+func ExcludeInterfaces(patterns ...string) SelectionRule {
+	return func(iface WirelessInterface) (int, string, bool) {
+		for _, pattern := range patterns {
+			if matchName(pattern, iface.Name) {
+				return 0, "excluded by " + pattern, true
+			}
+		}
+		return 0, "", false
+	}
+}
+
+// ExcludeUplink never picks the interface carrying the default route
+func ExcludeUplink() SelectionRule {
+	return func(iface WirelessInterface) (int, string, bool) {
+		if iface.Uplink {
+			return 0, "carries the default route", true
+		}
+		return 0, "", false
+	}
+}
+
+func matchName(pattern, name string) bool {
+	if ok, err := path.Match(pattern, name); err == nil && ok {
+		return true
+	}
+	return strings.EqualFold(pattern, name)
+}
@@ -0,0 +1,81 @@
+package network
+
+import (
+	"log/slog"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func testBoardInterfaces() []WirelessInterface {
+	builtin := parsePhyInfo(brcmfmacPhyInfo)
+	dongle := parsePhyInfo(dualBandPhyInfo)
+	return []WirelessInterface{
+		{Name: "wlan0", SupportAP: true, Driver: "brcmfmac", Capabilities: &builtin},
+		{Name: "wlx00c0ca123456", SupportAP: true, Driver: "mt76x2u", Capabilities: &dongle},
+		{Name: "wlan2", SupportAP: false, Driver: "rtl8xxxu"},
+	}
+}
+
+func TestSelectionPolicy_DefaultKeepsListOrder(t *testing.T) {
+	scores := DefaultSelectionPolicy().Rank(testBoardInterfaces())
+
+	require.Len(t, scores, 3)
+	assert.Equal(t, "wlan0", scores[0].Interface.Name)
+	assert.Equal(t, 100, scores[0].Score)
+	assert.Equal(t, []string{"not in use (+100)"}, scores[0].Reasons)
+	assert.Equal(t, "wlan2", scores[2].Interface.Name)
+	assert.True(t, scores[2].Excluded)
+	assert.Contains(t, scores[2].Reasons, "does not support AP mode")
+}
+
+func TestSelectionPolicy_Preferences(t *testing.T) {
+	tests := []struct {
+		name   string
+		policy SelectionPolicy
+		best   string
+	}{
+		{"prefer 5GHz", DefaultSelectionPolicy().With(PreferBand(Band5GHz, 50)), "wlx00c0ca123456"},
+		{"prefer driver", DefaultSelectionPolicy().With(PreferDriver(50, "mt76x2u", "rt2800usb")), "wlx00c0ca123456"},
+		{"prefer name pattern", DefaultSelectionPolicy().With(PreferName("wlx*", 50)), "wlx00c0ca123456"},
+		{"exclude built-in", DefaultSelectionPolicy().With(ExcludeInterfaces("wlan0")), "wlx00c0ca123456"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			scores := tt.policy.Rank(testBoardInterfaces())
+			assert.Equal(t, tt.best, scores[0].Interface.Name)
+			assert.False(t, scores[0].Excluded)
+		})
+	}
+}
+
+func TestSelectionPolicy_ExcludeUplink(t *testing.T) {
+	interfaces := testBoardInterfaces()
+	interfaces[1].Uplink = true
+	policy := DefaultSelectionPolicy().With(PreferBand(Band5GHz, 500), ExcludeUplink())
+
+	score := policy.Score(interfaces[1])
+	assert.True(t, score.Excluded)
+	assert.Equal(t, []string{"not in use (+100)", "supports 5GHz (+500)", "carries the default route"}, score.Reasons)
+	assert.Equal(t, "wlan0", policy.Rank(interfaces)[0].Interface.Name)
+}
+
+func TestBestAPInterface(t *testing.T) {
+	logger := slog.New(slog.DiscardHandler)
+
+	interfaces := testBoardInterfaces()
+	best, err := bestAPInterface(DefaultSelectionPolicy().Rank(interfaces), logger)
+	require.NoError(t, err)
+	assert.Equal(t, "wlan0", best.Name)
+
+	for i := range interfaces {
+		interfaces[i].InUse = true
+	}
+	best, err = bestAPInterface(DefaultSelectionPolicy().Rank(interfaces), logger)
+	assert.ErrorIs(t, err, ErrAllAccessPointsInUse)
+	assert.Equal(t, "wlan0", best.Name)
+
+	_, err = bestAPInterface(DefaultSelectionPolicy().With(ExcludeInterfaces("wl*")).Rank(interfaces), logger)
+	assert.ErrorIs(t, err, ErrNoAccessPointFound)
+}
@@ -0,0 +1,483 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+var (
+	ErrClientNotResolved = errors.New("could not resolve client MAC address")
+	ErrSessionNotFound   = errors.New("client session not found")
+	ErrInvalidClientAddr = errors.New("invalid client address")
+)
+
+const defaultSessionIdleTimeout = time.Hour
+
+// SessionState is the captive portal state of a client
+type SessionState string
+
+const (
+	// SessionPending clients are redirected to the portal
+	SessionPending SessionState = "pending"
+	// SessionAuthorized clients bypass the portal
+	SessionAuthorized SessionState = "authorized"
+	// SessionExpired clients were authorized but their session ran out; they are redirected again
+	SessionExpired SessionState = "expired"
+)
+
+// ClientSession is the portal state of a single client on the access point
+type ClientSession struct {
+	MAC          string       `json:"mac,omitempty"`
+	IP           string       `json:"ip"`
+	State        SessionState `json:"state"`
+	FirstSeen    time.Time    `json:"first_seen"`
+	LastSeen     time.Time    `json:"last_seen"`
+	AuthorizedAt time.Time    `json:"authorized_at,omitempty"`
+	ExpiresAt    time.Time    `json:"expires_at,omitempty"` // zero when authorization does not expire
+}
+
+// Remaining returns how long an authorized session has left, zero if it never expires or isn't authorized
+func (c ClientSession) Remaining(now time.Time) time.Duration {
+	if c.State != SessionAuthorized || c.ExpiresAt.IsZero() || !now.Before(c.ExpiresAt) {
+		return 0
+	}
+	return c.ExpiresAt.Sub(now)
+}
+
+// ClientResolver maps a client IP on the access point to its MAC address
+type ClientResolver interface {
+	ResolveMAC(ctx context.Context, ip string) (string, error)
+}
+
+// neighbourResolver reads the kernel neighbour (ARP) table with `ip neigh`
+type neighbourResolver struct {
+	runner command.Runner
+	iFace  string
+}
+
+func (n neighbourResolver) ResolveMAC(ctx context.Context, ip string) (string, error) {
+	args := []string{"neigh", "show", ip}
+	if n.iFace != "" {
+		args = append(args, "dev", n.iFace)
+	}
+	res, err := n.runner.RunWithContext(ctx, "ip", args...)
+	if err != nil {
+		return "", errors.Wrap(err, res.Combined())
+	}
+	if mac := parseNeighbourMAC(string(res.Stdout)); mac != "" {
+		return mac, nil
+	}
+	return "", errors.Wrapf(ErrClientNotResolved, "no neighbour entry for %s", ip)
+}
+
+// parseNeighbourMAC extracts the lladdr from `ip neigh show` output such as
+// "192.168.4.23 dev wlan0 lladdr aa:bb:cc:dd:ee:ff REACHABLE"
+func parseNeighbourMAC(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		for i := 0; i+1 < len(fields); i++ {
+			if fields[i] == "lladdr" {
+				if mac, err := net.ParseMAC(fields[i+1]); err == nil {
+					return mac.String()
+				}
+			}
+		}
+	}
+	return ""
+}
+
+// SessionOption configures a SessionManager
+type SessionOption func(*SessionManager)
+
+// WithSessionCommandRunner sets the runner used for iptables and ip neigh
+func WithSessionCommandRunner(runner command.Runner) SessionOption {
+	return func(m *SessionManager) {
+		m.runner = runner
+	}
+}
+
+// WithSessionResolver adds a resolver that is consulted before the neighbour table, e.g. a DHCPServer
+func WithSessionResolver(resolver ClientResolver) SessionOption {
+	return func(m *SessionManager) {
+		m.resolvers = append(m.resolvers, resolver)
+	}
+}
+
+// WithSessionTimeout limits how long an authorization lasts; zero means until revoked
+func WithSessionTimeout(d time.Duration) SessionOption {
+	return func(m *SessionManager) {
+		m.timeout = d
+	}
+}
+
+// WithSessionIdleTimeout sets how long unauthorized clients are remembered after they were last seen
+func WithSessionIdleTimeout(d time.Duration) SessionOption {
+	return func(m *SessionManager) {
+		m.idleTimeout = d
+	}
+}
+
+// WithSessionLogger sets the logger used by the manager
+func WithSessionLogger(logger *slog.Logger) SessionOption {
+	return func(m *SessionManager) {
+		m.logger = logger
+	}
+}
+
+// SessionManager tracks which clients on the access point are through the portal and
+// maintains per-client firewall exceptions so authorized clients are no longer redirected.
+//
+// The exceptions only affect the iptables redirect; when dnsmasq serves DNS every name still
+// resolves to the gateway. Use the embedded DNSServer with IsAuthorized as its client policy
+// to give authorized clients real DNS answers.
+type SessionManager struct {
+	mu          sync.Mutex
+	config      APConfig
+	runner      command.Runner
+	resolvers   []ClientResolver
+	timeout     time.Duration
+	idleTimeout time.Duration
+	logger      *slog.Logger
+	now         func() time.Time
+
+	sessions map[string]*ClientSession // keyed by MAC, or "ip:" + IP when the MAC is unknown
+}
+
+// NewSessionManager creates a session manager for the access point described by config
+func NewSessionManager(config APConfig, opts ...SessionOption) *SessionManager {
+	m := &SessionManager{
+		config:      config,
+		runner:      command.NewExecRunner(),
+		idleTimeout: defaultSessionIdleTimeout,
+		logger:      slog.Default().WithGroup("sessions"),
+		now:         time.Now,
+		sessions:    make(map[string]*ClientSession),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	m.resolvers = append(m.resolvers, neighbourResolver{runner: m.runner, iFace: config.Interface})
+	return m
+}
+
+// Track returns the session for the client at ip, creating a pending one on first sight. The
+// MAC is resolved on every call, a device given an address another client released starts a
+// new session instead of inheriting the old one.
+func (m *SessionManager) Track(ctx context.Context, ip string) (ClientSession, error) {
+	ip, err := normalizeClientIP(ip)
+	if err != nil {
+		return ClientSession{}, err
+	}
+
+	// Resolve outside the lock since it may shell out
+	mac := m.resolve(ctx, ip)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if s := m.findLocked(ip); s != nil && s.MAC != "" && (mac == "" || mac == s.MAC) {
+		// Same client, or one that cannot be told apart from it right now
+		s.LastSeen = m.now()
+		m.expireLocked(ctx, s)
+		return *s, nil
+	}
+	return *m.upsertLocked(ctx, ip, mac), nil
+}
+
+// Session returns the current session for a client IP or MAC without creating one
+func (m *SessionManager) Session(ctx context.Context, client string) (ClientSession, bool) {
+	client, err := normalizeClient(client)
+	if err != nil {
+		return ClientSession{}, false
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.findLocked(client)
+	if s == nil {
+		return ClientSession{}, false
+	}
+	m.expireLocked(ctx, s)
+	return *s, true
+}
+
+// Sessions returns all known sessions ordered by IP
+func (m *SessionManager) Sessions(ctx context.Context) []ClientSession {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	sessions := make([]ClientSession, 0, len(m.sessions))
+	for _, s := range m.sessions {
+		m.expireLocked(ctx, s)
+		sessions = append(sessions, *s)
+	}
+	sort.Slice(sessions, func(i, j int) bool {
+		return ipToUint32(net.ParseIP(sessions[i].IP)) < ipToUint32(net.ParseIP(sessions[j].IP))
+	})
+	return sessions
+}
+
+// IsAuthorized reports whether the client at ip is authorized; usable as a DNSClientPolicy
+func (m *SessionManager) IsAuthorized(ip net.IP) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.findLocked(ip.String())
+	if s == nil || s.State != SessionAuthorized {
+		return false
+	}
+	return s.ExpiresAt.IsZero() || m.now().Before(s.ExpiresAt)
+}
+
+// Authorize lets the client, given by IP or MAC, bypass the portal
+func (m *SessionManager) Authorize(ctx context.Context, client string) (ClientSession, error) {
+	client, err := normalizeClient(client)
+	if err != nil {
+		return ClientSession{}, err
+	}
+	if _, err := net.ParseMAC(client); err != nil {
+		// Make sure an IP we haven't seen yet gets a session
+		if _, err := m.Track(ctx, client); err != nil {
+			return ClientSession{}, err
+		}
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.findLocked(client)
+	if s == nil {
+		return ClientSession{}, errors.Wrap(ErrSessionNotFound, client)
+	}
+	if s.State == SessionAuthorized {
+		m.removeExceptionLocked(ctx, s)
+	}
+	if err := m.addExceptionLocked(ctx, s); err != nil {
+		if s.State == SessionAuthorized {
+			// Its previous exception is gone
+			s.State = SessionPending
+		}
+		return *s, errors.Wrap(err, "failed to add client firewall exception")
+	}
+
+	now := m.now()
+	s.State = SessionAuthorized
+	s.AuthorizedAt = now
+	s.ExpiresAt = time.Time{}
+	if m.timeout > 0 {
+		s.ExpiresAt = now.Add(m.timeout)
+	}
+	m.logger.Info("client authorized", slog.String("mac", s.MAC), slog.String("ip", s.IP))
+	return *s, nil
+}
+
+// Revoke sends the client, given by IP or MAC, back to the portal
+func (m *SessionManager) Revoke(ctx context.Context, client string) (ClientSession, error) {
+	client, err := normalizeClient(client)
+	if err != nil {
+		return ClientSession{}, err
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	s := m.findLocked(client)
+	if s == nil {
+		return ClientSession{}, errors.Wrap(ErrSessionNotFound, client)
+	}
+	if s.State == SessionAuthorized {
+		m.removeExceptionLocked(ctx, s)
+	}
+	s.State = SessionPending
+	s.AuthorizedAt = time.Time{}
+	s.ExpiresAt = time.Time{}
+	m.logger.Info("client authorization revoked", slog.String("mac", s.MAC), slog.String("ip", s.IP))
+	return *s, nil
+}
+
+// Sweep expires lapsed authorizations and forgets idle unauthorized clients
+func (m *SessionManager) Sweep(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	for key, s := range m.sessions {
+		m.expireLocked(ctx, s)
+		if s.State != SessionAuthorized && m.idleTimeout > 0 && now.Sub(s.LastSeen) > m.idleTimeout {
+			delete(m.sessions, key)
+		}
+	}
+}
+
+// Run sweeps sessions every interval until ctx is cancelled
+func (m *SessionManager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Sweep(ctx)
+		}
+	}
+}
+
+// Close removes every client firewall exception; call it when the access point stops
+func (m *SessionManager) Close(ctx context.Context) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, s := range m.sessions {
+		if s.State == SessionAuthorized {
+			m.removeExceptionLocked(ctx, s)
+			s.State = SessionPending
+		}
+	}
+}
+
+func (m *SessionManager) resolve(ctx context.Context, ip string) string {
+	for _, r := range m.resolvers {
+		mac, err := r.ResolveMAC(ctx, ip)
+		if err == nil && mac != "" {
+			return strings.ToLower(mac)
+		}
+		if err != nil {
+			m.logger.Debug("client resolver failed", slog.String("ip", ip), slog.String("error", err.Error()))
+		}
+	}
+	return ""
+}
+
+// findLocked looks a session up by MAC or IP
+func (m *SessionManager) findLocked(client string) *ClientSession {
+	if mac, err := net.ParseMAC(client); err == nil {
+		return m.sessions[mac.String()]
+	}
+	if s, ok := m.sessions["ip:"+client]; ok {
+		return s
+	}
+	for _, s := range m.sessions {
+		if s.IP == client {
+			return s
+		}
+	}
+	return nil
+}
+
+// upsertLocked records that mac (possibly unknown) is using ip
+func (m *SessionManager) upsertLocked(ctx context.Context, ip, mac string) *ClientSession {
+	now := m.now()
+	key := "ip:" + ip
+	if mac != "" {
+		key = mac
+	}
+
+	// Another client previously held this address; its lease moved on
+	for k, s := range m.sessions {
+		if s.IP != ip || k == key {
+			continue
+		}
+		if mac != "" && k == "ip:"+ip {
+			// Same client, now with a known MAC: carry the session over
+			s.MAC = mac
+			m.sessions[key] = s
+			delete(m.sessions, k)
+			break
+		}
+		if s.State == SessionAuthorized {
+			// The exception and IsAuthorized must not carry over to the new holder of the address
+			m.removeExceptionLocked(ctx, s)
+			m.logger.Info("client address taken over by another client",
+				slog.String("mac", s.MAC), slog.String("ip", ip), slog.String("new_mac", mac))
+		}
+		delete(m.sessions, k)
+	}
+
+	s, ok := m.sessions[key]
+	if !ok {
+		s = &ClientSession{MAC: mac, IP: ip, State: SessionPending, FirstSeen: now}
+		m.sessions[key] = s
+		m.logger.Debug("new client session", slog.String("mac", mac), slog.String("ip", ip))
+	}
+	if s.IP != ip && s.State == SessionAuthorized && s.MAC == "" {
+		// IP-matched exceptions must follow the address
+		m.removeExceptionLocked(ctx, s)
+		s.State = SessionPending
+	}
+	s.IP = ip
+	s.LastSeen = now
+	return s
+}
+
+// expireLocked moves a lapsed authorization to SessionExpired and drops its exception
+func (m *SessionManager) expireLocked(ctx context.Context, s *ClientSession) {
+	if s.State != SessionAuthorized || s.ExpiresAt.IsZero() || m.now().Before(s.ExpiresAt) {
+		return
+	}
+	m.removeExceptionLocked(ctx, s)
+	s.State = SessionExpired
+	m.logger.Info("client session expired", slog.String("mac", s.MAC), slog.String("ip", s.IP))
+}
+
+// addExceptionLocked inserts the client's firewall exception. When a rule fails the ones already
+// inserted are deleted again, so a failed Authorize leaves no half open exception behind.
+func (m *SessionManager) addExceptionLocked(ctx context.Context, s *ClientSession) error {
+	rules := CreateClientExceptionRules(m.config.Interface, s.MAC, s.IP)
+	for i, rule := range rules {
+		if err := rule.ApplyWith(ctx, m.runner); err != nil {
+			undo := CleanupClientExceptionRules(m.config.Interface, s.MAC, s.IP)[:i]
+			if undoErr := m.applyRules(context.WithoutCancel(ctx), undo); undoErr != nil {
+				m.logger.Warn("failed to remove partial client firewall exception", slog.String("ip", s.IP), slog.String("error", undoErr.Error()))
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *SessionManager) removeExceptionLocked(ctx context.Context, s *ClientSession) {
+	if err := m.applyRules(ctx, CleanupClientExceptionRules(m.config.Interface, s.MAC, s.IP)); err != nil {
+		m.logger.Warn("failed to remove client firewall exception", slog.String("ip", s.IP), slog.String("error", err.Error()))
+	}
+}
+
+func (m *SessionManager) applyRules(ctx context.Context, rules []IPTablesRule) error {
+	var firstErr error
+	for _, rule := range rules {
+		if err := rule.ApplyWith(ctx, m.runner); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+// normalizeClient returns the canonical form of a client MAC or IP address
+func normalizeClient(client string) (string, error) {
+	if mac, err := net.ParseMAC(client); err == nil {
+		return mac.String(), nil
+	}
+	return normalizeClientIP(client)
+}
+
+func normalizeClientIP(ip string) (string, error) {
+	if host, _, err := net.SplitHostPort(ip); err == nil {
+		ip = host
+	}
+	parsed := net.ParseIP(ip)
+	if parsed == nil {
+		return "", errors.Wrap(ErrInvalidClientAddr, ip)
+	}
+	if v4 := parsed.To4(); v4 != nil {
+		return v4.String(), nil
+	}
+	return parsed.String(), nil
+}
@@ -0,0 +1,183 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const testClientIP = "192.168.4.23"
+
+func newTestSessionManager(t *testing.T, opts ...SessionOption) (*SessionManager, *command.FakeRunner, *time.Time) {
+	t.Helper()
+	runner := command.NewFakeRunner()
+	runner.AddScript("ip", []string{"neigh", "show", testClientIP, "dev", "wlan0"}, command.Result{
+		Stdout: []byte(testClientIP + " dev wlan0 lladdr 02:00:00:AA:BB:CC REACHABLE\n"),
+	})
+	now := time.Date(2025, 1, 1, 12, 0, 0, 0, time.UTC)
+	m := NewSessionManager(testAPConfig(), append([]SessionOption{WithSessionCommandRunner(runner)}, opts...)...)
+	m.now = func() time.Time { return now }
+	return m, runner, &now
+}
+
+func TestParseNeighbourMAC(t *testing.T) {
+	tests := []struct {
+		output string
+		want   string
+	}{
+		{"192.168.4.23 dev wlan0 lladdr aa:bb:cc:dd:ee:ff REACHABLE\n", "aa:bb:cc:dd:ee:ff"},
+		{"192.168.4.23 dev wlan0 lladdr AA:BB:CC:DD:EE:FF STALE", "aa:bb:cc:dd:ee:ff"},
+		{"192.168.4.23 dev wlan0 FAILED\n", ""},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		assert.Equal(t, tt.want, parseNeighbourMAC(tt.output), tt.output)
+	}
+}
+
+func TestSessionManager_AuthorizeAndRevoke(t *testing.T) {
+	m, runner, _ := newTestSessionManager(t)
+	ctx := context.Background()
+
+	session, err := m.Track(ctx, testClientIP+":51234")
+	require.NoError(t, err)
+	assert.Equal(t, SessionPending, session.State)
+	assert.Equal(t, "02:00:00:aa:bb:cc", session.MAC)
+	assert.False(t, m.IsAuthorized(net.ParseIP(testClientIP)))
+
+	session, err = m.Authorize(ctx, testClientIP)
+	require.NoError(t, err)
+	assert.Equal(t, SessionAuthorized, session.State)
+	assert.True(t, session.ExpiresAt.IsZero())
+	assert.True(t, m.IsAuthorized(net.ParseIP(testClientIP)))
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-I", "PREROUTING", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "RETURN"))
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-I", "FORWARD", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "ACCEPT"))
+
+	session, err = m.Revoke(ctx, "02:00:00:AA:BB:CC")
+	require.NoError(t, err)
+	assert.Equal(t, SessionPending, session.State)
+	assert.False(t, m.IsAuthorized(net.ParseIP(testClientIP)))
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-D", "PREROUTING", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "RETURN"))
+}
+
+func TestSessionManager_SessionsExpire(t *testing.T) {
+	m, runner, now := newTestSessionManager(t, WithSessionTimeout(30*time.Minute))
+	ctx := context.Background()
+
+	session, err := m.Authorize(ctx, testClientIP)
+	require.NoError(t, err)
+	assert.Equal(t, 30*time.Minute, session.Remaining(*now))
+
+	*now = now.Add(31 * time.Minute)
+	assert.False(t, m.IsAuthorized(net.ParseIP(testClientIP)))
+	m.Sweep(ctx)
+
+	session, ok := m.Session(ctx, testClientIP)
+	require.True(t, ok)
+	assert.Equal(t, SessionExpired, session.State)
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-D", "FORWARD", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "ACCEPT"))
+}
+
+func TestSessionManager_FallsBackToIPMatch(t *testing.T) {
+	m, runner, _ := newTestSessionManager(t)
+	ctx := context.Background()
+
+	session, err := m.Authorize(ctx, "192.168.4.40")
+	require.NoError(t, err)
+	assert.Empty(t, session.MAC)
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-I", "PREROUTING", "-i", "wlan0",
+		"-s", "192.168.4.40", "-j", "RETURN"))
+}
+
+func TestSessionManager_PrefersDHCPLeases(t *testing.T) {
+	dhcp, _ := newTestDHCPServer(t, "192.168.4.10,192.168.4.20")
+	offer := dhcp.handle(dhcpClientPacket(dhcpDiscover, testClientMAC))
+	dhcp.handle(dhcpClientPacket(dhcpRequest, testClientMAC,
+		dhcpOptionField{Code: optRequestedIP, Value: offer.YIAddr.To4()}))
+
+	m, runner, _ := newTestSessionManager(t, WithSessionResolver(dhcp))
+	session, err := m.Track(context.Background(), offer.YIAddr.String())
+	require.NoError(t, err)
+	assert.Equal(t, testClientMAC.String(), session.MAC)
+	assert.Empty(t, runner.History(), "neighbour table should not be consulted")
+}
+
+func TestSessionManager_ReusedAddressStartsNewSession(t *testing.T) {
+	m, runner, _ := newTestSessionManager(t)
+	ctx := context.Background()
+	_, err := m.Authorize(ctx, testClientIP)
+	require.NoError(t, err)
+
+	// The lease was released and handed to another device
+	runner.AddScript("ip", []string{"neigh", "show", testClientIP, "dev", "wlan0"}, command.Result{
+		Stdout: []byte(testClientIP + " dev wlan0 lladdr 02:00:00:dd:ee:ff REACHABLE\n"),
+	})
+	session, err := m.Track(ctx, testClientIP)
+	require.NoError(t, err)
+	assert.Equal(t, "02:00:00:dd:ee:ff", session.MAC)
+	assert.Equal(t, SessionPending, session.State)
+	assert.False(t, m.IsAuthorized(net.ParseIP(testClientIP)))
+	assert.Len(t, m.Sessions(ctx), 1)
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-D", "PREROUTING", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "RETURN"))
+
+	// A failed lookup keeps the session that holds the address
+	runner.AddError("ip", []string{"neigh", "show", testClientIP, "dev", "wlan0"}, command.Result{}, errors.New("exit status 1"))
+	session, err = m.Track(ctx, testClientIP)
+	require.NoError(t, err)
+	assert.Equal(t, "02:00:00:dd:ee:ff", session.MAC)
+}
+
+func TestSessionManager_IdleClientsAreForgotten(t *testing.T) {
+	m, _, now := newTestSessionManager(t, WithSessionIdleTimeout(time.Minute))
+	ctx := context.Background()
+
+	_, err := m.Track(ctx, testClientIP)
+	require.NoError(t, err)
+	*now = now.Add(2 * time.Minute)
+	m.Sweep(ctx)
+	assert.Empty(t, m.Sessions(ctx))
+}
+
+func TestSessionManager_AuthorizeFailsWhenFirewallFails(t *testing.T) {
+	m, runner, _ := newTestSessionManager(t)
+	runner.AddError("sudo", []string{"iptables-legacy", "-t", "nat", "-I", "PREROUTING", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "RETURN"}, command.Result{}, errors.New("exit status 1"))
+
+	_, err := m.Authorize(context.Background(), testClientIP)
+	require.Error(t, err)
+	assert.False(t, m.IsAuthorized(net.ParseIP(testClientIP)))
+}
+
+func TestSessionManager_AuthorizeRemovesPartialException(t *testing.T) {
+	m, runner, _ := newTestSessionManager(t)
+	runner.AddError("sudo", []string{"iptables-legacy", "-I", "FORWARD", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "ACCEPT"}, command.Result{}, errors.New("exit status 1"))
+
+	session, err := m.Authorize(context.Background(), testClientIP)
+	require.Error(t, err)
+	assert.Equal(t, SessionPending, session.State)
+	assert.True(t, runner.Called("sudo", "iptables-legacy", "-t", "nat", "-D", "PREROUTING", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "RETURN"))
+	assert.False(t, runner.Called("sudo", "iptables-legacy", "-D", "FORWARD", "-i", "wlan0",
+		"-m", "mac", "--mac-source", "02:00:00:aa:bb:cc", "-j", "ACCEPT"))
+}
+
+func TestSessionManager_UnknownClient(t *testing.T) {
+	m, _, _ := newTestSessionManager(t)
+
+	_, err := m.Revoke(context.Background(), "02:00:00:00:00:99")
+	assert.ErrorIs(t, err, ErrSessionNotFound)
+	_, err = m.Track(context.Background(), "not-an-ip")
+	assert.ErrorIs(t, err, ErrInvalidClientAddr)
+}
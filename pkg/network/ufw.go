@@ -1,8 +1,9 @@
 package network
 
 import (
-	"os/exec"
+	"context"
 
+	"github.com/AnteWall/go-wifiportal/pkg/command"
 	"github.com/pkg/errors"
 )
 
@@ -61,10 +62,15 @@ func (p FireWallRule) ToArgs(iFace string) []string {
 }
 
 func (p FireWallRule) Apply(iFace string) error {
+	return p.ApplyWith(context.Background(), command.NewExecRunner(), iFace)
+}
+
+// ApplyWith applies the rule using the given runner
+func (p FireWallRule) ApplyWith(ctx context.Context, runner command.Runner, iFace string) error {
 	args := append([]string{"ufw"}, p.ToArgs(iFace)...)
-	o, err := exec.Command("sudo", args...).CombinedOutput()
+	res, err := runner.RunWithContext(ctx, "sudo", args...)
 	if err != nil {
-		return errors.Wrap(err, string(o))
+		return errors.Wrap(err, res.Combined())
 	}
 	return nil
 }
@@ -0,0 +1,242 @@
+package network
+
+import (
+	"context"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+// maxInterfaceNameLength is the kernel limit on interface names (IFNAMSIZ without the terminator)
+const maxInterfaceNameLength = 15
+
+// InterfacePlan describes which interface runs the access point and which joins networks
+type InterfacePlan struct {
+	AP      string `json:"ap"`      // Interface the APService runs on
+	Station string `json:"station"` // Interface the InterfaceManager connects
+	Virtual bool   `json:"virtual"` // AP is a virtual interface removed by Release
+	// SingleChannel is set when the radio can only use one channel at a time, so the access
+	// point follows the channel of the network the station joins, see FollowStation
+	SingleChannel bool `json:"single_channel"`
+}
+
+// Concurrent reports whether the access point can keep running while the station connects
+func (p InterfacePlan) Concurrent() bool {
+	return p.AP != p.Station
+}
+
+// VirtualAPOption configures a VirtualAPManager
+type VirtualAPOption func(*VirtualAPManager)
+
+// WithVirtualAPName sets the name of the created AP interface, defaults to "<physical>ap"
+func WithVirtualAPName(name string) VirtualAPOption {
+	return func(m *VirtualAPManager) {
+		m.name = name
+	}
+}
+
+// WithVirtualAPCommandRunner sets the runner used for the iw and ip commands
+func WithVirtualAPCommandRunner(runner command.Runner) VirtualAPOption {
+	return func(m *VirtualAPManager) {
+		m.runner = runner
+	}
+}
+
+// WithVirtualAPLogger sets the logger used by the manager
+func WithVirtualAPLogger(logger *slog.Logger) VirtualAPOption {
+	return func(m *VirtualAPManager) {
+		m.logger = logger
+	}
+}
+
+// VirtualAPManager runs the access point and the station on one radio at the same time by
+// adding a virtual __ap interface, on chipsets whose interface combinations allow it
+type VirtualAPManager struct {
+	runner command.Runner
+	logger *slog.Logger
+	name   string
+}
+
+// NewVirtualAPManager creates a VirtualAPManager
+func NewVirtualAPManager(opts ...VirtualAPOption) *VirtualAPManager {
+	m := &VirtualAPManager{
+		runner: command.NewExecRunner(),
+		logger: slog.Default().With("component", "virtual_ap"),
+	}
+	for _, opt := range opts {
+		opt(m)
+	}
+	return m
+}
+
+// Plan creates a virtual AP interface on top of physical when the radio supports a managed
+// and an AP interface at once. Otherwise, or when creating the interface fails, it falls
+// back to using physical for both roles.
+func (m *VirtualAPManager) Plan(ctx context.Context, physical string) (InterfacePlan, error) {
+	fallback := InterfacePlan{AP: physical, Station: physical}
+
+	combination, err := m.concurrentCombination(ctx, physical)
+	if err != nil {
+		m.logger.Warn("could not read interface combinations, using a single interface",
+			slog.String("interface", physical), slog.String("error", err.Error()))
+		return fallback, nil
+	}
+	if combination == nil {
+		m.logger.Info("radio does not support concurrent AP and station, using a single interface",
+			slog.String("interface", physical))
+		return fallback, nil
+	}
+
+	name := m.virtualName(physical)
+	if err := m.create(ctx, physical, name); err != nil {
+		m.logger.Warn("could not create virtual AP interface, using a single interface",
+			slog.String("interface", physical), slog.String("virtual", name), slog.String("error", err.Error()))
+		return fallback, nil
+	}
+
+	plan := InterfacePlan{AP: name, Station: physical, Virtual: true, SingleChannel: combination.Channels <= 1}
+	m.logger.Info("created virtual AP interface",
+		slog.String("interface", physical), slog.String("virtual", name), slog.Bool("single_channel", plan.SingleChannel))
+	return plan, nil
+}
+
+// Release removes the virtual AP interface created by Plan
+func (m *VirtualAPManager) Release(ctx context.Context, plan InterfacePlan) error {
+	if !plan.Virtual {
+		return nil
+	}
+	if _, err := m.runner.RunWithContext(ctx, "iw", "dev", plan.AP, "del"); err != nil {
+		return errors.Wrapf(err, "failed to remove virtual interface %s", plan.AP)
+	}
+	return nil
+}
+
+// FollowStation returns config set to the channel of the network the station has joined when
+// the radio can only use one channel at a time, an access point on another channel would fail
+// to start. It only has an effect while the station is associated, WithConnectorVirtualAP calls
+// it once a join is verified. config is returned unchanged otherwise.
+func (m *VirtualAPManager) FollowStation(ctx context.Context, plan InterfacePlan, config APConfig) APConfig {
+	if !plan.SingleChannel {
+		return config
+	}
+	result, err := m.runner.RunWithContext(ctx, "iw", "dev", plan.Station, "info")
+	if err != nil {
+		m.logger.Warn("could not read station channel", slog.String("interface", plan.Station), slog.String("error", err.Error()))
+		return config
+	}
+	channel := parseInterfaceChannel(string(result.Stdout))
+	if channel == 0 || channel == config.Channel {
+		return config
+	}
+	m.logger.Info("moving access point to the station channel",
+		slog.String("interface", plan.AP), slog.Int("channel", channel))
+	config.Channel = channel
+	config.HWMode = "" // Derived from the channel, the configured band may no longer match
+	return config
+}
+
+// concurrentCombination returns the interface combination of physical's radio that allows
+// a managed and an AP interface, or nil when there is none
+func (m *VirtualAPManager) concurrentCombination(ctx context.Context, physical string) (*InterfaceCombination, error) {
+	result, err := m.runner.RunWithContext(ctx, "iw", "dev", physical, "info")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get info of %s", physical)
+	}
+	phy := parseWiphy(string(result.Stdout))
+	if phy == "" {
+		return nil, errors.Errorf("no wiphy reported for %s", physical)
+	}
+
+	result, err = m.runner.RunWithContext(ctx, "iw", "phy", phy, "info")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to get info of %s", phy)
+	}
+	caps := parsePhyInfo(string(result.Stdout))
+	return caps.concurrentCombination(), nil
+}
+
+// create adds the virtual interface and gives it its own MAC address, since hostapd and
+// NetworkManager refuse to run an AP sharing the address of the station
+func (m *VirtualAPManager) create(ctx context.Context, physical, name string) error {
+	if _, err := m.runner.RunWithContext(ctx, "test", "-d", "/sys/class/net/"+name); err == nil {
+		m.logger.Debug("removing stale virtual interface", slog.String("virtual", name))
+		if _, err := m.runner.RunWithContext(ctx, "iw", "dev", name, "del"); err != nil {
+			return errors.Wrapf(err, "failed to remove stale interface %s", name)
+		}
+	}
+
+	if _, err := m.runner.RunWithContext(ctx, "iw", "dev", physical, "interface", "add", name, "type", "__ap"); err != nil {
+		return errors.Wrap(err, "failed to add interface")
+	}
+
+	result, err := m.runner.RunWithContext(ctx, "cat", "/sys/class/net/"+physical+"/address")
+	if err == nil {
+		var mac string
+		mac, err = virtualMACAddress(strings.TrimSpace(string(result.Stdout)))
+		if err == nil {
+			_, err = m.runner.RunWithContext(ctx, "ip", "link", "set", "dev", name, "address", mac)
+		}
+	}
+	if err != nil {
+		m.runner.RunWithContext(context.WithoutCancel(ctx), "iw", "dev", name, "del")
+		return errors.Wrap(err, "failed to set MAC address")
+	}
+	return nil
+}
+
+func (m *VirtualAPManager) virtualName(physical string) string {
+	if m.name != "" {
+		return m.name
+	}
+	name := physical + "ap"
+	if len(name) > maxInterfaceNameLength {
+		name = name[len(name)-maxInterfaceNameLength:]
+	}
+	return name
+}
+
+// parseWiphy returns the phy name, e.g. "phy0", from the "wiphy 0" line of "iw dev <iface> info"
+func parseWiphy(output string) string {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 && fields[0] == "wiphy" {
+			return "phy" + fields[1]
+		}
+	}
+	return ""
+}
+
+// parseInterfaceChannel returns the channel from the "channel 36 (5180 MHz), width: 80 MHz" line of
+// "iw dev <iface> info", 0 when the interface is not on a channel
+func parseInterfaceChannel(output string) int {
+	for _, line := range strings.Split(output, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) >= 2 && fields[0] == "channel" {
+			channel, _ := strconv.Atoi(fields[1])
+			return channel
+		}
+	}
+	return 0
+}
+
+// virtualMACAddress derives a locally administered address from the physical one
+func virtualMACAddress(physical string) (string, error) {
+	hw, err := net.ParseMAC(physical)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid MAC address %q", physical)
+	}
+	if len(hw) != 6 {
+		return "", errors.Errorf("unexpected MAC address length %q", physical)
+	}
+	mac := append(net.HardwareAddr(nil), hw...)
+	mac[0] = (mac[0] | 0x02) &^ 0x01
+	if mac[0] == hw[0] {
+		// Already locally administered, vary the last octet instead
+		mac[5] ^= 0x01
+	}
+	return mac.String(), nil
+}
@@ -0,0 +1,91 @@
+package network
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func scriptPhy(runner *command.FakeRunner, phyInfo string) {
+	runner.AddScript("iw", []string{"dev", "wlan0", "info"}, command.Result{Stdout: []byte("Interface wlan0\n\tifindex 3\n\twiphy 0\n\ttype managed\n")})
+	runner.AddScript("iw", []string{"phy", "phy0", "info"}, command.Result{Stdout: []byte(phyInfo)})
+	runner.AddError("test", []string{"-d", "/sys/class/net/wlan0ap"}, command.Result{ExitCode: 1}, errors.New("exit status 1"))
+	runner.AddScript("cat", []string{"/sys/class/net/wlan0/address"}, command.Result{Stdout: []byte("b8:27:eb:12:34:56\n")})
+}
+
+func TestVirtualAPManager_CreatesVirtualInterface(t *testing.T) {
+	runner := command.NewFakeRunner()
+	scriptPhy(runner, brcmfmacPhyInfo)
+	m := NewVirtualAPManager(WithVirtualAPCommandRunner(runner))
+
+	plan, err := m.Plan(context.Background(), "wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, InterfacePlan{AP: "wlan0ap", Station: "wlan0", Virtual: true, SingleChannel: true}, plan)
+	assert.True(t, plan.Concurrent())
+	assert.True(t, runner.Called("iw", "dev", "wlan0", "interface", "add", "wlan0ap", "type", "__ap"))
+	assert.True(t, runner.Called("ip", "link", "set", "dev", "wlan0ap", "address", "ba:27:eb:12:34:56"))
+
+	require.NoError(t, m.Release(context.Background(), plan))
+	assert.True(t, runner.Called("iw", "dev", "wlan0ap", "del"))
+}
+
+func TestVirtualAPManager_FollowStation(t *testing.T) {
+	runner := command.NewFakeRunner()
+	runner.AddScript("iw", []string{"dev", "wlan0", "info"}, command.Result{
+		Stdout: []byte("Interface wlan0\n\tifindex 3\n\twiphy 0\n\tssid HomeWiFi\n\ttype managed\n\tchannel 36 (5180 MHz), width: 80 MHz, center1: 5210 MHz\n"),
+	})
+	m := NewVirtualAPManager(WithVirtualAPCommandRunner(runner))
+	config := APConfig{Interface: "wlan0ap", Channel: 6, HWMode: "g"}
+
+	followed := m.FollowStation(context.Background(), InterfacePlan{AP: "wlan0ap", Station: "wlan0", Virtual: true, SingleChannel: true}, config)
+	assert.Equal(t, 36, followed.Channel)
+	assert.Equal(t, "", followed.HWMode)
+	assert.Equal(t, "a", followed.Band())
+
+	// Radios with several channels keep the configured one
+	assert.Equal(t, config, m.FollowStation(context.Background(), InterfacePlan{AP: "wlan0ap", Station: "wlan0", Virtual: true}, config))
+}
+
+func TestVirtualAPManager_FallsBackWithoutCombination(t *testing.T) {
+	runner := command.NewFakeRunner()
+	scriptPhy(runner, noConcurrencyPhyInfo)
+	m := NewVirtualAPManager(WithVirtualAPCommandRunner(runner))
+
+	plan, err := m.Plan(context.Background(), "wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, InterfacePlan{AP: "wlan0", Station: "wlan0"}, plan)
+	assert.False(t, plan.Concurrent())
+	assert.False(t, runner.Called("iw", "dev", "wlan0", "interface", "add", "wlan0ap", "type", "__ap"))
+
+	require.NoError(t, m.Release(context.Background(), plan))
+	assert.False(t, runner.Called("iw", "dev", "wlan0", "del"))
+}
+
+func TestVirtualAPManager_FallsBackWhenCreationFails(t *testing.T) {
+	runner := command.NewFakeRunner()
+	scriptPhy(runner, brcmfmacPhyInfo)
+	runner.AddError("iw", []string{"dev", "wlan0", "interface", "add", "uap0", "type", "__ap"},
+		command.Result{ExitCode: 161}, errors.New("command failed: Device or resource busy (-16)"))
+	m := NewVirtualAPManager(WithVirtualAPCommandRunner(runner), WithVirtualAPName("uap0"))
+
+	plan, err := m.Plan(context.Background(), "wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, InterfacePlan{AP: "wlan0", Station: "wlan0"}, plan)
+}
+
+func TestVirtualMACAddress(t *testing.T) {
+	mac, err := virtualMACAddress("b8:27:eb:12:34:56")
+	require.NoError(t, err)
+	assert.Equal(t, "ba:27:eb:12:34:56", mac)
+
+	mac, err = virtualMACAddress("02:00:00:00:00:10")
+	require.NoError(t, err)
+	assert.Equal(t, "02:00:00:00:00:11", mac)
+
+	_, err = virtualMACAddress("not-a-mac")
+	assert.Error(t, err)
+}
@@ -0,0 +1,951 @@
+package network
+
+import (
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/pkg/errors"
+)
+
+// DefaultWPACtrlDir is where wpa_supplicant creates its per-interface control sockets
+const DefaultWPACtrlDir = "/var/run/wpa_supplicant"
+
+const (
+	defaultWPARequestTimeout = 5 * time.Second
+	defaultWPAScanTimeout    = 15 * time.Second
+	defaultWPAConnectTimeout = 60 * time.Second
+	wpaMaxMessageSize        = 16384
+)
+
+var wpaCtrlCounter atomic.Uint64
+
+// wpaCtrl is a connection to a wpa_supplicant control socket. Replies and, once attached,
+// unsolicited events arrive on the same datagram socket.
+type wpaCtrl struct {
+	conn     *net.UnixConn
+	local    string
+	attached bool
+	timeout  time.Duration
+}
+
+// dialWPACtrl connects to the control socket at path from a socket bound in the temp dir
+func dialWPACtrl(path string, timeout time.Duration) (*wpaCtrl, error) {
+	local := filepath.Join(os.TempDir(), fmt.Sprintf("wpa_ctrl_%d-%d", os.Getpid(), wpaCtrlCounter.Add(1)))
+	os.Remove(local)
+	conn, err := net.DialUnix("unixgram",
+		&net.UnixAddr{Name: local, Net: "unixgram"},
+		&net.UnixAddr{Name: path, Net: "unixgram"})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to connect to wpa_supplicant at %s", path)
+	}
+	return &wpaCtrl{conn: conn, local: local, timeout: timeout}, nil
+}
+
+// request sends a command and returns its reply, skipping events that arrive in between
+func (c *wpaCtrl) request(cmd string) (string, error) {
+	c.conn.SetDeadline(time.Now().Add(c.timeout))
+	if _, err := c.conn.Write([]byte(cmd)); err != nil {
+		return "", errors.Wrapf(err, "failed to send %s", wpaCommandName(cmd))
+	}
+	buf := make([]byte, wpaMaxMessageSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", errors.Wrapf(err, "no reply to %s", wpaCommandName(cmd))
+		}
+		if reply := string(buf[:n]); !strings.HasPrefix(reply, "<") {
+			return reply, nil
+		}
+	}
+}
+
+// requestOK sends a command that replies with OK
+func (c *wpaCtrl) requestOK(cmd string) error {
+	reply, err := c.request(cmd)
+	if err != nil {
+		return err
+	}
+	if strings.TrimSpace(reply) != "OK" {
+		return errors.Errorf("%s failed: %s", wpaCommandName(cmd), strings.TrimSpace(reply))
+	}
+	return nil
+}
+
+// attach subscribes the connection to events
+func (c *wpaCtrl) attach() error {
+	if err := c.requestOK("ATTACH"); err != nil {
+		return err
+	}
+	c.attached = true
+	return nil
+}
+
+// event waits for the next event until deadline and returns it without the "<level>" prefix
+func (c *wpaCtrl) event(deadline time.Time) (string, error) {
+	c.conn.SetReadDeadline(deadline)
+	buf := make([]byte, wpaMaxMessageSize)
+	for {
+		n, err := c.conn.Read(buf)
+		if err != nil {
+			return "", err
+		}
+		msg := string(buf[:n])
+		if !strings.HasPrefix(msg, "<") {
+			continue
+		}
+		if end := strings.IndexByte(msg, '>'); end > 0 {
+			msg = msg[end+1:]
+		}
+		return strings.TrimSpace(msg), nil
+	}
+}
+
+func (c *wpaCtrl) Close() error {
+	if c.attached {
+		c.request("DETACH")
+	}
+	err := c.conn.Close()
+	os.Remove(c.local)
+	return err
+}
+
+// wpaCommandName returns the command without its arguments, which may contain secrets
+func wpaCommandName(cmd string) string {
+	name, _, _ := strings.Cut(cmd, " ")
+	return name
+}
+
+// wpaHex encodes a string value for SET_NETWORK, avoiding any quoting issues
+func wpaHex(value string) string {
+	return hex.EncodeToString([]byte(value))
+}
+
+// wpaQuote quotes a string value for SET_NETWORK
+func wpaQuote(value string) string {
+	return `"` + value + `"`
+}
+
+// decodeWPAString undoes the printf style escaping wpa_supplicant applies to SSIDs
+func decodeWPAString(s string) string {
+	if !strings.Contains(s, `\`) {
+		return s
+	}
+	var out bytes.Buffer
+	for i := 0; i < len(s); i++ {
+		if s[i] != '\\' || i+1 == len(s) {
+			out.WriteByte(s[i])
+			continue
+		}
+		i++
+		switch s[i] {
+		case 'n':
+			out.WriteByte('\n')
+		case 'r':
+			out.WriteByte('\r')
+		case 't':
+			out.WriteByte('\t')
+		case 'e':
+			out.WriteByte(0x1b)
+		case 'x':
+			if i+2 < len(s) {
+				if b, err := hex.DecodeString(s[i+1 : i+3]); err == nil {
+					out.WriteByte(b[0])
+					i += 2
+					continue
+				}
+			}
+			out.WriteString(`\x`)
+		default:
+			out.WriteByte(s[i])
+		}
+	}
+	return out.String()
+}
+
+// parseWPAScanResults parses the SCAN_RESULTS reply, one tab separated line per BSS:
+// bssid, frequency, signal level in dBm, flags and the escaped SSID
+func parseWPAScanResults(reply string) []WirelessNetwork {
+	var networks []WirelessNetwork
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.SplitN(line, "\t", 5)
+		if len(fields) < 5 || strings.HasPrefix(line, "bssid /") {
+			continue
+		}
+		ssid := decodeWPAString(fields[4])
+		if ssid == "" {
+			continue
+		}
+		security := wpaFlagsSecurity(fields[3])
+		network := WirelessNetwork{
+			SSID:         ssid,
+			DisplayName:  ssid,
+			BSSID:        fields[0],
+			Security:     security,
+			SecurityType: normalizeSecurity(security),
+			Enterprise:   IsEnterpriseSecurity(security),
+		}
+		if frequency, err := strconv.Atoi(fields[1]); err == nil {
+			network.Frequency = fields[1] + " MHz"
+			network.Band = bandName(frequency)
+			if channel := frequencyToChannel(frequency); channel > 0 {
+				network.Channel = strconv.Itoa(channel)
+			}
+		}
+		if signal, err := strconv.Atoi(fields[2]); err == nil {
+			network.Signal = dBmToPercent(signal)
+			network.SignalDBm = signal
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// wpaFlagsSecurity describes scan flags such as "[WPA2-PSK+SAE-CCMP][ESS]" the way the nmcli
+// SECURITY column does, so all backends report the same strings
+func wpaFlagsSecurity(flags string) string {
+	var wpa1, wpa2, wpa3, owe, eap, wep bool
+	for _, flag := range strings.Split(strings.ReplaceAll(flags, "]", ""), "[") {
+		proto, rest, _ := strings.Cut(flag, "-")
+		keyMgmt, _, _ := strings.Cut(rest, "-")
+		methods := strings.Split(keyMgmt, "+")
+		switch proto {
+		case "WEP":
+			wep = true
+		case "WPA":
+			wpa1 = true
+		case "WPA2", "RSN":
+			for _, m := range methods {
+				switch strings.TrimPrefix(m, "FT/") {
+				case "PSK", "EAP", "PSK-SHA256", "EAP-SHA256":
+					wpa2 = true
+				case "SAE", "SAE-EXT-KEY":
+					wpa3 = true
+				case "OWE":
+					owe = true
+				}
+			}
+		}
+		if proto == "WPA" || proto == "WPA2" || proto == "RSN" {
+			for _, m := range methods {
+				if strings.Contains(m, "EAP") {
+					eap = true
+				}
+			}
+		}
+	}
+
+	var parts []string
+	if wep {
+		parts = append(parts, "WEP")
+	}
+	if wpa1 {
+		parts = append(parts, "WPA1")
+	}
+	if wpa2 {
+		parts = append(parts, "WPA2")
+	}
+	if wpa3 {
+		parts = append(parts, "WPA3")
+	}
+	if owe {
+		parts = append(parts, "OWE")
+	}
+	if eap {
+		parts = append(parts, "802.1X")
+	}
+	if len(parts) == 0 {
+		return "none"
+	}
+	return strings.Join(parts, " ")
+}
+
+// parseWPAKeyValues parses key=value replies such as STATUS
+func parseWPAKeyValues(reply string) map[string]string {
+	values := make(map[string]string)
+	for _, line := range strings.Split(reply, "\n") {
+		if key, value, ok := strings.Cut(line, "="); ok {
+			values[key] = value
+		}
+	}
+	return values
+}
+
+// wpaNetwork is an entry of LIST_NETWORKS
+type wpaNetwork struct {
+	ID    string
+	SSID  string
+	Flags string // e.g. [CURRENT] or [DISABLED]
+}
+
+// parseWPANetworks parses the LIST_NETWORKS reply: id, ssid, bssid and flags per line
+func parseWPANetworks(reply string) []wpaNetwork {
+	var networks []wpaNetwork
+	for _, line := range strings.Split(reply, "\n") {
+		fields := strings.Split(line, "\t")
+		if len(fields) < 2 || strings.HasPrefix(line, "network id /") {
+			continue
+		}
+		network := wpaNetwork{ID: fields[0], SSID: decodeWPAString(fields[1])}
+		if len(fields) > 3 {
+			network.Flags = fields[3]
+		}
+		networks = append(networks, network)
+	}
+	return networks
+}
+
+// parseWPANetworkValue decodes a GET_NETWORK reply, strings are quoted or hex encoded
+func parseWPANetworkValue(value string) string {
+	if unquoted, err := strconv.Unquote(value); err == nil {
+		return unquoted
+	}
+	if decoded, err := hex.DecodeString(value); err == nil {
+		return string(decoded)
+	}
+	return value
+}
+
+// wpaKeyMgmtSecurity maps the key_mgmt of a configured network to its security
+func wpaKeyMgmtSecurity(keyMgmt string) NetworkSecurity {
+	methods := strings.Fields(keyMgmt)
+	switch {
+	case slices.ContainsFunc(methods, func(m string) bool { return strings.Contains(m, "EAP") }):
+		return NetworkSecurity8021X
+	case slices.ContainsFunc(methods, func(m string) bool { return strings.Contains(m, "SAE") }):
+		return NetworkSecuritySAE
+	case slices.ContainsFunc(methods, func(m string) bool { return strings.Contains(m, "PSK") }):
+		return NetworkSecurityWPA2PSK
+	case slices.Contains(methods, "OWE"):
+		return NetworkSecurityOWE
+	default:
+		return NetworkSecurityOpen
+	}
+}
+
+// wpaNetworkSettings returns the SET_NETWORK variables of a network joining ssid
+func wpaNetworkSettings(ssid string, creds Credentials, certs map[string]string) [][2]string {
+	settings := [][2]string{{"ssid", wpaHex(ssid)}}
+	if creds.Hidden {
+		settings = append(settings, [2]string{"scan_ssid", "1"})
+	}
+
+	switch creds.keyMgmt() {
+	case "none":
+		settings = append(settings, [2]string{"key_mgmt", "NONE"})
+	case "wpa-psk":
+		psk := wpaQuote(creds.Password)
+		if isHexPSK(creds.Password) {
+			psk = creds.Password
+		}
+		settings = append(settings, [2]string{"key_mgmt", "WPA-PSK"}, [2]string{"psk", psk})
+	case "sae":
+		settings = append(settings,
+			[2]string{"key_mgmt", "SAE"},
+			[2]string{"sae_password", wpaHex(creds.Password)},
+			[2]string{"ieee80211w", "2"})
+	case "wpa-eap":
+		settings = append(settings,
+			[2]string{"key_mgmt", "WPA-EAP"},
+			[2]string{"eap", strings.ToUpper(creds.EAPMethod)},
+			[2]string{"identity", wpaHex(creds.Identity)})
+		if creds.AnonymousIdentity != "" {
+			settings = append(settings, [2]string{"anonymous_identity", wpaHex(creds.AnonymousIdentity)})
+		}
+		if creds.Phase2 != "" {
+			settings = append(settings, [2]string{"phase2", wpaQuote("auth=" + strings.ToUpper(creds.Phase2))})
+		}
+		if creds.Password != "" {
+			settings = append(settings, [2]string{"password", wpaHex(creds.Password)})
+		}
+		for _, cert := range [][2]string{
+			{"802-1x.ca-cert", "ca_cert"},
+			{"802-1x.client-cert", "client_cert"},
+			{"802-1x.private-key", "private_key"},
+		} {
+			if path, ok := certs[cert[0]]; ok {
+				settings = append(settings, [2]string{cert[1], wpaQuote(path)})
+			}
+		}
+		if _, ok := certs["802-1x.private-key"]; ok && creds.PrivateKeyPassword != "" {
+			settings = append(settings, [2]string{"private_key_passwd", wpaHex(creds.PrivateKeyPassword)})
+		}
+	}
+	return settings
+}
+
+func isHexPSK(password string) bool {
+	if len(password) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(password)
+	return err == nil
+}
+
+// wpaSupplicantInterfaceManager implements InterfaceManager on the wpa_supplicant control
+// interface, for systems without NetworkManager. wpa_supplicant only associates, a DHCP
+// client such as udhcpc or dhcpcd has to configure the address.
+type wpaSupplicantInterfaceManager struct {
+	runner         command.Runner
+	logger         *slog.Logger
+	certDir        string
+	ctrlDir        string
+	policy         SelectionPolicy
+	requestTimeout time.Duration
+	scanTimeout    time.Duration
+	connectTimeout time.Duration
+}
+
+// NewWPASupplicantInterfaceManager creates an InterfaceManager that talks to wpa_supplicant
+// through the control sockets in DefaultWPACtrlDir, see WithInterfaceWPACtrlDir
+func NewWPASupplicantInterfaceManager(opts ...InterfaceManagerOption) InterfaceManager {
+	o := newInterfaceManagerOptions(opts)
+	return &wpaSupplicantInterfaceManager{
+		runner:         o.runner,
+		logger:         o.logger,
+		certDir:        o.certDir,
+		ctrlDir:        o.ctrlDir,
+		policy:         o.policy,
+		requestTimeout: defaultWPARequestTimeout,
+		scanTimeout:    defaultWPAScanTimeout,
+		connectTimeout: defaultWPAConnectTimeout,
+	}
+}
+
+func (im *wpaSupplicantInterfaceManager) dial(interfaceName string) (*wpaCtrl, error) {
+	return dialWPACtrl(filepath.Join(im.ctrlDir, interfaceName), im.requestTimeout)
+}
+
+// interfaces returns the interfaces wpa_supplicant controls, one socket each
+func (im *wpaSupplicantInterfaceManager) interfaces() ([]string, error) {
+	entries, err := os.ReadDir(im.ctrlDir)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read wpa_supplicant control directory")
+	}
+	var names []string
+	for _, entry := range entries {
+		if entry.Type()&os.ModeSocket != 0 {
+			names = append(names, entry.Name())
+		}
+	}
+	return names, nil
+}
+
+func (im *wpaSupplicantInterfaceManager) ListWirelessInterfaces() ([]WirelessInterface, error) {
+	names, err := im.interfaces()
+	if err != nil {
+		return nil, err
+	}
+	probe := newPhyProbe(im.runner, im.logger, nil)
+	uplink := DefaultRouteInterface(im.runner)
+
+	interfaces := make([]WirelessInterface, 0, len(names))
+	for _, name := range names {
+		ctrl, err := im.dial(name)
+		if err != nil {
+			im.logger.Warn("skipping interface", slog.String("interface", name), slog.String("error", err.Error()))
+			continue
+		}
+		reply, err := ctrl.request("STATUS")
+		ctrl.Close()
+		if err != nil {
+			im.logger.Warn("skipping interface", slog.String("interface", name), slog.String("error", err.Error()))
+			continue
+		}
+		status := parseWPAKeyValues(reply)
+		state := status["wpa_state"]
+		interfaces = append(interfaces, probe.describe(WirelessInterface{
+			Name:       name,
+			MACAddress: status["address"],
+			InUse:      state != "" && state != "DISCONNECTED" && state != "INACTIVE" && state != "INTERFACE_DISABLED",
+			Uplink:     name == uplink,
+			Driver:     interfaceDriver(im.runner, name),
+		}))
+	}
+	return interfaces, nil
+}
+
+func (im *wpaSupplicantInterfaceManager) GetBestAPInterface() (*WirelessInterface, error) {
+	scores, err := im.RankAPInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	return bestAPInterface(scores, im.logger)
+}
+
+func (im *wpaSupplicantInterfaceManager) RankAPInterfaces() ([]InterfaceScore, error) {
+	interfaces, err := im.ListWirelessInterfaces()
+	if err != nil {
+		return nil, err
+	}
+	return im.policy.Rank(interfaces), nil
+}
+
+// interfaceOrDefault returns interfaceName, or the first interface wpa_supplicant controls
+func (im *wpaSupplicantInterfaceManager) interfaceOrDefault(interfaceName string) (string, error) {
+	if interfaceName != "" {
+		return interfaceName, nil
+	}
+	names, err := im.interfaces()
+	if err != nil {
+		return "", err
+	}
+	if len(names) == 0 {
+		return "", ErrNoAccessPointFound
+	}
+	return names[0], nil
+}
+
+func (im *wpaSupplicantInterfaceManager) ListAvailableNetworks(interfaceName string) ([]WirelessNetwork, error) {
+	im.logger.Info("scanning for networks", slog.String("interface", interfaceName))
+	name, err := im.interfaceOrDefault(interfaceName)
+	if err != nil {
+		return nil, err
+	}
+
+	events, err := im.dial(name)
+	if err != nil {
+		return nil, err
+	}
+	defer events.Close()
+	if err := events.attach(); err != nil {
+		return nil, err
+	}
+	ctrl, err := im.dial(name)
+	if err != nil {
+		return nil, err
+	}
+	defer ctrl.Close()
+
+	if err := im.scan(ctrl, events); err != nil {
+		im.logger.Warn("failed to rescan networks", slog.String("error", err.Error()))
+	}
+	reply, err := ctrl.request("SCAN_RESULTS")
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to scan for networks (interface: %s)", name)
+	}
+	networks := parseWPAScanResults(reply)
+	im.logger.Debug("parsed networks", slog.Int("count", len(networks)))
+	return networks, nil
+}
+
+// scan triggers a scan and waits for its results
+func (im *wpaSupplicantInterfaceManager) scan(ctrl, events *wpaCtrl) error {
+	reply, err := ctrl.request("SCAN")
+	if err != nil {
+		return err
+	}
+	// FAIL-BUSY means a scan is already running, its results are just as good
+	if reply = strings.TrimSpace(reply); reply != "OK" && reply != "FAIL-BUSY" {
+		return errors.Errorf("SCAN failed: %s", reply)
+	}
+	deadline := time.Now().Add(im.scanTimeout)
+	for {
+		event, err := events.event(deadline)
+		if err != nil {
+			return errors.Wrap(err, "timed out waiting for scan results")
+		}
+		if strings.HasPrefix(event, "CTRL-EVENT-SCAN-RESULTS") {
+			return nil
+		}
+		if strings.HasPrefix(event, "CTRL-EVENT-SCAN-FAILED") {
+			return errors.New(event)
+		}
+	}
+}
+
+func (im *wpaSupplicantInterfaceManager) ConnectToNetwork(interfaceName, ssid, password string) error {
+	return im.ConnectWithCredentials(interfaceName, ssid, Credentials{Password: password})
+}
+
+func (im *wpaSupplicantInterfaceManager) ConnectWithCredentials(interfaceName, ssid string, creds Credentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	im.logger.Info("attempting to connect to network",
+		slog.String("interface", interfaceName),
+		slog.String("ssid", ssid),
+		slog.Bool("enterprise", creds.IsEnterprise()),
+		slog.Bool("hidden", creds.Hidden))
+
+	name, err := im.interfaceOrDefault(interfaceName)
+	if err != nil {
+		return err
+	}
+	var certs map[string]string
+	if creds.IsEnterprise() {
+		if certs, err = writeCertFiles(im.certDir, ssid, creds); err != nil {
+			return err
+		}
+	}
+
+	events, err := im.dial(name)
+	if err != nil {
+		return err
+	}
+	defer events.Close()
+	if err := events.attach(); err != nil {
+		return err
+	}
+	ctrl, err := im.dial(name)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	id, err := im.addNetwork(ctrl, ssid, creds, certs)
+	if err != nil {
+		return errors.Wrapf(err, "failed to configure network %s", ssid)
+	}
+	// SELECT_NETWORK disables every other network, they are enabled again once this one is
+	// settled so they stay available as fallbacks
+	if err := ctrl.requestOK("SELECT_NETWORK " + id); err != nil {
+		ctrl.request("REMOVE_NETWORK " + id)
+		return errors.Wrapf(err, "failed to select network %s", ssid)
+	}
+
+	// Networks of earlier attempts are only replaced once this one is connected, a wrong
+	// password must not cost a network that worked
+	err = im.waitConnected(events, id)
+	if err != nil {
+		ctrl.request("REMOVE_NETWORK " + id)
+	} else if removeErr := im.removeNetworks(ctrl, ssid, id); removeErr != nil {
+		im.logger.Warn("failed to remove previous network", slog.String("error", removeErr.Error()))
+	}
+	if enableErr := ctrl.requestOK("ENABLE_NETWORK all"); enableErr != nil {
+		im.logger.Warn("failed to enable networks", slog.String("error", enableErr.Error()))
+	}
+	if err != nil {
+		return errors.Wrapf(err, "failed to connect to network %s on interface %s", ssid, name)
+	}
+
+	// The network stays configured even when it cannot be persisted
+	im.saveConfig(ctrl)
+	im.logger.Info("successfully connected to network",
+		slog.String("interface", name),
+		slog.String("ssid", ssid))
+	return nil
+}
+
+// removeNetworks removes the configured networks for ssid other than keep
+func (im *wpaSupplicantInterfaceManager) removeNetworks(ctrl *wpaCtrl, ssid, keep string) error {
+	reply, err := ctrl.request("LIST_NETWORKS")
+	if err != nil {
+		return err
+	}
+	for _, network := range parseWPANetworks(reply) {
+		if network.SSID != ssid || network.ID == keep {
+			continue
+		}
+		if err := ctrl.requestOK("REMOVE_NETWORK " + network.ID); err != nil {
+			return err
+		}
+		im.logger.Debug("removed previous network", slog.String("ssid", ssid), slog.String("id", network.ID))
+	}
+	return nil
+}
+
+// addNetwork configures a disabled network and returns its id
+func (im *wpaSupplicantInterfaceManager) addNetwork(ctrl *wpaCtrl, ssid string, creds Credentials, certs map[string]string) (string, error) {
+	reply, err := ctrl.request("ADD_NETWORK")
+	if err != nil {
+		return "", err
+	}
+	id := strings.TrimSpace(reply)
+	if _, err := strconv.Atoi(id); err != nil {
+		return "", errors.Errorf("ADD_NETWORK failed: %s", id)
+	}
+	for _, setting := range wpaNetworkSettings(ssid, creds, certs) {
+		if err := ctrl.requestOK(fmt.Sprintf("SET_NETWORK %s %s %s", id, setting[0], setting[1])); err != nil {
+			ctrl.request("REMOVE_NETWORK " + id)
+			return "", errors.Wrapf(err, "failed to set %s", setting[0])
+		}
+	}
+	return id, nil
+}
+
+// waitConnected follows events until network id is connected or has failed to authenticate
+func (im *wpaSupplicantInterfaceManager) waitConnected(events *wpaCtrl, id string) error {
+	deadline := time.Now().Add(im.connectTimeout)
+	last := ""
+	for {
+		event, err := events.event(deadline)
+		if err != nil {
+			if last != "" {
+				return errors.Wrapf(ErrConnectionFailed, "timed out, last event: %s", last)
+			}
+			return errors.Wrap(ErrConnectionFailed, "timed out")
+		}
+		im.logger.Debug("wpa_supplicant event", slog.String("event", event))
+
+		fields := strings.Fields(event)
+		if len(fields) == 0 {
+			continue
+		}
+		switch fields[0] {
+		case "CTRL-EVENT-CONNECTED":
+			if strings.Contains(event, "[id="+id+" ") || !strings.Contains(event, "[id=") {
+				return nil
+			}
+		case "CTRL-EVENT-SSID-TEMP-DISABLED":
+			if strings.Contains(event, " id="+id+" ") {
+				reason := "authentication failed"
+				for _, field := range fields {
+					if value, ok := strings.CutPrefix(field, "reason="); ok {
+						reason = value
+					}
+				}
+				if reason == "WRONG_KEY" {
+					reason = "secrets were required, but not provided or wrong"
+				}
+				return errors.Wrap(ErrConnectionFailed, reason)
+			}
+		case "CTRL-EVENT-EAP-FAILURE":
+			return errors.Wrap(ErrConnectionFailed, "EAP authentication failed")
+		case "CTRL-EVENT-TERMINATING":
+			return errors.Wrap(ErrConnectionFailed, "wpa_supplicant is terminating")
+		case "CTRL-EVENT-NETWORK-NOT-FOUND", "CTRL-EVENT-ASSOC-REJECT", "CTRL-EVENT-DISCONNECTED":
+			last = event
+		}
+	}
+}
+
+// wpaProfileID identifies a configured network, network ids are only unique per interface
+func wpaProfileID(interfaceName, networkID string) string {
+	return interfaceName + ":" + networkID
+}
+
+// dialProfile connects to the interface of profile id and returns its network id, checking that
+// the network is still configured
+func (im *wpaSupplicantInterfaceManager) dialProfile(id string) (*wpaCtrl, string, error) {
+	sep := strings.LastIndex(id, ":")
+	if sep < 0 {
+		return nil, "", errors.Wrap(ErrProfileNotFound, id)
+	}
+	interfaceName, networkID := id[:sep], id[sep+1:]
+	if _, err := strconv.Atoi(networkID); err != nil || interfaceName == "" {
+		return nil, "", errors.Wrap(ErrProfileNotFound, id)
+	}
+	ctrl, err := im.dial(interfaceName)
+	if err != nil {
+		return nil, "", err
+	}
+	if reply, err := ctrl.request("GET_NETWORK " + networkID + " ssid"); err != nil || strings.HasPrefix(reply, "FAIL") {
+		ctrl.Close()
+		return nil, "", errors.Wrap(ErrProfileNotFound, id)
+	}
+	return ctrl, networkID, nil
+}
+
+// getNetwork returns a variable of a configured network, empty when it is not set
+func (im *wpaSupplicantInterfaceManager) getNetwork(ctrl *wpaCtrl, networkID, name string) string {
+	reply, err := ctrl.request("GET_NETWORK " + networkID + " " + name)
+	if err != nil || strings.HasPrefix(reply, "FAIL") {
+		return ""
+	}
+	return strings.TrimSpace(reply)
+}
+
+// saveConfig persists the configuration, which only works with update_config=1
+func (im *wpaSupplicantInterfaceManager) saveConfig(ctrl *wpaCtrl) {
+	if err := ctrl.requestOK("SAVE_CONFIG"); err != nil {
+		im.logger.Debug("could not save wpa_supplicant configuration", slog.String("error", err.Error()))
+	}
+}
+
+// JoinStage maps the wpa_state of the interface, wpa_supplicant has no part in address configuration
+func (im *wpaSupplicantInterfaceManager) JoinStage(interfaceName string) (ConnectionStage, error) {
+	name, err := im.interfaceOrDefault(interfaceName)
+	if err != nil {
+		return "", err
+	}
+	ctrl, err := im.dial(name)
+	if err != nil {
+		return "", err
+	}
+	defer ctrl.Close()
+	reply, err := ctrl.request("STATUS")
+	if err != nil {
+		return "", errors.Wrapf(err, "failed to read status (interface: %s)", name)
+	}
+	return wpaStateStage(parseWPAKeyValues(reply)["wpa_state"]), nil
+}
+
+// wpaStateStage maps a wpa_state to the stage of a connection attempt
+func wpaStateStage(state string) ConnectionStage {
+	switch state {
+	case "SCANNING", "AUTHENTICATING", "ASSOCIATING":
+		return StageAssociate
+	case "ASSOCIATED", "4WAY_HANDSHAKE", "GROUP_HANDSHAKE":
+		return StageAuthenticate
+	case "COMPLETED":
+		return StageDHCP
+	}
+	return ""
+}
+
+// ListProfiles returns the networks configured on every interface wpa_supplicant controls
+func (im *wpaSupplicantInterfaceManager) ListProfiles() ([]Profile, error) {
+	names, err := im.interfaces()
+	if err != nil {
+		return nil, err
+	}
+	profiles := []Profile{}
+	for _, name := range names {
+		ctrl, err := im.dial(name)
+		if err != nil {
+			im.logger.Warn("skipping interface", slog.String("interface", name), slog.String("error", err.Error()))
+			continue
+		}
+		reply, err := ctrl.request("LIST_NETWORKS")
+		if err != nil {
+			ctrl.Close()
+			return nil, errors.Wrapf(err, "failed to list networks (interface: %s)", name)
+		}
+		for _, network := range parseWPANetworks(reply) {
+			priority, _ := strconv.Atoi(im.getNetwork(ctrl, network.ID, "priority"))
+			keyMgmt := im.getNetwork(ctrl, network.ID, "key_mgmt")
+			if keyMgmt == "" {
+				keyMgmt = "WPA-PSK WPA-EAP"
+			}
+			profiles = append(profiles, Profile{
+				ID:          wpaProfileID(name, network.ID),
+				Name:        network.SSID,
+				SSID:        network.SSID,
+				Security:    wpaKeyMgmtSecurity(keyMgmt),
+				Hidden:      im.getNetwork(ctrl, network.ID, "scan_ssid") == "1",
+				AutoConnect: !strings.Contains(network.Flags, "[DISABLED]"),
+				Priority:    priority,
+				Active:      strings.Contains(network.Flags, "[CURRENT]"),
+			})
+		}
+		ctrl.Close()
+	}
+	sortProfiles(profiles)
+	return profiles, nil
+}
+
+func (im *wpaSupplicantInterfaceManager) UpdateProfile(id string, update ProfileUpdate) error {
+	ctrl, networkID, err := im.dialProfile(id)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	if update.Priority != nil {
+		if err := ctrl.requestOK(fmt.Sprintf("SET_NETWORK %s priority %d", networkID, *update.Priority)); err != nil {
+			return errors.Wrapf(err, "failed to set priority of %s", id)
+		}
+	}
+	if update.AutoConnect != nil {
+		cmd := "DISABLE_NETWORK "
+		if *update.AutoConnect {
+			cmd = "ENABLE_NETWORK "
+		}
+		if err := ctrl.requestOK(cmd + networkID); err != nil {
+			return errors.Wrapf(err, "failed to update %s", id)
+		}
+	}
+	im.saveConfig(ctrl)
+	im.logger.Info("updated network", slog.String("id", id))
+	return nil
+}
+
+func (im *wpaSupplicantInterfaceManager) ForgetProfile(id string) error {
+	ctrl, networkID, err := im.dialProfile(id)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	if err := ctrl.requestOK("REMOVE_NETWORK " + networkID); err != nil {
+		return errors.Wrapf(err, "failed to remove %s", id)
+	}
+	im.saveConfig(ctrl)
+	im.logger.Info("removed network", slog.String("id", id))
+	return nil
+}
+
+// UpdateProfileCredentials sets new security variables on a configured network
+func (im *wpaSupplicantInterfaceManager) UpdateProfileCredentials(id string, creds Credentials) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	ctrl, networkID, err := im.dialProfile(id)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	ssid := parseWPANetworkValue(im.getNetwork(ctrl, networkID, "ssid"))
+	var certs map[string]string
+	if creds.IsEnterprise() {
+		if certs, err = writeCertFiles(im.certDir, ssid, creds); err != nil {
+			return err
+		}
+	}
+	settings := wpaNetworkSettings(ssid, creds, certs)
+	if !creds.Hidden {
+		settings = append(settings, [2]string{"scan_ssid", "0"})
+	}
+	for _, setting := range settings {
+		if err := ctrl.requestOK(fmt.Sprintf("SET_NETWORK %s %s %s", networkID, setting[0], setting[1])); err != nil {
+			return errors.Wrapf(err, "failed to set %s", setting[0])
+		}
+	}
+	im.saveConfig(ctrl)
+	im.logger.Info("updated network credentials", slog.String("id", id), slog.String("ssid", ssid))
+	return nil
+}
+
+// SaveProfile configures an enabled network for ssid without selecting it. The networks
+// configured for ssid before are replaced once it is saved.
+func (im *wpaSupplicantInterfaceManager) SaveProfile(interfaceName, ssid string, creds Credentials, priority int) error {
+	if err := creds.Validate(); err != nil {
+		return err
+	}
+	name, err := im.interfaceOrDefault(interfaceName)
+	if err != nil {
+		return err
+	}
+	var certs map[string]string
+	if creds.IsEnterprise() {
+		if certs, err = writeCertFiles(im.certDir, ssid, creds); err != nil {
+			return err
+		}
+	}
+	ctrl, err := im.dial(name)
+	if err != nil {
+		return err
+	}
+	defer ctrl.Close()
+
+	id, err := im.addNetwork(ctrl, ssid, creds, certs)
+	if err != nil {
+		return errors.Wrapf(err, "failed to configure network %s", ssid)
+	}
+	if err := ctrl.requestOK(fmt.Sprintf("SET_NETWORK %s priority %d", id, priority)); err != nil {
+		ctrl.request("REMOVE_NETWORK " + id)
+		return errors.Wrapf(err, "failed to set priority of %s", ssid)
+	}
+	if err := ctrl.requestOK("ENABLE_NETWORK " + id); err != nil {
+		ctrl.request("REMOVE_NETWORK " + id)
+		return errors.Wrapf(err, "failed to enable network %s", ssid)
+	}
+	if err := im.removeNetworks(ctrl, ssid, id); err != nil {
+		im.logger.Warn("failed to remove previous network", slog.String("error", err.Error()))
+	}
+	im.saveConfig(ctrl)
+	im.logger.Info("saved network", slog.String("interface", name), slog.String("ssid", ssid), slog.Int("priority", priority))
+	return nil
+}
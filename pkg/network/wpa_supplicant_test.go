@@ -0,0 +1,382 @@
+package network
+
+import (
+	"fmt"
+	"maps"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+const wpaTestScanResults = "bssid / frequency / signal level / flags / ssid\n" +
+	"aa:bb:cc:dd:ee:01\t2437\t-64\t[ESS]\tCaf\\xc3\\xa9:Guest\n" +
+	"aa:bb:cc:dd:ee:02\t5180\t-72\t[WPA2-PSK+SAE-CCMP][ESS]\tHome\n" +
+	"aa:bb:cc:dd:ee:03\t2412\t-80\t[WPA-EAP-TKIP][WPA2-EAP-CCMP][ESS]\tCorp\n" +
+	"aa:bb:cc:dd:ee:04\t2462\t-50\t[ESS]\t\n"
+
+// wpaTestPassword is the only psk the fake accepts
+const wpaTestPassword = "secret123"
+
+// fakeWPASupplicant answers control interface commands on a socket in a temporary directory
+type fakeWPASupplicant struct {
+	t    *testing.T
+	conn *net.UnixConn
+
+	mu       sync.Mutex
+	attached map[string]*net.UnixAddr
+	networks map[string]map[string]string
+	current  string
+	nextID   int
+	commands []string
+}
+
+func newFakeWPASupplicant(t *testing.T, dir, iface string) *fakeWPASupplicant {
+	t.Helper()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: filepath.Join(dir, iface), Net: "unixgram"})
+	require.NoError(t, err)
+	f := &fakeWPASupplicant{
+		t:        t,
+		conn:     conn,
+		attached: make(map[string]*net.UnixAddr),
+		networks: make(map[string]map[string]string),
+	}
+	t.Cleanup(func() { conn.Close() })
+	go f.serve()
+	return f
+}
+
+// newWPATestDir returns a short directory for control sockets, t.TempDir can exceed the socket path limit
+func newWPATestDir(t *testing.T) string {
+	t.Helper()
+	dir, err := os.MkdirTemp("", "wpa")
+	require.NoError(t, err)
+	t.Cleanup(func() { os.RemoveAll(dir) })
+	return dir
+}
+
+func (f *fakeWPASupplicant) serve() {
+	buf := make([]byte, wpaMaxMessageSize)
+	for {
+		n, addr, err := f.conn.ReadFromUnix(buf)
+		if err != nil {
+			return
+		}
+		reply, events := f.handle(string(buf[:n]), addr)
+		f.conn.WriteToUnix([]byte(reply), addr)
+		for _, event := range events {
+			f.emit(event)
+		}
+	}
+}
+
+func (f *fakeWPASupplicant) emit(event string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, addr := range f.attached {
+		f.conn.WriteToUnix([]byte("<3>"+event), addr)
+	}
+}
+
+func (f *fakeWPASupplicant) handle(cmd string, addr *net.UnixAddr) (string, []string) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.commands = append(f.commands, cmd)
+
+	fields := strings.SplitN(cmd, " ", 4)
+	switch fields[0] {
+	case "ATTACH":
+		f.attached[addr.Name] = addr
+		return "OK\n", nil
+	case "DETACH":
+		delete(f.attached, addr.Name)
+		return "OK\n", nil
+	case "STATUS":
+		return "bssid=aa:bb:cc:dd:ee:02\nssid=Home\nwpa_state=COMPLETED\naddress=02:00:00:00:00:01\n", nil
+	case "SCAN":
+		return "OK\n", []string{"CTRL-EVENT-SCAN-STARTED ", "CTRL-EVENT-SCAN-RESULTS "}
+	case "SCAN_RESULTS":
+		return wpaTestScanResults, nil
+	case "LIST_NETWORKS":
+		reply := "network id / ssid / bssid / flags\n"
+		for id, network := range f.networks {
+			ssid, _ := wpaDecodeHexSSID(network["ssid"])
+			flags := ""
+			if id == f.current {
+				flags += "[CURRENT]"
+			}
+			if network["disabled"] == "1" {
+				flags += "[DISABLED]"
+			}
+			reply += id + "\t" + ssid + "\tany\t" + flags + "\n"
+		}
+		return reply, nil
+	case "ADD_NETWORK":
+		id := strconv.Itoa(f.nextID)
+		f.nextID++
+		f.networks[id] = make(map[string]string)
+		return id + "\n", nil
+	case "SET_NETWORK":
+		network, ok := f.networks[fields[1]]
+		if !ok || len(fields) < 4 {
+			return "FAIL\n", nil
+		}
+		network[fields[2]] = fields[3]
+		return "OK\n", nil
+	case "GET_NETWORK":
+		value, ok := f.networks[fields[1]][fields[2]]
+		if !ok {
+			return "FAIL\n", nil
+		}
+		return value, nil
+	case "ENABLE_NETWORK", "DISABLE_NETWORK":
+		disabled := "0"
+		if fields[0] == "DISABLE_NETWORK" {
+			disabled = "1"
+		}
+		for id, network := range f.networks {
+			if fields[1] == "all" || fields[1] == id {
+				network["disabled"] = disabled
+			}
+		}
+		return "OK\n", nil
+	case "REMOVE_NETWORK":
+		delete(f.networks, fields[1])
+		return "OK\n", nil
+	case "SELECT_NETWORK":
+		network, ok := f.networks[fields[1]]
+		if !ok {
+			return "FAIL\n", nil
+		}
+		if network["key_mgmt"] == "WPA-PSK" && network["psk"] != wpaQuote(wpaTestPassword) {
+			return "OK\n", []string{
+				"CTRL-EVENT-SSID-TEMP-DISABLED id=" + fields[1] + " ssid=\"Home\" auth_failures=1 duration=10 reason=WRONG_KEY",
+			}
+		}
+		f.current = fields[1]
+		return "OK\n", []string{
+			"", // an event without text must not end the wait
+			"Trying to associate with aa:bb:cc:dd:ee:02 (SSID='Home' freq=5180 MHz)",
+			"CTRL-EVENT-CONNECTED - Connection to aa:bb:cc:dd:ee:02 completed [id=" + fields[1] + " id_str=]",
+		}
+	case "SAVE_CONFIG":
+		return "OK\n", nil
+	}
+	return "UNKNOWN COMMAND\n", nil
+}
+
+// network returns a copy of the variables of network id
+func (f *fakeWPASupplicant) network(id string) map[string]string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return maps.Clone(f.networks[id])
+}
+
+func (f *fakeWPASupplicant) sent(prefix string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for _, cmd := range f.commands {
+		if strings.HasPrefix(cmd, prefix) {
+			return true
+		}
+	}
+	return false
+}
+
+func wpaDecodeHexSSID(value string) (string, error) {
+	var ssid []byte
+	_, err := fmt.Sscanf(value, "%x", &ssid)
+	return string(ssid), err
+}
+
+func newTestWPAManager(t *testing.T, opts ...InterfaceManagerOption) (*fakeWPASupplicant, InterfaceManager) {
+	t.Helper()
+	dir := newWPATestDir(t)
+	fake := newFakeWPASupplicant(t, dir, "wlan0")
+	opts = append([]InterfaceManagerOption{
+		WithInterfaceWPACtrlDir(dir),
+		WithInterfaceCommandRunner(command.NewFakeRunner()),
+	}, opts...)
+	im := NewWPASupplicantInterfaceManager(opts...)
+	im.(*wpaSupplicantInterfaceManager).connectTimeout = 2 * time.Second
+	return fake, im
+}
+
+func TestWPASupplicantInterfaceManager_ListWirelessInterfaces(t *testing.T) {
+	_, im := newTestWPAManager(t)
+
+	interfaces, err := im.ListWirelessInterfaces()
+	require.NoError(t, err)
+	require.Len(t, interfaces, 1)
+	assert.Equal(t, "wlan0", interfaces[0].Name)
+	assert.Equal(t, "02:00:00:00:00:01", interfaces[0].MACAddress)
+	assert.True(t, interfaces[0].InUse)
+}
+
+func TestWPASupplicantInterfaceManager_JoinStage(t *testing.T) {
+	_, im := newTestWPAManager(t)
+
+	stage, err := im.JoinStage("wlan0")
+	require.NoError(t, err)
+	assert.Equal(t, StageDHCP, stage)
+	assert.Equal(t, StageAuthenticate, wpaStateStage("4WAY_HANDSHAKE"))
+	assert.Equal(t, StageAssociate, wpaStateStage("SCANNING"))
+	assert.Equal(t, ConnectionStage(""), wpaStateStage("DISCONNECTED"))
+}
+
+func TestWPASupplicantInterfaceManager_ListAvailableNetworks(t *testing.T) {
+	fake, im := newTestWPAManager(t)
+
+	networks, err := im.ListAvailableNetworks("")
+	require.NoError(t, err)
+	assert.Equal(t, []WirelessNetwork{
+		{SSID: "Café:Guest", DisplayName: "Café:Guest", BSSID: "aa:bb:cc:dd:ee:01", Signal: 43, SignalDBm: -64, Security: "none", SecurityType: NetworkSecurityOpen, Frequency: "2437 MHz", Channel: "6", Band: Band24GHz},
+		{SSID: "Home", DisplayName: "Home", BSSID: "aa:bb:cc:dd:ee:02", Signal: 30, SignalDBm: -72, Security: "WPA2 WPA3", SecurityType: NetworkSecuritySAE, Frequency: "5180 MHz", Channel: "36", Band: Band5GHz},
+		{SSID: "Corp", DisplayName: "Corp", BSSID: "aa:bb:cc:dd:ee:03", Signal: 16, SignalDBm: -80, Security: "WPA1 WPA2 802.1X", SecurityType: NetworkSecurity8021X, Enterprise: true, Frequency: "2412 MHz", Channel: "1", Band: Band24GHz},
+	}, networks)
+	assert.True(t, fake.sent("SCAN"))
+}
+
+func TestWPASupplicantInterfaceManager_Connect(t *testing.T) {
+	fake, im := newTestWPAManager(t)
+
+	require.NoError(t, im.ConnectWithCredentials("wlan0", "Home", Credentials{Password: "secret123", Hidden: true}))
+	network := fake.network("0")
+	require.NotNil(t, network)
+	assert.Equal(t, wpaHex("Home"), network["ssid"])
+	assert.Equal(t, "1", network["scan_ssid"])
+	assert.Equal(t, "WPA-PSK", network["key_mgmt"])
+	assert.Equal(t, `"secret123"`, network["psk"])
+	assert.True(t, fake.sent("ENABLE_NETWORK all"))
+	assert.True(t, fake.sent("SAVE_CONFIG"))
+
+	// Connecting again replaces the network
+	require.NoError(t, im.ConnectToNetwork("wlan0", "Home", "secret123"))
+	assert.Nil(t, fake.network("0"))
+	assert.NotNil(t, fake.network("1"))
+}
+
+func TestWPASupplicantInterfaceManager_ConnectWrongKey(t *testing.T) {
+	fake, im := newTestWPAManager(t)
+
+	err := im.ConnectToNetwork("wlan0", "Home", "wrong-password")
+	require.Error(t, err)
+	assert.ErrorIs(t, err, ErrConnectionFailed)
+	assert.Contains(t, err.Error(), "secrets were required")
+	assert.Nil(t, fake.network("0"))
+
+	// A failed attempt keeps the network that worked before
+	require.NoError(t, im.ConnectToNetwork("wlan0", "Home", wpaTestPassword))
+	require.Error(t, im.ConnectToNetwork("wlan0", "Home", "wrong-password"))
+	assert.Equal(t, `"secret123"`, fake.network("1")["psk"])
+	assert.Nil(t, fake.network("2"))
+}
+
+func TestWPASupplicantInterfaceManager_ConnectEnterprise(t *testing.T) {
+	certDir := t.TempDir()
+	fake, im := newTestWPAManager(t, WithInterfaceCertDir(certDir))
+
+	require.NoError(t, im.ConnectWithCredentials("wlan0", "Corp", Credentials{
+		EAPMethod:         EAPMethodPEAP,
+		Phase2:            "mschapv2",
+		Identity:          "alice",
+		AnonymousIdentity: "anonymous",
+		Password:          "p@ss \"word\"",
+		CACert:            testPEM,
+	}))
+	network := fake.network("0")
+	require.NotNil(t, network)
+	assert.Equal(t, "WPA-EAP", network["key_mgmt"])
+	assert.Equal(t, "PEAP", network["eap"])
+	assert.Equal(t, wpaHex("alice"), network["identity"])
+	assert.Equal(t, wpaHex("anonymous"), network["anonymous_identity"])
+	assert.Equal(t, wpaHex("p@ss \"word\""), network["password"])
+	assert.Equal(t, `"auth=MSCHAPV2"`, network["phase2"])
+	assert.True(t, strings.HasPrefix(network["ca_cert"], `"`+certDir))
+}
+
+func TestWPASupplicantInterfaceManager_Profiles(t *testing.T) {
+	fake, im := newTestWPAManager(t)
+	require.NoError(t, im.ConnectToNetwork("wlan0", "Home", wpaTestPassword))
+
+	profiles, err := im.ListProfiles()
+	require.NoError(t, err)
+	assert.Equal(t, []Profile{
+		{ID: "wlan0:0", Name: "Home", SSID: "Home", Security: NetworkSecurityWPA2PSK, AutoConnect: true, Active: true},
+	}, profiles)
+
+	priority, autoConnect := 5, false
+	require.NoError(t, im.UpdateProfile("wlan0:0", ProfileUpdate{Priority: &priority, AutoConnect: &autoConnect}))
+	assert.Equal(t, "5", fake.network("0")["priority"])
+	profiles, err = im.ListProfiles()
+	require.NoError(t, err)
+	assert.False(t, profiles[0].AutoConnect)
+	assert.Equal(t, 5, profiles[0].Priority)
+
+	require.NoError(t, im.UpdateProfileCredentials("wlan0:0", Credentials{Security: SecurityWPA3, Password: "newsecret", Hidden: true}))
+	assert.Equal(t, "SAE", fake.network("0")["key_mgmt"])
+	assert.Equal(t, "1", fake.network("0")["scan_ssid"])
+	assert.Equal(t, wpaHex("Home"), fake.network("0")["ssid"])
+
+	require.NoError(t, im.ForgetProfile("wlan0:0"))
+	assert.Nil(t, fake.network("0"))
+	assert.ErrorIs(t, im.ForgetProfile("wlan0:0"), ErrProfileNotFound)
+	assert.ErrorIs(t, im.ForgetProfile("wlan0"), ErrProfileNotFound)
+
+	require.NoError(t, im.SaveProfile("wlan0", "Hotspot", Credentials{Password: "hotspot123"}, 3))
+	assert.Equal(t, "3", fake.network("1")["priority"])
+	assert.True(t, fake.sent("ENABLE_NETWORK 1"))
+	assert.False(t, fake.sent("SELECT_NETWORK 1"))
+
+	require.NoError(t, im.SaveProfile("wlan0", "Hotspot", Credentials{Password: "hotspot456"}, 3))
+	assert.Nil(t, fake.network("1"))
+	assert.Equal(t, `"hotspot456"`, fake.network("2")["psk"])
+}
+
+func TestParseWPANetworkValue(t *testing.T) {
+	assert.Equal(t, "Home", parseWPANetworkValue(`"Home"`))
+	assert.Equal(t, "Café", parseWPANetworkValue(wpaHex("Café")))
+}
+
+func TestWPANetworkSettings_SAE(t *testing.T) {
+	settings := wpaNetworkSettings("Home", Credentials{Password: "secret123", Security: SecurityWPA3}, nil)
+	assert.Contains(t, settings, [2]string{"key_mgmt", "SAE"})
+	assert.Contains(t, settings, [2]string{"sae_password", wpaHex("secret123")})
+	assert.Contains(t, settings, [2]string{"ieee80211w", "2"})
+
+	hex := strings.Repeat("ab", 32)
+	settings = wpaNetworkSettings("Home", Credentials{Password: hex}, nil)
+	assert.Contains(t, settings, [2]string{"psk", hex})
+}
+
+func TestWPAFlagsSecurity(t *testing.T) {
+	tests := map[string]string{
+		"[ESS]":                              "none",
+		"[WEP][ESS]":                         "WEP",
+		"[WPA-PSK-TKIP][ESS]":                "WPA1",
+		"[WPA2-PSK-CCMP][ESS]":               "WPA2",
+		"[RSN-SAE-CCMP][ESS]":                "WPA3",
+		"[WPA2-PSK+SAE-CCMP][ESS]":           "WPA2 WPA3",
+		"[WPA2-EAP-CCMP][ESS]":               "WPA2 802.1X",
+		"[OWE-TRANS-OPEN][ESS]":              "none",
+		"[WPA2-OWE-CCMP][ESS]":               "OWE",
+		"[WPA-PSK-TKIP][WPA2-PSK-CCMP][WPS]": "WPA1 WPA2",
+	}
+	for flags, want := range tests {
+		assert.Equal(t, want, wpaFlagsSecurity(flags), flags)
+	}
+}
+
+func TestDecodeWPAString(t *testing.T) {
+	assert.Equal(t, "Café", decodeWPAString(`Caf\xc3\xa9`))
+	assert.Equal(t, `a"b\c`, decodeWPAString(`a\"b\\c`))
+	assert.Equal(t, "plain", decodeWPAString("plain"))
+}
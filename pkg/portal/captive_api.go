@@ -0,0 +1,78 @@
+package portal
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+)
+
+// captiveAPIContentType is the media type defined by RFC 8908
+const captiveAPIContentType = "application/captive+json"
+
+// captiveAPIResponse is the RFC 8908 section 5 JSON document
+type captiveAPIResponse struct {
+	Captive          bool   `json:"captive"`
+	UserPortalURL    string `json:"user-portal-url,omitempty"`
+	VenueInfoURL     string `json:"venue-info-url,omitempty"`
+	CanExtendSession bool   `json:"can-extend-session,omitempty"`
+	SecondsRemaining *int64 `json:"seconds-remaining,omitempty"`
+}
+
+// userPortalURL returns the page clients are sent to while captive
+func (s *Server) userPortalURL() string {
+	if s.config.PortalURL != "" {
+		return s.config.PortalURL
+	}
+	if s.config.Gateway != "" {
+		return "http://" + s.config.Gateway + "/"
+	}
+	return ""
+}
+
+// clientSession returns the captive session of the requesting client, if sessions are tracked
+func (s *Server) clientSession(r *http.Request) (network.ClientSession, bool) {
+	if s.sessions == nil {
+		return network.ClientSession{}, false
+	}
+	session, err := s.sessions.Track(r.Context(), r.RemoteAddr)
+	if err != nil {
+		s.logger.Warn("failed to track client session",
+			slog.String("client_ip", r.RemoteAddr),
+			slog.String("error", err.Error()))
+		return network.ClientSession{}, false
+	}
+	return session, true
+}
+
+// handleCaptiveAPI serves the RFC 8908 Captive Portal API for the requesting client
+func (s *Server) handleCaptiveAPI(w http.ResponseWriter, r *http.Request) {
+	response := captiveAPIResponse{
+		Captive:       true,
+		UserPortalURL: s.userPortalURL(),
+		VenueInfoURL:  s.config.VenueInfoURL,
+	}
+
+	// Without session tracking every client is captive until the device is provisioned,
+	// the same as the connectivity probes report
+	if s.Provisioned() {
+		response.Captive = false
+	} else if session, ok := s.clientSession(r); ok && session.State == network.SessionAuthorized {
+		response.Captive = false
+		if !session.ExpiresAt.IsZero() {
+			remaining := int64(session.Remaining(time.Now()) / time.Second)
+			response.SecondsRemaining = &remaining
+			response.CanExtendSession = s.config.CanExtendSession
+		}
+	}
+
+	s.logger.Debug("captive portal API request",
+		slog.String("client_ip", r.RemoteAddr),
+		slog.Bool("captive", response.Captive))
+
+	w.Header().Set("Content-Type", captiveAPIContentType)
+	w.Header().Set("Cache-Control", "private")
+	json.NewEncoder(w).Encode(response)
+}
@@ -0,0 +1,76 @@
+package portal
+
+import (
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+)
+
+const (
+	maxConnectFormSize = 1 << 20
+	maxCertUploadSize  = 64 << 10
+)
+
+// credentialsFromForm reads network credentials from a urlencoded or multipart form.
+// Certificates may be uploaded as files or pasted as PEM text in a field of the same name.
+func credentialsFromForm(r *http.Request) (network.Credentials, error) {
+	if strings.HasPrefix(r.Header.Get("Content-Type"), "multipart/form-data") {
+		if err := r.ParseMultipartForm(maxConnectFormSize); err != nil {
+			return network.Credentials{}, err
+		}
+	} else if err := r.ParseForm(); err != nil {
+		return network.Credentials{}, err
+	}
+
+	creds := network.Credentials{
+		Password:           r.FormValue("password"),
+		Hidden:             formBool(r.FormValue("hidden")),
+		Security:           r.FormValue("security"),
+		Identity:           r.FormValue("identity"),
+		AnonymousIdentity:  r.FormValue("anonymous_identity"),
+		EAPMethod:          r.FormValue("eap_method"),
+		Phase2:             r.FormValue("phase2"),
+		PrivateKeyPassword: r.FormValue("private_key_password"),
+	}
+	for field, dst := range map[string]*string{
+		"ca_cert":     &creds.CACert,
+		"client_cert": &creds.ClientCert,
+		"private_key": &creds.PrivateKey,
+	} {
+		pem, err := formFile(r, field)
+		if err != nil {
+			return network.Credentials{}, err
+		}
+		*dst = pem
+	}
+	return creds, nil
+}
+
+// formFile returns the contents of an uploaded file, or the plain form value when none was uploaded
+func formFile(r *http.Request, field string) (string, error) {
+	file, _, err := r.FormFile(field)
+	if err == http.ErrMissingFile || err == http.ErrNotMultipart {
+		return r.FormValue(field), nil
+	}
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	b, err := io.ReadAll(io.LimitReader(file, maxCertUploadSize))
+	if err != nil {
+		return "", err
+	}
+	return string(b), nil
+}
+
+// formBool interprets checkbox and select values as a boolean
+func formBool(value string) bool {
+	switch strings.ToLower(value) {
+	case "1", "on", "true", "yes":
+		return true
+	}
+	return false
+}
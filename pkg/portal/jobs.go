@@ -0,0 +1,213 @@
+package portal
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+)
+
+// ErrConnectionInProgress is returned when a connection job is started while another one runs
+var ErrConnectionInProgress = errors.New("a connection attempt is already in progress")
+
+// JobState is the lifecycle state of a connection job
+type JobState string
+
+const (
+	JobRunning   JobState = "running"
+	JobSucceeded JobState = "succeeded"
+	JobFailed    JobState = "failed"
+)
+
+// maxRetainedJobs bounds how many finished jobs are kept for clients that reconnect late
+const maxRetainedJobs = 10
+
+// stageMessages are the progress messages shown for each connection stage
+var stageMessages = map[network.ConnectionStage]string{
+	network.StageAssociate:    "Associating with the network",
+	network.StageAuthenticate: "Authenticating",
+	network.StageDHCP:         "Obtaining an IP address",
+	network.StageGateway:      "Checking the gateway",
+	network.StageConnectivity: "Verifying internet access",
+}
+
+// JobEvent is a progress update of a connection job
+type JobEvent struct {
+	ID      int                     `json:"id"`
+	State   JobState                `json:"state"`
+	Stage   network.ConnectionStage `json:"stage,omitempty"`
+	Message string                  `json:"message"`
+	Time    time.Time               `json:"time"`
+}
+
+// ConnectionJob is a snapshot of a background connection attempt
+type ConnectionJob struct {
+	ID         string                    `json:"id"`
+	SSID       string                    `json:"ssid"`
+	Interface  string                    `json:"interface"`
+	State      JobState                  `json:"state"`
+	Stage      network.ConnectionStage   `json:"stage,omitempty"`
+	Error      string                    `json:"error,omitempty"`
+	RolledBack bool                      `json:"rolled_back,omitempty"`
+	Result     *network.ConnectionResult `json:"result,omitempty"`
+	Events     []JobEvent                `json:"events"`
+	CreatedAt  time.Time                 `json:"created_at"`
+	UpdatedAt  time.Time                 `json:"updated_at"`
+}
+
+// Done reports whether the job has finished
+func (j ConnectionJob) Done() bool {
+	return j.State != JobRunning
+}
+
+// connectionJob is a running or finished job, changed is closed and replaced on every event
+type connectionJob struct {
+	mu      sync.Mutex
+	job     ConnectionJob
+	changed chan struct{}
+}
+
+func (j *connectionJob) snapshot() ConnectionJob {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	job := j.job
+	job.Events = append([]JobEvent(nil), j.job.Events...)
+	return job
+}
+
+// wait returns a channel that is closed on the next event
+func (j *connectionJob) wait() <-chan struct{} {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.changed
+}
+
+func (j *connectionJob) emit(state JobState, stage network.ConnectionStage, message string, update func(*ConnectionJob)) {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	now := time.Now()
+	j.job.State = state
+	if stage != "" {
+		j.job.Stage = stage
+	}
+	if update != nil {
+		update(&j.job)
+	}
+	j.job.UpdatedAt = now
+	j.job.Events = append(j.job.Events, JobEvent{
+		ID:      len(j.job.Events) + 1,
+		State:   state,
+		Stage:   stage,
+		Message: message,
+		Time:    now,
+	})
+	close(j.changed)
+	j.changed = make(chan struct{})
+}
+
+// jobManager runs connection attempts in the background, one at a time
+type jobManager struct {
+	mu     sync.Mutex
+	jobs   map[string]*connectionJob
+	order  []string
+	active *connectionJob
+}
+
+func newJobManager() *jobManager {
+	return &jobManager{jobs: make(map[string]*connectionJob)}
+}
+
+// start registers a job for ssid and runs connect in the background
+func (m *jobManager) start(ssid, interfaceName string, connect func(context.Context, network.ConnectionProgress) (*network.ConnectionResult, error)) (*connectionJob, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.active != nil {
+		return m.active, ErrConnectionInProgress
+	}
+
+	now := time.Now()
+	j := &connectionJob{
+		job: ConnectionJob{
+			ID:        newJobID(),
+			SSID:      ssid,
+			Interface: interfaceName,
+			State:     JobRunning,
+			Events:    []JobEvent{},
+			CreatedAt: now,
+			UpdatedAt: now,
+		},
+		changed: make(chan struct{}),
+	}
+	m.jobs[j.job.ID] = j
+	m.order = append(m.order, j.job.ID)
+	m.active = j
+	m.prune()
+
+	go m.run(j, connect)
+	return j, nil
+}
+
+func (m *jobManager) run(j *connectionJob, connect func(context.Context, network.ConnectionProgress) (*network.ConnectionResult, error)) {
+	defer func() {
+		m.mu.Lock()
+		m.active = nil
+		m.mu.Unlock()
+	}()
+
+	result, err := connect(context.Background(), func(stage network.ConnectionStage) {
+		j.emit(JobRunning, stage, stageMessages[stage], nil)
+	})
+	if err != nil {
+		var connErr *network.ConnectionError
+		rolledBack := errors.As(err, &connErr) && connErr.RolledBack
+		message := "Could not connect: " + err.Error()
+		if rolledBack {
+			message += ". The setup network is available again, please retry."
+		}
+		j.emit(JobFailed, "", message, func(job *ConnectionJob) {
+			job.Error = err.Error()
+			job.RolledBack = rolledBack
+		})
+		return
+	}
+	// A job trying several networks reports the one it joined
+	ssid := j.job.SSID
+	if result != nil && result.SSID != "" {
+		ssid = result.SSID
+	}
+	j.emit(JobSucceeded, "", fmt.Sprintf("Connected to %s", ssid), func(job *ConnectionJob) {
+		job.SSID = ssid
+		job.Result = result
+	})
+}
+
+// get returns the job with the given ID
+func (m *jobManager) get(id string) (*connectionJob, bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	j, ok := m.jobs[id]
+	return j, ok
+}
+
+// prune forgets the oldest finished jobs, m.mu must be held
+func (m *jobManager) prune() {
+	for len(m.order) > maxRetainedJobs {
+		id := m.order[0]
+		if m.jobs[id] == m.active {
+			return
+		}
+		delete(m.jobs, id)
+		m.order = m.order[1:]
+	}
+}
+
+func newJobID() string {
+	b := make([]byte, 8)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
@@ -0,0 +1,110 @@
+package portal
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readEvents reads Server-Sent Events until the stream ends
+func readEvents(t *testing.T, url, lastEventID string) []JobEvent {
+	t.Helper()
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	require.NoError(t, err)
+	req.Header.Set("Accept", "text/event-stream")
+	if lastEventID != "" {
+		req.Header.Set("Last-Event-ID", lastEventID)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	require.Equal(t, http.StatusOK, resp.StatusCode)
+	assert.Equal(t, "text/event-stream", resp.Header.Get("Content-Type"))
+
+	var events []JobEvent
+	scanner := bufio.NewScanner(resp.Body)
+	for scanner.Scan() {
+		data, ok := strings.CutPrefix(scanner.Text(), "data: ")
+		if !ok {
+			continue
+		}
+		var event JobEvent
+		require.NoError(t, json.Unmarshal([]byte(data), &event))
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestConnectJob_StreamsProgress(t *testing.T) {
+	s := NewServer(testConfig())
+	ts := httptest.NewServer(s.router)
+	defer ts.Close()
+
+	proceed := make(chan struct{})
+	job, err := s.jobs.start("HomeWiFi", "wlan0", func(ctx context.Context, progress network.ConnectionProgress) (*network.ConnectionResult, error) {
+		progress(network.StageAssociate)
+		<-proceed
+		progress(network.StageAuthenticate)
+		progress(network.StageDHCP)
+		return &network.ConnectionResult{Address: "192.168.1.57"}, nil
+	})
+	require.NoError(t, err)
+	id := job.snapshot().ID
+
+	// Only one attempt may run at a time
+	_, err = s.jobs.start("Other", "wlan0", nil)
+	assert.ErrorIs(t, err, ErrConnectionInProgress)
+
+	done := make(chan []JobEvent)
+	go func() { done <- readEvents(t, ts.URL+"/api/connect/"+id+"/events", "") }()
+	close(proceed)
+	events := <-done
+
+	require.Len(t, events, 4)
+	assert.Equal(t, network.StageAssociate, events[0].Stage)
+	assert.Equal(t, "Obtaining an IP address", events[2].Message)
+	assert.Equal(t, JobSucceeded, events[3].State)
+	assert.Equal(t, 4, events[3].ID)
+
+	// A client that lost the stream only receives what it missed
+	events = readEvents(t, ts.URL+"/api/connect/"+id+"/events", "2")
+	require.Len(t, events, 2)
+	assert.Equal(t, 3, events[0].ID)
+
+	resp, err := http.Get(ts.URL + "/api/connect/" + id)
+	require.NoError(t, err)
+	defer resp.Body.Close()
+	var snapshot ConnectionJob
+	require.NoError(t, json.NewDecoder(resp.Body).Decode(&snapshot))
+	assert.Equal(t, JobSucceeded, snapshot.State)
+	assert.Equal(t, "192.168.1.57", snapshot.Result.Address)
+}
+
+func TestAPIConnect_RejectsConcurrentAttempts(t *testing.T) {
+	s := NewServer(testConfig(), WithInterfaceManager(&fakeInterfaceManager{}))
+	block := make(chan struct{})
+	defer close(block)
+	running, err := s.jobs.start("HomeWiFi", "wlan0", func(context.Context, network.ConnectionProgress) (*network.ConnectionResult, error) {
+		<-block
+		return nil, nil
+	})
+	require.NoError(t, err)
+
+	req := httptest.NewRequest(http.MethodPost, "/api/connect", strings.NewReader(`{"ssid":"Other","password":"secret123"}`))
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	assert.Equal(t, http.StatusConflict, rec.Code)
+	assert.Contains(t, rec.Body.String(), running.snapshot().ID)
+
+	rec = httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/connect/unknown", nil))
+	assert.Equal(t, http.StatusNotFound, rec.Code)
+}
@@ -0,0 +1,92 @@
+package portal
+
+import (
+	"log/slog"
+	"net/http"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+)
+
+// captiveProbe describes the answer an OS expects from its connectivity check
+// once the network is usable. Anything else keeps the captive sheet open.
+type captiveProbe struct {
+	Vendor      string
+	Path        string
+	Status      int
+	ContentType string
+	Body        string
+}
+
+// captiveProbes lists the connectivity checks of the major platforms
+var captiveProbes = []captiveProbe{
+	// Android and ChromeOS
+	{Vendor: "android", Path: "/generate_204", Status: http.StatusNoContent},
+	{Vendor: "android", Path: "/gen_204", Status: http.StatusNoContent},
+	// Apple iOS and macOS
+	{Vendor: "apple", Path: "/hotspot-detect.html", Status: http.StatusOK, ContentType: "text/html",
+		Body: "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>\n"},
+	{Vendor: "apple", Path: "/library/test/success.html", Status: http.StatusOK, ContentType: "text/html",
+		Body: "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>\n"},
+	// Windows
+	{Vendor: "microsoft", Path: "/connecttest.txt", Status: http.StatusOK, ContentType: "text/plain",
+		Body: "Microsoft Connect Test"},
+	{Vendor: "microsoft", Path: "/ncsi.txt", Status: http.StatusOK, ContentType: "text/plain",
+		Body: "Microsoft NCSI"},
+	// Firefox
+	{Vendor: "firefox", Path: "/success.txt", Status: http.StatusOK, ContentType: "text/plain",
+		Body: "success\n"},
+	{Vendor: "firefox", Path: "/canonical.html", Status: http.StatusOK, ContentType: "text/html",
+		Body: `<meta http-equiv="refresh" content="0;url=https://support.mozilla.org/kb/captive-portal"/>`},
+	// NetworkManager based Linux desktops
+	{Vendor: "networkmanager", Path: "/check_network_status.txt", Status: http.StatusOK, ContentType: "text/plain",
+		Body: "NetworkManager is online\n"},
+}
+
+// SetProvisioned marks the device as connected to an upstream network. From then
+// on every client receives the online answer to its connectivity probes.
+func (s *Server) SetProvisioned(provisioned bool) {
+	s.provisioned.Store(provisioned)
+}
+
+// Provisioned reports whether the device has been connected to an upstream network
+func (s *Server) Provisioned() bool {
+	return s.provisioned.Load()
+}
+
+// clientOnline reports whether the requesting client should be treated as online
+func (s *Server) clientOnline(r *http.Request) bool {
+	if s.Provisioned() {
+		return true
+	}
+	session, ok := s.clientSession(r)
+	return ok && session.State == network.SessionAuthorized
+}
+
+// probeHandler answers a connectivity probe according to the client's state
+func (s *Server) probeHandler(probe captiveProbe) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		online := s.clientOnline(r)
+		s.logger.Debug("captive portal detection request",
+			slog.String("vendor", probe.Vendor),
+			slog.String("path", r.URL.Path),
+			slog.String("user_agent", r.UserAgent()),
+			slog.String("client_ip", r.RemoteAddr),
+			slog.Bool("online", online))
+
+		// Probe answers must never be cached, the client state changes underneath them
+		w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate")
+		if !online {
+			// Redirect to WiFi setup page
+			http.Redirect(w, r, s.userPortalURL(), http.StatusFound)
+			return
+		}
+
+		if probe.ContentType != "" {
+			w.Header().Set("Content-Type", probe.ContentType)
+		}
+		w.WriteHeader(probe.Status)
+		if probe.Body != "" {
+			w.Write([]byte(probe.Body))
+		}
+	}
+}
@@ -0,0 +1,74 @@
+package portal
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func probe(s *Server, path string) *httptest.ResponseRecorder {
+	req := httptest.NewRequest(http.MethodGet, path, nil)
+	req.RemoteAddr = testClientIP + ":51234"
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, req)
+	return rec
+}
+
+func TestProbes_OnlineResponses(t *testing.T) {
+	tests := []struct {
+		path   string
+		status int
+		body   string
+	}{
+		{"/generate_204", http.StatusNoContent, ""},
+		{"/gen_204", http.StatusNoContent, ""},
+		{"/hotspot-detect.html", http.StatusOK, "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>\n"},
+		{"/library/test/success.html", http.StatusOK, "<HTML><HEAD><TITLE>Success</TITLE></HEAD><BODY>Success</BODY></HTML>\n"},
+		{"/connecttest.txt", http.StatusOK, "Microsoft Connect Test"},
+		{"/ncsi.txt", http.StatusOK, "Microsoft NCSI"},
+		{"/success.txt", http.StatusOK, "success\n"},
+		{"/canonical.html", http.StatusOK, `<meta http-equiv="refresh" content="0;url=https://support.mozilla.org/kb/captive-portal"/>`},
+		{"/check_network_status.txt", http.StatusOK, "NetworkManager is online\n"},
+	}
+
+	s := NewServer(testConfig())
+	s.SetProvisioned(true)
+	for _, tt := range tests {
+		t.Run(tt.path, func(t *testing.T) {
+			rec := probe(s, tt.path)
+			assert.Equal(t, tt.status, rec.Code)
+			assert.Equal(t, tt.body, rec.Body.String())
+			assert.Contains(t, rec.Header().Get("Cache-Control"), "no-store")
+		})
+	}
+}
+
+func TestProbes_CaptiveResponses(t *testing.T) {
+	s := NewServer(testConfig())
+	for _, p := range captiveProbes {
+		t.Run(p.Path, func(t *testing.T) {
+			rec := probe(s, p.Path)
+			assert.Equal(t, http.StatusFound, rec.Code)
+			assert.Equal(t, "http://192.168.4.1/", rec.Header().Get("Location"))
+		})
+	}
+}
+
+func TestProbes_FollowSessionState(t *testing.T) {
+	sessions := testSessions(t)
+	s := NewServer(testConfig(), WithSessions(sessions))
+
+	assert.Equal(t, http.StatusFound, probe(s, "/generate_204").Code)
+
+	_, err := sessions.Authorize(context.Background(), testClientIP)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusNoContent, probe(s, "/generate_204").Code)
+
+	_, err = sessions.Revoke(context.Background(), testClientIP)
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusFound, probe(s, "/generate_204").Code)
+}
@@ -0,0 +1,100 @@
+package portal
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/gorilla/mux"
+	"github.com/pkg/errors"
+)
+
+// handleAPIProfiles lists the saved Wi-Fi profiles
+func (s *Server) handleAPIProfiles(w http.ResponseWriter, r *http.Request) {
+	profiles, err := s.interfaceManager.ListProfiles()
+	if err != nil {
+		s.logger.Error("failed to list profiles", slog.String("error", err.Error()))
+		writeProfileError(w, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":   "success",
+		"profiles": profiles,
+		"count":    len(profiles),
+	})
+}
+
+// handleAPIUpdateProfile changes the priority or autoconnect setting of a profile
+func (s *Server) handleAPIUpdateProfile(w http.ResponseWriter, r *http.Request) {
+	var update network.ProfileUpdate
+	if err := json.NewDecoder(r.Body).Decode(&update); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := s.interfaceManager.UpdateProfile(id, update); err != nil {
+		s.logger.Error("failed to update profile", slog.String("id", id), slog.String("error", err.Error()))
+		writeProfileError(w, err)
+		return
+	}
+	writeProfileSuccess(w)
+}
+
+// handleAPIForgetProfile removes a saved profile
+func (s *Server) handleAPIForgetProfile(w http.ResponseWriter, r *http.Request) {
+	id := mux.Vars(r)["id"]
+	if err := s.interfaceManager.ForgetProfile(id); err != nil {
+		s.logger.Error("failed to forget profile", slog.String("id", id), slog.String("error", err.Error()))
+		writeProfileError(w, err)
+		return
+	}
+	writeProfileSuccess(w)
+}
+
+// handleAPIProfileCredentials replaces the credentials of a saved profile, it takes the same
+// JSON fields as /api/connect
+func (s *Server) handleAPIProfileCredentials(w http.ResponseWriter, r *http.Request) {
+	var creds network.Credentials
+	if err := json.NewDecoder(r.Body).Decode(&creds); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	id := mux.Vars(r)["id"]
+	if err := s.interfaceManager.UpdateProfileCredentials(id, creds); err != nil {
+		s.logger.Error("failed to update profile credentials", slog.String("id", id), slog.String("error", err.Error()))
+		writeProfileError(w, err)
+		return
+	}
+	writeProfileSuccess(w)
+}
+
+func writeProfileSuccess(w http.ResponseWriter) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"status": "success"})
+}
+
+// writeProfileError responds with the status matching err
+func writeProfileError(w http.ResponseWriter, err error) {
+	status := http.StatusInternalServerError
+	switch {
+	case errors.Is(err, network.ErrProfileNotFound):
+		status = http.StatusNotFound
+	case errors.Is(err, network.ErrInvalidCredentials):
+		status = http.StatusBadRequest
+	case errors.Is(err, network.ErrNotSupported):
+		status = http.StatusNotImplemented
+	}
+	writeJSONError(w, status, err.Error())
+}
+
+func writeJSONError(w http.ResponseWriter, status int, message string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{
+		"status": "error",
+		"error":  message,
+	})
+}
@@ -0,0 +1,60 @@
+package portal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func serveProfiles(t *testing.T, s *Server, method, target, body string) (int, map[string]any) {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(method, target, strings.NewReader(body)))
+	var response map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &response))
+	return rec.Code, response
+}
+
+func TestAPIProfiles(t *testing.T) {
+	im := &fakeInterfaceManager{profiles: []network.Profile{
+		{ID: "486f6d65_psk", Name: "Home", SSID: "Home", AutoConnect: true, Active: true},
+		{ID: "2222", Name: "Old", SSID: "Old", AutoConnect: true},
+	}}
+	s := NewServer(testConfig(), WithInterfaceManager(im))
+
+	code, body := serveProfiles(t, s, http.MethodGet, "/api/profiles", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, float64(2), body["count"])
+	home := body["profiles"].([]any)[0].(map[string]any)
+	assert.Equal(t, "Home", home["ssid"])
+	assert.Equal(t, true, home["active"])
+
+	code, _ = serveProfiles(t, s, http.MethodPatch, "/api/profiles/486f6d65_psk", `{"priority":5,"autoconnect":false}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, 5, im.profiles[0].Priority)
+	assert.False(t, im.profiles[0].AutoConnect)
+
+	code, _ = serveProfiles(t, s, http.MethodPut, "/api/profiles/2222/credentials", `{"password":"newsecret"}`)
+	require.Equal(t, http.StatusOK, code)
+	assert.Equal(t, "newsecret", im.creds.Password)
+
+	code, _ = serveProfiles(t, s, http.MethodPut, "/api/profiles/2222/credentials", `{"security":"wpa3"}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+
+	code, _ = serveProfiles(t, s, http.MethodDelete, "/api/profiles/2222", "")
+	require.Equal(t, http.StatusOK, code)
+	assert.Len(t, im.profiles, 1)
+
+	code, body = serveProfiles(t, s, http.MethodDelete, "/api/profiles/2222", "")
+	assert.Equal(t, http.StatusNotFound, code)
+	assert.Equal(t, "error", body["status"])
+
+	code, _ = serveProfiles(t, s, http.MethodPatch, "/api/profiles/2222", "{")
+	assert.Equal(t, http.StatusBadRequest, code)
+}
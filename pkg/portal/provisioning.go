@@ -0,0 +1,68 @@
+package portal
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+)
+
+// handleAPIProvision takes an ordered list of networks, e.g. the site network and a phone
+// hotspot as backup. Like /api/connect it starts a connection job, which joins the first network
+// that works and saves every network so the device falls back to the next one on its own.
+func (s *Server) handleAPIProvision(w http.ResponseWriter, r *http.Request) {
+	var request struct {
+		Interface string                       `json:"interface"`
+		Networks  []network.ProvisionedNetwork `json:"networks"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
+		writeJSONError(w, http.StatusBadRequest, "Invalid request body")
+		return
+	}
+	if request.Interface == "" {
+		request.Interface = s.config.Interface
+	}
+	if err := s.provisioner.Validate(request.Networks); err != nil {
+		writeJSONError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	j, err := s.jobs.start(request.Networks[0].SSID, request.Interface, func(ctx context.Context, progress network.ConnectionProgress) (*network.ConnectionResult, error) {
+		result, err := s.provisioner.Provision(ctx, request.Interface, request.Networks, progress)
+		if err != nil {
+			s.logger.Error("failed to provision networks",
+				slog.Int("count", len(request.Networks)),
+				slog.String("error", err.Error()))
+			// The device is online even when a fallback could not be saved
+			if result == nil {
+				return nil, err
+			}
+		}
+		s.SetProvisioned(true)
+		return result, nil
+	})
+	job := j.snapshot()
+
+	w.Header().Set("Content-Type", "application/json")
+	if err != nil {
+		w.WriteHeader(http.StatusConflict)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "error",
+			"error":  err.Error(),
+			"job_id": job.ID,
+		})
+		return
+	}
+
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"status":     "accepted",
+		"job_id":     job.ID,
+		"job_url":    "/api/connect/" + job.ID,
+		"events_url": "/api/connect/" + job.ID + "/events",
+		"networks":   len(request.Networks),
+		"interface":  request.Interface,
+	})
+}
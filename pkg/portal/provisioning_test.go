@@ -0,0 +1,45 @@
+package portal
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAPIProvision(t *testing.T) {
+	im := &fakeInterfaceManager{unreachable: map[string]bool{"Site": true}}
+	s := NewServer(testConfig(), WithInterfaceManager(im))
+
+	rec := httptest.NewRecorder()
+	s.router.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/api/provision",
+		strings.NewReader(`{"networks":[{"ssid":"Site","password":"sitepass123"},{"ssid":"Hotspot","password":"hotspot123"}]}`)))
+	require.Equal(t, http.StatusAccepted, rec.Code)
+	var accepted map[string]any
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &accepted))
+
+	job := waitForJob(t, s, accepted["job_id"].(string))
+	assert.Equal(t, JobSucceeded, job.State)
+	assert.Equal(t, "Hotspot", job.SSID)
+	assert.True(t, s.Provisioned())
+	assert.Equal(t, []network.Profile{
+		{ID: "Site", Name: "Site", SSID: "Site", AutoConnect: true, Priority: 1},
+		{ID: "Hotspot", Name: "Hotspot", SSID: "Hotspot", AutoConnect: true, Active: true},
+	}, im.profiles)
+
+	code, body := serveProfiles(t, s, http.MethodGet, "/api/status", "")
+	require.Equal(t, http.StatusOK, code)
+	status := body["network"].(map[string]any)
+	assert.Equal(t, "Hotspot", status["active"].(map[string]any)["ssid"])
+	assert.Equal(t, true, status["fallback"])
+
+	code, _ = serveProfiles(t, s, http.MethodPost, "/api/provision", `{"networks":[]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+	code, _ = serveProfiles(t, s, http.MethodPost, "/api/provision", `{"networks":[{"ssid":"Site","security":"wpa2"}]}`)
+	assert.Equal(t, http.StatusBadRequest, code)
+}
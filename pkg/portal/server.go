@@ -7,11 +7,17 @@ import (
 	"fmt"
 	"html/template"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gorilla/mux"
 	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/pkg/errors"
 )
 
 //go:embed templates/*.html
@@ -24,20 +30,87 @@ type Config struct {
 	SSID        string `yaml:"ssid" json:"ssid"`                 // SSID of the AP hosting this portal
 	Gateway     string `yaml:"gateway" json:"gateway"`           // Gateway IP of the AP
 	RedirectURL string `yaml:"redirect_url" json:"redirect_url"` // Optional redirect after setup
+
+	PortalURL        string `yaml:"portal_url" json:"portal_url"`                 // user-portal-url in the Captive Portal API, defaults to the gateway
+	VenueInfoURL     string `yaml:"venue_info_url" json:"venue_info_url"`         // Optional venue-info-url in the Captive Portal API
+	CanExtendSession bool   `yaml:"can_extend_session" json:"can_extend_session"` // Whether clients may extend their session by revisiting the portal
 }
 
+const (
+	// connectEventsRoute names the Server-Sent Events route, which bypasses the request timeout
+	connectEventsRoute   = "connect-events"
+	sseKeepAliveInterval = 15 * time.Second
+)
+
 // Server represents the WiFi setup portal HTTP server
 type Server struct {
 	config           Config
+	mu               sync.Mutex // Guards server
 	server           *http.Server
 	router           *mux.Router
 	logger           *slog.Logger
 	interfaceManager network.InterfaceManager
+	sessions         *network.SessionManager
+	connector        *network.Connector
+	provisioner      *network.Provisioner
+	accessPoint      network.MonitoredAPService
+	groupNetworks    bool
+	jobs             *jobManager
+	provisioned      atomic.Bool
 	setupTemplate    *template.Template
 }
 
+// ServerOption configures a Server
+type ServerOption func(*Server)
+
+// WithInterfaceManager replaces the default NetworkManager-based interface manager
+func WithInterfaceManager(im network.InterfaceManager) ServerOption {
+	return func(s *Server) {
+		s.interfaceManager = im
+	}
+}
+
+// WithSessions makes the portal report per-client captive state from the session manager
+func WithSessions(sessions *network.SessionManager) ServerOption {
+	return func(s *Server) {
+		s.sessions = sessions
+	}
+}
+
+// WithConnector verifies connections and restores the access point when they fail,
+// instead of trusting the exit status of nmcli
+func WithConnector(connector *network.Connector) ServerOption {
+	return func(s *Server) {
+		s.connector = connector
+	}
+}
+
+// WithProvisioner replaces the provisioner saving fallback networks, by default one using the
+// interface manager and connector of the server
+func WithProvisioner(provisioner *network.Provisioner) ServerOption {
+	return func(s *Server) {
+		s.provisioner = provisioner
+	}
+}
+
+// WithAccessPoint makes /api/status report the health of the access point service, and the
+// status "degraded" while one of its child processes is down
+func WithAccessPoint(ap network.MonitoredAPService) ServerOption {
+	return func(s *Server) {
+		s.accessPoint = ap
+	}
+}
+
+// WithGroupedNetworks makes /api/networks return one entry per SSID instead of one per access
+// point, requests can still choose with the group query parameter
+func WithGroupedNetworks(enabled bool) ServerOption {
+	return func(s *Server) {
+		s.groupNetworks = enabled
+	}
+}
+
 // NewServer creates a new WiFi setup portal server
-func NewServer(config Config) *Server {
+func NewServer(config Config, opts ...ServerOption) *Server {
 	router := mux.NewRouter()
 
 	// Pre-parse the setup template
@@ -47,19 +120,24 @@ func NewServer(config Config) *Server {
 	}
 
 	server := &Server{
-		config:           config,
-		router:           router,
-		logger:           slog.Default().WithGroup("wifi_setup_portal"),
-		interfaceManager: network.NewInterfaceManager(),
-		setupTemplate:    setupTemplate,
-		server: &http.Server{
-			Addr:           fmt.Sprintf(":%s", config.Port),
-			Handler:        router,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			IdleTimeout:    30 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+		config:        config,
+		router:        router,
+		logger:        slog.Default().WithGroup("wifi_setup_portal"),
+		setupTemplate: setupTemplate,
+		jobs:          newJobManager(),
+	}
+	server.server = server.httpServer()
+
+	for _, opt := range opts {
+		opt(server)
+	}
+	if server.interfaceManager == nil {
+		server.interfaceManager = network.NewInterfaceManager()
+	}
+	if server.provisioner == nil {
+		server.provisioner = network.NewProvisioner(server.interfaceManager,
+			network.WithProvisionerConnector(server.connector),
+			network.WithProvisionerLogger(server.logger))
 	}
 
 	server.setupRoutes()
@@ -82,9 +160,16 @@ func (s *Server) loggingMiddleware(next http.Handler) http.Handler {
 	})
 }
 
-// timeoutMiddleware handles request timeouts
+// timeoutMiddleware handles request timeouts, except for event streams which stay open
 func (s *Server) timeoutMiddleware(next http.Handler) http.Handler {
-	return http.TimeoutHandler(next, 30*time.Second, "Request timeout")
+	timeout := http.TimeoutHandler(next, 30*time.Second, "Request timeout")
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if route := mux.CurrentRoute(r); route != nil && route.GetName() == connectEventsRoute {
+			next.ServeHTTP(w, r)
+			return
+		}
+		timeout.ServeHTTP(w, r)
+	})
 }
 
 // setupRoutes configures all the HTTP routes
@@ -93,12 +178,13 @@ func (s *Server) setupRoutes() {
 	s.router.Use(s.loggingMiddleware)
 	s.router.Use(s.timeoutMiddleware)
 
-	// Captive portal detection endpoints - redirect to WiFi setup
-	s.router.HandleFunc("/generate_204", s.handleCaptiveDetection).Methods("GET")
-	s.router.HandleFunc("/hotspot-detect.html", s.handleCaptiveDetection).Methods("GET")
-	s.router.HandleFunc("/connecttest.txt", s.handleCaptiveDetection).Methods("GET")
-	s.router.HandleFunc("/canonical.html", s.handleCaptiveDetection).Methods("GET")
-	s.router.HandleFunc("/success.txt", s.handleCaptiveDetection).Methods("GET")
+	// Captive portal detection endpoints - redirect to WiFi setup until the client is online
+	for _, probe := range captiveProbes {
+		s.router.HandleFunc(probe.Path, s.probeHandler(probe)).Methods("GET", "HEAD")
+	}
+
+	// RFC 8908 Captive Portal API, advertised through DHCP option 114
+	s.router.HandleFunc(network.CaptivePortalAPIPath, s.handleCaptiveAPI).Methods("GET")
 
 	// Main WiFi setup pages
 	s.router.HandleFunc("/", s.handleWiFiSetup).Methods("GET")
@@ -109,8 +195,15 @@ func (s *Server) setupRoutes() {
 	// API endpoints
 	s.router.HandleFunc("/api/networks", s.handleAPINetworks).Methods("GET")
 	s.router.HandleFunc("/api/connect", s.handleAPIConnect).Methods("POST")
+	s.router.HandleFunc("/api/connect/{id}", s.handleAPIConnectJob).Methods("GET")
+	s.router.HandleFunc("/api/connect/{id}/events", s.handleAPIConnectEvents).Methods("GET").Name(connectEventsRoute)
+	s.router.HandleFunc("/api/provision", s.handleAPIProvision).Methods("POST")
 	s.router.HandleFunc("/api/status", s.handleAPIStatus).Methods("GET")
 	s.router.HandleFunc("/api/interfaces", s.handleAPIInterfaces).Methods("GET")
+	s.router.HandleFunc("/api/profiles", s.handleAPIProfiles).Methods("GET")
+	s.router.HandleFunc("/api/profiles/{id}", s.handleAPIUpdateProfile).Methods("PATCH")
+	s.router.HandleFunc("/api/profiles/{id}", s.handleAPIForgetProfile).Methods("DELETE")
+	s.router.HandleFunc("/api/profiles/{id}/credentials", s.handleAPIProfileCredentials).Methods("PUT")
 
 	// Static files
 	s.router.PathPrefix("/static/").Handler(http.StripPrefix("/static/", http.FileServer(http.Dir("./static/"))))
@@ -119,19 +212,6 @@ func (s *Server) setupRoutes() {
 	s.router.PathPrefix("/").HandlerFunc(s.handleCatchAll)
 }
 
-// Captive Portal Detection Handlers
-
-// handleCaptiveDetection handles captive portal detection requests
-func (s *Server) handleCaptiveDetection(w http.ResponseWriter, r *http.Request) {
-	s.logger.Debug("captive portal detection request",
-		slog.String("path", r.URL.Path),
-		slog.String("user_agent", r.UserAgent()),
-		slog.String("client_ip", r.RemoteAddr))
-
-	// Redirect to WiFi setup page
-	http.Redirect(w, r, "/", http.StatusFound)
-}
-
 // handleWiFiSetup displays the WiFi setup page
 func (s *Server) handleWiFiSetup(w http.ResponseWriter, r *http.Request) {
 	start := time.Now()
@@ -166,16 +246,17 @@ func (s *Server) handleWiFiSetup(w http.ResponseWriter, r *http.Request) {
 		slog.Duration("total_duration", time.Since(start)))
 }
 
-// handleConnect processes WiFi connection attempts
+// handleConnect starts a WiFi connection job from the setup form and sends the
+// browser back to the setup page, which follows the job's progress
 func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
-	if err := r.ParseForm(); err != nil {
+	creds, err := credentialsFromForm(r)
+	if err != nil {
 		s.logger.Error("failed to parse connection form", slog.String("error", err.Error()))
 		http.Redirect(w, r, "/setup?error=invalid_form", http.StatusSeeOther)
 		return
 	}
 
 	ssid := r.FormValue("ssid")
-	password := r.FormValue("password")
 	interfaceName := r.FormValue("interface")
 
 	s.logger.Info("connection attempt",
@@ -193,18 +274,19 @@ func (s *Server) handleConnect(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	// Attempt to connect to the network
-	err := s.interfaceManager.ConnectToNetwork(interfaceName, ssid, password)
+	if err := creds.Validate(); err != nil {
+		http.Redirect(w, r, "/setup?error=invalid_credentials", http.StatusSeeOther)
+		return
+	}
+
+	job, err := s.startConnectJob(interfaceName, ssid, creds)
 	if err != nil {
-		s.logger.Error("failed to connect to network",
-			slog.String("ssid", ssid),
-			slog.String("error", err.Error()))
-		http.Redirect(w, r, "/setup?error=connection_failed", http.StatusSeeOther)
+		http.Redirect(w, r, "/setup?error=connection_in_progress&job="+url.QueryEscape(job.ID), http.StatusSeeOther)
 		return
 	}
 
-	// Redirect to success page
-	http.Redirect(w, r, "/success?ssid="+ssid, http.StatusSeeOther)
+	// Follow the job's progress on the setup page
+	http.Redirect(w, r, "/setup?job="+url.QueryEscape(job.ID), http.StatusSeeOther)
 }
 
 // handleSuccess serves the success page after connection
@@ -231,8 +313,24 @@ func (s *Server) handleSuccess(w http.ResponseWriter, r *http.Request) {
 
 // API Handlers
 
-// handleAPINetworks returns available networks as JSON
+// handleAPINetworks returns available networks as JSON, grouped by SSID when the group query
+// parameter or WithGroupedNetworks asks for it
 func (s *Server) handleAPINetworks(w http.ResponseWriter, r *http.Request) {
+	group := s.groupNetworks
+	if value := r.URL.Query().Get("group"); value != "" {
+		parsed, err := strconv.ParseBool(value)
+		if err != nil {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusBadRequest)
+			json.NewEncoder(w).Encode(map[string]string{
+				"status": "error",
+				"error":  "Invalid group parameter",
+			})
+			return
+		}
+		group = parsed
+	}
+
 	interfaceName := r.URL.Query().Get("interface")
 	if interfaceName == "" || interfaceName == "auto" {
 		// Use configured interface or let nmcli scan all interfaces
@@ -262,14 +360,36 @@ func (s *Server) handleAPINetworks(w http.ResponseWriter, r *http.Request) {
 		slog.Int("count", len(networks)))
 
 	w.Header().Set("Content-Type", "application/json")
+	if group {
+		groups := network.GroupNetworks(networks, s.knownNetworks())
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"status":    "success",
+			"networks":  groups,
+			"interface": interfaceName,
+			"count":     len(groups),
+			"grouped":   true,
+		})
+		return
+	}
 	json.NewEncoder(w).Encode(map[string]interface{}{
 		"status":    "success",
 		"networks":  networks,
 		"interface": interfaceName,
 		"count":     len(networks),
+		"grouped":   false,
 	})
 }
 
+// knownNetworks returns the SSIDs with saved profiles
+func (s *Server) knownNetworks() []string {
+	profiles, err := s.interfaceManager.ListProfiles()
+	if err != nil {
+		s.logger.Warn("failed to list known networks", slog.String("error", err.Error()))
+		return nil
+	}
+	return network.KnownSSIDs(profiles)
+}
+
 // handleAPIInterfaces returns available wireless interfaces as JSON
 func (s *Server) handleAPIInterfaces(w http.ResponseWriter, r *http.Request) {
 	interfaces, err := s.interfaceManager.ListWirelessInterfaces()
@@ -285,16 +405,17 @@ func (s *Server) handleAPIInterfaces(w http.ResponseWriter, r *http.Request) {
 	})
 }
 
-// handleAPIConnect handles API-based connection requests
+// handleAPIConnect starts a background connection job. Its progress is available from
+// /api/connect/{id} and streamed as Server-Sent Events from /api/connect/{id}/events.
 func (s *Server) handleAPIConnect(w http.ResponseWriter, r *http.Request) {
 	var request struct {
 		SSID      string `json:"ssid"`
-		Password  string `json:"password"`
 		Interface string `json:"interface"`
+		network.Credentials
 	}
 
+	w.Header().Set("Content-Type", "application/json")
 	if err := json.NewDecoder(r.Body).Decode(&request); err != nil {
-		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(http.StatusBadRequest)
 		json.NewEncoder(w).Encode(map[string]string{
 			"status": "error",
@@ -309,27 +430,126 @@ func (s *Server) handleAPIConnect(w http.ResponseWriter, r *http.Request) {
 		// Note: ConnectToNetwork can handle empty interface name if needed
 	}
 
-	err := s.interfaceManager.ConnectToNetwork(request.Interface, request.SSID, request.Password)
-	w.Header().Set("Content-Type", "application/json")
+	if err := request.Credentials.Validate(); err != nil {
+		w.WriteHeader(http.StatusBadRequest)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "error",
+			"error":  err.Error(),
+		})
+		return
+	}
 
+	job, err := s.startConnectJob(request.Interface, request.SSID, request.Credentials)
 	if err != nil {
-		w.WriteHeader(http.StatusInternalServerError)
+		w.WriteHeader(http.StatusConflict)
 		json.NewEncoder(w).Encode(map[string]string{
 			"status": "error",
 			"error":  err.Error(),
+			"job_id": job.ID,
 		})
 		return
 	}
 
-	w.WriteHeader(http.StatusOK)
+	w.WriteHeader(http.StatusAccepted)
 	json.NewEncoder(w).Encode(map[string]string{
-		"status":    "success",
-		"message":   "Connected to WiFi network",
-		"ssid":      request.SSID,
-		"interface": request.Interface,
+		"status":     "accepted",
+		"job_id":     job.ID,
+		"job_url":    "/api/connect/" + job.ID,
+		"events_url": "/api/connect/" + job.ID + "/events",
+		"ssid":       request.SSID,
+		"interface":  request.Interface,
 	})
 }
 
+// startConnectJob runs a connection attempt in the background, verifying it when a
+// Connector is configured. On conflict the running job is returned with the error.
+func (s *Server) startConnectJob(interfaceName, ssid string, creds network.Credentials) (ConnectionJob, error) {
+	j, err := s.jobs.start(ssid, interfaceName, func(ctx context.Context, progress network.ConnectionProgress) (*network.ConnectionResult, error) {
+		var result *network.ConnectionResult
+		var err error
+		if s.connector != nil {
+			result, err = s.connector.ConnectWithProgress(ctx, interfaceName, ssid, creds, progress)
+		} else {
+			progress(network.StageAssociate)
+			err = s.interfaceManager.ConnectWithCredentials(interfaceName, ssid, creds)
+		}
+		if err != nil {
+			s.logger.Error("failed to connect to network",
+				slog.String("ssid", ssid),
+				slog.String("error", err.Error()))
+			return nil, err
+		}
+		s.SetProvisioned(true)
+		return result, nil
+	})
+	return j.snapshot(), err
+}
+
+// handleAPIConnectJob returns the current state of a connection job
+func (s *Server) handleAPIConnectJob(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.jobs.get(mux.Vars(r)["id"])
+	w.Header().Set("Content-Type", "application/json")
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		json.NewEncoder(w).Encode(map[string]string{
+			"status": "error",
+			"error":  "unknown connection job",
+		})
+		return
+	}
+	json.NewEncoder(w).Encode(j.snapshot())
+}
+
+// handleAPIConnectEvents streams the progress of a connection job as Server-Sent Events.
+// Events carry their sequence number as ID, so a client reconnecting with Last-Event-ID
+// after the access point dropped only receives what it missed.
+func (s *Server) handleAPIConnectEvents(w http.ResponseWriter, r *http.Request) {
+	j, ok := s.jobs.get(mux.Vars(r)["id"])
+	if !ok {
+		http.Error(w, "unknown connection job", http.StatusNotFound)
+		return
+	}
+
+	// The stream outlives the server's write timeout
+	rc := http.NewResponseController(w)
+	rc.SetWriteDeadline(time.Time{})
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+
+	lastID, _ := strconv.Atoi(r.Header.Get("Last-Event-ID"))
+	keepAlive := time.NewTicker(sseKeepAliveInterval)
+	defer keepAlive.Stop()
+	for {
+		changed := j.wait()
+		job := j.snapshot()
+		for _, event := range job.Events {
+			if event.ID <= lastID {
+				continue
+			}
+			data, _ := json.Marshal(event)
+			fmt.Fprintf(w, "id: %d\nevent: progress\ndata: %s\n\n", event.ID, data)
+			lastID = event.ID
+		}
+		if err := rc.Flush(); err != nil {
+			return
+		}
+		if job.Done() {
+			return
+		}
+
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		case <-changed:
+		}
+	}
+}
+
 // handleAPIStatus provides connection status
 func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
 	interfaces, err := s.interfaceManager.ListWirelessInterfaces()
@@ -343,11 +563,25 @@ func (s *Server) handleAPIStatus(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(map[string]interface{}{
+	response := map[string]interface{}{
 		"status":     "active",
 		"interfaces": interfaces,
-	})
+	}
+	if provisioning, err := s.provisioner.Status(); err != nil {
+		s.logger.Warn("failed to read saved networks", slog.String("error", err.Error()))
+	} else {
+		response["network"] = provisioning
+	}
+	if s.accessPoint != nil {
+		health := s.accessPoint.Health()
+		response["access_point"] = health
+		if health.Degraded {
+			response["status"] = "degraded"
+		}
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
 }
 
 // handleCatchAll redirects any unmatched requests to WiFi setup
@@ -359,16 +593,37 @@ func (s *Server) handleCatchAll(w http.ResponseWriter, r *http.Request) {
 	http.Redirect(w, r, "/", http.StatusFound)
 }
 
-// Start starts the HTTP server
+// httpServer returns a new HTTP server for the router, a server that was shut down cannot
+// be started again
+func (s *Server) httpServer() *http.Server {
+	return &http.Server{
+		Addr:           fmt.Sprintf(":%s", s.config.Port),
+		Handler:        s.router,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		IdleTimeout:    30 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+}
+
+// Start binds the HTTP server and serves it in the background, it can be started again after Stop
 func (s *Server) Start(ctx context.Context) error {
+	s.mu.Lock()
+	server := s.server
+	s.mu.Unlock()
+
 	s.logger.Info("starting WiFi setup captive portal server",
-		slog.String("address", s.server.Addr),
+		slog.String("address", server.Addr),
 		slog.String("interface", s.config.Interface),
 		slog.String("ssid", s.config.SSID))
 
-	// Start server in goroutine
+	// Bind before returning so a port in use is reported to the caller
+	listener, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		return errors.Wrapf(err, "failed to listen on %s", server.Addr)
+	}
 	go func() {
-		if err := s.server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
 			s.logger.Error("server error", slog.String("error", err.Error()))
 		}
 	}()
@@ -383,7 +638,12 @@ func (s *Server) Stop(ctx context.Context) error {
 	ctx, cancel := context.WithTimeout(ctx, 30*time.Second)
 	defer cancel()
 
-	return s.server.Shutdown(ctx)
+	// Swap in a fresh server first, a concurrent Start then serves that one
+	s.mu.Lock()
+	server := s.server
+	s.server = s.httpServer()
+	s.mu.Unlock()
+	return server.Shutdown(ctx)
 }
 
 // Router returns the underlying mux router for custom route registration
@@ -0,0 +1,57 @@
+package supervisor
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/pkg/errors"
+)
+
+var ErrNoUplink = errors.New("no interface carries the default route")
+
+// CheckFunc returns nil when the device has a working uplink
+type CheckFunc func(ctx context.Context) error
+
+// UplinkCheck passes when an interface carries the default route, wired or wireless
+func UplinkCheck(runner command.Runner) CheckFunc {
+	return func(ctx context.Context) error {
+		if network.DefaultRouteInterface(runner) == "" {
+			return ErrNoUplink
+		}
+		return nil
+	}
+}
+
+// HTTPCheck passes when url answers with status, e.g.
+// "http://connectivitycheck.gstatic.com/generate_204" and 204
+func HTTPCheck(client *http.Client, url string, status int) CheckFunc {
+	return func(ctx context.Context) error {
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+		if err != nil {
+			return errors.Wrap(err, "invalid connectivity check URL")
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			return errors.Wrap(network.ErrNoConnectivity, err.Error())
+		}
+		resp.Body.Close()
+		if resp.StatusCode != status {
+			return errors.Wrapf(network.ErrNoConnectivity, "%s returned %d, expected %d", url, resp.StatusCode, status)
+		}
+		return nil
+	}
+}
+
+// AllChecks passes when every check passes, they run in order
+func AllChecks(checks ...CheckFunc) CheckFunc {
+	return func(ctx context.Context) error {
+		for _, check := range checks {
+			if err := check(ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
@@ -0,0 +1,39 @@
+package supervisor
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestUplinkCheck(t *testing.T) {
+	runner := command.NewFakeRunner()
+	check := UplinkCheck(runner)
+	assert.ErrorIs(t, check(context.Background()), ErrNoUplink)
+
+	// A wired uplink counts as well
+	setUplink(runner, true)
+	assert.NoError(t, check(context.Background()))
+}
+
+func TestHTTPCheck(t *testing.T) {
+	status := http.StatusNoContent
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(status)
+	}))
+	defer server.Close()
+
+	runner := command.NewFakeRunner()
+	setUplink(runner, true)
+	check := AllChecks(UplinkCheck(runner), HTTPCheck(server.Client(), server.URL, http.StatusNoContent))
+	assert.NoError(t, check(context.Background()))
+
+	// A captive network answers with its login page
+	status = http.StatusFound
+	assert.ErrorIs(t, check(context.Background()), network.ErrNoConnectivity)
+}
@@ -0,0 +1,20 @@
+package supervisor
+
+import "time"
+
+// Clock is the time source of the supervisor, tests replace it to step through timeouts
+type Clock interface {
+	Now() time.Time
+	After(d time.Duration) <-chan time.Time
+}
+
+// systemClock is the Clock of the time package
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+func (systemClock) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
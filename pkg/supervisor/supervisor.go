@@ -0,0 +1,336 @@
+// Package supervisor brings the setup access point and captive portal up when the device has
+// no working uplink and takes them down again once a connection is confirmed.
+package supervisor
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/pkg/errors"
+)
+
+// State is a state of the provisioning state machine
+type State string
+
+const (
+	StateStarting     State = "starting"     // Before the first check
+	StateConnected    State = "connected"    // The uplink works, the portal is down
+	StateDisconnected State = "disconnected" // The uplink is lost, waiting for the grace period
+	StateProvisioning State = "provisioning" // The access point and portal are up
+)
+
+const (
+	defaultGracePeriod   = 30 * time.Second
+	defaultConfirmPeriod = 10 * time.Second
+	defaultPollInterval  = 5 * time.Second
+	shutdownTimeout      = 30 * time.Second
+)
+
+// Portal is the captive portal served while the access point is up, *portal.Server implements it
+type Portal interface {
+	Start(ctx context.Context) error
+	Stop(ctx context.Context) error
+}
+
+// provisionedPortal is implemented by portals tracking whether the device is connected, it is
+// reset when the portal comes back for a lost uplink
+type provisionedPortal interface {
+	SetProvisioned(provisioned bool)
+}
+
+// Hooks are called as the supervisor changes state, nil hooks are skipped
+type Hooks struct {
+	OnStateChange func(from, to State)
+	OnPortalStart func()          // After the access point and portal are up
+	OnPortalStop  func()          // After they are taken down
+	OnError       func(err error) // When they fail to start or stop
+}
+
+// Option configures a Supervisor
+type Option func(*Supervisor)
+
+// WithGracePeriod sets how long the uplink may be lost before the portal starts
+func WithGracePeriod(d time.Duration) Option {
+	return func(s *Supervisor) {
+		s.gracePeriod = d
+	}
+}
+
+// WithConfirmPeriod sets how long the uplink must work before the portal is taken down
+func WithConfirmPeriod(d time.Duration) Option {
+	return func(s *Supervisor) {
+		s.confirmPeriod = d
+	}
+}
+
+// WithPollInterval sets how often connectivity is checked
+func WithPollInterval(d time.Duration) Option {
+	return func(s *Supervisor) {
+		s.pollInterval = d
+	}
+}
+
+// WithCheck replaces the connectivity check, UplinkCheck by default
+func WithCheck(check CheckFunc) Option {
+	return func(s *Supervisor) {
+		s.check = check
+	}
+}
+
+// WithCommandRunner sets the runner UplinkCheck reads the default route with
+func WithCommandRunner(runner command.Runner) Option {
+	return func(s *Supervisor) {
+		s.runner = runner
+	}
+}
+
+// WithClock replaces the system clock, e.g. to step through timeouts in tests
+func WithClock(clock Clock) Option {
+	return func(s *Supervisor) {
+		s.clock = clock
+	}
+}
+
+// WithHooks sets the hooks called on state changes
+func WithHooks(hooks Hooks) Option {
+	return func(s *Supervisor) {
+		s.hooks = hooks
+	}
+}
+
+// WithLogger sets the logger used by the supervisor
+func WithLogger(logger *slog.Logger) Option {
+	return func(s *Supervisor) {
+		s.logger = logger
+	}
+}
+
+// Supervisor watches station connectivity and runs the access point and portal only while the
+// device has no working uplink, or on first boot when no network is saved yet
+type Supervisor struct {
+	interfaces    network.InterfaceManager
+	ap            network.APService
+	apConfig      network.APConfig
+	portal        Portal
+	check         CheckFunc
+	runner        command.Runner
+	clock         Clock
+	hooks         Hooks
+	logger        *slog.Logger
+	gracePeriod   time.Duration
+	confirmPeriod time.Duration
+	pollInterval  time.Duration
+
+	mu      sync.Mutex
+	state   State
+	lostAt  time.Time // When the uplink was lost
+	upSince time.Time // When the uplink came back while provisioning
+}
+
+// New creates a Supervisor starting ap with apConfig and portal when connectivity is lost
+func New(interfaces network.InterfaceManager, ap network.APService, apConfig network.APConfig, portal Portal, opts ...Option) *Supervisor {
+	s := &Supervisor{
+		interfaces:    interfaces,
+		ap:            ap,
+		apConfig:      apConfig,
+		portal:        portal,
+		runner:        command.NewExecRunner(),
+		clock:         systemClock{},
+		logger:        slog.Default().WithGroup("supervisor"),
+		gracePeriod:   defaultGracePeriod,
+		confirmPeriod: defaultConfirmPeriod,
+		pollInterval:  defaultPollInterval,
+		state:         StateStarting,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	if s.check == nil {
+		s.check = UplinkCheck(s.runner)
+	}
+	return s
+}
+
+// State returns the current state
+func (s *Supervisor) State() State {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.state
+}
+
+// Run recovers the access point of a crashed run, then checks connectivity every poll interval
+// until ctx is cancelled and takes the portal down if it is up
+func (s *Supervisor) Run(ctx context.Context) error {
+	s.logger.Info("starting provisioning supervisor",
+		slog.Duration("grace_period", s.gracePeriod),
+		slog.Duration("confirm_period", s.confirmPeriod))
+	// Remove a hotspot profile and firewall rules a crashed process left behind, they would
+	// otherwise capture the uplink while the device is connected
+	if ap, ok := s.ap.(network.RecoverableAPService); ok {
+		if err := ap.Recover(ctx); err != nil {
+			s.fail(errors.Wrap(err, "failed to recover access point"))
+		}
+	}
+	for {
+		s.step(ctx)
+		select {
+		case <-ctx.Done():
+			if s.State() == StateProvisioning {
+				stopCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+				s.stopPortal(stopCtx)
+				cancel()
+			}
+			return nil
+		case <-s.clock.After(s.pollInterval):
+		}
+	}
+}
+
+// step checks connectivity once and advances the state machine
+func (s *Supervisor) step(ctx context.Context) {
+	now := s.clock.Now()
+	err := s.check(ctx)
+	up := err == nil
+
+	s.mu.Lock()
+	state := s.state
+	s.mu.Unlock()
+
+	switch state {
+	case StateStarting:
+		switch {
+		case up:
+			s.setState(StateConnected)
+		case !s.hasSavedNetworks():
+			s.logger.Info("no saved networks, starting the portal")
+			s.startPortal(ctx)
+		default:
+			// The backend may still be joining a saved network
+			s.lost(now, err)
+		}
+	case StateConnected:
+		if !up {
+			s.lost(now, err)
+		}
+	case StateDisconnected:
+		if up {
+			s.logger.Info("uplink restored")
+			s.setState(StateConnected)
+			return
+		}
+		s.mu.Lock()
+		expired := now.Sub(s.lostAt) >= s.gracePeriod
+		s.mu.Unlock()
+		if expired {
+			s.logger.Info("no uplink within the grace period, starting the portal")
+			s.startPortal(ctx)
+		}
+	case StateProvisioning:
+		s.mu.Lock()
+		if !up {
+			s.upSince = time.Time{}
+			s.mu.Unlock()
+			return
+		}
+		if s.upSince.IsZero() {
+			s.upSince = now
+		}
+		confirmed := now.Sub(s.upSince) >= s.confirmPeriod
+		s.mu.Unlock()
+		if confirmed {
+			s.logger.Info("connection confirmed, stopping the portal")
+			s.stopPortal(ctx)
+			s.setState(StateConnected)
+		}
+	}
+}
+
+// lost records when the uplink went away
+func (s *Supervisor) lost(now time.Time, err error) {
+	s.logger.Warn("no uplink", slog.String("error", err.Error()))
+	s.mu.Lock()
+	s.lostAt = now
+	s.mu.Unlock()
+	s.setState(StateDisconnected)
+}
+
+// hasSavedNetworks reports whether the device knows a network to join, assuming it does when
+// the profiles cannot be read so a boot does not skip the grace period
+func (s *Supervisor) hasSavedNetworks() bool {
+	profiles, err := s.interfaces.ListProfiles()
+	if err != nil {
+		s.logger.Warn("failed to list saved networks", slog.String("error", err.Error()))
+		return true
+	}
+	return len(profiles) > 0
+}
+
+// startPortal brings up the access point and the portal, the state is left as it is on
+// failure so the next step retries
+func (s *Supervisor) startPortal(ctx context.Context) {
+	if !s.ap.IsRunning() {
+		if err := s.ap.Start(ctx, s.apConfig); err != nil {
+			s.fail(errors.Wrap(err, "failed to start access point"))
+			return
+		}
+	}
+	if p, ok := s.portal.(provisionedPortal); ok {
+		p.SetProvisioned(false)
+	}
+	if err := s.portal.Start(ctx); err != nil {
+		s.fail(errors.Wrap(err, "failed to start portal"))
+		if err := s.ap.Stop(ctx); err != nil {
+			s.logger.Warn("failed to stop access point", slog.String("error", err.Error()))
+		}
+		return
+	}
+
+	s.mu.Lock()
+	s.upSince = time.Time{}
+	s.mu.Unlock()
+	s.setState(StateProvisioning)
+	if s.hooks.OnPortalStart != nil {
+		s.hooks.OnPortalStart()
+	}
+}
+
+// stopPortal takes the portal and the access point down, the connector may have stopped the
+// access point already
+func (s *Supervisor) stopPortal(ctx context.Context) {
+	if err := s.portal.Stop(ctx); err != nil {
+		s.fail(errors.Wrap(err, "failed to stop portal"))
+	}
+	if s.ap.IsRunning() {
+		if err := s.ap.Stop(ctx); err != nil {
+			s.fail(errors.Wrap(err, "failed to stop access point"))
+		}
+	}
+	if s.hooks.OnPortalStop != nil {
+		s.hooks.OnPortalStop()
+	}
+}
+
+func (s *Supervisor) fail(err error) {
+	s.logger.Error("provisioning supervisor error", slog.String("error", err.Error()))
+	if s.hooks.OnError != nil {
+		s.hooks.OnError(err)
+	}
+}
+
+func (s *Supervisor) setState(state State) {
+	s.mu.Lock()
+	from := s.state
+	s.state = state
+	s.mu.Unlock()
+	if from == state {
+		return
+	}
+	s.logger.Info("state changed", slog.String("from", string(from)), slog.String("to", string(state)))
+	if s.hooks.OnStateChange != nil {
+		s.hooks.OnStateChange(from, state)
+	}
+}
@@ -0,0 +1,302 @@
+package supervisor
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AnteWall/go-wifiportal/pkg/command"
+	"github.com/AnteWall/go-wifiportal/pkg/network"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeClock only moves when the test advances it
+type fakeClock struct {
+	mu      sync.Mutex
+	now     time.Time
+	waiters []fakeTimer
+}
+
+type fakeTimer struct {
+	deadline time.Time
+	ch       chan time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) After(d time.Duration) <-chan time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	ch := make(chan time.Time, 1)
+	c.waiters = append(c.waiters, fakeTimer{deadline: c.now.Add(d), ch: ch})
+	return ch
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.waiters[:0]
+	for _, timer := range c.waiters {
+		if timer.deadline.After(c.now) {
+			pending = append(pending, timer)
+			continue
+		}
+		timer.ch <- c.now
+	}
+	c.waiters = pending
+}
+
+// fakeAPService records Start, Stop and Recover calls
+type fakeAPService struct {
+	mu       sync.Mutex
+	running  bool
+	starts   int
+	stops    int
+	recovers int
+}
+
+func (f *fakeAPService) Start(context.Context, network.APConfig) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.starts++
+	f.running = true
+	return nil
+}
+
+func (f *fakeAPService) Stop(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.stops++
+	f.running = false
+	return nil
+}
+
+func (f *fakeAPService) Recover(context.Context) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.recovers++
+	return nil
+}
+
+func (f *fakeAPService) IsRunning() bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.running
+}
+
+// fakePortal records Start and Stop calls
+type fakePortal struct {
+	mu          sync.Mutex
+	running     bool
+	provisioned bool
+	err         error
+}
+
+func (p *fakePortal) Start(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.err != nil {
+		return p.err
+	}
+	p.running = true
+	return nil
+}
+
+func (p *fakePortal) Stop(context.Context) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.running = false
+	return nil
+}
+
+func (p *fakePortal) SetProvisioned(provisioned bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.provisioned = provisioned
+}
+
+func (p *fakePortal) isRunning() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.running
+}
+
+// fakeInterfaceManager reports the saved profiles
+type fakeInterfaceManager struct {
+	network.InterfaceManager
+	profiles []network.Profile
+}
+
+func (f *fakeInterfaceManager) ListProfiles() ([]network.Profile, error) {
+	return f.profiles, nil
+}
+
+// setUplink scripts runner to report a default route through eth0, or none
+func setUplink(runner *command.FakeRunner, uplink bool) {
+	result := command.Result{}
+	if uplink {
+		result.Stdout = []byte("default via 192.168.1.1 dev eth0 proto dhcp src 192.168.1.57 metric 100\n")
+	}
+	runner.AddScript("ip", []string{"-4", "route", "show", "default"}, result)
+}
+
+type supervisorTest struct {
+	s       *Supervisor
+	clock   *fakeClock
+	ap      *fakeAPService
+	portal  *fakePortal
+	im      *fakeInterfaceManager
+	runner  *command.FakeRunner
+	changes []State
+}
+
+func newSupervisorTest(t *testing.T, profiles ...network.Profile) *supervisorTest {
+	t.Helper()
+	st := &supervisorTest{
+		clock:  newFakeClock(),
+		ap:     &fakeAPService{},
+		portal: &fakePortal{provisioned: true},
+		im:     &fakeInterfaceManager{profiles: profiles},
+		runner: command.NewFakeRunner(),
+	}
+	st.s = New(st.im, st.ap, network.APConfig{SSID: "Setup"}, st.portal,
+		WithCommandRunner(st.runner),
+		WithClock(st.clock),
+		WithGracePeriod(30*time.Second),
+		WithConfirmPeriod(10*time.Second),
+		WithHooks(Hooks{OnStateChange: func(from, to State) { st.changes = append(st.changes, to) }}))
+	return st
+}
+
+func (st *supervisorTest) setUplink(uplink bool) {
+	setUplink(st.runner, uplink)
+}
+
+// advance moves the clock and checks connectivity once
+func (st *supervisorTest) advance(d time.Duration) {
+	st.clock.Advance(d)
+	st.s.step(context.Background())
+}
+
+func TestSupervisor_FirstBoot(t *testing.T) {
+	st := newSupervisorTest(t)
+	st.advance(0)
+
+	assert.Equal(t, StateProvisioning, st.s.State())
+	assert.True(t, st.ap.IsRunning())
+	assert.True(t, st.portal.isRunning())
+	assert.False(t, st.portal.provisioned)
+}
+
+func TestSupervisor_GracePeriod(t *testing.T) {
+	st := newSupervisorTest(t, network.Profile{ID: "1", SSID: "Home"})
+	st.setUplink(true)
+	st.advance(0)
+	assert.Equal(t, StateConnected, st.s.State())
+
+	// A short outage does not start the portal
+	st.setUplink(false)
+	st.advance(5 * time.Second)
+	assert.Equal(t, StateDisconnected, st.s.State())
+	st.advance(20 * time.Second)
+	st.setUplink(true)
+	st.advance(5 * time.Second)
+	assert.Equal(t, StateConnected, st.s.State())
+	assert.Zero(t, st.ap.starts)
+
+	st.setUplink(false)
+	st.advance(5 * time.Second)
+	st.advance(29 * time.Second)
+	assert.Equal(t, StateDisconnected, st.s.State())
+	st.advance(time.Second)
+	assert.Equal(t, StateProvisioning, st.s.State())
+	assert.Equal(t, 1, st.ap.starts)
+
+	// The portal is taken down once the uplink has worked for the confirm period
+	st.setUplink(true)
+	st.advance(5 * time.Second)
+	st.setUplink(false)
+	st.advance(5 * time.Second)
+	st.setUplink(true)
+	st.advance(5 * time.Second)
+	st.advance(9 * time.Second)
+	assert.Equal(t, StateProvisioning, st.s.State())
+	st.advance(time.Second)
+	assert.Equal(t, StateConnected, st.s.State())
+	assert.False(t, st.ap.IsRunning())
+	assert.False(t, st.portal.isRunning())
+
+	assert.Equal(t, []State{StateConnected, StateDisconnected, StateConnected, StateDisconnected, StateProvisioning, StateConnected}, st.changes)
+}
+
+func TestSupervisor_BootWaitsForSavedNetwork(t *testing.T) {
+	st := newSupervisorTest(t, network.Profile{ID: "1", SSID: "Home"})
+	st.advance(0)
+	assert.Equal(t, StateDisconnected, st.s.State())
+	st.advance(30 * time.Second)
+	assert.Equal(t, StateProvisioning, st.s.State())
+}
+
+func TestSupervisor_PortalStartFailure(t *testing.T) {
+	st := newSupervisorTest(t)
+	st.portal.err = errors.New("address in use")
+	var failures []error
+	st.s.hooks.OnError = func(err error) { failures = append(failures, err) }
+
+	st.advance(0)
+	assert.Equal(t, StateStarting, st.s.State())
+	assert.False(t, st.ap.IsRunning())
+	require.Len(t, failures, 1)
+	assert.Contains(t, failures[0].Error(), "address in use")
+
+	// The next check retries
+	st.portal.err = nil
+	st.advance(5 * time.Second)
+	assert.Equal(t, StateProvisioning, st.s.State())
+}
+
+func TestSupervisor_Run(t *testing.T) {
+	st := newSupervisorTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- st.s.Run(ctx) }()
+
+	require.Eventually(t, st.portal.isRunning, time.Second, time.Millisecond)
+	st.ap.mu.Lock()
+	assert.Equal(t, 1, st.ap.recovers)
+	st.ap.mu.Unlock()
+	st.setUplink(true)
+	require.Eventually(t, func() bool {
+		st.clock.Advance(defaultPollInterval)
+		return st.s.State() == StateConnected
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	require.NoError(t, <-done)
+	assert.False(t, st.portal.isRunning())
+}
+
+func TestSupervisor_RunStopsPortal(t *testing.T) {
+	st := newSupervisorTest(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() { done <- st.s.Run(ctx) }()
+
+	require.Eventually(t, st.portal.isRunning, time.Second, time.Millisecond)
+	cancel()
+	require.NoError(t, <-done)
+	assert.False(t, st.portal.isRunning())
+	assert.False(t, st.ap.IsRunning())
+}